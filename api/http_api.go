@@ -0,0 +1,898 @@
+// Package api serves the query API of a Server over HTTP.
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/go.net/websocket"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/adatboss/statsd/datastore"
+	"github.com/adatboss/statsd/query"
+	"github.com/adatboss/statsd/server"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
+
+type HttpApi struct {
+	Addr          string
+	Server        *server.Server
+	Timeout       time.Duration
+	MaxQueries    int
+	AccessLog     bool
+	MetricsPrefix string
+	// Watches are pinged every WsPingInterval, and closed if the peer
+	// sends nothing for WsIdleTimeout, see DefaultWsPingInterval and
+	// DefaultWsIdleTimeout. Negative values disable them.
+	WsPingInterval time.Duration
+	WsIdleTimeout  time.Duration
+	// At most MaxConnWatches watches are served over one websocket, e.g.
+	// granularities of a multi-watch, and MaxClientWatches over all the
+	// websockets of a client IP address. Zero means unlimited.
+	MaxConnWatches   int
+	MaxClientWatches int
+	mu               sync.Mutex
+	watchesMu        sync.Mutex
+	clientWatches    map[string]int
+	queries          chan int
+	running          bool
+	listener         *net.TCPListener
+	httpSrv          http.Server
+	wg               sync.WaitGroup
+	panics           uint64
+}
+
+func (ha *HttpApi) Start() error {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+
+	if ha.running {
+		return Error("API already running")
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", ha.Addr)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	ha.running = true
+	ha.listener = listener
+	if ha.MaxQueries > 0 {
+		ha.queries = make(chan int, ha.MaxQueries)
+	} else {
+		ha.queries = nil
+	}
+	ha.httpSrv.Handler = ha.routes().handler()
+	go func() {
+		err := ha.httpSrv.Serve(listener)
+		if err != nil {
+			log.Println("http.Server.Serve:", err)
+		}
+	}()
+	return nil
+}
+
+func (ha *HttpApi) Stop() error {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+
+	if !ha.running {
+		return Error("API not running")
+	}
+
+	ha.running = false
+	ha.listener.Close()
+	ha.wg.Wait()
+	return nil
+}
+
+// routes returns the router of the API. Most queries are made at any other
+// path with the type parameter, see serveByType.
+func (ha *HttpApi) routes() *router {
+	rt := &router{}
+	rt.use(ha.accessLog)
+	rt.use(ha.recoverPanics)
+	rt.use(ha.prepare)
+	rt.handle("/q", ha.serveQuery, "GET")
+	rt.handle("/storage", ha.serveStorage, "GET")
+	rt.handle("/usage", ha.serveUsage, "GET")
+	rt.handle("/health", ha.serveHealth, "GET")
+	rt.handle("/metrics/tree", ha.serveMetricTree, "GET")
+	rt.handle("/metrics/active", ha.serveActiveMetrics, "GET")
+	rt.handle("/inject", ha.serveInject, "POST")
+	rt.handle("/live/{metric}", ha.serveLive, "GET")
+	rt.handle("/log/{metric}", ha.serveArchive, "GET")
+	rt.handle("/series/{metric}", ha.serveSeries, "GET")
+	rt.handle("/...", ha.serveByType)
+	return rt
+}
+
+// prepare sets the headers common to every response and the timeout of
+// requests other than watches.
+func (ha *HttpApi) prepare(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		ha.wg.Add(1)
+		defer ha.wg.Done()
+
+		rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		rw.Header().Set("Pragma", "no-cache")
+		rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+		if ha.Timeout > 0 && !isWatch(rq) {
+			ctx, cancel := context.WithTimeout(rq.Context(), ha.Timeout)
+			defer cancel()
+			rq = rq.WithContext(ctx)
+		}
+		h.ServeHTTP(rw, rq)
+	})
+}
+
+func isWatch(rq *http.Request) bool {
+	return strings.ToLower(rq.Header.Get("Upgrade")) == "websocket"
+}
+
+// byTypes are the values of the type parameter served by serveByType.
+var byTypes = map[string]bool{
+	"live":      true,
+	"archive":   true,
+	"series":    true,
+	"combine":   true,
+	"list":      true,
+	"clockSkew": true,
+	"types":     true,
+	"usage":     true,
+}
+
+func (ha *HttpApi) serveByType(rw http.ResponseWriter, rq *http.Request) {
+	switch rq.URL.Query().Get("type") {
+	case "live":
+		ha.serveLive(rw, rq)
+	case "archive":
+		ha.serveArchive(rw, rq)
+	case "series":
+		ha.serveSeries(rw, rq)
+	case "combine":
+		ha.serveCombine(rw, rq)
+	case "list":
+		ha.serveList(rw, rq)
+	case "clockSkew":
+		ha.serveClockSkew(rw, rq)
+	case "types":
+		ha.serveTypes(rw, rq)
+	case "usage":
+		ha.serveUsage(rw, rq)
+	default:
+		ha.sendError(Error("Invalid type"), rw)
+	}
+}
+
+func (ha *HttpApi) serveLive(rw http.ResponseWriter, rq *http.Request) {
+	if isWatch(rq) {
+		ha.serveLiveWatch(rw, rq)
+	} else {
+		ha.serveLiveLog(rw, rq)
+	}
+}
+
+func (ha *HttpApi) serveArchive(rw http.ResponseWriter, rq *http.Request) {
+	if isWatch(rq) {
+		ha.serveArchiveWatch(rw, rq)
+	} else {
+		ha.serveArchiveLog(rw, rq)
+	}
+}
+
+func (ha *HttpApi) serveLiveWatch(rw http.ResponseWriter, rq *http.Request) {
+	m, chs := ha.metricAndChannels(rq)
+	release, err := ha.acquireWatches(rq, 1)
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+	defer release()
+	watcher, err := ha.Server.LiveWatch(m, chs)
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+	ha.serveWs(watcher, 1, rw, rq)
+}
+
+func (ha *HttpApi) serveLiveLog(rw http.ResponseWriter, rq *http.Request) {
+	m, chs := ha.metricAndChannels(rq)
+	window, err := ha.optionalParam(rq, "window", server.LiveLogSize)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	step, err := ha.optionalParam(rq, "step", 1)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	data, ts, err := ha.Server.LiveLogWindow(m, chs, window, step)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	ha.serveData(ts, data, step, rw)
+}
+
+func (ha *HttpApi) serveArchiveWatch(rw http.ResponseWriter, rq *http.Request) {
+	if rq.URL.Query().Get("granularities") != "" {
+		ha.serveMultiWatch(rw, rq)
+		return
+	}
+	m, chs := ha.metricAndChannels(rq)
+	og, err := ha.params(rq, "offset", "granularity")
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+	shift, err := ha.shift(rq)
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+	release, err := ha.acquireWatches(rq, 1)
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+	defer release()
+	watcher, err := ha.Server.WatchShift(rq.Context(), m, chs, og[0], og[1], shift, ha.aggregator(rq))
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+	ha.serveWs(watcher, og[1], rw, rq)
+}
+
+func (ha *HttpApi) serveMultiWatch(rw http.ResponseWriter, rq *http.Request) {
+	m, chs := ha.metricAndChannels(rq)
+	o, err := ha.params(rq, "offset")
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+	grans := make([]int64, 0)
+	for _, s := range strings.Split(rq.URL.Query().Get("granularities"), ",") {
+		g, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			ha.sendWsError(Error("Not an integer: granularities"), rw, rq)
+			return
+		}
+		grans = append(grans, g)
+	}
+	release, err := ha.acquireWatches(rq, len(grans))
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+	defer release()
+
+	mw, err := ha.Server.MultiWatch(rq.Context(), m, chs, o[0], grans, ha.aggregator(rq))
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+
+	// Rows are prefixed with their granularity
+	ha.serveWatch(rw, rq, mw.Close, func(conn *websocket.Conn, ping <-chan time.Time) {
+		defer mw.Close()
+		buf := new(bytes.Buffer)
+		for {
+			select {
+			case row, ok := <-mw.C:
+				if !ok {
+					if err := mw.Err(); err != nil {
+						ha.writeWsFrame(conn, websocket.TextFrame, ha.wsErrorFrame(err))
+					}
+					return
+				}
+				ha.writeWsGran(conn, row.Gran, buf)
+				ha.writeWsRecord(conn, row.Ts, row.Values, buf)
+				if _, err := buf.WriteTo(conn); err != nil {
+					return
+				}
+				buf.Reset()
+			case <-ping:
+				if err := ha.pingWs(conn); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+func (ha *HttpApi) serveArchiveLog(rw http.ResponseWriter, rq *http.Request) {
+	if !ha.acquireQuery(rw) {
+		return
+	}
+	defer ha.releaseQuery()
+
+	m, chs := ha.metricAndChannels(rq)
+	flg, err := ha.logParams(rq)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	fill, err := ha.fill(rq)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	shift, err := ha.shift(rq)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	// Shifted values are returned with the timestamps of the requested
+	// intervals, so they can be overlaid
+	data, filled, err := ha.Server.LogFill(rq.Context(), m, chs, flg[0]+shift, flg[1], flg[2], ha.aggregator(rq), fill)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	if fill.Policy != server.FillNull {
+		// The last value of every row tells whether it was filled in
+		for i, f := range filled {
+			if f {
+				data[i] = append(data[i], 1)
+			} else {
+				data[i] = append(data[i], 0)
+			}
+		}
+	}
+	ha.serveData(flg[0], data, flg[2], rw)
+}
+
+func (ha *HttpApi) serveCombine(rw http.ResponseWriter, rq *http.Request) {
+	if !ha.acquireQuery(rw) {
+		return
+	}
+	defer ha.releaseQuery()
+
+	q := rq.URL.Query()
+	flg, err := ha.params(rq, "from", "length", "granularity")
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	missing, err := server.ParseMissingPolicy(q.Get("missing"))
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	names := strings.Split(q.Get("metrics"), ",")
+	data, err := ha.Server.Combine(rq.Context(), names, q.Get("channel"), flg[0], flg[1], flg[2],
+		ha.aggregator(rq), q.Get("op"), missing)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	ha.serveData(flg[0], data, flg[2], rw)
+}
+
+// serveQuery evaluates the expression given in expr, see package query.
+func (ha *HttpApi) serveQuery(rw http.ResponseWriter, rq *http.Request) {
+	if !ha.acquireQuery(rw) {
+		return
+	}
+	defer ha.releaseQuery()
+
+	e, err := query.Parse(rq.URL.Query().Get("expr"))
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	flg, err := ha.logParams(rq)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	values, err := query.Eval(rq.Context(), ha.Server, e, flg[0], flg[1], flg[2])
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	data := make([][]float64, len(values))
+	for i, v := range values {
+		data[i] = []float64{v}
+	}
+	ha.serveData(flg[0], data, flg[2], rw)
+}
+
+// logParams returns the from, length and granularity parameters of an
+// archive query. Instead of length and granularity, the query may specify
+// until and maxPoints, and the granularity is chosen to fit.
+func (ha *HttpApi) logParams(rq *http.Request) ([]int64, error) {
+	if rq.URL.Query().Get("maxPoints") == "" {
+		return ha.params(rq, "from", "length", "granularity")
+	}
+
+	fum, err := ha.params(rq, "from", "until", "maxPoints")
+	if err != nil {
+		return nil, err
+	}
+	gran, err := server.ChooseGranularity(fum[0], fum[1], fum[2])
+	if err != nil {
+		return nil, err
+	}
+	return []int64{fum[0], (fum[1] - fum[0] + gran - 1) / gran, gran}, nil
+}
+
+func (ha *HttpApi) serveSeries(rw http.ResponseWriter, rq *http.Request) {
+	if isWatch(rq) {
+		ha.serveSeriesWatch(rw, rq)
+	} else {
+		ha.serveSeriesLog(rw, rq)
+	}
+}
+
+// serveSeriesLog returns the intervals from the from parameter up to the
+// current one, like the rows a series watch starts with.
+func (ha *HttpApi) serveSeriesLog(rw http.ResponseWriter, rq *http.Request) {
+	if !ha.acquireQuery(rw) {
+		return
+	}
+	defer ha.releaseQuery()
+
+	m, chs := ha.metricAndChannels(rq)
+	fg, err := ha.params(rq, "from", "granularity")
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	// Log stops at the current interval
+	length := int64(0)
+	if now := ha.Server.Now().Unix(); fg[1] > 0 && now > fg[0] {
+		length = (now-fg[0])/fg[1] + 1
+	}
+	data, err := ha.Server.Log(rq.Context(), m, chs, fg[0], length, fg[1], ha.aggregator(rq))
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	ha.serveData(fg[0], data, fg[1], rw)
+}
+
+func (ha *HttpApi) serveSeriesWatch(rw http.ResponseWriter, rq *http.Request) {
+	m, chs := ha.metricAndChannels(rq)
+	fg, err := ha.params(rq, "from", "granularity")
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+	release, err := ha.acquireWatches(rq, 1)
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+	defer release()
+	data, watcher, err := ha.Server.Series(rq.Context(), m, chs, fg[0], fg[1], ha.aggregator(rq))
+	if err != nil {
+		ha.sendWsError(err, rw, rq)
+		return
+	}
+
+	ha.serveWatch(rw, rq, watcher.Close, func(conn *websocket.Conn, ping <-chan time.Time) {
+		buf, ts := new(bytes.Buffer), fg[0]
+		for _, values := range data {
+			ha.writeWsRecord(conn, ts, values, buf)
+			if _, err := buf.WriteTo(conn); err != nil {
+				watcher.Close()
+				return
+			}
+			buf.Reset()
+			ts += fg[1]
+		}
+		ha.serveWsConn(watcher, fg[1], conn, ping)
+	})
+}
+
+func (ha *HttpApi) serveList(rw http.ResponseWriter, rq *http.Request) {
+	names, err := ha.Server.Ds.ListNames(rq.URL.Query().Get("pattern"))
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	for _, name := range names {
+		rw.Write([]byte(name))
+		rw.Write([]byte("\n"))
+	}
+}
+
+func (ha *HttpApi) serveMetricTree(rw http.ResponseWriter, rq *http.Request) {
+	nodes, err := ha.Server.MetricTree(rq.URL.Query().Get("path"))
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(nodes); err != nil {
+		log.Println("HttpApi.serveMetricTree:", err)
+	}
+}
+
+// serveActiveMetrics lists the metrics which have received input within
+// the since parameter, a duration like 5m (the default).
+func (ha *HttpApi) serveActiveMetrics(rw http.ResponseWriter, rq *http.Request) {
+	s := rq.URL.Query().Get("since")
+	if s == "" {
+		s = "5m"
+	}
+	since, err := query.ParseDuration(s)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	metrics, err := ha.Server.ActiveMetrics(since)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(metrics); err != nil {
+		log.Println("HttpApi.serveActiveMetrics:", err)
+	}
+}
+
+// MaxInjectSize is the maximum size of the body of an inject request.
+const MaxInjectSize = 1 << 20
+
+type injectResult struct {
+	Accepted int            `json:"accepted"`
+	Rejected []rejectedLine `json:"rejected"`
+}
+
+type rejectedLine struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// serveInject injects the metrics posted one per line, and tells which
+// lines were rejected and why. Lines before a rejected one are injected
+// all the same. Empty lines are skipped.
+func (ha *HttpApi) serveInject(rw http.ResponseWriter, rq *http.Request) {
+	result := injectResult{Rejected: []rejectedLine{}}
+	sc := bufio.NewScanner(http.MaxBytesReader(rw, rq.Body, MaxInjectSize))
+	n := 0
+	for sc.Scan() {
+		n++
+		line := bytes.TrimSuffix(sc.Bytes(), []byte{'\r'})
+		if len(line) == 0 {
+			continue
+		}
+		if err := ha.Server.InjectLine(line); err != nil {
+			result.Rejected = append(result.Rejected, rejectedLine{n, err.Error()})
+		} else {
+			result.Accepted++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		// The rest of the body is lost
+		result.Rejected = append(result.Rejected, rejectedLine{n + 1, err.Error()})
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(result); err != nil {
+		log.Println("HttpApi.serveInject:", err)
+	}
+}
+
+func (ha *HttpApi) serveTypes(rw http.ResponseWriter, rq *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(server.MetricTypes()); err != nil {
+		log.Println("HttpApi.serveTypes:", err)
+	}
+}
+
+// serveUsage responds with the usage of the server, and the usage of every
+// prefix since the start of the day.
+func (ha *HttpApi) serveUsage(rw http.ResponseWriter, rq *http.Request) {
+	day, prefixes, err := ha.Server.PrefixUsage()
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	usage := struct {
+		server.Usage
+		Day      int64                `json:"day"`
+		Prefixes []server.PrefixUsage `json:"prefixes"`
+	}{ha.Server.Usage(), day, prefixes}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(usage); err != nil {
+		log.Println("HttpApi.serveUsage:", err)
+	}
+}
+
+// serveHealth responds with the health of the server, with status 503 if it
+// is not running.
+func (ha *HttpApi) serveHealth(rw http.ResponseWriter, rq *http.Request) {
+	h := ha.Server.Health()
+	rw.Header().Set("Content-Type", "application/json")
+	if !h.Running {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(rw).Encode(h); err != nil {
+		log.Println("HttpApi.serveHealth:", err)
+	}
+}
+
+func (ha *HttpApi) serveStorage(rw http.ResponseWriter, rq *http.Request) {
+	stats, err := ha.Server.Ds.Stats()
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(stats); err != nil {
+		log.Println("HttpApi.serveStorage:", err)
+	}
+}
+
+func (ha *HttpApi) serveClockSkew(rw http.ResponseWriter, rq *http.Request) {
+	ts, err := strconv.ParseInt(rq.URL.Query().Get("ts"), 10, 64)
+	if err != nil {
+		ha.sendError(err, rw)
+		return
+	}
+	rw.Write([]byte(strconv.FormatInt(ha.Server.Now().UnixNano()/1e6-ts, 10)))
+}
+
+// acquireQuery reserves a slot for a heavy query. If all MaxQueries slots
+// are in use it responds with 503 and returns false.
+func (ha *HttpApi) acquireQuery(rw http.ResponseWriter) bool {
+	if ha.queries == nil {
+		return true
+	}
+	select {
+	case ha.queries <- 1:
+		return true
+	default:
+		rw.Header().Set("Retry-After", "1")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte("Too many concurrent queries"))
+		return false
+	}
+}
+
+func (ha *HttpApi) releaseQuery() {
+	if ha.queries != nil {
+		<-ha.queries
+	}
+}
+
+func (ha *HttpApi) sendError(err error, rw http.ResponseWriter) {
+	if err == context.Canceled {
+		// The client is gone, nobody to respond to
+		return
+	}
+	if err == context.DeadlineExceeded {
+		rw.Header().Set("Retry-After", "1")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte("Query timed out"))
+		return
+	}
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Println(err)
+		rw.WriteHeader(status)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+	if status == http.StatusServiceUnavailable {
+		rw.Header().Set("Retry-After", "1")
+	}
+	rw.WriteHeader(status)
+	rw.Write([]byte(err.Error()))
+}
+
+// errorStatus returns the HTTP status code of an error.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, datastore.ErrNoData):
+		return http.StatusNotFound
+	case errors.Is(err, server.ErrNotRunning), errors.Is(err, server.ErrStopping),
+		errors.Is(err, datastore.ErrNotRunning), errors.Is(err, datastore.ErrStopping):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, datastore.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrTooManyWatches):
+		return http.StatusTooManyRequests
+	case isClientError(err):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func isClientError(err error) bool {
+	switch err.(type) {
+	case Error, server.Error, query.Error:
+		return true
+	}
+	return false
+}
+
+func (ha *HttpApi) metricAndChannels(rq *http.Request) (string, []string) {
+	q := rq.URL.Query()
+	m := routeParam(rq, "metric")
+	if m == "" {
+		m = q.Get("metric")
+	}
+	return m, strings.Split(q.Get("channels"), ",")
+}
+
+// shift returns the shift parameter, a duration like -7d, or 0 if missing.
+func (ha *HttpApi) shift(rq *http.Request) (int64, error) {
+	s := rq.URL.Query().Get("shift")
+	if s == "" {
+		return 0, nil
+	}
+	shift, err := query.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if shift%60 != 0 {
+		return 0, Error("Shift must be divisable by 60")
+	}
+	return shift, nil
+}
+
+// fill returns the fill policy, and the maximum staleness of the values
+// carried forward, a duration like 2h, or 0 if missing.
+func (ha *HttpApi) fill(rq *http.Request) (server.Fill, error) {
+	var fill server.Fill
+	q := rq.URL.Query()
+	p, err := server.ParseFillPolicy(q.Get("fill"))
+	if err != nil {
+		return fill, err
+	}
+	fill.Policy = p
+	if s := q.Get("staleness"); s != "" {
+		if fill.MaxStaleness, err = query.ParseDuration(s); err != nil {
+			return fill, err
+		}
+		if fill.MaxStaleness < 0 {
+			return fill, Error("Staleness must not be negative")
+		}
+	}
+	return fill, nil
+}
+
+func (ha *HttpApi) aggregator(rq *http.Request) string {
+	return rq.URL.Query().Get("aggregator")
+}
+
+func (ha *HttpApi) params(rq *http.Request, vars ...string) ([]int64, error) {
+	q := rq.URL.Query()
+	r := make([]int64, len(vars))
+	for i, n := range vars {
+		v, err := strconv.ParseInt(q.Get(n), 10, 64)
+		if err != nil {
+			return nil, Error("Not an integer: " + n)
+		}
+		r[i] = v
+	}
+	return r, nil
+}
+
+// optionalParam is like params for a single variable, which defaults to def
+// if missing.
+func (ha *HttpApi) optionalParam(rq *http.Request, name string, def int64) (int64, error) {
+	if rq.URL.Query().Get(name) == "" {
+		return def, nil
+	}
+	v, err := ha.params(rq, name)
+	if err != nil {
+		return 0, err
+	}
+	return v[0], nil
+}
+
+func (ha *HttpApi) serveWs(w *server.Watcher, n int64, rw http.ResponseWriter, rq *http.Request) {
+	ha.serveWatch(rw, rq, w.Close, func(conn *websocket.Conn, ping <-chan time.Time) {
+		ha.serveWsConn(w, n, conn, ping)
+	})
+}
+
+func (ha *HttpApi) serveWsConn(w *server.Watcher, n int64, conn *websocket.Conn, ping <-chan time.Time) {
+	buf := new(bytes.Buffer)
+	for {
+		select {
+		case values, ok := <-w.C:
+			if !ok {
+				if err := w.Err(); err != nil {
+					ha.writeWsFrame(conn, websocket.TextFrame, ha.wsErrorFrame(err))
+				}
+				return
+			}
+			if err := ha.writeWsRecord(conn, w.Ts, values, buf); err != nil {
+				w.Close()
+				return
+			}
+			if _, err := buf.WriteTo(conn); err != nil {
+				w.Close()
+				return
+			}
+			buf.Reset()
+			w.Ts += n
+		case <-ping:
+			if err := ha.pingWs(conn); err != nil {
+				w.Close()
+				return
+			}
+		}
+	}
+}
+
+// sendWsError accepts the websocket connection only to send a single error
+// frame and close it, since browsers don't expose the HTTP response of a
+// failed websocket handshake. ErrTooManyWatches is also told by the close
+// code.
+func (ha *HttpApi) sendWsError(err error, rw http.ResponseWriter, rq *http.Request) {
+	wsServer(func(conn *websocket.Conn) {
+		ha.writeWsFrame(conn, websocket.TextFrame, ha.wsErrorFrame(err))
+		if errors.Is(err, ErrTooManyWatches) {
+			ha.closeWs(conn, wsClosePolicyViolation, err.Error())
+		}
+	}).ServeHTTP(rw, rq)
+}
+
+// wsErrorFrame formats an error as "error,<message>". Data frames always
+// begin with a timestamp or granularity, so clients can tell them apart.
+func (ha *HttpApi) wsErrorFrame(err error) []byte {
+	msg := err.Error()
+	if !isClientError(err) {
+		log.Println(err)
+		msg = "Internal Server Error"
+	}
+	return []byte("error," + msg)
+}
+
+type byteStringWriter interface {
+	WriteString(string) (int, error)
+	WriteByte(byte) error
+}
+
+func (ha *HttpApi) serveData(ts int64, data [][]float64, n int64, rw http.ResponseWriter) {
+	buf := bufio.NewWriter(rw)
+	for _, values := range data {
+		ha.writeRecord(ts, values, buf)
+		buf.WriteByte('\n')
+		ts += n
+	}
+	buf.Flush()
+}
+
+func (ha *HttpApi) writeRecord(ts int64, values []float64, w byteStringWriter) error {
+	w.WriteString(strconv.FormatInt(ts, 10))
+	for _, val := range values {
+		if err := w.WriteByte(','); err != nil {
+			return err
+		}
+		_, err := w.WriteString(strconv.FormatFloat(val, 'e', -1, 64))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeSeries(t *testing.T) {
+	srv, c, stop := newTestServer(t)
+	defer stop()
+	ha := &HttpApi{Server: srv}
+	h := ha.routes().handler()
+
+	srv.InjectBytes([]byte("a:5|g"))
+	c.Advance(180 * time.Second)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		data, err := srv.Log(context.Background(), "a", []string{"gauge"}, 6000000, 3, 60, "")
+		if err != nil {
+			t.Fatal("Log:", err)
+		}
+		if len(data) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Intervals not flushed:", data)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/series/a?channels=gauge&from=6000000&granularity=60", nil))
+	expected := "6000000,5e+00\n6000060,5e+00\n"
+	if rw.Code != 200 || rw.Body.String() != expected {
+		t.Error("Incorrect result")
+		t.Error("Expected:", expected)
+		t.Error("Result:", rw.Code, rw.Body.String())
+	}
+
+	// Parameter errors of a watch are sent over the websocket
+	hs := httptest.NewServer(h)
+	defer hs.Close()
+	frames := readWsFrames(t, hs, "/series/a?channels=gauge&from=x&granularity=60")
+	if len(frames) == 0 || frames[0].opcode != websocket.TextFrame ||
+		!strings.HasPrefix(string(frames[0].payload), "error,") {
+		t.Error("Incorrect result of a bad watch:", frames)
+	}
+}
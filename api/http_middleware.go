@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bufio"
+	"github.com/adatboss/statsd/server"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.size += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, Error("Hijacking not supported")
+	}
+	rr.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// recoverPanics answers requests whose handler panicked with a 500 error,
+// unless the response has already started, and counts them in Panics and,
+// if MetricsPrefix is set, in the panics counter.
+func (ha *HttpApi) recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		rr := &responseRecorder{ResponseWriter: rw}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			} else if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Println("HttpApi: Panic:", rq.URL.RequestURI(), err, "\n"+string(debug.Stack()))
+			atomic.AddUint64(&ha.panics, 1)
+			if len(ha.MetricsPrefix) != 0 {
+				m := server.Metric{Name: ha.MetricsPrefix + ".panics", Type: server.Counter, Value: 1, SampleRate: 1}
+				if err := ha.Server.Inject(&m); err != nil {
+					log.Println("HttpApi.recoverPanics:", err)
+				}
+			}
+			if rr.status == 0 {
+				rw.Header().Set("Content-Type", "application/json")
+				rr.WriteHeader(http.StatusInternalServerError)
+				rr.Write([]byte(`{"error":"Internal Server Error"}` + "\n"))
+			}
+		}()
+		h.ServeHTTP(rr, rq)
+	})
+}
+
+// Panics returns the number of requests whose handler panicked.
+func (ha *HttpApi) Panics() uint64 {
+	return atomic.LoadUint64(&ha.panics)
+}
+
+// accessLog logs every request and, if MetricsPrefix is set, injects the
+// request latency and the status code into the server as metrics.
+func (ha *HttpApi) accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		rr, start := &responseRecorder{ResponseWriter: rw}, time.Now()
+		h.ServeHTTP(rr, rq)
+		d := time.Since(start)
+		if rr.status == 0 {
+			rr.status = http.StatusOK
+		}
+
+		if ha.AccessLog {
+			log.Println(rq.RemoteAddr, rq.Method, rq.URL.RequestURI(), rr.status, rr.size, d)
+		}
+		if len(ha.MetricsPrefix) != 0 {
+			ha.injectRequestMetrics(rq, rr.status, d)
+		}
+	})
+}
+
+func (ha *HttpApi) injectRequestMetrics(rq *http.Request, status int, d time.Duration) {
+	// Only known names, so clients can't create any number of metrics
+	route := routeName(rq)
+	if t := rq.URL.Query().Get("type"); route == "" && byTypes[t] {
+		route = t
+	} else if route == "" {
+		route = "invalid"
+	}
+	prefix := ha.MetricsPrefix + "." + route + "."
+	metrics := []server.Metric{
+		{
+			Name:       prefix + "latency",
+			Type:       server.Timer,
+			Value:      d.Seconds() * 1000,
+			SampleRate: 1,
+		},
+		{
+			Name:       prefix + "status." + strconv.Itoa(status),
+			Type:       server.Counter,
+			Value:      1,
+			SampleRate: 1,
+		},
+	}
+	for i := range metrics {
+		if err := ha.Server.Inject(&metrics[i]); err != nil {
+			log.Println("HttpApi.injectRequestMetrics:", err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"github.com/adatboss/statsd/clock"
+	"github.com/adatboss/statsd/datastore"
+	"github.com/adatboss/statsd/server"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a server with a manual clock and an in-memory
+// datastore, and returns a function stopping it.
+func newTestServer(t *testing.T) (*server.Server, *clock.Manual, func()) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	c := clock.NewManual(time.Unix(6000000, 0))
+	srv := &server.Server{Ds: ds, Clock: c}
+	if err := srv.Start(nil, nil); err != nil {
+		ds.Close()
+		t.Fatal("Start:", err)
+	}
+
+	return srv, c, func() {
+		done := make(chan int)
+		go func() {
+			if _, _, err := srv.Stop(); err != nil {
+				t.Error("Stop:", err)
+			}
+			close(done)
+		}()
+		for {
+			select {
+			case <-done:
+			default:
+				c.AdvanceUntil(time.Second, done)
+				continue
+			}
+			break
+		}
+		ds.Close()
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	srv, _, stop := newTestServer(t)
+	defer stop()
+	ha := &HttpApi{Server: srv, MetricsPrefix: "api"}
+	h := ha.routes().handler()
+
+	for _, url := range []string{
+		"/q?expr=1&from=6000000&length=1&granularity=60",
+		"/storage",
+		"/usage",
+		"/health",
+		"/metrics/tree",
+		"/live/a.gauge?channels=gauge",
+		"/?type=types",
+		"/?type=clockSkew",
+		"/series/a.gauge?channels=gauge&from=6000000&granularity=60",
+		"/?type=any.name",
+		"/?type=other",
+		"/nothing",
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+
+	active, err := srv.ActiveMetrics(60)
+	if err != nil {
+		t.Fatal("ActiveMetrics:", err)
+	}
+	var names []string
+	for _, am := range active {
+		if strings.HasSuffix(am.Name, ".latency") {
+			names = append(names, am.Name)
+		}
+	}
+	sort.Strings(names)
+	expected := []string{"api.clockSkew.latency", "api.health.latency", "api.invalid.latency", "api.live.latency", "api.metrics.tree.latency",
+		"api.q.latency", "api.series.latency", "api.storage.latency", "api.types.latency", "api.usage.latency"}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Error("Incorrect request metrics")
+		t.Error("Expected:", expected)
+		t.Error("Result:", names)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	srv, _, stop := newTestServer(t)
+	defer stop()
+	ha := &HttpApi{Server: srv, MetricsPrefix: "api"}
+
+	var testCases = []struct {
+		h      http.HandlerFunc
+		status int
+		body   string
+		ctype  string
+		panics uint64
+	}{
+		{func(rw http.ResponseWriter, rq *http.Request) {
+			rw.Write([]byte("ok"))
+		}, 200, "ok", "text/plain; charset=utf-8", 0},
+		{func(rw http.ResponseWriter, rq *http.Request) {
+			panic("boom")
+		}, 500, `{"error":"Internal Server Error"}` + "\n", "application/json", 1},
+		// Too late for an error response
+		{func(rw http.ResponseWriter, rq *http.Request) {
+			rw.Write([]byte("partial"))
+			panic("boom")
+		}, 200, "partial", "text/plain; charset=utf-8", 2},
+		{func(rw http.ResponseWriter, rq *http.Request) {
+			rw.WriteHeader(http.StatusAccepted)
+			panic("boom")
+		}, 202, "", "", 3},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		ha.recoverPanics(tc.h).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		ctype := rec.Header().Get("Content-Type")
+		if rec.Code != tc.status || rec.Body.String() != tc.body || ctype != tc.ctype || ha.Panics() != tc.panics {
+			t.Error("Incorrect result")
+			t.Error("Expected:", tc.status, tc.body, tc.ctype, tc.panics)
+			t.Error("Result:", rec.Code, rec.Body.String(), ctype, ha.Panics())
+		}
+	}
+
+	// Aborted requests are left to the HTTP server
+	func() {
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Error("ErrAbortHandler should have been raised again:", err)
+			}
+		}()
+		ha.recoverPanics(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			panic(http.ErrAbortHandler)
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	if ha.Panics() != 3 {
+		t.Error("Aborted request counted as panic:", ha.Panics())
+	}
+
+	active, err := srv.ActiveMetrics(60)
+	if err != nil {
+		t.Fatal("ActiveMetrics:", err)
+	}
+	found := false
+	for _, am := range active {
+		found = found || am.Name == "api.panics" && am.Type == "counter"
+	}
+	if !found {
+		t.Error("No api.panics counter:", active)
+	}
+}
+
+func TestByTypes(t *testing.T) {
+	srv, _, stop := newTestServer(t)
+	defer stop()
+	ha := &HttpApi{Server: srv}
+	for typ := range byTypes {
+		rec := httptest.NewRecorder()
+		ha.serveByType(rec, httptest.NewRequest("GET", "/?type="+typ, nil))
+		if strings.Contains(rec.Body.String(), "Invalid type") {
+			t.Error("Type not served:", typ)
+		}
+	}
+}
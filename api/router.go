@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// router passes requests to the first route matching their path and
+// method, or answers 405 if only the method differs. The segments of route
+// patterns may be {name}, matching any one segment of the path, and the
+// last one may be "...", matching the rest, unless a route with another
+// method matched before.
+type router struct {
+	routes     []route
+	middleware []func(http.Handler) http.Handler
+}
+
+type route struct {
+	name    string // see routeName
+	segs    []string
+	methods []string // any if empty
+	h       http.Handler
+}
+
+type routeParamsKey struct{}
+
+type routeNameKey struct{}
+
+func (rt *router) handle(pattern string, h http.HandlerFunc, methods ...string) {
+	segs := splitPath(pattern)
+	var name []string
+	for _, s := range segs {
+		if s != "" && s != "..." && s[0] != '{' {
+			name = append(name, s)
+		}
+	}
+	rt.routes = append(rt.routes, route{name: strings.Join(name, "."), segs: segs, methods: methods, h: h})
+}
+
+// use adds a middleware to every route, the one added first is the
+// outermost.
+func (rt *router) use(mw func(http.Handler) http.Handler) {
+	rt.middleware = append(rt.middleware, mw)
+}
+
+// handler returns the router wrapped in its middleware, which can tell the
+// route matched by routeName once the request has been served.
+func (rt *router) handler() http.Handler {
+	var h http.Handler = http.HandlerFunc(rt.serveHTTP)
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		h = rt.middleware[i](h)
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		name := new(string)
+		h.ServeHTTP(rw, rq.WithContext(context.WithValue(rq.Context(), routeNameKey{}, name)))
+	})
+}
+
+func (rt *router) serveHTTP(rw http.ResponseWriter, rq *http.Request) {
+	segs := splitPath(rq.URL.Path)
+	var allowed []string
+	for _, r := range rt.routes {
+		params, ok := r.match(segs)
+		if !ok || len(allowed) > 0 && r.segs[len(r.segs)-1] == "..." {
+			continue
+		}
+		if !r.allows(rq.Method) {
+			allowed = append(allowed, r.methods...)
+			continue
+		}
+		if name, ok := rq.Context().Value(routeNameKey{}).(*string); ok {
+			*name = r.name
+		}
+		if params != nil {
+			rq = rq.WithContext(context.WithValue(rq.Context(), routeParamsKey{}, params))
+		}
+		r.h.ServeHTTP(rw, rq)
+		return
+	}
+
+	if len(allowed) > 0 {
+		rw.Header().Set("Allow", strings.Join(allowed, ", "))
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		rw.Write([]byte("Method not allowed"))
+		return
+	}
+	rw.WriteHeader(http.StatusNotFound)
+	rw.Write([]byte("Not found"))
+}
+
+func (r *route) match(segs []string) (map[string]string, bool) {
+	var params map[string]string
+	for i, s := range r.segs {
+		if s == "..." {
+			return params, true
+		}
+		if i >= len(segs) {
+			return nil, false
+		}
+		if len(s) > 2 && s[0] == '{' && s[len(s)-1] == '}' {
+			if segs[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[s[1:len(s)-1]] = segs[i]
+		} else if s != segs[i] {
+			return nil, false
+		}
+	}
+	return params, len(segs) == len(r.segs)
+}
+
+func (r *route) allows(method string) bool {
+	if len(r.methods) == 0 {
+		return true
+	}
+	for _, m := range r.methods {
+		if m == method || m == "GET" && method == "HEAD" {
+			return true
+		}
+	}
+	return false
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// routeName returns the name of the route matched by the request, made of
+// the fixed segments of its pattern, e.g. "metrics.tree" for /metrics/tree
+// or "live" for /live/{metric}. It is empty if no route or the catch-all
+// one has matched.
+func routeName(rq *http.Request) string {
+	name, _ := rq.Context().Value(routeNameKey{}).(*string)
+	if name == nil {
+		return ""
+	}
+	return *name
+}
+
+// routeParam returns a segment of the path matched by {name}, or an empty
+// string.
+func routeParam(rq *http.Request, name string) string {
+	params, _ := rq.Context().Value(routeParamsKey{}).(map[string]string)
+	return params[name]
+}
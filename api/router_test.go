@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestRouter(catchAll bool) (*router, *string) {
+	rt, name := &router{}, new(string)
+	rt.use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			h.ServeHTTP(rw, rq)
+			*name = routeName(rq)
+		})
+	})
+	reply := func(s string) http.HandlerFunc {
+		return func(rw http.ResponseWriter, rq *http.Request) {
+			rw.Write([]byte(s + routeParam(rq, "metric")))
+		}
+	}
+	rt.handle("/q", reply("q"), "GET")
+	rt.handle("/metrics/tree", reply("tree"), "GET")
+	rt.handle("/inject", reply("inject"), "POST")
+	rt.handle("/live/{metric}", reply("live:"), "GET")
+	rt.handle("/live/{metric}", reply("delete:"), "DELETE")
+	if catchAll {
+		rt.handle("/...", reply("other"))
+	}
+	return rt, name
+}
+
+func TestRouter(t *testing.T) {
+	var testCases = []struct {
+		catchAll     bool
+		method, path string
+		status       int
+		body         string
+		allow        string
+		name         string
+	}{
+		{true, "GET", "/q", 200, "q", "", "q"},
+		{true, "GET", "/q/", 200, "q", "", "q"},
+		{true, "HEAD", "/q", 200, "q", "", "q"},
+		{true, "GET", "/metrics/tree", 200, "tree", "", "metrics.tree"},
+		{true, "POST", "/inject", 200, "inject", "", "inject"},
+		{true, "GET", "/live/a.b", 200, "live:a.b", "", "live"},
+		{true, "DELETE", "/live/a.b", 200, "delete:a.b", "", "live"},
+
+		// Empty segments don't match parameters
+		{true, "GET", "/live/", 200, "other", "", ""},
+		{true, "GET", "/live//", 200, "other", "", ""},
+		{true, "GET", "/live/a/b", 200, "other", "", ""},
+		{true, "GET", "/", 200, "other", "", ""},
+		{true, "POST", "/x/y", 200, "other", "", ""},
+		{false, "GET", "/x/y", 404, "Not found", "", ""},
+		{false, "GET", "/live/", 404, "Not found", "", ""},
+
+		// Not passed to the catch-all once the method didn't match
+		{true, "POST", "/q", 405, "Method not allowed", "GET", ""},
+		{true, "GET", "/inject", 405, "Method not allowed", "POST", ""},
+		{true, "PUT", "/live/a", 405, "Method not allowed", "GET, DELETE", ""},
+		{false, "POST", "/q", 405, "Method not allowed", "GET", ""},
+	}
+
+	for _, tc := range testCases {
+		rt, name := newTestRouter(tc.catchAll)
+		rec := httptest.NewRecorder()
+		rt.handler().ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.status || rec.Body.String() != tc.body ||
+			rec.Header().Get("Allow") != tc.allow || *name != tc.name {
+			t.Error("Incorrect result:", tc.catchAll, tc.method, tc.path)
+			t.Error("Expected:", tc.status, tc.body, tc.allow, tc.name)
+			t.Error("Result:", rec.Code, rec.Body.String(), rec.Header().Get("Allow"), *name)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"bytes"
+	"code.google.com/p/go.net/websocket"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// WsBinaryProtocol is the websocket subprotocol of watches sending their
+// rows as binary frames: the timestamp as a little-endian int64, followed
+// by the values as little-endian float64s. Rows of multi-watches are
+// prefixed with their granularity as another int64. Errors are sent as
+// text frames either way.
+const WsBinaryProtocol = "statsd.binary"
+
+// wsServer returns a websocket server checking the origin like
+// websocket.Handler, which uses WsBinaryProtocol if the client offers it.
+func wsServer(h websocket.Handler) websocket.Server {
+	return websocket.Server{Handler: h, Handshake: wsHandshake}
+}
+
+func wsHandshake(config *websocket.Config, rq *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, rq)
+	if err == nil && config.Origin == nil {
+		return Error("null origin")
+	}
+	for _, p := range config.Protocol {
+		if p == WsBinaryProtocol {
+			config.Protocol = []string{p}
+			break
+		}
+	}
+	return err
+}
+
+func isBinaryWs(conn *websocket.Conn) bool {
+	protocol := conn.Config().Protocol
+	return len(protocol) == 1 && protocol[0] == WsBinaryProtocol
+}
+
+// writeWsRecord formats a record like writeRecord, or in binary if the
+// watch uses WsBinaryProtocol.
+func (ha *HttpApi) writeWsRecord(conn *websocket.Conn, ts int64, values []float64, buf *bytes.Buffer) error {
+	if conn.PayloadType != websocket.BinaryFrame {
+		return ha.writeRecord(ts, values, buf)
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(ts))
+	buf.Write(b[:])
+	for _, val := range values {
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(val))
+		buf.Write(b[:])
+	}
+	return nil
+}
+
+// writeWsGran writes the granularity prefixing the rows of multi-watches.
+func (ha *HttpApi) writeWsGran(conn *websocket.Conn, gran int64, buf *bytes.Buffer) {
+	if conn.PayloadType != websocket.BinaryFrame {
+		buf.WriteString(strconv.FormatInt(gran, 10))
+		buf.WriteByte(',')
+		return
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(gran))
+	buf.Write(b[:])
+}
+
+// writeWsFrame writes a frame of another payload type than the rows.
+func (ha *HttpApi) writeWsFrame(conn *websocket.Conn, payloadType byte, msg []byte) error {
+	pt := conn.PayloadType
+	conn.PayloadType = payloadType
+	_, err := conn.Write(msg)
+	conn.PayloadType = pt
+	return err
+}
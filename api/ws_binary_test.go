@@ -0,0 +1,95 @@
+package api
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/binary"
+	"github.com/adatboss/statsd/server"
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWsBinary(t *testing.T) {
+	srv, c, stop := newTestServer(t)
+	defer stop()
+	ha := &HttpApi{Server: srv}
+	hs := httptest.NewServer(ha.routes().handler())
+	defer hs.Close()
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+
+	gauge := &server.Metric{Name: "a.gauge", Type: server.Gauge, Value: 5, SampleRate: 1}
+	if err := srv.Inject(gauge); err != nil {
+		t.Fatal("Inject:", err)
+	}
+
+	var testCases = []struct {
+		protocol string
+		binary   bool
+	}{
+		{"", false},
+		{"chat", false},
+		{WsBinaryProtocol, true},
+	}
+	for _, tc := range testCases {
+		conn, err := websocket.Dial(url+"/live/a.gauge?channels=gauge,gauge-max", tc.protocol, "http://localhost/")
+		if err != nil {
+			t.Fatal("Dial:", err)
+		}
+		if p := conn.Config().Protocol; tc.binary && (len(p) != 1 || p[0] != WsBinaryProtocol) {
+			t.Error("Binary protocol not negotiated:", p)
+		}
+		ts := c.Now().Unix()
+		c.Advance(time.Second)
+
+		var row []float64
+		var rowTs int64
+		if tc.binary {
+			var msg []byte
+			if err := websocket.Message.Receive(conn, &msg); err != nil {
+				t.Fatal("Receive:", err)
+			}
+			if len(msg)%8 != 0 {
+				t.Fatal("Incorrect binary frame length:", len(msg))
+			}
+			rowTs = int64(binary.LittleEndian.Uint64(msg))
+			for i := 8; i < len(msg); i += 8 {
+				row = append(row, math.Float64frombits(binary.LittleEndian.Uint64(msg[i:])))
+			}
+		} else {
+			var msg string
+			if err := websocket.Message.Receive(conn, &msg); err != nil {
+				t.Fatal("Receive:", err)
+			}
+			fields := strings.Split(msg, ",")
+			rowTs, _ = strconv.ParseInt(fields[0], 10, 64)
+			for _, f := range fields[1:] {
+				v, _ := strconv.ParseFloat(f, 64)
+				row = append(row, v)
+			}
+		}
+		conn.Close()
+
+		if rowTs != ts || len(row) != 2 || row[0] != 5 || row[1] != 5 {
+			t.Error("Incorrect result:", tc.protocol)
+			t.Error("Expected:", ts, []float64{5, 5})
+			t.Error("Result:", rowTs, row)
+		}
+	}
+
+	// Errors are text frames either way
+	conn, err := websocket.Dial(url+"/live/a.gauge?channels=nothing", WsBinaryProtocol, "http://localhost/")
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer conn.Close()
+	var msg string
+	if err := websocket.Message.Receive(conn, &msg); err != nil {
+		t.Fatal("Receive:", err)
+	}
+	if !strings.HasPrefix(msg, "error,") {
+		t.Error("Incorrect error frame:", msg)
+	}
+}
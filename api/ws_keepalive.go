@@ -0,0 +1,116 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/go.net/websocket"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Defaults of HttpApi.WsPingInterval and WsIdleTimeout.
+const (
+	DefaultWsPingInterval = 30 * time.Second
+	DefaultWsIdleTimeout  = 90 * time.Second
+)
+
+func (ha *HttpApi) wsTimeouts() (ping, idle time.Duration) {
+	ping, idle = ha.WsPingInterval, ha.WsIdleTimeout
+	if ping == 0 {
+		ping = DefaultWsPingInterval
+	}
+	if idle == 0 {
+		idle = DefaultWsIdleTimeout
+	}
+	return ping, idle
+}
+
+// serveWatch accepts the websocket connection of a watch, and passes it to
+// serve, which writes the rows and calls ha.pingWs whenever ping fires.
+// Rows are written as binary frames if the client asked for
+// WsBinaryProtocol.
+// Whatever the peer sends is discarded. Once it has sent nothing, not even
+// a pong, for the idle timeout, or the connection is closed, stop is
+// called, which must end serve.
+func (ha *HttpApi) serveWatch(rw http.ResponseWriter, rq *http.Request, stop func(), serve func(conn *websocket.Conn, ping <-chan time.Time)) {
+	pingInterval, idle := ha.wsTimeouts()
+	var ping <-chan time.Time
+	if pingInterval > 0 {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	if idle > 0 {
+		rw = &idleHijacker{ResponseWriter: rw, timeout: idle}
+	}
+
+	wsServer(func(conn *websocket.Conn) {
+		if isBinaryWs(conn) {
+			conn.PayloadType = websocket.BinaryFrame
+		}
+		go func() {
+			buf := make([]byte, 512)
+			for {
+				if _, err := conn.Read(buf); err != nil {
+					stop()
+					return
+				}
+			}
+		}()
+		serve(conn, ping)
+	}).ServeHTTP(rw, rq)
+}
+
+func (ha *HttpApi) pingWs(conn *websocket.Conn) error {
+	return ha.writeWsFrame(conn, websocket.PingFrame, nil)
+}
+
+// idleHijacker hands out connections whose reads fail once nothing has been
+// received for timeout, and whose writes fail if blocked for as long. Pongs
+// are handled while reading data frames, so they count as well.
+type idleHijacker struct {
+	http.ResponseWriter
+	timeout time.Duration
+}
+
+func (ih *idleHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := ih.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, Error("Hijacking not supported")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	ic := &idleConn{Conn: conn, timeout: ih.timeout}
+	ic.SetReadDeadline(time.Now().Add(ic.timeout))
+
+	// The bytes buffered by the HTTP server are read first
+	if err := brw.Writer.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+	rd := io.MultiReader(bytes.NewReader(buffered), ic)
+	return ic, bufio.NewReadWriter(bufio.NewReader(rd), bufio.NewWriter(ic)), nil
+}
+
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (ic *idleConn) Read(b []byte) (int, error) {
+	n, err := ic.Conn.Read(b)
+	if n > 0 {
+		ic.SetReadDeadline(time.Now().Add(ic.timeout))
+	}
+	return n, err
+}
+
+func (ic *idleConn) Write(b []byte) (int, error) {
+	ic.SetWriteDeadline(time.Now().Add(ic.timeout))
+	return ic.Conn.Write(b)
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/adatboss/statsd/server"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWsKeepalive(t *testing.T) {
+	srv, c, stop := newTestServer(t)
+	defer stop()
+	ha := &HttpApi{Server: srv, WsPingInterval: 20 * time.Millisecond, WsIdleTimeout: 200 * time.Millisecond}
+	hs := httptest.NewServer(ha.routes().handler())
+	defer hs.Close()
+	live := "/live/a.gauge?channels=gauge"
+
+	// A peer answering the pings is kept
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(hs.URL, "http")+live, "", "http://localhost/")
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer conn.Close()
+	rows := make(chan string)
+	go func() {
+		defer close(rows)
+		for {
+			var msg string
+			if err := websocket.Message.Receive(conn, &msg); err != nil {
+				return
+			}
+			rows <- msg
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+	gauge := &server.Metric{Name: "a.gauge", Type: server.Gauge, Value: 5, SampleRate: 1}
+	if err := srv.Inject(gauge); err != nil {
+		t.Fatal("Inject:", err)
+	}
+	c.Advance(time.Second)
+	select {
+	case row, ok := <-rows:
+		if !ok || !strings.HasSuffix(row, ",5e+00") {
+			t.Error("Incorrect row:", row, ok)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timeout waiting for row")
+	}
+	conn.Close()
+	waitWatches(t, ha, 0)
+
+	// A silent one is pinged until closed
+	start := time.Now()
+	frames := readWsFrames(t, hs, live)
+	d := time.Since(start)
+	pings := 0
+	for _, f := range frames {
+		if f.opcode == websocket.PingFrame {
+			pings++
+		}
+	}
+	if pings < 2 || d < ha.WsIdleTimeout || d > 5*ha.WsIdleTimeout {
+		t.Error("Incorrect result:", pings, "pings, closed after", d)
+	}
+	waitWatches(t, ha, 0)
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/binary"
+	"net"
+	"net/http"
+)
+
+// ErrTooManyWatches is sent to clients exceeding HttpApi.MaxConnWatches or
+// MaxClientWatches, followed by a close frame with wsClosePolicyViolation.
+var ErrTooManyWatches = Error("Too many watches")
+
+const wsClosePolicyViolation = 1008
+
+// acquireWatches reserves n watches for the client of a websocket request,
+// and returns a function releasing them once the connection is closed.
+func (ha *HttpApi) acquireWatches(rq *http.Request, n int) (func(), error) {
+	if ha.MaxConnWatches > 0 && n > ha.MaxConnWatches {
+		return nil, ErrTooManyWatches
+	}
+	client := wsClient(rq)
+
+	ha.watchesMu.Lock()
+	defer ha.watchesMu.Unlock()
+	if ha.MaxClientWatches > 0 && ha.clientWatches[client]+n > ha.MaxClientWatches {
+		return nil, ErrTooManyWatches
+	}
+	if ha.clientWatches == nil {
+		ha.clientWatches = make(map[string]int)
+	}
+	ha.clientWatches[client] += n
+
+	return func() {
+		ha.watchesMu.Lock()
+		defer ha.watchesMu.Unlock()
+		if ha.clientWatches[client] -= n; ha.clientWatches[client] <= 0 {
+			delete(ha.clientWatches, client)
+		}
+	}, nil
+}
+
+// wsClient identifies the client of a request by its IP address.
+func wsClient(rq *http.Request) string {
+	host, _, err := net.SplitHostPort(rq.RemoteAddr)
+	if err != nil {
+		return rq.RemoteAddr
+	}
+	return host
+}
+
+// closeWs sends a close frame with a status code and reason. The connection
+// is closed once the handler returns.
+func (ha *HttpApi) closeWs(conn *websocket.Conn, status int, reason string) error {
+	msg := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(msg, uint16(status))
+	msg = append(msg, reason...)
+	return ha.writeWsFrame(conn, websocket.CloseFrame, msg)
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"bufio"
+	"code.google.com/p/go.net/websocket"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type wsFrame struct {
+	opcode  byte
+	payload []byte
+}
+
+// readWsFrames makes a websocket handshake without a client, and returns
+// the frames sent by the server until it closes the connection.
+func readWsFrames(t *testing.T, hs *httptest.Server, path string) []wsFrame {
+	conn, err := net.Dial("tcp", hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: localhost\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nOrigin: http://localhost\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+	rd := bufio.NewReader(conn)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal("Handshake:", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	var frames []wsFrame
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(rd, hdr[:]); err == io.EOF {
+			return frames
+		} else if err != nil {
+			t.Fatal("Read:", err)
+		}
+		n := uint64(hdr[1] & 0x7f)
+		if n == 126 {
+			var ext [2]byte
+			io.ReadFull(rd, ext[:])
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(rd, payload); err != nil {
+			t.Fatal("Read:", err)
+		}
+		frames = append(frames, wsFrame{opcode: hdr[0] & 0x0f, payload: payload})
+	}
+}
+
+func checkTooManyWatches(t *testing.T, hs *httptest.Server, path string) {
+	frames := readWsFrames(t, hs, path)
+	if len(frames) != 2 || frames[0].opcode != websocket.TextFrame ||
+		string(frames[0].payload) != "error,Too many watches" ||
+		frames[1].opcode != websocket.CloseFrame || len(frames[1].payload) < 2 ||
+		binary.BigEndian.Uint16(frames[1].payload) != wsClosePolicyViolation {
+		t.Error("Incorrect result:", path)
+		t.Error("Expected: error frame, close frame with", wsClosePolicyViolation)
+		t.Error("Result:", frames)
+	}
+}
+
+// waitWatches waits until the client has n watches.
+func waitWatches(t *testing.T, ha *HttpApi, n int) {
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		ha.watchesMu.Lock()
+		m, ok := ha.clientWatches["127.0.0.1"]
+		ha.watchesMu.Unlock()
+		if m == n && (n > 0 || !ok) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Incorrect number of watches:", m, "expected:", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWsLimits(t *testing.T) {
+	srv, _, stop := newTestServer(t)
+	defer stop()
+	ha := &HttpApi{Server: srv, MaxConnWatches: 2, MaxClientWatches: 3}
+	hs := httptest.NewServer(ha.routes().handler())
+	defer hs.Close()
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+	live := "/live/a.gauge?channels=gauge"
+	multi := "/log/a.gauge?channels=gauge&offset=0&granularities="
+
+	dial := func(path string) *websocket.Conn {
+		conn, err := websocket.Dial(url+path, "", "http://localhost/")
+		if err != nil {
+			t.Fatal("Dial:", err)
+		}
+		return conn
+	}
+
+	// More than MaxConnWatches over one websocket
+	checkTooManyWatches(t, hs, multi+"60,300,3600")
+	waitWatches(t, ha, 0)
+
+	a := dial(multi + "60,300")
+	defer a.Close()
+	waitWatches(t, ha, 2)
+	b := dial(live)
+	waitWatches(t, ha, 3)
+
+	// More than MaxClientWatches, until one is closed
+	checkTooManyWatches(t, hs, live)
+	b.Close()
+	waitWatches(t, ha, 2)
+	b = dial(live)
+	defer b.Close()
+	waitWatches(t, ha, 3)
+	checkTooManyWatches(t, hs, live)
+
+	a.Close()
+	b.Close()
+	waitWatches(t, ha, 0)
+}
@@ -0,0 +1,106 @@
+// Package clock abstracts the source of time, so tests and replays can
+// control it instead of waiting for the wall clock.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// System is the wall clock.
+var System Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// Manual is a Clock that only advances when told to. It supports a single
+// sleeping goroutine, like the tick loop of a server.
+type Manual struct {
+	mu      sync.Mutex
+	now     time.Time
+	sleep   chan manualSleeper
+	pending *manualSleeper
+}
+
+type manualSleeper struct {
+	until time.Time
+	wake  chan int
+}
+
+func NewManual(now time.Time) *Manual {
+	return &Manual{now: now, sleep: make(chan manualSleeper)}
+}
+
+func (c *Manual) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Manual) Sleep(d time.Duration) {
+	s := manualSleeper{until: c.Now().Add(d), wake: make(chan int)}
+	c.sleep <- s
+	<-s.wake
+}
+
+// Advance moves the clock forward by d, waking the sleeper whenever its time
+// comes. It returns once the sleeper has gone back to sleep after the last
+// wakeup, so everything up to the new time has been handled.
+func (c *Manual) Advance(d time.Duration) {
+	c.AdvanceUntil(d, nil)
+}
+
+// AdvanceUntil is like Advance, but it also returns when done is closed,
+// for sleepers which may stop sleeping for good.
+func (c *Manual) AdvanceUntil(d time.Duration, done <-chan int) {
+	target := c.Now().Add(d)
+	for {
+		c.mu.Lock()
+		p := c.pending
+		c.pending = nil
+		c.mu.Unlock()
+
+		var s manualSleeper
+		if p != nil {
+			s = *p
+		} else {
+			select {
+			case s = <-c.sleep:
+			case <-done:
+				return
+			}
+		}
+
+		c.mu.Lock()
+		if s.until.After(target) {
+			c.now, c.pending = target, &s
+			c.mu.Unlock()
+			return
+		}
+		if s.until.After(c.now) {
+			c.now = s.until
+		}
+		c.mu.Unlock()
+		close(s.wake)
+	}
+}
+
+// Jump moves the clock forward by d without waking the sleeper, like a
+// suspend it oversleeps. The next Advance wakes it up late.
+func (c *Manual) Jump(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
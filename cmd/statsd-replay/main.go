@@ -0,0 +1,183 @@
+// Command statsd-replay sends the metrics of a packet capture or of a log
+// of timestamped lines to a statsd injector, keeping their original pace or
+// a multiple of it, e.g. to reproduce an incident on a staging server:
+//
+//	tcpdump -i eth0 -w incident.pcap udp port 6000
+//	statsd-replay -udp staging:6000 -speed 10 incident.pcap
+//
+// Lines of a log look like "1500000000.250 name:1|c", with the time in Unix
+// seconds. Captures are in the classic libpcap format.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	var udpAddr, tcpAddr string
+	var speed float64
+	var port int
+
+	flag.StringVar(&udpAddr, "udp", "127.0.0.1:6000", "UDP address to send to")
+	flag.StringVar(&tcpAddr, "tcp", "", "TCP address to send to instead of UDP")
+	flag.Float64Var(&speed, "speed", 1, "Speed relative to the original (0: as fast as possible)")
+	flag.IntVar(&port, "port", 0, "Only replay captured packets sent to this port (0: all)")
+	flag.Usage = func() {
+		os.Stderr.Write([]byte("Usage: statsd-replay [flags] file...\n"))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	network, addr := "udp", udpAddr
+	if tcpAddr != "" {
+		network, addr = "tcp", tcpAddr
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		log.Fatalln("Dial:", err)
+	}
+	defer conn.Close()
+
+	r := &replayer{conn: conn, speed: speed, stream: network == "tcp"}
+	for _, fn := range flag.Args() {
+		if err := r.replayFile(fn, port); err != nil {
+			log.Fatalln(fn+":", err)
+		}
+	}
+	log.Println("Replayed", r.packets, "packets,", r.bytes, "bytes")
+}
+
+type packet struct {
+	ts   time.Time
+	data []byte
+}
+
+type packetReader interface {
+	// next returns io.EOF after the last packet.
+	next() (packet, error)
+}
+
+// replayer sends packets keeping their pace. The files replayed one after
+// the other are treated as a single capture.
+type replayer struct {
+	conn    net.Conn
+	speed   float64
+	stream  bool
+	first   time.Time
+	start   time.Time
+	packets int
+	bytes   int64
+}
+
+func (r *replayer) replayFile(fn string, port int) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var pr packetReader
+	if magic, err := br.Peek(4); err == nil && isPcapMagic(magic) {
+		if pr, err = newPcapReader(br, port); err != nil {
+			return err
+		}
+	} else {
+		pr = &logReader{r: br}
+	}
+
+	for {
+		p, err := pr.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := r.send(p); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *replayer) send(p packet) error {
+	if r.packets == 0 {
+		r.first, r.start = p.ts, time.Now()
+	} else if r.speed > 0 {
+		at := r.start.Add(time.Duration(float64(p.ts.Sub(r.first)) / r.speed))
+		if d := time.Until(at); d > 0 {
+			time.Sleep(d)
+		}
+	}
+
+	data := p.data
+	if r.stream && (len(data) == 0 || data[len(data)-1] != '\n') {
+		data = append(data[:len(data):len(data)], '\n')
+	}
+	if _, err := r.conn.Write(data); err != nil {
+		return err
+	}
+	r.packets++
+	r.bytes += int64(len(data))
+	return nil
+}
+
+// logReader reads lines prefixed with their time in Unix seconds, each of
+// them sent in a packet of its own. Empty lines are skipped.
+type logReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func (lr *logReader) next() (packet, error) {
+	for {
+		b, err := lr.r.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			return packet{}, io.EOF
+		} else if err != nil && err != io.EOF {
+			return packet{}, err
+		}
+		lr.line++
+		b = trimNewline(b)
+		if len(b) == 0 {
+			continue
+		}
+
+		i := 0
+		for i < len(b) && b[i] != ' ' {
+			i++
+		}
+		sec, perr := strconv.ParseFloat(string(b[:i]), 64)
+		if perr != nil || i == len(b) {
+			return packet{}, Error("Line " + strconv.Itoa(lr.line) + ": timestamp or metric missing")
+		}
+		ts := time.Unix(0, int64(sec*1e9))
+		return packet{ts, b[i+1:]}, nil
+	}
+}
+
+func trimNewline(b []byte) []byte {
+	if len(b) > 0 && b[len(b)-1] == '\n' {
+		b = b[:len(b)-1]
+	}
+	if len(b) > 0 && b[len(b)-1] == '\r' {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
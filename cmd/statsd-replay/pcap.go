@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Link layers of the captured packets
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+)
+
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+)
+
+func isPcapMagic(b []byte) bool {
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if m := bo.Uint32(b); m == pcapMagicMicro || m == pcapMagicNano {
+			return true
+		}
+	}
+	return false
+}
+
+// pcapReader returns the payloads of the UDP packets of a capture, over
+// IPv4 or IPv6. Fragmented packets and IPv6 extension headers aren't
+// supported, those packets are skipped.
+type pcapReader struct {
+	r    io.Reader
+	bo   binary.ByteOrder
+	nano bool
+	link uint32
+	port int
+}
+
+func newPcapReader(r io.Reader, port int) (*pcapReader, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	pr := &pcapReader{r: r, port: port}
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch bo.Uint32(hdr[0:]) {
+		case pcapMagicMicro:
+			pr.bo = bo
+		case pcapMagicNano:
+			pr.bo, pr.nano = bo, true
+		}
+	}
+	if pr.bo == nil {
+		return nil, Error("Not a pcap file")
+	}
+	pr.link = pr.bo.Uint32(hdr[20:])
+	switch pr.link {
+	case linkNull, linkEthernet, linkRaw, linkLinuxSLL:
+	default:
+		return nil, Error("Unsupported link layer in pcap file")
+	}
+	return pr, nil
+}
+
+func (pr *pcapReader) next() (packet, error) {
+	var hdr [16]byte
+	for {
+		if _, err := io.ReadFull(pr.r, hdr[:]); err == io.EOF {
+			return packet{}, io.EOF
+		} else if err != nil {
+			return packet{}, Error("Truncated pcap file")
+		}
+		frac := int64(pr.bo.Uint32(hdr[4:]))
+		if !pr.nano {
+			frac *= 1000
+		}
+		ts := time.Unix(int64(pr.bo.Uint32(hdr[0:])), frac)
+
+		data := make([]byte, pr.bo.Uint32(hdr[8:]))
+		if _, err := io.ReadFull(pr.r, data); err != nil {
+			return packet{}, Error("Truncated pcap file")
+		}
+		if payload, ok := pr.udpPayload(data); ok {
+			return packet{ts, payload}, nil
+		}
+	}
+}
+
+// udpPayload strips the link, IP and UDP headers of a packet.
+func (pr *pcapReader) udpPayload(b []byte) ([]byte, bool) {
+	switch pr.link {
+	case linkNull:
+		if len(b) < 4 {
+			return nil, false
+		}
+		b = b[4:]
+	case linkEthernet:
+		if len(b) < 14 {
+			return nil, false
+		}
+		typ := binary.BigEndian.Uint16(b[12:])
+		b = b[14:]
+		// 802.1Q VLAN tag
+		if typ == 0x8100 && len(b) >= 4 {
+			typ = binary.BigEndian.Uint16(b[2:])
+			b = b[4:]
+		}
+		if typ != 0x0800 && typ != 0x86dd {
+			return nil, false
+		}
+	case linkLinuxSLL:
+		if len(b) < 16 {
+			return nil, false
+		}
+		b = b[16:]
+	}
+
+	if len(b) == 0 {
+		return nil, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return nil, false
+		}
+		ihl := int(b[0]&15) * 4
+		if b[9] != 17 || binary.BigEndian.Uint16(b[6:])&0x3fff != 0 || len(b) < ihl {
+			return nil, false
+		}
+		b = b[ihl:]
+	case 6:
+		if len(b) < 40 || b[6] != 17 {
+			return nil, false
+		}
+		b = b[40:]
+	default:
+		return nil, false
+	}
+
+	if len(b) < 8 {
+		return nil, false
+	}
+	if pr.port != 0 && int(binary.BigEndian.Uint16(b[2:])) != pr.port {
+		return nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b[4:]))
+	if n < 8 || n > len(b) {
+		// Truncated by the snapshot length
+		n = len(b)
+	}
+	return b[8:n], true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPcapReader(t *testing.T) {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	hdr := make([]byte, 24)
+	le.PutUint32(hdr[0:], pcapMagicMicro)
+	le.PutUint32(hdr[20:], linkEthernet)
+	buf.Write(hdr)
+
+	write := func(sec, usec uint32, ethType uint16, proto byte, dport uint16, payload string) {
+		ip := make([]byte, 20+8+len(payload))
+		ip[0], ip[9] = 0x45, proto
+		binary.BigEndian.PutUint16(ip[22:], dport)
+		binary.BigEndian.PutUint16(ip[24:], uint16(8+len(payload)))
+		copy(ip[28:], payload)
+		frame := append(make([]byte, 14), ip...)
+		binary.BigEndian.PutUint16(frame[12:], ethType)
+
+		rec := make([]byte, 16)
+		le.PutUint32(rec[0:], sec)
+		le.PutUint32(rec[4:], usec)
+		le.PutUint32(rec[8:], uint32(len(frame)))
+		le.PutUint32(rec[12:], uint32(len(frame)))
+		buf.Write(rec)
+		buf.Write(frame)
+	}
+	write(100, 500000, 0x0800, 17, 6000, "a:1|c")
+	write(101, 0, 0x0800, 6, 6000, "tcp")
+	write(102, 0, 0x0806, 17, 6000, "arp")
+	write(103, 0, 0x0800, 17, 6001, "other:1|c")
+	write(104, 250000, 0x0800, 17, 6000, "b:2|g\nc:3|ms")
+
+	br := bufio.NewReader(&buf)
+	if magic, _ := br.Peek(4); !isPcapMagic(magic) {
+		t.Fatal("Magic not recognized")
+	}
+	pr, err := newPcapReader(br, 6000)
+	if err != nil {
+		t.Fatal("newPcapReader:", err)
+	}
+	expected := []packet{
+		{time.Unix(100, 5e8), []byte("a:1|c")},
+		{time.Unix(104, 2.5e8), []byte("b:2|g\nc:3|ms")},
+	}
+	for _, e := range expected {
+		p, err := pr.next()
+		if err != nil || !p.ts.Equal(e.ts) || !bytes.Equal(p.data, e.data) {
+			t.Error("Incorrect result:", p.ts, string(p.data), err)
+			t.Error("Expected:", e.ts, string(e.data))
+		}
+	}
+	if _, err := pr.next(); err != io.EOF {
+		t.Error("Expected EOF:", err)
+	}
+}
+
+func TestLogReader(t *testing.T) {
+	lr := &logReader{r: bufio.NewReader(strings.NewReader("10.5 a:1|c\n\n12 b:2|g\r\n13"))}
+	expected := []packet{
+		{time.Unix(10, 5e8), []byte("a:1|c")},
+		{time.Unix(12, 0), []byte("b:2|g")},
+	}
+	for _, e := range expected {
+		p, err := lr.next()
+		if err != nil || !p.ts.Equal(e.ts) || !bytes.Equal(p.data, e.data) {
+			t.Error("Incorrect result:", p.ts, string(p.data), err)
+			t.Error("Expected:", e.ts, string(e.data))
+		}
+	}
+	if _, err := lr.next(); err == nil {
+		t.Error("Line without a metric should have failed")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/adatboss/statsd/datastore"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// compact runs "statsd compact dir...", removing the empty series of the
+// data directories, which must not be in use.
+func compact(dirs []string) {
+	if len(dirs) == 0 {
+		os.Stderr.Write([]byte("Usage: statsd compact datadir...\n"))
+		os.Exit(2)
+	}
+	failed := false
+	for _, dir := range dirs {
+		ds := &datastore.FsDatastore{Dir: dir}
+		if err := ds.Open(); err != nil {
+			log.Println("Datastore.Open:", err)
+			failed = true
+			continue
+		}
+		cs, err := ds.Compact()
+		if err != nil {
+			log.Println("FsDatastore.Compact:", err)
+			failed = true
+		}
+		if err := ds.Close(); err != nil {
+			log.Println("Datastore.Close:", err)
+			failed = true
+		}
+		os.Stdout.Write([]byte(dir + ": " + compactReport(cs) + "\n"))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func compactEvery(dss []*datastore.FsDatastore, interval time.Duration, stop chan int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, ds := range dss {
+			cs, err := ds.Compact()
+			if err != nil {
+				log.Println("FsDatastore.Compact:", err)
+			} else if cs.Files > 0 {
+				log.Println("Compacted", ds.Dir+":", compactReport(cs))
+			}
+		}
+	}
+}
+
+func compactReport(cs datastore.CompactStats) string {
+	return "removed " + strconv.Itoa(cs.Series) + " empty series, " + strconv.Itoa(cs.Files) +
+		" files, " + strconv.FormatInt(cs.Bytes, 10) + " bytes reclaimed"
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"github.com/adatboss/statsd/api"
+	"github.com/adatboss/statsd/datastore"
+	"github.com/adatboss/statsd/datastore/cassandra"
+	"github.com/adatboss/statsd/election"
+	"github.com/adatboss/statsd/injector"
+	"github.com/adatboss/statsd/redismirror"
+	"github.com/adatboss/statsd/server"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "compact" {
+		compact(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stale" {
+		stale(os.Args[2:])
+		return
+	}
+
+	var dataDir, apiAddr, udpAddr, tcpAddr string
+	var nosync, accessLog, takeover, skipCorrupted, tcpReply bool
+	var apiMetrics, usageMetrics, udpDropsMetric string
+	var cassandraHosts, cassandraKeyspace string
+	var mirrorAddr, replicaAddr, redisStream string
+	var leaderLock, leaderCassandra string
+	var timeout, cassandraTTL, compactInterval, maxBatchAge, wsPing, wsIdle time.Duration
+	var maxQueries, udpSockets, udpReadBuffer, tickWorkers, minBatch, maxOpenFiles, timerSamples int
+	var maxConnWatches, maxClientWatches int
+	var liveHot, flushSpread int64
+	var routes routeList
+	var quotas quotaList
+	var defaults defaultList
+	var etsy etsyFlag
+	var chaos chaosList
+
+	flag.StringVar(&dataDir, "data", "", "     Data directory")
+	flag.StringVar(&apiAddr, "api", ":5999", " HTTP query API address")
+	flag.StringVar(&udpAddr, "udp", ":6000", " UDP input addresses, comma separated")
+	flag.IntVar(&udpSockets, "udpsockets", 1, "Number of SO_REUSEPORT sockets per UDP address (Linux only)")
+	flag.IntVar(&udpReadBuffer, "udpreadbuffer", 0, "UDP socket receive buffer size in bytes (0: system default)")
+	flag.StringVar(&udpDropsMetric, "udpdropsmetric", "", "Name of a counter of UDP packets dropped by the kernel (disabled if empty, Linux only)")
+	flag.StringVar(&tcpAddr, "tcp", ":6000", " TCP input address")
+	flag.BoolVar(&tcpReply, "tcpreply", false, "Answer every line received over TCP with ok or error and the reason")
+	flag.BoolVar(&nosync, "nosync", false, "Don't call sync() after every disk write")
+	flag.IntVar(&minBatch, "minbatch", 0, "Hold back the disk writes of a series until this many records are pending (0: disabled)")
+	flag.DurationVar(&maxBatchAge, "maxbatchage", 0, "Hold back the disk writes of a series until its oldest pending record is this old (0: disabled)")
+	flag.IntVar(&maxOpenFiles, "maxopenfiles", datastore.DefaultMaxOpenFiles, "Maximum number of data files kept open while unused (negative: none)")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "Query API request timeout")
+	flag.DurationVar(&wsPing, "wsping", api.DefaultWsPingInterval, "Ping watch websockets this often (negative: never)")
+	flag.DurationVar(&wsIdle, "wsidle", api.DefaultWsIdleTimeout, "Close watch websockets if the peer sends nothing, not even a pong, for this long (negative: never)")
+	flag.IntVar(&maxConnWatches, "maxconnwatches", 0, "Maximum number of watches per websocket, e.g. granularities of a multi-watch (0: unlimited)")
+	flag.IntVar(&maxClientWatches, "maxclientwatches", 0, "Maximum number of watches per client IP address (0: unlimited)")
+	flag.IntVar(&maxQueries, "maxqueries", 16, "Maximum number of concurrent archive queries")
+	flag.IntVar(&timerSamples, "timersamples", 0, "Maximum number of samples kept per timer and interval (0: unlimited)")
+	flag.BoolVar(&takeover, "forcetakeover", false, "Take over the data directory even if the process that last locked it still exists (e.g. its PID has been reused)")
+	flag.BoolVar(&skipCorrupted, "skipcorrupted", false, "Leave out stored data with checksum errors instead of failing queries")
+	flag.BoolVar(&accessLog, "accesslog", false, "Log every query API request")
+	flag.StringVar(&apiMetrics, "apimetrics", "", "Prefix of internal query API metrics (disabled if empty)")
+	flag.StringVar(&usageMetrics, "usagemetrics", "", "Prefix of usage statistics stored every minute (disabled if empty)")
+	flag.Var(&routes, "route", "Store metrics with a prefix in a separate directory (prefix=dir)")
+	flag.DurationVar(&compactInterval, "compactinterval", 0, "Remove empty series in the background this often (0: never)")
+	flag.Var(&quotas, "quota", "Maximum bytes stored for a prefix like \"web.\" (prefix=bytes)")
+	flag.Int64Var(&liveHot, "livehot", server.LiveLogSize, "Seconds kept at full resolution in the live log, older ones are averaged over 10 seconds")
+	flag.Int64Var(&flushSpread, "flushspread", 0, "Spread the datastore writes of each minute over this many seconds (at most 59)")
+	flag.IntVar(&tickWorkers, "tickworkers", 0, "Goroutines processing the metrics every second (0: one per CPU)")
+	flag.Var(&etsy, "etsy", "Quirks of Etsy's statsd to follow, comma separated: emptycounters, gaugedeltas, multivalue, legacynamespace or all")
+	flag.Var(&chaos, "chaos", "Delay and fail datastore operations at random for testing (insert, query or latestbefore=maxlatency/errorrate)")
+	flag.Var(&defaults, "default", "Default of a channel for a prefix (prefix:channel=value, or prefix:channel=previous for persistent channels)")
+	flag.StringVar(&cassandraHosts, "cassandra", "", "Store data in Cassandra instead of the data directory (hosts, comma separated)")
+	flag.StringVar(&cassandraKeyspace, "cassandrakeyspace", "statsd", "Cassandra keyspace")
+	flag.DurationVar(&cassandraTTL, "cassandrattl", 0, "Expire data stored in Cassandra after this long (0: never)")
+	flag.StringVar(&mirrorAddr, "mirror", "", "Redis address to mirror live rows to, for replicas")
+	flag.StringVar(&replicaAddr, "replica", "", "Run as a replica fed by the live rows mirrored to this Redis address (no input)")
+	flag.StringVar(&redisStream, "redisstream", redismirror.DefaultStream, "Redis stream of mirrored live rows")
+	flag.StringVar(&leaderLock, "leaderlock", "", "Stand by until elected leader by locking this file (needs -cassandra)")
+	flag.StringVar(&leaderCassandra, "leadercassandra", "", "Stand by until elected leader by taking this lock in Cassandra (needs -cassandra)")
+	flag.Parse()
+
+	if err := flagsFromEnv("STATSD_"); err != nil {
+		os.Stderr.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	if len(dataDir) == 0 {
+		os.Stderr.Write([]byte("No data directory specified\n"))
+		return
+	}
+
+	if err := checkElection(leaderLock, leaderCassandra, cassandraHosts, routes); err != nil {
+		os.Stderr.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	log.Println("StatsD starting...")
+
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	fsds := &datastore.FsDatastore{
+		Dir:           dataDir,
+		NoSync:        nosync,
+		ForceTakeover: takeover,
+		SkipCorrupted: skipCorrupted,
+		Quotas:        quotas,
+		MinBatch:      minBatch,
+		MaxBatchAge:   maxBatchAge,
+		MaxOpenFiles:  maxOpenFiles,
+	}
+	var ds datastore.Datastore = fsds
+	fsdss := []*datastore.FsDatastore{fsds}
+	if len(cassandraHosts) > 0 {
+		ds = &cassandra.Datastore{
+			Hosts:    strings.Split(cassandraHosts, ","),
+			Keyspace: cassandraKeyspace,
+			TTL:      cassandraTTL,
+		}
+		fsdss = nil
+	}
+	if len(routes) > 0 {
+		rds := &datastore.RoutingDatastore{Default: ds}
+		for _, rt := range routes {
+			fsds := &datastore.FsDatastore{
+				Dir:           rt.dir,
+				NoSync:        nosync,
+				ForceTakeover: takeover,
+				SkipCorrupted: skipCorrupted,
+				Quotas:        quotas,
+				MinBatch:      minBatch,
+				MaxBatchAge:   maxBatchAge,
+				MaxOpenFiles:  maxOpenFiles,
+			}
+			fsdss = append(fsdss, fsds)
+			route := datastore.DatastoreRoute{Prefix: rt.prefix, Ds: fsds}
+			rds.Routes = append(rds.Routes, route)
+		}
+		ds = rds
+	}
+	if len(chaos) > 0 {
+		log.Println("Datastore chaos enabled:", chaos.String())
+		ds = &datastore.ChaosDatastore{
+			Ds:                ds,
+			InsertChaos:       chaos["insert"],
+			QueryChaos:        chaos["query"],
+			LatestBeforeChaos: chaos["latestbefore"],
+		}
+	}
+	if err := ds.Open(); err != nil {
+		log.Println("Datastore.Open:", err)
+		return
+	}
+	defer func() {
+		ds.Close()
+		log.Println("Datastore closed")
+	}()
+	log.Println("Datastore opened")
+
+	if compactInterval > 0 {
+		stopCompact := make(chan int)
+		defer close(stopCompact)
+		go compactEvery(fsdss, compactInterval, stopCompact)
+	}
+
+	wcsfn := filepath.Join(dataDir, "wildcards")
+	wcs, err := loadWildcards(wcsfn)
+	if err == nil {
+		log.Println("Wildcards loaded")
+	} else {
+		log.Println("Failed to load wildcards:", err)
+	}
+
+	srv := &server.Server{
+		Ds:           ds,
+		AutoWc:       true,
+		UsagePrefix:  usageMetrics,
+		LiveLogDir:   dataDir,
+		Defaults:     defaults,
+		LiveLogHot:   liveHot,
+		TickWorkers:  tickWorkers,
+		FlushSpread:  flushSpread,
+		TimerSamples: timerSamples,
+		Conformance:  server.Conformance(etsy),
+	}
+
+	// Standby servers are replicas until elected
+	var lock election.Lock
+	if len(leaderLock) > 0 {
+		lock = &election.FileLock{Path: leaderLock}
+	} else if len(leaderCassandra) > 0 {
+		lock = &cassandra.Lock{
+			Hosts:    strings.Split(cassandraHosts, ","),
+			Keyspace: cassandraKeyspace,
+			Name:     leaderCassandra,
+		}
+	}
+	srv.Replica = len(replicaAddr) > 0 || lock != nil
+
+	var pub *redismirror.Publisher
+	if len(mirrorAddr) > 0 {
+		pub = &redismirror.Publisher{Addr: mirrorAddr, Stream: redisStream}
+		if err := pub.Start(); err != nil {
+			log.Println("Publisher.Start:", err)
+			return
+		}
+		srv.Mirror = pub
+		log.Println("Mirroring live rows to Redis at", mirrorAddr)
+	}
+
+	log.Println("Server started")
+	srv.Start(nil, wcs)
+
+	var sub *redismirror.Subscriber
+	if len(replicaAddr) > 0 {
+		sub = &redismirror.Subscriber{Addr: replicaAddr, Stream: redisStream, Server: srv}
+		if err := sub.Start(); err != nil {
+			log.Println("Subscriber.Start:", err)
+			return
+		}
+		log.Println("Replica of the live rows mirrored to Redis at", replicaAddr)
+	}
+
+	var ha *api.HttpApi
+	if len(apiAddr) > 0 {
+		ha = &api.HttpApi{
+			Addr:             apiAddr,
+			Server:           srv,
+			Timeout:          timeout,
+			MaxQueries:       maxQueries,
+			AccessLog:        accessLog,
+			MetricsPrefix:    apiMetrics,
+			WsPingInterval:   wsPing,
+			WsIdleTimeout:    wsIdle,
+			MaxConnWatches:   maxConnWatches,
+			MaxClientWatches: maxClientWatches,
+		}
+		if err := ha.Start(); err != nil {
+			log.Println("HttpApi.Start:", err)
+		}
+		log.Println("Query API listening on TCP address", ha.Addr)
+	}
+
+	var ui *injector.UDPInjector
+	var ti *injector.TCPInjector
+	startInput := func() bool {
+		if len(udpAddr) > 0 {
+			ui = &injector.UDPInjector{
+				Addr:        udpAddr,
+				Server:      srv,
+				Sockets:     udpSockets,
+				ReadBuffer:  udpReadBuffer,
+				DropsMetric: udpDropsMetric,
+			}
+			if err := ui.Start(); err != nil {
+				log.Println("UDPInjector.Start:", err)
+				return false
+			}
+			log.Println("Listening on UDP addresses", ui.LocalAddrs())
+		}
+
+		if len(tcpAddr) > 0 {
+			ti = &injector.TCPInjector{Addr: tcpAddr, Server: srv, Reply: tcpReply}
+			if err := ti.Start(); err != nil {
+				log.Println("TCPInjector.Start:", err)
+				return false
+			}
+			log.Println("Listening on TCP address", ti.Addr)
+		}
+		return true
+	}
+
+	var elected chan (<-chan int)
+	var lost <-chan int
+	electCtx, cancelElect := context.WithCancel(context.Background())
+	defer cancelElect()
+	if lock != nil {
+		elected = make(chan (<-chan int), 1)
+		go func() {
+			log.Println("Standing by until elected leader")
+			if l, err := lock.Acquire(electCtx); err == nil {
+				elected <- l
+			} else if err != context.Canceled {
+				log.Println("Lock.Acquire:", err)
+			}
+		}()
+	} else if !srv.Replica && !startInput() {
+		return
+	}
+
+	for running := true; running; {
+		select {
+		case <-sighup:
+			log.Println("Received SIGHUP, reloading...")
+			reload(srv, wcsfn)
+		case lost = <-elected:
+			log.Println("Elected leader")
+			if sub != nil {
+				sub.Stop()
+				sub = nil
+				log.Println("Replica subscriber stopped")
+			}
+			if err := srv.Promote(); err != nil {
+				log.Println("Server.Promote:", err)
+			}
+			running = startInput()
+		case <-lost:
+			// Someone else may be writing already
+			log.Println("Lost leadership, stopping...")
+			lost, running = nil, false
+		case <-sigint:
+			running = false
+		}
+	}
+	if lost != nil {
+		defer func() {
+			lock.Release()
+			log.Println("Leadership released")
+		}()
+	}
+	log.Println("Received SIGTERM, stopping...")
+
+	if sub != nil {
+		sub.Stop()
+		log.Println("Replica subscriber stopped")
+	}
+
+	_, wcs, _ = srv.Stop()
+	log.Println("Server stopped")
+
+	if pub != nil {
+		pub.Stop()
+		log.Println("Mirror publisher stopped")
+	}
+
+	if ui != nil {
+		ui.Stop()
+		log.Println("UDP injector stopped")
+	}
+
+	if ti != nil {
+		ti.Stop()
+		log.Println("TCP injector stopped")
+	}
+
+	if err := saveWildcards(wcsfn, wcs); err == nil {
+		log.Println("Wildcards saved")
+	} else {
+		log.Println("Failed to save wildcards:", err)
+		if err := os.Remove(wcsfn); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if ha != nil {
+		ha.Stop()
+		log.Println("Query API stopped")
+	}
+}
+
+// checkElection makes sure the datastore can be shared by the servers
+// taking part in leader election. Standbys open the datastore too, which
+// only Cassandra allows, data directories are locked by their user.
+func checkElection(leaderLock, leaderCassandra, cassandraHosts string, routes routeList) error {
+	if len(leaderLock) == 0 && len(leaderCassandra) == 0 {
+		return nil
+	}
+	if len(cassandraHosts) == 0 {
+		return errors.New("Leader election needs -cassandra, data directories can't be shared")
+	}
+	if len(routes) > 0 {
+		return errors.New("Leader election can't be used with -route, data directories can't be shared")
+	}
+	return nil
+}
+
+// flagsFromEnv sets every flag not given on the command line from the
+// environment variable named prefix + the upper case flag name, if set.
+func flagsFromEnv(prefix string) error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		name := prefix + strings.ToUpper(f.Name)
+		if v, ok := os.LookupEnv(name); ok {
+			if e := f.Value.Set(v); e != nil {
+				err = errors.New("Invalid value for " + name + ": " + e.Error())
+			}
+		}
+	})
+	return err
+}
+
+// reload adds the wildcards of the file to the ones of the server, which
+// may have learned some since the file was saved, and reports the outcome
+// through Server.Health. A reload only adds wildcards: the ones removed
+// from the file are kept, and saved again when the server stops.
+func reload(srv *server.Server, wcsfn string) {
+	wcs, err := loadWildcards(wcsfn)
+	if err == nil {
+		err = srv.MergeWildcards(wcs)
+	}
+	srv.Reloaded(err)
+	if err != nil {
+		log.Println("Failed to reload wildcards:", err)
+		return
+	}
+	log.Println("Wildcards reloaded")
+}
+
+func saveWildcards(fn string, wcs []string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, name := range wcs {
+		if _, err := f.Write([]byte(name)); err != nil {
+			return err
+		}
+		if _, err := f.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadWildcards(fn string) ([]string, error) {
+	buff, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	r := make([]string, 0)
+	for _, line := range bytes.Split(buff, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		r = append(r, string(line))
+	}
+
+	return r, nil
+}
+
+type routeList []routeFlag
+
+type routeFlag struct {
+	prefix, dir string
+}
+
+func (rl *routeList) String() string {
+	s := make([]string, len(*rl))
+	for i, rt := range *rl {
+		s[i] = rt.prefix + "=" + rt.dir
+	}
+	return strings.Join(s, ",")
+}
+
+func (rl *routeList) Set(value string) error {
+	s := strings.SplitN(value, "=", 2)
+	if len(s) != 2 || len(s[1]) == 0 {
+		return errors.New("Route must be in prefix=dir format")
+	}
+	*rl = append(*rl, routeFlag{s[0], s[1]})
+	return nil
+}
+
+type quotaList map[string]int64
+
+func (ql *quotaList) String() string {
+	s := make([]string, 0, len(*ql))
+	for prefix, bytes := range *ql {
+		s = append(s, prefix+"="+strconv.FormatInt(bytes, 10))
+	}
+	return strings.Join(s, ",")
+}
+
+func (ql *quotaList) Set(value string) error {
+	s := strings.SplitN(value, "=", 2)
+	if len(s) != 2 {
+		return errors.New("Quota must be in prefix=bytes format")
+	}
+	bytes, err := strconv.ParseInt(s[1], 10, 64)
+	if err != nil || bytes < 0 {
+		return errors.New("Invalid quota: " + s[1])
+	}
+	if *ql == nil {
+		*ql = make(quotaList)
+	}
+	(*ql)[s[0]] = bytes
+	return nil
+}
+
+type chaosList map[string]datastore.Chaos
+
+func (cl *chaosList) String() string {
+	s := make([]string, 0, len(*cl))
+	for op, c := range *cl {
+		s = append(s, op+"="+c.Latency.String()+"/"+strconv.FormatFloat(c.ErrorRate, 'g', -1, 64))
+	}
+	return strings.Join(s, ",")
+}
+
+func (cl *chaosList) Set(value string) error {
+	s := strings.SplitN(value, "=", 2)
+	if len(s) != 2 || s[0] != "insert" && s[0] != "query" && s[0] != "latestbefore" {
+		return errors.New("Chaos must be in operation=maxlatency/errorrate format")
+	}
+	v := strings.SplitN(s[1], "/", 2)
+	if len(v) != 2 {
+		return errors.New("Chaos must be in operation=maxlatency/errorrate format")
+	}
+	latency, err := time.ParseDuration(v[0])
+	if err != nil || latency < 0 {
+		return errors.New("Invalid latency: " + v[0])
+	}
+	rate, err := strconv.ParseFloat(v[1], 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return errors.New("Invalid error rate: " + v[1])
+	}
+	if *cl == nil {
+		*cl = make(chaosList)
+	}
+	(*cl)[s[0]] = datastore.Chaos{Latency: latency, ErrorRate: rate}
+	return nil
+}
+
+type defaultList []server.ChannelDefault
+
+func (dl *defaultList) String() string {
+	s := make([]string, len(*dl))
+	for i, cd := range *dl {
+		v := strconv.FormatFloat(cd.Value, 'g', -1, 64)
+		if cd.Previous {
+			v = "previous"
+		}
+		s[i] = cd.Prefix + ":" + cd.Channel + "=" + v
+	}
+	return strings.Join(s, ",")
+}
+
+func (dl *defaultList) Set(value string) error {
+	cd, err := server.ParseChannelDefault(value)
+	if err != nil {
+		return err
+	}
+	*dl = append(*dl, cd)
+	return nil
+}
+
+type etsyFlag server.Conformance
+
+func (ef *etsyFlag) String() string {
+	s := []string(nil)
+	for _, q := range ef.quirks() {
+		if *q.set {
+			s = append(s, q.name)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (ef *etsyFlag) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		found := false
+		for _, q := range ef.quirks() {
+			if name == q.name || name == "all" {
+				*q.set, found = true, true
+			}
+		}
+		if !found {
+			return errors.New("Unknown quirk: " + name)
+		}
+	}
+	return nil
+}
+
+type etsyQuirk struct {
+	name string
+	set  *bool
+}
+
+func (ef *etsyFlag) quirks() []etsyQuirk {
+	return []etsyQuirk{
+		{"emptycounters", &ef.EmptyCounters},
+		{"gaugedeltas", &ef.GaugeDeltas},
+		{"multivalue", &ef.MultiValue},
+		{"legacynamespace", &ef.StripLegacyNamespace},
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestCheckElection(t *testing.T) {
+	routes := routeList{{prefix: "a.", dir: "/tmp/a"}}
+	var testCases = []struct {
+		leaderLock, leaderCassandra, cassandraHosts string
+		routes                                      routeList
+		ok                                          bool
+	}{
+		{"", "", "", nil, true},
+		{"", "", "", routes, true},
+		{"/tmp/leader", "", "", nil, false},
+		{"", "leader", "", nil, false},
+		{"/tmp/leader", "", "localhost", nil, true},
+		{"", "leader", "localhost", nil, true},
+		{"", "leader", "localhost", routes, false},
+	}
+
+	for _, tc := range testCases {
+		err := checkElection(tc.leaderLock, tc.leaderCassandra, tc.cassandraHosts, tc.routes)
+		if (err == nil) != tc.ok {
+			t.Error("Incorrect result:", tc.leaderLock, tc.leaderCassandra, tc.cassandraHosts, tc.routes)
+			t.Error("Expected:", tc.ok)
+			t.Error("Result:", err)
+		}
+	}
+}
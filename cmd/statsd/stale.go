@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"github.com/adatboss/statsd/datastore"
+	"log"
+	"os"
+	"time"
+)
+
+// stale runs "statsd stale [-age duration] dir...", listing the series of
+// the data directories with no records written for age, which must not be
+// in use. Only the catalogs of the directories are read.
+func stale(args []string) {
+	fs := flag.NewFlagSet("stale", flag.ExitOnError)
+	age := fs.Duration("age", 7*24*time.Hour, "List series whose last record is older than this")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		os.Stderr.Write([]byte("Usage: statsd stale [-age duration] datadir...\n"))
+		os.Exit(2)
+	}
+
+	before := time.Now().Add(-*age).Unix()
+	failed := false
+	for _, dir := range fs.Args() {
+		ds := &datastore.FsDatastore{Dir: dir}
+		if err := ds.Open(); err != nil {
+			log.Println("Datastore.Open:", err)
+			failed = true
+			continue
+		}
+		cat, err := ds.Catalog()
+		if err != nil {
+			log.Println("FsDatastore.Catalog:", err)
+			failed = true
+		}
+		for _, si := range cat {
+			if si.Last < before {
+				last := time.Unix(si.Last, 0).UTC().Format(time.RFC3339)
+				os.Stdout.Write([]byte(si.Name + "\t" + last + "\n"))
+			}
+		}
+		if err := ds.Close(); err != nil {
+			log.Println("Datastore.Close:", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,31 @@
+package datastore_test
+
+import (
+	"github.com/adatboss/statsd/datastore"
+	"github.com/adatboss/statsd/datastore/dsbench"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func BenchmarkFsDatastore(b *testing.B) {
+	dsbench.Run(b, dsbench.Backend{
+		New: func() (datastore.Datastore, func()) {
+			dir, err := ioutil.TempDir("", "statsd")
+			if err != nil {
+				b.Fatal(err)
+			}
+			ds := &datastore.FsDatastore{Dir: dir, NoSync: true}
+			return ds, func() { os.RemoveAll(dir) }
+		},
+		Reopen: true,
+	})
+}
+
+func BenchmarkMemDatastore(b *testing.B) {
+	dsbench.Run(b, dsbench.Backend{
+		New: func() (datastore.Datastore, func()) {
+			return &datastore.MemDatastore{}, func() {}
+		},
+	})
+}
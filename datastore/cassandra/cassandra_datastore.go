@@ -0,0 +1,417 @@
+// Package cassandra provides a Datastore storing records in Cassandra or
+// ScyllaDB. It is kept out of package datastore so that programs not using
+// it don't depend on the driver.
+package cassandra
+
+import (
+	"context"
+	"github.com/adatboss/statsd/datastore"
+	"github.com/gocql/gocql"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBucketSize    = 7 * 86400
+	DefaultBatchSize     = 100
+	DefaultFlushInterval = time.Second
+)
+
+// The keyspace has to exist, the tables are created by Open.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS records (
+		name text, bucket bigint, ts bigint, value double,
+		PRIMARY KEY ((name, bucket), ts))`,
+	`CREATE TABLE IF NOT EXISTS names (name text PRIMARY KEY, first bigint)`,
+}
+
+// Datastore keeps the records of a name in partitions of BucketSize
+// seconds. Inserts are buffered and written in batches every FlushInterval,
+// or as soon as BatchSize records are waiting. Buffered records are
+// returned by queries as well. If TTL is positive, records expire after
+// it.
+type Datastore struct {
+	Hosts         []string
+	Keyspace      string
+	BucketSize    int64
+	TTL           time.Duration
+	BatchSize     int
+	FlushInterval time.Duration
+	mu            sync.Mutex
+	session       *gocql.Session
+	pending       map[string][]datastore.Record
+	writing       map[string][]datastore.Record
+	npending      int
+	names         map[string]int64 // first bucket of every name
+	newNames      []string
+	running       bool
+	flush         chan int
+	quit          chan int
+	done          chan int
+}
+
+func (ds *Datastore) Open() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.running {
+		return datastore.ErrAlreadyRunning
+	}
+	if ds.BucketSize <= 0 || ds.BucketSize%60 != 0 {
+		if ds.BucketSize != 0 {
+			return datastore.Error("Bucket size must be a positive multiple of 60")
+		}
+		ds.BucketSize = DefaultBucketSize
+	}
+	if ds.BatchSize <= 0 {
+		ds.BatchSize = DefaultBatchSize
+	}
+	if ds.FlushInterval <= 0 {
+		ds.FlushInterval = DefaultFlushInterval
+	}
+
+	cluster := gocql.NewCluster(ds.Hosts...)
+	cluster.Keyspace = ds.Keyspace
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range schema {
+		if err := session.Query(stmt).Exec(); err != nil {
+			session.Close()
+			return err
+		}
+	}
+
+	ds.names = make(map[string]int64)
+	iter := session.Query(`SELECT name, first FROM names`).Iter()
+	var name string
+	var first int64
+	for iter.Scan(&name, &first) {
+		ds.names[name] = first
+	}
+	if err := iter.Close(); err != nil {
+		session.Close()
+		return err
+	}
+
+	ds.session = session
+	ds.pending = make(map[string][]datastore.Record)
+	ds.writing = make(map[string][]datastore.Record)
+	ds.npending = 0
+	ds.newNames = nil
+	ds.flush = make(chan int, 1)
+	ds.quit = make(chan int)
+	ds.done = make(chan int)
+	ds.running = true
+	go ds.write()
+	return nil
+}
+
+func (ds *Datastore) Close() error {
+	ds.mu.Lock()
+	if !ds.running {
+		ds.mu.Unlock()
+		return datastore.ErrNotRunning
+	}
+	ds.running = false
+	ds.mu.Unlock()
+
+	close(ds.quit)
+	<-ds.done
+	ds.session.Close()
+	return nil
+}
+
+func (ds *Datastore) Insert(name string, r datastore.Record) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if !ds.running {
+		return datastore.ErrNotRunning
+	}
+	if r.Ts%60 != 0 {
+		return datastore.Error("Timestamp not divisible by 60")
+	}
+
+	if _, ok := ds.names[name]; !ok {
+		ds.names[name] = ds.bucket(r.Ts)
+		ds.newNames = append(ds.newNames, name)
+	}
+	ds.pending[name] = append(ds.pending[name], r)
+	if ds.npending++; ds.npending == ds.BatchSize {
+		select {
+		case ds.flush <- 1:
+		default:
+		}
+	}
+	return nil
+}
+
+func (ds *Datastore) Query(ctx context.Context, name string, from, until int64) ([]datastore.Record, error) {
+	it, err := ds.Iterate(ctx, name, from, until)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.Collect(it)
+}
+
+func (ds *Datastore) Iterate(ctx context.Context, name string, from, until int64) (datastore.Iterator, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if !ds.running {
+		return nil, datastore.ErrNotRunning
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Unknown names have no partitions to read
+	it := &iterator{ctx: ctx, ds: ds, name: name, from: from, until: until, bucket: 0, lastBucket: -1}
+	first, ok := ds.names[name]
+	if !ok {
+		return it, nil
+	}
+	it.bucket, it.lastBucket = ds.bucket(from), ds.bucket(until)
+	if it.bucket < first {
+		it.bucket = first
+	}
+	for _, r := range ds.buffered(name) {
+		if r.Ts >= from && r.Ts <= until {
+			it.buffered = append(it.buffered, r)
+		}
+	}
+	return it, nil
+}
+
+func (ds *Datastore) LatestBefore(ctx context.Context, name string, ts int64) (datastore.Record, error) {
+	ds.mu.Lock()
+	if !ds.running {
+		ds.mu.Unlock()
+		return datastore.Record{}, datastore.ErrNotRunning
+	}
+	first, ok := ds.names[name]
+	buffered := ds.buffered(name)
+	ds.mu.Unlock()
+
+	if !ok {
+		return datastore.Record{}, datastore.NoDataError{Name: name}
+	}
+
+	// Buffered records are newer than the stored ones
+	for i := len(buffered) - 1; i >= 0; i-- {
+		if buffered[i].Ts <= ts {
+			return buffered[i], nil
+		}
+	}
+
+	for b := ds.bucket(ts); b >= first; b -= ds.BucketSize {
+		var r datastore.Record
+		err := ds.session.Query(`SELECT ts, value FROM records WHERE name = ? AND bucket = ? AND ts <= ?
+			ORDER BY ts DESC LIMIT 1`, name, b, ts).WithContext(ctx).Scan(&r.Ts, &r.Value)
+		if err == nil {
+			return r, nil
+		} else if err != gocql.ErrNotFound {
+			return datastore.Record{}, err
+		}
+	}
+	return datastore.Record{}, datastore.NoDataError{Name: name}
+}
+
+// ListNames matches the names known when the datastore was opened, and the
+// ones inserted since.
+func (ds *Datastore) ListNames(pattern string) ([]string, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	r := make([]string, 0)
+	for name := range ds.names {
+		m, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if m {
+			r = append(r, name)
+		}
+	}
+	return r, nil
+}
+
+// Stats only counts the series, the size of the data is not known.
+func (ds *Datastore) Stats() ([]datastore.PrefixStats, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if !ds.running {
+		return nil, datastore.ErrNotRunning
+	}
+	series := make(map[string]int)
+	for name := range ds.names {
+		series[datastore.NamePrefix(name)]++
+	}
+	r := make([]datastore.PrefixStats, 0, len(series))
+	for prefix, n := range series {
+		r = append(r, datastore.PrefixStats{Prefix: prefix, Series: n})
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Prefix < r[j].Prefix
+	})
+	return r, nil
+}
+
+// bucket returns the first timestamp of the partition of ts.
+func (ds *Datastore) bucket(ts int64) int64 {
+	return bucket(ts, ds.BucketSize)
+}
+
+func bucket(ts, size int64) int64 {
+	if m := ts % size; m < 0 {
+		return ts - m - size
+	} else {
+		return ts - m
+	}
+}
+
+// buffered returns the records of a name not yet written, in the order
+// they were inserted. The caller must hold ds.mu.
+func (ds *Datastore) buffered(name string) []datastore.Record {
+	w, p := ds.writing[name], ds.pending[name]
+	return append(append(make([]datastore.Record, 0, len(w)+len(p)), w...), p...)
+}
+
+func (ds *Datastore) write() {
+	defer close(ds.done)
+	ticker := time.NewTicker(ds.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ds.quit:
+			ds.writePending()
+			return
+		case <-ticker.C:
+		case <-ds.flush:
+		}
+		ds.writePending()
+	}
+}
+
+// writePending writes the buffered records in an unlogged batch per
+// partition. Records which couldn't be written are kept for the next
+// attempt.
+func (ds *Datastore) writePending() {
+	ds.mu.Lock()
+	ds.writing, ds.pending = ds.pending, make(map[string][]datastore.Record)
+	ds.npending = 0
+	newNames := ds.newNames
+	ds.newNames = nil
+	firsts := make([]int64, len(newNames))
+	for i, name := range newNames {
+		firsts[i] = ds.names[name]
+	}
+	ds.mu.Unlock()
+
+	for i, name := range newNames {
+		err := ds.session.Query(`INSERT INTO names (name, first) VALUES (?, ?)`, name, firsts[i]).Exec()
+		if err != nil {
+			log.Println("cassandra.Datastore.writePending:", err)
+			ds.mu.Lock()
+			ds.newNames = append(ds.newNames, name)
+			ds.mu.Unlock()
+		}
+	}
+
+	ttl := int64(ds.TTL / time.Second)
+	failed := make(map[string][]datastore.Record)
+	for name, records := range ds.writing {
+		for len(records) > 0 {
+			b := ds.bucket(records[0].Ts)
+			batch := ds.session.NewBatch(gocql.UnloggedBatch)
+			n := 0
+			for ; n < len(records) && n < ds.BatchSize && ds.bucket(records[n].Ts) == b; n++ {
+				batch.Query(`INSERT INTO records (name, bucket, ts, value) VALUES (?, ?, ?, ?) USING TTL ?`,
+					name, b, records[n].Ts, records[n].Value, ttl)
+			}
+			if err := ds.session.ExecuteBatch(batch); err != nil {
+				log.Println("cassandra.Datastore.writePending:", err)
+				failed[name] = append(failed[name], records[:n]...)
+			}
+			records = records[n:]
+		}
+	}
+
+	ds.mu.Lock()
+	for name, records := range failed {
+		ds.pending[name] = append(records, ds.pending[name]...)
+		ds.npending += len(records)
+	}
+	ds.writing = make(map[string][]datastore.Record)
+	ds.mu.Unlock()
+}
+
+// iterator reads the partitions of a name one after the other, followed by
+// the buffered records.
+type iterator struct {
+	ctx         context.Context
+	ds          *Datastore
+	name        string
+	from, until int64
+	bucket      int64
+	lastBucket  int64
+	records     []datastore.Record
+	buffered    []datastore.Record
+	last        int64
+	started     bool
+	closed      bool
+	err         error
+}
+
+func (it *iterator) Next() (datastore.Record, bool) {
+	for !it.closed && it.err == nil {
+		if len(it.records) > 0 {
+			r := it.records[0]
+			it.records = it.records[1:]
+			it.last, it.started = r.Ts, true
+			return r, true
+		}
+		if it.bucket <= it.lastBucket {
+			it.err = it.readBucket()
+			continue
+		}
+		for len(it.buffered) > 0 {
+			r := it.buffered[0]
+			it.buffered = it.buffered[1:]
+			if !it.started || r.Ts > it.last {
+				it.last, it.started = r.Ts, true
+				return r, true
+			}
+		}
+		it.Close()
+	}
+	return datastore.Record{}, false
+}
+
+func (it *iterator) readBucket() error {
+	iter := it.ds.session.Query(`SELECT ts, value FROM records WHERE name = ? AND bucket = ? AND ts >= ? AND ts <= ?`,
+		it.name, it.bucket, it.from, it.until).WithContext(it.ctx).Iter()
+	var r datastore.Record
+	for iter.Scan(&r.Ts, &r.Value) {
+		it.records = append(it.records, r)
+	}
+	it.bucket += it.ds.BucketSize
+	return iter.Close()
+}
+
+func (it *iterator) Err() error {
+	return it.err
+}
+
+func (it *iterator) Close() error {
+	it.closed = true
+	it.records, it.buffered = nil, nil
+	return nil
+}
@@ -0,0 +1,169 @@
+package cassandra
+
+import (
+	"context"
+	"errors"
+	"github.com/adatboss/statsd/datastore"
+	"github.com/adatboss/statsd/datastore/dsbench"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	var testCases = []struct {
+		ts, size, bucket int64
+	}{
+		{0, 3600, 0},
+		{60, 3600, 0},
+		{3540, 3600, 0},
+		{3600, 3600, 3600},
+		{7260, 3600, 7200},
+		{-60, 3600, -3600},
+		{-3600, 3600, -3600},
+	}
+	for _, tc := range testCases {
+		if b := bucket(tc.ts, tc.size); b != tc.bucket {
+			t.Error("Incorrect result:", tc.ts, tc.size)
+			t.Error("Expected:", tc.bucket)
+			t.Error("Result:", b)
+		}
+	}
+}
+
+// TestDatastore needs a running cluster with an empty keyspace, e.g.
+// STATSD_TEST_CASSANDRA=localhost/statsd_test.
+func TestDatastore(t *testing.T) {
+	env := os.Getenv("STATSD_TEST_CASSANDRA")
+	if env == "" {
+		t.Skip("STATSD_TEST_CASSANDRA not set")
+	}
+	i := strings.LastIndexByte(env, '/')
+	if i == -1 {
+		t.Fatal("STATSD_TEST_CASSANDRA should look like host,host/keyspace")
+	}
+	ds := &Datastore{
+		Hosts:         strings.Split(env[:i], ","),
+		Keyspace:      env[i+1:],
+		BucketSize:    600,
+		FlushInterval: 10 * time.Millisecond,
+	}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	ctx := context.Background()
+
+	name := "test" + time.Now().Format("150405.000000") + ":gauge"
+	for ts := int64(60); ts <= 1800; ts += 60 {
+		if err := ds.Insert(name, datastore.Record{Ts: ts, Value: float64(ts)}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+
+	check := func() {
+		var testCases = []struct {
+			from, until int64
+			n           int
+		}{
+			{0, 10000, 30},
+			{540, 660, 3},
+			{601, 659, 0},
+			{1800, 1800, 1},
+		}
+		for _, tc := range testCases {
+			r, err := ds.Query(ctx, name, tc.from, tc.until)
+			if err != nil {
+				t.Error("Query:", err)
+			} else if len(r) != tc.n {
+				t.Error("Incorrect result:", tc.from, tc.until)
+				t.Error("Expected:", tc.n)
+				t.Error("Result:", r)
+			}
+		}
+		if _, err := ds.LatestBefore(ctx, name, 59); !errors.Is(err, datastore.ErrNoData) {
+			t.Error("LatestBefore should have returned ErrNoData:", err)
+		}
+		if r, err := ds.LatestBefore(ctx, name, 1259); err != nil || r.Ts != 1200 {
+			t.Error("Incorrect LatestBefore result:", r, err)
+		}
+	}
+
+	// Once while the records are buffered, and once after reopening
+	check()
+	if err := ds.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	if names, err := ds.ListNames(name); err != nil || len(names) != 1 {
+		t.Error("Incorrect ListNames result:", names, err)
+	}
+	check()
+}
+
+func TestLock(t *testing.T) {
+	env := os.Getenv("STATSD_TEST_CASSANDRA")
+	if env == "" {
+		t.Skip("STATSD_TEST_CASSANDRA not set")
+	}
+	i := strings.LastIndexByte(env, '/')
+	if i == -1 {
+		t.Fatal("STATSD_TEST_CASSANDRA should look like host,host/keyspace")
+	}
+	name := "test" + time.Now().Format("150405.000000")
+	newLock := func() *Lock {
+		return &Lock{
+			Hosts:    strings.Split(env[:i], ","),
+			Keyspace: env[i+1:],
+			Name:     name,
+			TTL:      3 * time.Second,
+			Poll:     10 * time.Millisecond,
+		}
+	}
+	a, b := newLock(), newLock()
+
+	if _, err := a.Acquire(context.Background()); err != nil {
+		t.Fatal("Acquire:", err)
+	}
+	// Held across renewals
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	if _, err := b.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Error("Acquire should have timed out:", err)
+	}
+	cancel()
+
+	if err := a.Release(); err != nil {
+		t.Error("Release:", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := b.Acquire(ctx); err != nil {
+		t.Fatal("Acquire:", err)
+	}
+	if err := b.Release(); err != nil {
+		t.Error("Release:", err)
+	}
+}
+
+// BenchmarkDatastore needs a running cluster like TestDatastore. Every run
+// leaves its series behind in the keyspace.
+func BenchmarkDatastore(b *testing.B) {
+	env := os.Getenv("STATSD_TEST_CASSANDRA")
+	if env == "" {
+		b.Skip("STATSD_TEST_CASSANDRA not set")
+	}
+	i := strings.LastIndexByte(env, '/')
+	if i == -1 {
+		b.Fatal("STATSD_TEST_CASSANDRA should look like host,host/keyspace")
+	}
+	dsbench.Run(b, dsbench.Backend{
+		New: func() (datastore.Datastore, func()) {
+			ds := &Datastore{Hosts: strings.Split(env[:i], ","), Keyspace: env[i+1:]}
+			return ds, func() {}
+		},
+		Reopen: true,
+	})
+}
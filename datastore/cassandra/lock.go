@@ -0,0 +1,136 @@
+package cassandra
+
+import (
+	"context"
+	"github.com/adatboss/statsd/datastore"
+	"github.com/gocql/gocql"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLockTTL  = 10 * time.Second
+	DefaultLockPoll = time.Second
+)
+
+const lockSchema = `CREATE TABLE IF NOT EXISTS locks (name text PRIMARY KEY, owner text)`
+
+// Lock is a lock stored in Cassandra with lightweight transactions, for
+// electing a leader among servers sharing a keyspace. The holder renews it
+// every third of TTL, and it expires if the holder fails to do so.
+type Lock struct {
+	Hosts    []string
+	Keyspace string
+	Name     string
+	TTL      time.Duration
+	Poll     time.Duration
+	mu       sync.Mutex
+	session  *gocql.Session
+	owner    string
+	stop     chan int
+	done     chan int
+}
+
+func (l *Lock) Acquire(ctx context.Context) (<-chan int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.session != nil {
+		return nil, datastore.Error("Lock already held")
+	}
+	if l.TTL < time.Second {
+		l.TTL = DefaultLockTTL
+	}
+	if l.Poll <= 0 {
+		l.Poll = DefaultLockPoll
+	}
+
+	cluster := gocql.NewCluster(l.Hosts...)
+	cluster.Keyspace = l.Keyspace
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, err
+	}
+	if err := session.Query(lockSchema).WithContext(ctx).Exec(); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	owner := host + ":" + strconv.Itoa(os.Getpid()) + ":" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	for {
+		applied, err := session.Query(`INSERT INTO locks (name, owner) VALUES (?, ?) IF NOT EXISTS USING TTL ?`,
+			l.Name, owner, l.ttl()).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+		if err == nil && applied {
+			break
+		} else if err != nil && ctx.Err() == nil {
+			log.Println("cassandra.Lock.Acquire:", err)
+		}
+		select {
+		case <-ctx.Done():
+			session.Close()
+			return nil, ctx.Err()
+		case <-time.After(l.Poll):
+		}
+	}
+
+	l.session, l.owner = session, owner
+	l.stop, l.done = make(chan int), make(chan int)
+	lost := make(chan int)
+	go l.renew(lost)
+	return lost, nil
+}
+
+func (l *Lock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.session == nil {
+		return datastore.Error("Lock not held")
+	}
+
+	close(l.stop)
+	<-l.done
+	_, err := l.session.Query(`DELETE FROM locks WHERE name = ? IF owner = ?`,
+		l.Name, l.owner).MapScanCAS(make(map[string]interface{}))
+	l.session.Close()
+	l.session = nil
+	return err
+}
+
+func (l *Lock) ttl() int {
+	return int(l.TTL / time.Second)
+}
+
+// renew extends the TTL of the lock until it is released. The lock is lost
+// if someone else holds it, or it couldn't be renewed in time.
+func (l *Lock) renew(lost chan int) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.TTL / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		applied, err := l.session.Query(`UPDATE locks USING TTL ? SET owner = ? WHERE name = ? IF owner = ?`,
+			l.ttl(), l.owner, l.Name, l.owner).MapScanCAS(make(map[string]interface{}))
+		if err == nil && applied {
+			renewed = time.Now()
+			continue
+		}
+		if err != nil {
+			log.Println("cassandra.Lock.renew:", err)
+		}
+		if err == nil || time.Since(renewed) >= l.TTL {
+			close(lost)
+			<-l.stop
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrChaos is returned by ChaosDatastore for the failures it makes up.
+const ErrChaos = Error("Injected datastore failure")
+
+// Chaos tells how an operation of ChaosDatastore misbehaves. Every call is
+// delayed by a random duration up to Latency, then fails with probability
+// ErrorRate.
+type Chaos struct {
+	Latency   time.Duration
+	ErrorRate float64
+}
+
+// ChaosDatastore wraps Ds, delaying and failing its operations at random,
+// to check that a server degrades gracefully when the storage misbehaves.
+// Iterate behaves like Query. The other operations are passed through, so
+// it can also wrap a Datastore which is already open.
+type ChaosDatastore struct {
+	Ds                Datastore
+	InsertChaos       Chaos
+	QueryChaos        Chaos
+	LatestBeforeChaos Chaos
+	Seed              int64 // of the random numbers, the time by default
+	mu                sync.Mutex
+	rand              *rand.Rand
+}
+
+func (ds *ChaosDatastore) Open() error {
+	return ds.Ds.Open()
+}
+
+func (ds *ChaosDatastore) Close() error {
+	return ds.Ds.Close()
+}
+
+func (ds *ChaosDatastore) Insert(name string, r Record) error {
+	if err := ds.misbehave(context.Background(), ds.InsertChaos); err != nil {
+		return err
+	}
+	return ds.Ds.Insert(name, r)
+}
+
+func (ds *ChaosDatastore) Query(ctx context.Context, name string, from, until int64) ([]Record, error) {
+	if err := ds.misbehave(ctx, ds.QueryChaos); err != nil {
+		return nil, err
+	}
+	return ds.Ds.Query(ctx, name, from, until)
+}
+
+func (ds *ChaosDatastore) Iterate(ctx context.Context, name string, from, until int64) (Iterator, error) {
+	if err := ds.misbehave(ctx, ds.QueryChaos); err != nil {
+		return nil, err
+	}
+	return ds.Ds.Iterate(ctx, name, from, until)
+}
+
+func (ds *ChaosDatastore) LatestBefore(ctx context.Context, name string, ts int64) (Record, error) {
+	if err := ds.misbehave(ctx, ds.LatestBeforeChaos); err != nil {
+		return Record{}, err
+	}
+	return ds.Ds.LatestBefore(ctx, name, ts)
+}
+
+func (ds *ChaosDatastore) ListNames(pattern string) ([]string, error) {
+	return ds.Ds.ListNames(pattern)
+}
+
+func (ds *ChaosDatastore) Stats() ([]PrefixStats, error) {
+	return ds.Ds.Stats()
+}
+
+// misbehave waits for the latency of an operation, and decides whether it
+// fails. The wait is cut short if ctx is done.
+func (ds *ChaosDatastore) misbehave(ctx context.Context, c Chaos) error {
+	ds.mu.Lock()
+	if ds.rand == nil {
+		seed := ds.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		ds.rand = rand.New(rand.NewSource(seed))
+	}
+	var d time.Duration
+	if c.Latency > 0 {
+		d = time.Duration(ds.rand.Int63n(int64(c.Latency) + 1))
+	}
+	fail := c.ErrorRate > 0 && ds.rand.Float64() < c.ErrorRate
+	ds.mu.Unlock()
+
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fail {
+		return ErrChaos
+	}
+	return nil
+}
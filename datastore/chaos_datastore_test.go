@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestChaosDatastore(t *testing.T) {
+	ds := &ChaosDatastore{
+		Ds:                &MemDatastore{},
+		InsertChaos:       Chaos{ErrorRate: 0.5},
+		QueryChaos:        Chaos{Latency: 20 * time.Millisecond},
+		LatestBeforeChaos: Chaos{ErrorRate: 1},
+		Seed:              1,
+	}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	ctx := context.Background()
+
+	inserted, failed := 0, 0
+	for ts := int64(60); ts <= 6000; ts += 60 {
+		if err := ds.Insert("test:gauge", Record{ts, 1}); err == ErrChaos {
+			failed++
+		} else if err != nil {
+			t.Fatal("Insert:", err)
+		} else {
+			inserted++
+		}
+	}
+	if failed < 25 || inserted < 25 {
+		t.Error("Incorrect number of failed inserts:", failed, inserted)
+	}
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if r, err := ds.Query(ctx, "test:gauge", 0, 6000); err != nil || len(r) != inserted {
+			t.Error("Incorrect Query result:", len(r), err)
+		}
+	}
+	if d := time.Since(start); d < 20*time.Millisecond || d > 2*time.Second {
+		t.Error("Incorrect Query latency:", d)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	ds.QueryChaos.Latency = time.Hour
+	if _, err := ds.Iterate(cctx, "test:gauge", 0, 6000); err != context.Canceled {
+		t.Error("Iterate should have been canceled:", err)
+	}
+
+	if _, err := ds.LatestBefore(ctx, "test:gauge", 6000); err != ErrChaos {
+		t.Error("LatestBefore should have failed:", err)
+	}
+}
@@ -0,0 +1,47 @@
+// Package datastore provides storage backends for metric records.
+package datastore
+
+import "context"
+
+type Record struct {
+	Ts    int64
+	Value float64
+}
+
+type Datastore interface {
+	Open() error
+	Close() error
+	Insert(name string, r Record) error
+	Query(ctx context.Context, name string, from, until int64) ([]Record, error)
+	Iterate(ctx context.Context, name string, from, until int64) (Iterator, error)
+	LatestBefore(ctx context.Context, name string, ts int64) (Record, error)
+	ListNames(pattern string) ([]string, error)
+	Stats() ([]PrefixStats, error)
+}
+
+const (
+	ErrNoData         = Error("No data")
+	ErrNotRunning     = Error("Datastore not running")
+	ErrAlreadyRunning = Error("Datastore already running")
+	ErrStopping       = Error("Datastore is stopping")
+)
+
+// NoDataError is returned instead of ErrNoData to tell the series.
+// errors.Is(err, ErrNoData) holds for it.
+type NoDataError struct {
+	Name string
+}
+
+func (err NoDataError) Error() string {
+	return string(ErrNoData) + ": " + err.Name
+}
+
+func (err NoDataError) Is(target error) bool {
+	return target == ErrNoData
+}
+
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
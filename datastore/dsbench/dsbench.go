@@ -0,0 +1,134 @@
+// Package dsbench benchmarks Datastore implementations the same way, so
+// that backends can be compared and regressions caught before a release.
+// A backend is benchmarked by calling Run from a benchmark of its package:
+//
+//	func BenchmarkMyDatastore(b *testing.B) {
+//		dsbench.Run(b, dsbench.Backend{New: newMyDatastore})
+//	}
+//
+// and the results of two versions compared with benchstat:
+//
+//	go test -run - -bench . -count 10 ./datastore/... > new.txt
+//	benchstat old.txt new.txt
+//
+// Every operation is benchmarked with each of SeriesCounts series. Queries
+// ask for an hour of a random series filled with RecordsPerSeries records.
+package dsbench
+
+import (
+	"context"
+	"errors"
+	"github.com/adatboss/statsd/datastore"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	SeriesCounts     = []int{1, 100, 1000}
+	RecordsPerSeries = 240
+)
+
+type Backend struct {
+	// New returns a Datastore on empty storage, not opened yet, and a
+	// function removing the storage.
+	New func() (datastore.Datastore, func())
+
+	// Reopen tells to close and reopen the datastore once it is filled,
+	// so that queries see it like after a restart.
+	Reopen bool
+}
+
+// Run runs the Insert, Query and LatestBefore benchmarks of a backend.
+func Run(b *testing.B, be Backend) {
+	for _, n := range SeriesCounts {
+		b.Run("Insert/series="+strconv.Itoa(n), func(b *testing.B) {
+			benchmarkInsert(b, be, n)
+		})
+	}
+	for _, n := range SeriesCounts {
+		benchmarkQueries(b, be, n)
+	}
+}
+
+// seriesNames returns the names of n series, unique to the run so that backends
+// with shared storage can be benchmarked too.
+func seriesNames(n int) []string {
+	prefix := "bench" + strconv.FormatInt(time.Now().UnixNano(), 36) + ".s"
+	names := make([]string, n)
+	for i := range names {
+		names[i] = prefix + strconv.Itoa(i) + ":gauge"
+	}
+	return names
+}
+
+func open(b *testing.B, be Backend) (datastore.Datastore, func()) {
+	ds, cleanup := be.New()
+	if err := ds.Open(); err != nil {
+		cleanup()
+		b.Fatal("Open:", err)
+	}
+	return ds, func() {
+		if err := ds.Close(); err != nil {
+			b.Error("Close:", err)
+		}
+		cleanup()
+	}
+}
+
+func benchmarkInsert(b *testing.B, be Backend, n int) {
+	ds, done := open(b, be)
+	defer done()
+	names := seriesNames(n)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := datastore.Record{Ts: int64(i/n+1) * 60, Value: float64(i)}
+		if err := ds.Insert(names[i%n], r); err != nil {
+			b.Fatal("Insert:", err)
+		}
+	}
+}
+
+// benchmarkQueries fills a datastore once for the Query and LatestBefore
+// benchmarks with n series.
+func benchmarkQueries(b *testing.B, be Backend, n int) {
+	ds, done := open(b, be)
+	defer done()
+	names := seriesNames(n)
+	for ts := int64(1); ts <= int64(RecordsPerSeries); ts++ {
+		for _, name := range names {
+			if err := ds.Insert(name, datastore.Record{Ts: ts * 60, Value: float64(ts)}); err != nil {
+				b.Fatal("Insert:", err)
+			}
+		}
+	}
+	if be.Reopen {
+		if err := ds.Close(); err != nil {
+			b.Fatal("Close:", err)
+		}
+		if err := ds.Open(); err != nil {
+			b.Fatal("Open:", err)
+		}
+	}
+
+	ctx, end := context.Background(), int64(RecordsPerSeries)*60
+	r := rand.New(rand.NewSource(1))
+	b.Run("Query/series="+strconv.Itoa(n), func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			from := r.Int63n(end)
+			if _, err := ds.Query(ctx, names[r.Intn(n)], from, from+3599); err != nil {
+				b.Fatal("Query:", err)
+			}
+		}
+	})
+	b.Run("LatestBefore/series="+strconv.Itoa(n), func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := ds.LatestBefore(ctx, names[r.Intn(n)], 60+r.Int63n(end))
+			if err != nil && !errors.Is(err, datastore.ErrNoData) {
+				b.Fatal("LatestBefore:", err)
+			}
+		}
+	})
+}
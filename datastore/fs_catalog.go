@@ -0,0 +1,186 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SeriesInfo tells the timestamps of the first and the last record written
+// of a series.
+type SeriesInfo struct {
+	Name  string
+	First int64
+	Last  int64
+}
+
+var fsDsCatalogMagic = [8]byte{'S', 'T', 'A', 'T', 'S', 'C', 'A', 'T'}
+
+// The catalog is kept in memory and saved to the catalog file by Close. The
+// file is removed once loaded, so it is rebuilt from the series files after
+// a crash.
+
+func (ds *FsDatastore) catalogFile() string {
+	return filepath.Join(ds.Dir, "catalog")
+}
+
+// Catalog returns the series written to, sorted by name, without reading
+// their files. Records not yet written are not included.
+func (ds *FsDatastore) Catalog() ([]SeriesInfo, error) {
+	ds.mu.Lock()
+	running := ds.running
+	ds.mu.Unlock()
+	if !running {
+		return nil, ErrNotRunning
+	}
+
+	ds.catalogMu.Lock()
+	r := make([]SeriesInfo, 0, len(ds.catalog))
+	for name, si := range ds.catalog {
+		si.Name = name
+		r = append(r, si)
+	}
+	ds.catalogMu.Unlock()
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Name < r[j].Name
+	})
+	return r, nil
+}
+
+// catalogWritten records that the records of a series up to last have been
+// written, the first of them at first.
+func (ds *FsDatastore) catalogWritten(name string, first, last int64) {
+	ds.catalogMu.Lock()
+	defer ds.catalogMu.Unlock()
+	si, ok := ds.catalog[name]
+	if !ok {
+		si.First = first
+	}
+	si.Last = last
+	ds.catalog[name] = si
+}
+
+func (ds *FsDatastore) catalogRemove(name string) {
+	ds.catalogMu.Lock()
+	defer ds.catalogMu.Unlock()
+	delete(ds.catalog, name)
+}
+
+// loadCatalog loads the catalog file, or rebuilds the catalog from the
+// files of the series if it is missing or invalid.
+func (ds *FsDatastore) loadCatalog() error {
+	ds.catalog = make(map[string]SeriesInfo)
+	err := ds.readCatalog()
+	if err == nil {
+		return os.Remove(ds.catalogFile())
+	} else if !os.IsNotExist(err) {
+		log.Println("FsDatastore.loadCatalog:", err)
+		ds.catalog = make(map[string]SeriesInfo)
+	}
+
+	if len(ds.names) > 0 {
+		log.Println("FsDatastore: Rebuilding the series catalog")
+	}
+	for name := range ds.names {
+		st := &fsDsStream{ds: ds, name: name}
+		first, err := st.firstWritten()
+		if err != nil {
+			log.Println("FsDatastore.loadCatalog:", name+":", err)
+			continue
+		}
+		if st.isize > 0 {
+			ds.catalog[name] = SeriesInfo{First: first, Last: st.lastWr}
+		}
+	}
+	if err := os.Remove(ds.catalogFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// firstWritten returns the timestamp of the first record in the files of
+// a stream, which is not valid afterwards.
+func (st *fsDsStream) firstWritten() (int64, error) {
+	if err := st.openFiles(); err != nil {
+		return 0, err
+	}
+	defer st.closeFiles()
+	st.valid = false
+	if st.isize == 0 {
+		return 0, nil
+	}
+	s := &fsDsSnapshot{name: st.name, idx: st.idx}
+	ts, _, err := s.readIdxEntry(0)
+	return ts, err
+}
+
+func (ds *FsDatastore) readCatalog() error {
+	f, err := os.Open(ds.catalogFile())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rd, le := bufio.NewReader(f), binary.LittleEndian
+
+	if err = readFsDsHeader(rd, fsDsCatalogMagic, "catalog"); err != nil {
+		return err
+	}
+	var n uint64
+	if err = binary.Read(rd, le, &n); err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		var lname uint64
+		var ts [2]int64
+		if err = binary.Read(rd, le, &lname); err != nil {
+			return err
+		}
+		if lname > 1<<16 {
+			return Error("Invalid catalog file")
+		}
+		name := make([]byte, lname)
+		if err = binary.Read(rd, le, name); err != nil {
+			return err
+		}
+		if err = binary.Read(rd, le, &ts); err != nil {
+			return err
+		}
+		ds.catalog[string(name)] = SeriesInfo{First: ts[0], Last: ts[1]}
+	}
+	return nil
+}
+
+func (ds *FsDatastore) saveCatalog() error {
+	f, err := os.Create(ds.catalogFile())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	wr, le := bufio.NewWriter(f), binary.LittleEndian
+
+	if err = writeFsDsHeader(wr, fsDsCatalogMagic, fsDsVersion); err != nil {
+		return err
+	}
+	if err = binary.Write(wr, le, uint64(len(ds.catalog))); err != nil {
+		return err
+	}
+	for name, si := range ds.catalog {
+		if err = binary.Write(wr, le, uint64(len(name))); err != nil {
+			return err
+		}
+		if _, err = wr.WriteString(name); err != nil {
+			return err
+		}
+		if err = binary.Write(wr, le, [2]int64{si.First, si.Last}); err != nil {
+			return err
+		}
+	}
+
+	if err = wr.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
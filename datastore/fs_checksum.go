@@ -0,0 +1,277 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Index entries end with a CRC of their timestamp and position. The data
+// file is divided into blocks of fsDsBlockSize bytes, and the CRC of every
+// block is stored in the .crc file next to it. The CRC of the last block
+// is updated whenever values are appended to it.
+const (
+	fsDsBlockSize = fsDsChunkSize * fsDsDSize
+	fsDsCSize     = 4
+)
+
+const ErrCorrupted = Error("Data corrupted, checksum mismatch")
+
+var (
+	fsDsCrcMagic = [8]byte{'S', 'T', 'A', 'T', 'S', 'C', 'R', 'C'}
+	fsDsCrcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// fsDsCrcSize returns the size of the checksums of dsize bytes of data.
+func fsDsCrcSize(dsize int64) int64 {
+	return (dsize + fsDsBlockSize - 1) / fsDsBlockSize * fsDsCSize
+}
+
+func encodeFsDsIdxEntry(ts, pos int64) []byte {
+	buf, le := make([]byte, fsDsISize), binary.LittleEndian
+	le.PutUint64(buf, uint64(ts))
+	le.PutUint64(buf[8:], uint64(pos))
+	le.PutUint32(buf[16:], crc32.Checksum(buf[:16], fsDsCrcTable))
+	return buf
+}
+
+func decodeFsDsIdxEntry(buf []byte) (ts, pos int64, err error) {
+	le := binary.LittleEndian
+	if le.Uint32(buf[16:]) != crc32.Checksum(buf[:16], fsDsCrcTable) {
+		return 0, 0, ErrCorrupted
+	}
+	return int64(le.Uint64(buf)), int64(le.Uint64(buf[8:])), nil
+}
+
+// appendChecksums updates the checksums of the blocks data is appended to
+// at the end of the data file.
+func (st *fsDsStream) appendChecksums(data []byte) error {
+	pos, sum := st.dsize, st.dcrc
+	first, buf := pos/fsDsBlockSize, new(bytes.Buffer)
+	for len(data) > 0 {
+		n := fsDsBlockSize - pos%fsDsBlockSize
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+		sum = crc32.Update(sum, fsDsCrcTable, data[:n])
+		data, pos = data[n:], pos+n
+		binary.Write(buf, binary.LittleEndian, sum)
+		if pos%fsDsBlockSize == 0 {
+			sum = 0
+		}
+	}
+	if _, err := st.crc.WriteAt(buf.Bytes(), fsDsHeaderSize+first*fsDsCSize); err != nil {
+		return err
+	}
+	st.dcrc = sum
+	return nil
+}
+
+// loadLastChecksum reads the checksum of the last, partial block of the
+// data file, which is extended by the next append.
+func (st *fsDsStream) loadLastChecksum() error {
+	st.dcrc = 0
+	if st.dsize%fsDsBlockSize == 0 {
+		return nil
+	}
+	var buf [fsDsCSize]byte
+	n, err := st.crc.ReadAt(buf[:], fsDsHeaderSize+st.dsize/fsDsBlockSize*fsDsCSize)
+	if n == fsDsCSize {
+		st.dcrc = binary.LittleEndian.Uint32(buf[:])
+		return nil
+	} else if err != io.EOF {
+		return err
+	}
+
+	// The checksum was lost along with the end of the file, start over
+	// from the data
+	log.Println("FsDatastore: Missing checksum:", st.name)
+	data := make([]byte, st.dsize%fsDsBlockSize)
+	if _, err := st.dat.ReadAt(data, fsDsHeaderSize+st.dsize-int64(len(data))); err != nil {
+		return err
+	}
+	st.dcrc = crc32.Checksum(data, fsDsCrcTable)
+	return nil
+}
+
+// readBlock reads and verifies block b of the data file.
+func (s *fsDsSnapshot) readBlock(b int64) ([]float64, error) {
+	start := b * fsDsBlockSize
+	size := s.dsize - start
+	if size > fsDsBlockSize {
+		size = fsDsBlockSize
+	}
+	buf := make([]byte, size)
+	if _, err := s.dat.ReadAt(buf, fsDsHeaderSize+start); err != nil {
+		return nil, err
+	}
+
+	// Full blocks don't change any more, while the checksum of the last
+	// one is taken along with the snapshot
+	sum := s.dcrc
+	if size == fsDsBlockSize {
+		var cbuf [fsDsCSize]byte
+		if _, err := s.crc.ReadAt(cbuf[:], fsDsHeaderSize+b*fsDsCSize); err != nil && err != io.EOF {
+			return nil, err
+		}
+		sum = binary.LittleEndian.Uint32(cbuf[:])
+	}
+	if crc32.Checksum(buf, fsDsCrcTable) != sum {
+		log.Println("FsDatastore: Checksum mismatch:", s.name, "data block", b)
+		return nil, ErrCorrupted
+	}
+
+	values := make([]float64, size/fsDsDSize)
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, values)
+	return values, nil
+}
+
+// nextValidIdxEntry returns the first index entry from n on which isn't
+// corrupted, or the number of entries if there is none.
+func (s *fsDsSnapshot) nextValidIdxEntry(n int64) (int64, int64, int64, error) {
+	for ; n < s.isize/fsDsISize; n++ {
+		ts, pos, err := s.readIdxEntry(n)
+		if err == nil {
+			return n, ts, pos, nil
+		} else if err != ErrCorrupted {
+			return 0, 0, 0, err
+		}
+	}
+	return n, 0, 0, nil
+}
+
+// addChecksums adds checksums to the index entries and creates the .crc
+// files of a version 2 directory.
+func (ds *FsDatastore) addChecksums() error {
+	files, err := ioutil.ReadDir(ds.Dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		path := filepath.Join(ds.Dir, fi.Name())
+		switch {
+		case filepath.Ext(fi.Name()) == ".idx":
+			err = ds.addIdxChecksums(path)
+		case filepath.Ext(fi.Name()) == ".dat":
+			err = ds.addDatChecksums(path)
+		case fi.Name() == "tail_data":
+			err = ds.setHeaderVersion(path, 3)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *FsDatastore) addIdxChecksums(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var h fsDsHeader
+	if err := binary.Read(f, binary.LittleEndian, &h); err != nil {
+		return err
+	}
+	if h.Version >= 3 {
+		return nil
+	}
+
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = writeFsDsHeader(tmp, fsDsIdxMagic, 3)
+	for d := []int64{0, 0}; err == nil; {
+		if err = binary.Read(f, binary.LittleEndian, d); err == io.EOF {
+			err = nil
+			break
+		} else if err == nil {
+			_, err = tmp.Write(encodeFsDsIdxEntry(d[0], d[1]))
+		}
+	}
+	return ds.replaceFile(tmp, path, err)
+}
+
+func (ds *FsDatastore) addDatChecksums(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var h fsDsHeader
+	if err := binary.Read(f, binary.LittleEndian, &h); err != nil {
+		return err
+	}
+	if h.Version >= 3 {
+		return nil
+	}
+
+	crcPath := path[:len(path)-4] + ".crc"
+	tmp, err := os.Create(crcPath + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = writeFsDsHeader(tmp, fsDsCrcMagic, 3)
+	buf := make([]byte, fsDsBlockSize)
+	for err == nil {
+		var n int
+		n, err = io.ReadFull(f, buf)
+		if n > 0 {
+			binary.Write(tmp, binary.LittleEndian, crc32.Checksum(buf[:n], fsDsCrcTable))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+			break
+		}
+	}
+	if err := ds.replaceFile(tmp, crcPath, err); err != nil {
+		return err
+	}
+	// The data file is marked last, so it is done again if interrupted
+	return ds.setHeaderVersion(path, 3)
+}
+
+// replaceFile closes the temporary file written in place of path, and
+// renames it to path if err is nil.
+func (ds *FsDatastore) replaceFile(tmp *os.File, path string, err error) error {
+	if err == nil && !ds.NoSync {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (ds *FsDatastore) setHeaderVersion(path string, v uint64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	if _, err := f.WriteAt(buf[:], 8); err != nil {
+		f.Close()
+		return err
+	}
+	if !ds.NoSync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// CompactStats tells what Compact has removed.
+type CompactStats struct {
+	Series int
+	Files  int
+	Bytes  int64
+}
+
+// Compact removes the files of series holding no data, which are created
+// e.g. by queries for names never inserted, and temporary files left behind
+// by interrupted upgrades. Series with records not yet written are skipped.
+// It can run while the datastore is in use.
+func (ds *FsDatastore) Compact() (CompactStats, error) {
+	var cs CompactStats
+	ds.mu.Lock()
+	if !ds.running {
+		ds.mu.Unlock()
+		return cs, ErrNotRunning
+	}
+	names := make([]string, 0, len(ds.names))
+	for name := range ds.names {
+		names = append(names, name)
+	}
+	ds.mu.Unlock()
+
+	for _, name := range names {
+		ds.compactSeries(name, &cs)
+	}
+
+	// Upgrades only run in Open, so no temporary files are being written
+	files, err := ioutil.ReadDir(ds.Dir)
+	if err != nil {
+		return cs, err
+	}
+	for _, fi := range files {
+		if filepath.Ext(fi.Name()) != ".tmp" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(ds.Dir, fi.Name())); err != nil {
+			log.Println("FsDatastore.Compact:", err)
+			continue
+		}
+		cs.Files++
+		cs.Bytes += fi.Size()
+	}
+	return cs, nil
+}
+
+// compactSeries removes the files of a series if they hold nothing but
+// their headers. The datastore is locked meanwhile, so the series can't be
+// written to.
+func (ds *FsDatastore) compactSeries(name string, cs *CompactStats) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, ok := ds.streams[name]; ok || !ds.running {
+		return
+	}
+
+	path := filepath.Join(ds.Dir, fsDsEncodeName(name))
+	exts := []string{".idx", ".dat", ".crc"}
+	for _, ext := range exts {
+		fi, err := os.Stat(path + ext)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			log.Println("FsDatastore.Compact:", err)
+			return
+		} else if fi.Size() > fsDsHeaderSize {
+			return
+		}
+	}
+
+	// The index goes first, so an interrupted removal leaves no name behind
+	ds.files.evict(name)
+	for _, ext := range exts {
+		fi, err := os.Stat(path + ext)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path + ext); err != nil {
+			log.Println("FsDatastore.Compact:", err)
+			return
+		}
+		cs.Files++
+		cs.Bytes += fi.Size()
+		ds.addUsage(name, -fi.Size())
+	}
+	delete(ds.names, name)
+	ds.catalogRemove(name)
+	cs.Series++
+}
@@ -1,33 +1,62 @@
-package main
+package datastore
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
-	fsDsISize = 16
+	fsDsISize = 24
 	fsDsDSize = 8
 )
 
+// fsDsBatchPoll is how often the writer looks at the series it holds back
+// when no MaxBatchAge is sooner.
+const fsDsBatchPoll = time.Second
+
 type FsDatastore struct {
-	Dir      string
-	NoSync   bool
-	mu       sync.Mutex
-	cond     sync.Cond
-	streams  map[string]*fsDsStream
-	names    map[string]int
-	queue    []*fsDsStream
-	running  bool
-	stopping bool
-	quit     chan int
-	wg       sync.WaitGroup
+	Dir           string
+	NoSync        bool
+	ForceTakeover bool
+	SkipCorrupted bool // leave out corrupted data instead of failing queries
+	// Quotas limits the bytes stored per prefix (see NamePrefix); further
+	// inserts fail with ErrQuotaExceeded.
+	Quotas map[string]int64
+	// MinBatch and MaxBatchAge hold back the writes of a series until it
+	// has at least MinBatch records pending or the oldest one has been
+	// pending for MaxBatchAge, so low rate series are written in batches.
+	// Records are written one by one if both are zero.
+	MinBatch    int
+	MaxBatchAge time.Duration
+	// MaxOpenFiles bounds the files of unused series kept open, see
+	// DefaultMaxOpenFiles. Negative values keep none.
+	MaxOpenFiles int
+	files        fsDsFileCache
+	lock         *os.File
+	usageMu      sync.Mutex
+	usage        map[string]int64
+	exceeded     map[string]bool
+	catalogMu    sync.Mutex
+	catalog      map[string]SeriesInfo
+	mu           sync.Mutex
+	cond         sync.Cond
+	streams      map[string]*fsDsStream
+	names        map[string]int
+	queue        []*fsDsStream
+	running      bool
+	stopping     bool
+	quit         chan int
+	wake         chan int // closed by Close
+	wg           sync.WaitGroup
 }
 
 type fsDsStream struct {
@@ -35,7 +64,11 @@ type fsDsStream struct {
 	ds       *FsDatastore
 	name     string
 	tail     []fsDsRecord
+	since    time.Time // when the first record of tail was inserted
+	files    *fsDsFiles
 	dat, idx *os.File
+	crc      *os.File
+	dcrc     uint32
 	valid    bool
 	lastWr   int64
 	dsize    int64
@@ -49,8 +82,12 @@ type fsDsRecord struct {
 
 type fsDsSnapshot struct {
 	ds       *FsDatastore
+	name     string
 	tail     []fsDsRecord
+	files    *fsDsFiles
 	dat, idx *os.File
+	crc      *os.File
+	dcrc     uint32
 	lastWr   int64
 	dsize    int64
 	isize    int64
@@ -60,10 +97,10 @@ func (ds *FsDatastore) Open() error {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 	if ds.running {
-		return Error("Datastore already running")
+		return ErrAlreadyRunning
 	}
 	if ds.stopping {
-		return Error("Datastore is stopping")
+		return ErrStopping
 	}
 
 	if fi, err := os.Stat(ds.Dir); err != nil {
@@ -72,19 +109,44 @@ func (ds *FsDatastore) Open() error {
 		return Error("Not a directory: " + ds.Dir)
 	}
 
+	if err := ds.acquireLock(); err != nil {
+		return err
+	}
+
+	if err := ds.migrate(); err != nil {
+		ds.releaseLock()
+		return err
+	}
+
 	if err := ds.loadNames(); err != nil {
+		ds.releaseLock()
+		return err
+	}
+
+	if err := ds.loadUsage(); err != nil {
+		ds.releaseLock()
 		return err
 	}
 
 	ds.streams = make(map[string]*fsDsStream)
+	ds.files.init(ds.MaxOpenFiles)
 	ds.cond.L = &ds.mu
 	if err := ds.loadTails(); err != nil {
 		ds.streams = nil
 		ds.queue = nil
+		ds.releaseLock()
+		return err
+	}
+	if err := ds.loadCatalog(); err != nil {
+		ds.files.closeAll()
+		ds.streams = nil
+		ds.queue = nil
+		ds.releaseLock()
 		return err
 	}
 	ds.running = true
 	ds.quit = make(chan int, 1)
+	ds.wake = make(chan int)
 	go ds.write()
 	return nil
 }
@@ -94,14 +156,15 @@ func (ds *FsDatastore) Close() error {
 	defer ds.mu.Unlock()
 
 	if !ds.running {
-		return Error("Datastore not running")
+		return ErrNotRunning
 	}
 	if ds.stopping {
-		return Error("Datastore is stopping")
+		return ErrStopping
 	}
 
 	ds.stopping = true
 	ds.cond.Broadcast()
+	close(ds.wake)
 	ds.mu.Unlock()
 	<-ds.quit
 	ds.mu.Lock()
@@ -112,6 +175,7 @@ func (ds *FsDatastore) Close() error {
 		st.Unlock()
 	}
 	ds.wg.Wait()
+	ds.files.closeAll()
 
 	if err := ds.saveTails(); err != nil {
 		log.Println("FsDatastore.Close:", err)
@@ -119,109 +183,48 @@ func (ds *FsDatastore) Close() error {
 			log.Println("FsDatastore.Close:", err)
 		}
 	}
-	ds.running = false
+	if err := ds.saveCatalog(); err != nil {
+		log.Println("FsDatastore.Close:", err)
+		if err := os.Remove(ds.catalogFile()); err != nil {
+			log.Println("FsDatastore.Close:", err)
+		}
+	}
+	ds.releaseLock()
+	ds.running, ds.stopping = false, false
 	ds.streams = nil
 	ds.queue = nil
 	return nil
 }
 
 func (ds *FsDatastore) Insert(name string, r Record) error {
+	if err := ds.checkQuota(name); err != nil {
+		return err
+	}
 	st := ds.getStream(name)
 	defer st.Unlock()
 
 	if st == nil {
-		return Error("Datastore not running")
+		return ErrNotRunning
+	}
+	if len(st.tail) == 0 {
+		st.since = time.Now()
 	}
 	st.tail = append(st.tail, fsDsRecord{Ts: r.Ts, Value: r.Value})
 	return nil
 }
 
-func (ds *FsDatastore) Query(name string, from, until int64) ([]Record, error) {
-	s, err := ds.takeSnapshot(name)
-	if err != nil {
-		return []Record{}, err
-	}
-	defer s.close()
-
-	nEntries := s.isize / fsDsISize
-	if nEntries == 0 {
-		return []Record{}, nil
-	}
-
-	if from < 0 {
-		from -= from % 60
-	} else if from%60 != 0 {
-		from -= from%60 - 60
-	}
-	if until > 0 {
-		until -= until % 60
-	} else if until%60 != 0 {
-		until -= until%60 + 60
-	}
-
-	n, err := s.findIdx(from)
+func (ds *FsDatastore) Query(ctx context.Context, name string, from, until int64) ([]Record, error) {
+	it, err := ds.Iterate(ctx, name, from, until)
 	if err != nil {
 		return nil, err
 	}
-	if n == -1 {
-		n = 0
-	}
-
-	result := make([]Record, 0)
-	var ts, pos, nts, npos int64
-
-	if ts, pos, err = s.readIdxEntry(n); err != nil {
-		return nil, err
-	}
-
-	for ; n < nEntries && ts <= until; n, ts, pos = n+1, nts, npos {
-		if n != nEntries-1 {
-			if nts, npos, err = s.readIdxEntry(n + 1); err != nil {
-				return nil, err
-			}
-		} else {
-			npos = s.dsize
-		}
-
-		f, u := (from-ts)/60, (until-ts)/60
-		if f < 0 {
-			f = 0
-		}
-		if maxu := (npos-pos)/fsDsDSize - 1; u > maxu {
-			u = maxu
-		}
-		if f > u {
-			continue
-		}
-
-		if _, err = s.dat.Seek(pos+f*fsDsDSize, os.SEEK_SET); err != nil {
-			return nil, err
-		}
-		data := make([]float64, u-f+1)
-		if err := binary.Read(s.dat, binary.LittleEndian, data); err != nil {
-			return nil, err
-		}
-		for i, val := range data {
-			rec := Record{Ts: ts + (f+int64(i))*60, Value: val}
-			result = append(result, rec)
-		}
-	}
-
-	last := s.lastWr
-	for _, r := range s.tail {
-		if r.Ts%60 != 0 || last >= r.Ts {
-			continue
-		}
-		if r.Ts >= from || r.Ts <= until {
-			result = append(result, Record{Ts: r.Ts, Value: r.Value})
-		}
-		last = r.Ts
-	}
-
-	return result, nil
+	return Collect(it)
 }
 
-func (ds *FsDatastore) LatestBefore(name string, ts int64) (Record, error) {
+func (ds *FsDatastore) LatestBefore(ctx context.Context, name string, ts int64) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
 	s, err := ds.takeSnapshot(name)
 	if err != nil {
 		return Record{}, err
@@ -243,7 +246,7 @@ func (ds *FsDatastore) LatestBefore(name string, ts int64) (Record, error) {
 		return Record{}, err
 	}
 	if n == -1 {
-		return Record{}, ErrNoData
+		return Record{}, NoDataError{Name: name}
 	}
 
 	t, pos, err := s.readIdxEntry(n)
@@ -262,13 +265,11 @@ func (ds *FsDatastore) LatestBefore(name string, ts int64) (Record, error) {
 		lastPos = p - fsDsDSize
 	}
 
-	if _, err := s.dat.Seek(lastPos, os.SEEK_SET); err != nil {
-		return Record{}, err
-	}
-	var val float64
-	if err := binary.Read(s.dat, binary.LittleEndian, &val); err != nil {
+	values, err := s.readBlock(lastPos / fsDsBlockSize)
+	if err != nil {
 		return Record{}, err
 	}
+	val := values[lastPos%fsDsBlockSize/fsDsDSize]
 	return Record{Ts: t + 60*((lastPos-pos)/fsDsDSize), Value: val}, nil
 }
 
@@ -307,7 +308,7 @@ func (ds *FsDatastore) getStream(name string) *fsDsStream {
 func (ds *FsDatastore) takeSnapshot(name string) (*fsDsSnapshot, error) {
 	st := ds.getStream(name)
 	if st == nil {
-		return nil, Error("Datastore not running")
+		return nil, ErrNotRunning
 	}
 	defer st.Unlock()
 
@@ -320,9 +321,10 @@ func (ds *FsDatastore) takeSnapshot(name string) (*fsDsSnapshot, error) {
 
 func (ds *FsDatastore) createStream(name string, tail []fsDsRecord) {
 	st := &fsDsStream{
-		name: name,
-		tail: tail,
-		ds:   ds,
+		name:  name,
+		tail:  tail,
+		since: time.Now(),
+		ds:    ds,
 	}
 	ds.streams[name] = st
 	ds.queue = append(ds.queue, st)
@@ -334,7 +336,8 @@ func (ds *FsDatastore) createStream(name string, tail []fsDsRecord) {
 }
 
 func (ds *FsDatastore) write() {
-	for n := -1; ; {
+	// idle counts the streams held back since the last one written
+	for n, idle := -1, 0; ; {
 		ds.mu.Lock()
 		if len(ds.queue) == 0 && !ds.stopping {
 			ds.cond.Wait()
@@ -362,7 +365,15 @@ func (ds *FsDatastore) write() {
 			}
 			st.Unlock()
 			ds.mu.Unlock()
+		} else if !st.batchReady() {
+			st.Unlock()
+			ds.mu.Unlock()
+			if idle++; idle >= l {
+				idle = 0
+				ds.waitBatches()
+			}
 		} else {
+			idle = 0
 			ds.mu.Unlock()
 			if err := st.flushTail(); err != nil {
 				st.valid = false
@@ -378,8 +389,36 @@ func (ds *FsDatastore) write() {
 	}
 }
 
+// waitBatches sleeps while every stream is held back, until one may be
+// due or the datastore is closed.
+func (ds *FsDatastore) waitBatches() {
+	d := fsDsBatchPoll
+	if ds.MaxBatchAge > 0 && ds.MaxBatchAge < d {
+		d = ds.MaxBatchAge
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ds.wake:
+	}
+}
+
+// batchReady tells whether the tail of a stream should be written, see
+// FsDatastore.MinBatch.
+func (st *fsDsStream) batchReady() bool {
+	ds := st.ds
+	if ds.MinBatch <= 0 && ds.MaxBatchAge <= 0 {
+		return true
+	}
+	if ds.MinBatch > 0 && len(st.tail) >= ds.MinBatch {
+		return true
+	}
+	return ds.MaxBatchAge > 0 && time.Since(st.since) >= ds.MaxBatchAge
+}
+
 func (ds *FsDatastore) tailFile() string {
-	return ds.Dir + string(os.PathSeparator) + "tail_data"
+	return filepath.Join(ds.Dir, "tail_data")
 }
 
 func (ds *FsDatastore) saveTails() error {
@@ -390,7 +429,17 @@ func (ds *FsDatastore) saveTails() error {
 	defer f.Close()
 	wr, le := bufio.NewWriter(f), binary.LittleEndian
 
-	if err = binary.Write(wr, le, uint64(len(ds.streams))); err != nil {
+	if err = writeFsDsHeader(wr, fsDsTailMagic, fsDsVersion); err != nil {
+		return err
+	}
+	// Streams without records are left out, their files are up to date
+	ntails := 0
+	for _, st := range ds.streams {
+		if len(st.tail) > 0 {
+			ntails++
+		}
+	}
+	if err = binary.Write(wr, le, uint64(ntails)); err != nil {
 		return err
 	}
 
@@ -400,6 +449,9 @@ func (ds *FsDatastore) saveTails() error {
 	)
 	i := 0
 	for n, st = range ds.streams {
+		if len(st.tail) == 0 {
+			continue
+		}
 		i++
 		name := []byte(n)
 		if err = binary.Write(wr, le, uint64(len(name))); err != nil {
@@ -426,27 +478,56 @@ func (ds *FsDatastore) saveTails() error {
 }
 
 func (ds *FsDatastore) loadNames() error {
-	dir := strings.Replace(ds.Dir, "\\", "\\\\", -1)
-	dir = strings.Replace(ds.Dir, "*", "\\*", -1)
-	dir = strings.Replace(ds.Dir, "?", "\\?", -1)
-	dir = strings.Replace(ds.Dir, "[", "\\[", -1)
-
-	files, err := filepath.Glob(dir + string(os.PathSeparator) + "*:*.idx")
+	files, err := ioutil.ReadDir(ds.Dir)
 	if err != nil {
 		return err
 	}
 
 	ds.names = make(map[string]int)
 
-	for _, fn := range files {
-		fn = filepath.Base(fn)
-		fn = fn[0 : len(fn)-4]
-		ds.names[fn] = 1
+	for _, fi := range files {
+		fn := fi.Name()
+		if filepath.Ext(fn) != ".idx" {
+			continue
+		}
+		if strings.Index(fn, ":") != -1 {
+			// Written by an older version which didn't encode file names
+			if err := ds.renameFiles(fn[:len(fn)-4], fn[:len(fn)-4]); err != nil {
+				return err
+			}
+			ds.names[fn[:len(fn)-4]] = 1
+			continue
+		}
+		name, err := fsDsDecodeName(fn[:len(fn)-4])
+		if err != nil {
+			log.Println("FsDatastore.loadNames:", err)
+			continue
+		}
+		if fsDsEncodeName(name) != fn[:len(fn)-4] {
+			// Written by an older version which didn't escape uppercase
+			// letters and device names
+			if err := ds.renameFiles(fn[:len(fn)-4], name); err != nil {
+				return err
+			}
+		}
+		ds.names[name] = 1
 	}
 
 	return nil
 }
 
+// renameFiles renames the files of a series from fn to the encoded name.
+func (ds *FsDatastore) renameFiles(fn, name string) error {
+	for _, ext := range []string{".idx", ".dat", ".crc"} {
+		old := filepath.Join(ds.Dir, fn+ext)
+		err := os.Rename(old, filepath.Join(ds.Dir, fsDsEncodeName(name)+ext))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ds *FsDatastore) loadTails() error {
 	f, err := os.Open(ds.tailFile())
 	if os.IsNotExist(err) {
@@ -457,6 +538,9 @@ func (ds *FsDatastore) loadTails() error {
 	defer f.Close()
 	rd, le := bufio.NewReader(f), binary.LittleEndian
 
+	if err = readFsDsHeader(rd, fsDsTailMagic, "tail_data"); err != nil {
+		return err
+	}
 	var ntails int64
 	if err = binary.Read(rd, le, &ntails); err != nil {
 		return err
@@ -492,6 +576,7 @@ func (st *fsDsStream) flushTail() error {
 
 	dbuff, ibuff := new(bytes.Buffer), new(bytes.Buffer)
 	dsize, isize, lastWr := st.dsize, st.isize, st.lastWr
+	first := int64(0)
 
 	for _, r := range st.tail {
 		if r.Ts%60 != 0 {
@@ -502,51 +587,59 @@ func (st *fsDsStream) flushTail() error {
 			continue
 		}
 
+		if dsize == st.dsize {
+			first = r.Ts
+		}
 		le := binary.LittleEndian
 		binary.Write(dbuff, le, r.Value)
 		dsize += fsDsDSize
 		lastWr += 60
 
 		if r.Ts > lastWr {
-			binary.Write(ibuff, le, []int64{r.Ts, dsize - fsDsDSize})
+			ibuff.Write(encodeFsDsIdxEntry(r.Ts, dsize-fsDsDSize))
 			isize += fsDsISize
 			lastWr = r.Ts
 		}
 	}
 
-	if _, err := st.dat.Seek(0, os.SEEK_END); err != nil {
+	if _, err := st.dat.WriteAt(dbuff.Bytes(), fsDsHeaderSize+st.dsize); err != nil {
 		return err
 	}
-	if _, err := st.idx.Seek(0, os.SEEK_END); err != nil {
+	if err := st.appendChecksums(dbuff.Bytes()); err != nil {
 		return err
 	}
-
-	if _, err := dbuff.WriteTo(st.dat); err != nil {
+	if _, err := st.idx.WriteAt(ibuff.Bytes(), fsDsHeaderSize+st.isize); err != nil {
 		return err
 	}
-	if _, err := ibuff.WriteTo(st.idx); err != nil {
-		return err
+	if !st.ds.NoSync {
+		for _, f := range []*os.File{st.dat, st.idx, st.crc} {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+		}
 	}
 
+	grown := dsize - st.dsize + isize - st.isize + fsDsCrcSize(dsize) - fsDsCrcSize(st.dsize)
+	st.ds.addUsage(st.name, grown)
+	if dsize > st.dsize {
+		st.ds.catalogWritten(st.name, first, lastWr)
+	}
 	st.dsize, st.isize, st.lastWr = dsize, isize, lastWr
 	return nil
 }
 
 func (st *fsDsStream) path() string {
-	return st.ds.Dir + string(os.PathSeparator) + st.name
+	return filepath.Join(st.ds.Dir, fsDsEncodeName(st.name))
 }
 
 func (st *fsDsStream) openFiles() error {
-	dat, err := os.OpenFile(st.path()+".dat", os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
-		return err
-	}
-	idx, err := os.OpenFile(st.path()+".idx", os.O_CREATE|os.O_RDWR, 0666)
+	files, err := st.ds.files.acquire(st.name, st.path())
 	if err != nil {
-		dat.Close()
 		return err
 	}
-	st.dat, st.idx = dat, idx
+	st.files = files
+	dat, idx, crc := files.dat, files.idx, files.crc
+	st.dat, st.idx, st.crc = dat, idx, crc
 
 	if !st.valid {
 		di, err := dat.Stat()
@@ -559,25 +652,59 @@ func (st *fsDsStream) openFiles() error {
 			st.closeFiles()
 			return err
 		}
-		st.dsize, st.isize = di.Size(), ii.Size()
+		ci, err := crc.Stat()
+		if err != nil {
+			st.closeFiles()
+			return err
+		}
+		for _, size := range []int64{di.Size(), ii.Size(), ci.Size()} {
+			if size == 0 {
+				st.ds.addUsage(st.name, fsDsHeaderSize)
+			}
+		}
+		if err := checkFsDsHeader(dat, di.Size(), fsDsDatMagic, st.name+".dat"); err != nil {
+			st.closeFiles()
+			return err
+		}
+		if err := checkFsDsHeader(idx, ii.Size(), fsDsIdxMagic, st.name+".idx"); err != nil {
+			st.closeFiles()
+			return err
+		}
+		if err := checkFsDsHeader(crc, ci.Size(), fsDsCrcMagic, st.name+".crc"); err != nil {
+			st.closeFiles()
+			return err
+		}
+
+		st.dsize, st.isize = di.Size()-fsDsHeaderSize, ii.Size()-fsDsHeaderSize
+		if di.Size() == 0 {
+			st.dsize = 0
+		}
+		if ii.Size() == 0 {
+			st.isize = 0
+		}
 		if st.isize%fsDsISize != 0 || st.dsize%fsDsDSize != 0 {
 			st.closeFiles()
 			return Error("Invalid file size: " + st.name)
 		}
+		if err := st.loadLastChecksum(); err != nil {
+			st.closeFiles()
+			return err
+		}
 
 		if st.isize == 0 {
 			st.lastWr = -1<<63 - (-1<<63)%60
 		} else {
-			if _, err := st.idx.Seek(st.isize-fsDsISize, os.SEEK_SET); err != nil {
+			buf := make([]byte, fsDsISize)
+			if _, err := st.idx.ReadAt(buf, fsDsHeaderSize+st.isize-fsDsISize); err != nil {
 				st.closeFiles()
 				return err
 			}
-			d := []int64{0, 0}
-			if err := binary.Read(st.idx, binary.LittleEndian, d); err != nil {
+			ts, pos, err := decodeFsDsIdxEntry(buf)
+			if err != nil {
+				log.Println("FsDatastore: Checksum mismatch:", st.name, "last index entry")
 				st.closeFiles()
 				return err
 			}
-			ts, pos := d[0], d[1]
 			st.lastWr = ts + 60*((st.dsize-pos)/fsDsDSize-1)
 		}
 		st.valid = true
@@ -587,24 +714,11 @@ func (st *fsDsStream) openFiles() error {
 }
 
 func (st *fsDsStream) closeFiles() {
-	if st.dat != nil {
-		if !st.ds.NoSync {
-			if err := st.dat.Sync(); err != nil {
-				log.Println("fsDsStream.closeFiles:", err)
-			}
-		}
-		st.dat.Close()
-		st.dat = nil
-	}
-	if st.idx != nil {
-		if !st.ds.NoSync {
-			if err := st.idx.Sync(); err != nil {
-				log.Println("fsDsStream.closeFiles:", err)
-			}
-		}
-		st.idx.Close()
-		st.idx = nil
+	if st.files != nil {
+		st.ds.files.release(st.files)
+		st.files = nil
 	}
+	st.dat, st.idx, st.crc = nil, nil, nil
 }
 
 func (st *fsDsStream) takeSnapshot() (*fsDsSnapshot, error) {
@@ -613,23 +727,26 @@ func (st *fsDsStream) takeSnapshot() (*fsDsSnapshot, error) {
 	}
 	s := &fsDsSnapshot{
 		ds:     st.ds,
+		name:   st.name,
 		tail:   append([]fsDsRecord(nil), st.tail...),
+		files:  st.files,
 		dat:    st.dat,
 		idx:    st.idx,
+		crc:    st.crc,
+		dcrc:   st.dcrc,
 		lastWr: st.lastWr,
 		dsize:  st.dsize,
 		isize:  st.isize,
 	}
-	st.dat, st.dat = nil, nil
+	st.files, st.dat, st.idx, st.crc = nil, nil, nil, nil
 	st.ds.wg.Add(1)
 	return s, nil
 }
 
 func (s *fsDsSnapshot) close() {
+	s.ds.files.release(s.files)
 	s.ds.wg.Done()
-	s.dat.Close()
-	s.idx.Close()
-	s.dat, s.idx = nil, nil
+	s.files, s.dat, s.idx, s.crc = nil, nil, nil, nil
 }
 
 func (s *fsDsSnapshot) findIdx(ts int64) (int64, error) {
@@ -694,15 +811,17 @@ func (s *fsDsSnapshot) findTail(ts int64) int64 {
 }
 
 func (s *fsDsSnapshot) readIdxEntry(n int64) (ts int64, pos int64, err error) {
-	if _, err := s.idx.Seek(n*fsDsISize, os.SEEK_SET); err != nil {
+	buf := make([]byte, fsDsISize)
+	if _, err := s.idx.ReadAt(buf, fsDsHeaderSize+n*fsDsISize); err != nil {
 		return 0, 0, err
 	}
-	d := []int64{0, 0}
-	if err := binary.Read(s.idx, binary.LittleEndian, d); err != nil {
+	ts, pos, err = decodeFsDsIdxEntry(buf)
+	if err != nil {
+		log.Println("FsDatastore: Checksum mismatch:", s.name, "index entry", n)
 		return 0, 0, err
 	}
-	if d[0] % 60 != 0 || d[1]%fsDsDSize != 0 {
+	if ts % 60 != 0 || pos%fsDsDSize != 0 {
 		return 0, 0, Error("Invalid index data")
 	}
-	return d[0], d[1], nil
+	return ts, pos, nil
 }
@@ -0,0 +1,680 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFsDatastoreLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds1 := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds1.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	ds2 := &FsDatastore{Dir: dir, NoSync: true, ForceTakeover: true}
+	if err := ds2.Open(); err == nil {
+		ds2.Close()
+		t.Error("Second Open should have failed")
+	}
+
+	if err := ds1.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if err := ds2.Open(); err != nil {
+		t.Error("Open after Close failed:", err)
+	} else {
+		ds2.Close()
+	}
+
+	// Left behind by a crash, by a process that is gone or that still
+	// exists, which could be an unrelated one with the same PID
+	proc, err := os.StartProcess(os.Args[0], []string{os.Args[0], "-test.run=^$"}, &os.ProcAttr{})
+	if err != nil {
+		t.Fatal("StartProcess:", err)
+	}
+	if _, err := proc.Wait(); err != nil {
+		t.Fatal("Wait:", err)
+	}
+	var testCases = []struct {
+		pid      int
+		takeover bool
+		ok       bool
+	}{
+		{proc.Pid, false, true},
+		{os.Getppid(), false, false},
+		{os.Getppid(), true, true},
+	}
+	for _, tc := range testCases {
+		err := ioutil.WriteFile(filepath.Join(dir, "lock"), []byte(strconv.Itoa(tc.pid)+"\n"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds := &FsDatastore{Dir: dir, NoSync: true, ForceTakeover: tc.takeover}
+		err = ds.Open()
+		if err == nil {
+			ds.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Error("Incorrect result:", tc.pid, tc.takeover)
+			t.Error("Expected:", tc.ok)
+			t.Error("Result:", err)
+		}
+	}
+}
+
+func TestFsDatastoreIterate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	for i := int64(1); i <= 2000; i++ {
+		if i > 700 && i < 720 {
+			continue
+		}
+		if err := ds.Insert("test:gauge", Record{60 * i, float64(i)}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+	defer ds.Close()
+	ctx := context.Background()
+
+	var testCases = []struct {
+		from, until int64
+		n           int
+	}{
+		{0, 200000, 1981},
+		{60 * 650, 200000, 1332},
+		{60 * 700, 200000, 1282},
+		{60 * 701, 200000, 1281},
+	}
+	for _, tc := range testCases {
+		r, err := ds.Query(ctx, "test:gauge", tc.from, tc.until)
+		if err != nil {
+			t.Error("Query:", err)
+			continue
+		}
+		if len(r) != tc.n {
+			t.Error("Incorrect result:", tc.from, tc.until)
+			t.Error("Expected:", tc.n)
+			t.Error("Returned:", len(r))
+		}
+		for i, rec := range r {
+			if rec.Ts < tc.from || rec.Ts%60 != 0 || rec.Value != float64(rec.Ts/60) ||
+				i > 0 && rec.Ts <= r[i-1].Ts {
+				t.Error("Incorrect record:", tc.from, tc.until, rec)
+				break
+			}
+		}
+	}
+
+	it, err := ds.Iterate(ctx, "test:gauge", 60*650, 200000)
+	if err != nil {
+		t.Fatal("Iterate:", err)
+	}
+	if rec, ok := it.Next(); !ok || rec.Ts != 60*650 {
+		t.Error("Incorrect first record:", rec, ok)
+	}
+	if err := it.Close(); err != nil {
+		t.Error("Close:", err)
+	}
+	if _, ok := it.Next(); ok {
+		t.Error("Next should fail after Close")
+	}
+
+	// Series with all records still in the tail
+	ds2 := &FsDatastore{Dir: filepath.Join(dir, "tail"), NoSync: true, MinBatch: 100}
+	if err := os.Mkdir(ds2.Dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds2.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds2.Close()
+	for ts := int64(60); ts <= 300; ts += 60 {
+		if err := ds2.Insert("test:gauge", Record{ts, float64(ts / 60)}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+
+	var tailCases = []struct {
+		from, until int64
+		n           int
+	}{
+		{0, 1000, 5},
+		{60, 300, 5},
+		{120, 240, 3},
+		{300, 300, 1},
+		{360, 1000, 0},
+		{0, 30, 0},
+	}
+	for _, tc := range tailCases {
+		it, err := ds2.Iterate(ctx, "test:gauge", tc.from, tc.until)
+		if err != nil {
+			t.Fatal("Iterate:", err)
+		}
+		r, err := Collect(it)
+		if err != nil {
+			t.Fatal("Collect:", err)
+		}
+		ok := len(r) == tc.n
+		for i := 0; ok && i < len(r); i++ {
+			ok = r[i].Ts >= tc.from && r[i].Ts <= tc.until && r[i].Value == float64(r[i].Ts/60)
+		}
+		if !ok {
+			t.Error("Incorrect tail result:", tc.from, tc.until)
+			t.Error("Expected:", tc.n)
+			t.Error("Result:", r)
+		}
+	}
+}
+
+func TestFsDatastoreMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files of a version 1 directory have no headers
+	idx, dat := new(bytes.Buffer), new(bytes.Buffer)
+	binary.Write(idx, binary.LittleEndian, []int64{60, 0, 600, 16})
+	binary.Write(dat, binary.LittleEndian, []float64{1, 2, 10})
+	path := filepath.Join(dir, fsDsEncodeName("test:gauge"))
+	if err := ioutil.WriteFile(path+".idx", idx.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".dat", dat.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	r, err := ds.Query(context.Background(), "test:gauge", 0, 1000)
+	if err != nil {
+		t.Error("Query:", err)
+	} else if len(r) != 3 || r[0] != (Record{Ts: 60, Value: 1}) || r[2] != (Record{Ts: 600, Value: 10}) {
+		t.Error("Incorrect result:", r)
+	}
+	if err := ds.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+
+	if v, err := (&FsDatastore{Dir: dir}).formatVersion(); err != nil || v != fsDsVersion {
+		t.Error("Incorrect format version:", v, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "format"), []byte("1000\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	ds = &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err == nil {
+		ds.Close()
+		t.Error("Open should fail for a newer format")
+	}
+}
+
+func TestFsDatastoreChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	ds := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	for i := int64(1); i <= 2000; i++ {
+		if err := ds.Insert("test:gauge", Record{Ts: 60 * i, Value: float64(i)}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+	path := filepath.Join(dir, fsDsEncodeName("test:gauge")) + ".dat"
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if fi, err := os.Stat(path); err == nil && fi.Size() == fsDsHeaderSize+2000*fsDsDSize {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the data files")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ds.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+
+	// Corrupt a value of the second block
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, fsDsHeaderSize+600*fsDsDSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	ds = &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	if _, err := ds.Query(ctx, "test:gauge", 0, 200000); err != ErrCorrupted {
+		t.Error("Expected ErrCorrupted, returned:", err)
+	}
+	ds.Close()
+
+	ds = &FsDatastore{Dir: dir, NoSync: true, SkipCorrupted: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	r, err := ds.Query(ctx, "test:gauge", 0, 200000)
+	if err != nil {
+		t.Fatal("Query:", err)
+	}
+	if len(r) != 2000-fsDsChunkSize {
+		t.Error("Incorrect number of records:", len(r))
+	}
+	for _, rec := range r {
+		if rec.Value != float64(rec.Ts/60) || rec.Ts > 60*fsDsChunkSize && rec.Ts <= 60*2*fsDsChunkSize {
+			t.Error("Incorrect record:", rec)
+			break
+		}
+	}
+}
+
+func TestFsDatastoreQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &FsDatastore{Dir: dir, NoSync: true, Quotas: map[string]int64{"a.": 1000}}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+
+	// The quota is checked against the bytes already written to the files
+	for i := int64(1); i <= 200; i++ {
+		if err := ds.Insert("a.x:gauge", Record{Ts: 60 * i, Value: 1}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+		if err := ds.Insert("b.x:gauge", Record{Ts: 60 * i, Value: 1}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if ds.Insert("a.x:gauge", Record{Ts: 60 * 1000, Value: 1}) == ErrQuotaExceeded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the quota to be exceeded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ds.Insert("b.x:gauge", Record{Ts: 60 * 1000, Value: 1}); err != nil {
+		t.Error("Insert without quota:", err)
+	}
+
+	stats, err := ds.Stats()
+	if err != nil {
+		t.Fatal("Stats:", err)
+	}
+	if len(stats) != 2 || stats[0].Prefix != "a." || stats[1].Prefix != "b." {
+		t.Fatal("Incorrect stats:", stats)
+	}
+	if stats[0].Series != 1 || stats[0].Bytes < 1000 || stats[0].Quota != 1000 || !stats[0].Exceeded {
+		t.Error("Incorrect stats:", stats[0])
+	}
+	if stats[1].Series != 1 || stats[1].Bytes <= 0 || stats[1].Quota != 0 || stats[1].Exceeded {
+		t.Error("Incorrect stats:", stats[1])
+	}
+}
+
+func TestFsDatastoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "x.idx.tmp"), make([]byte, 10), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	ctx := context.Background()
+
+	if err := ds.Insert("a:gauge", Record{Ts: 60, Value: 1}); err != nil {
+		t.Fatal("Insert:", err)
+	}
+	// Queries for unknown names leave empty files behind
+	if _, err := ds.Query(ctx, "missing:gauge", 0, 600); err != nil {
+		t.Fatal("Query:", err)
+	}
+
+	// Series are skipped until their streams are gone
+	var total CompactStats
+	for deadline := time.Now().Add(5 * time.Second); total.Series == 0; {
+		cs, err := ds.Compact()
+		if err != nil {
+			t.Fatal("Compact:", err)
+		}
+		total.Series += cs.Series
+		total.Files += cs.Files
+		total.Bytes += cs.Bytes
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for compaction")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	expected := CompactStats{Series: 1, Files: 4, Bytes: 3*fsDsHeaderSize + 10}
+	if total != expected {
+		t.Error("Incorrect result:", total)
+		t.Error("Expected:", expected)
+	}
+	if names, _ := ds.ListNames("*"); len(names) != 1 || names[0] != "a:gauge" {
+		t.Error("Incorrect names after compaction:", names)
+	}
+	if r, err := ds.Query(ctx, "a:gauge", 0, 600); err != nil || len(r) != 1 {
+		t.Error("Incorrect query result after compaction:", r, err)
+	}
+}
+
+func TestFsDatastoreBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &FsDatastore{Dir: dir, NoSync: true, MinBatch: 3, MaxBatchAge: time.Hour}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	ctx := context.Background()
+	dat := filepath.Join(dir, fsDsEncodeName("a:gauge")+".dat")
+	written := func() int64 {
+		fi, err := os.Stat(dat)
+		if err != nil {
+			return 0
+		}
+		return (fi.Size() - fsDsHeaderSize) / fsDsDSize
+	}
+
+	for ts := int64(60); ts <= 120; ts += 60 {
+		if err := ds.Insert("a:gauge", Record{Ts: ts, Value: 1}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := written(); n != 0 {
+		t.Error("Records written before the batch is full:", n)
+	}
+	// Held back records are still visible
+	if r, err := ds.Query(ctx, "a:gauge", 0, 600); err != nil || len(r) != 2 {
+		t.Error("Incorrect query result:", r, err)
+	}
+
+	if err := ds.Insert("a:gauge", Record{Ts: 180, Value: 1}); err != nil {
+		t.Fatal("Insert:", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); written() != 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the batch to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := ds.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+
+	// A short MaxBatchAge writes a partial batch
+	ds = &FsDatastore{Dir: dir, NoSync: true, MinBatch: 100, MaxBatchAge: 20 * time.Millisecond}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	if err := ds.Insert("a:gauge", Record{Ts: 240, Value: 1}); err != nil {
+		t.Fatal("Insert:", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); written() != 4; {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the partial batch to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFsDatastoreFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &FsDatastore{Dir: dir, NoSync: true, MaxOpenFiles: 6}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	ctx := context.Background()
+
+	names := []string{"a:gauge", "b:gauge", "c:gauge", "d:gauge", "e:gauge"}
+	for ts := int64(60); ts <= 600; ts += 60 {
+		for i, name := range names {
+			if err := ds.Insert(name, Record{Ts: ts, Value: float64(i)}); err != nil {
+				t.Fatal("Insert:", err)
+			}
+		}
+		for i, name := range names {
+			r, err := ds.Query(ctx, name, 0, ts)
+			if err != nil {
+				t.Fatal("Query:", err)
+			}
+			if len(r) != int(ts/60) || r[len(r)-1] != (Record{Ts: ts, Value: float64(i)}) {
+				t.Error("Incorrect result:", name, r)
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Files in use by the writer may be open meanwhile
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		ds.files.mu.Lock()
+		n := len(ds.files.files)
+		ds.files.mu.Unlock()
+		if n <= 2 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Too many series with open files:", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFsDatastoreNamesWithoutTails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	if err := ds.Insert("a.b:gauge", Record{Ts: 60, Value: 1}); err != nil {
+		t.Fatal("Insert:", err)
+	}
+	dat := filepath.Join(dir, fsDsEncodeName("a.b:gauge")+".dat")
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if fi, err := os.Stat(dat); err == nil && fi.Size() > fsDsHeaderSize {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the record to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ds.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+
+	// Series on disk are found by their files, e.g. after a crash
+	if err := os.Remove(filepath.Join(dir, "tail_data")); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	if names, err := ds.ListNames("a.*"); err != nil || len(names) != 1 || names[0] != "a.b:gauge" {
+		t.Error("Incorrect ListNames result:", names, err)
+	}
+	if r, err := ds.Query(context.Background(), "a.b:gauge", 0, 600); err != nil || len(r) != 1 {
+		t.Error("Incorrect query result:", r, err)
+	}
+}
+
+func TestFsDatastoreCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	for _, r := range []struct {
+		name string
+		ts   int64
+	}{
+		{"a:gauge", 120}, {"b:gauge", 60}, {"a:gauge", 180}, {"b:gauge", 600},
+	} {
+		if err := ds.Insert(r.name, Record{Ts: r.ts, Value: 1}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+	expected := []SeriesInfo{{Name: "a:gauge", First: 120, Last: 180}, {Name: "b:gauge", First: 60, Last: 600}}
+	check := func(what string) {
+		cat, err := ds.Catalog()
+		if err != nil {
+			t.Fatal("Catalog:", err)
+		}
+		if len(cat) != len(expected) || cat[0] != expected[0] || cat[1] != expected[1] {
+			t.Error("Incorrect result:", what)
+			t.Error("Expected:", expected)
+			t.Error("Result:", cat)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if cat, _ := ds.Catalog(); len(cat) == 2 && cat[1].Last == 600 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the records to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	check("written")
+
+	// Loaded from the catalog file, then rebuilt without it
+	if err := ds.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	check("reopened")
+	if err := ds.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "catalog")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	check("rebuilt")
+}
+
+func TestFsDatastoreRenameFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	if err := ds.Insert("Web.x:gauge", Record{60, 1}); err != nil {
+		t.Fatal("Insert:", err)
+	}
+	path := filepath.Join(dir, fsDsEncodeName("Web.x:gauge"))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, err := os.Stat(path + ".idx"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the data files")
+		}
+	}
+	if err := ds.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+
+	// Files named by older versions, without escaped uppercase letters
+	old := filepath.Join(dir, "Web.x%3Agauge")
+	for _, ext := range []string{".idx", ".dat", ".crc"} {
+		if err := os.Rename(path+ext, old+ext); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+
+	ds = &FsDatastore{Dir: dir, NoSync: true}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	r, err := ds.Query(context.Background(), "Web.x:gauge", 0, 60)
+	if err != nil || len(r) != 1 || r[0] != (Record{60, 1}) {
+		t.Error("Incorrect result:", r, err)
+	}
+	if _, err := os.Stat(path + ".idx"); err != nil {
+		t.Error("Files not renamed:", err)
+	}
+	if _, err := os.Stat(old + ".idx"); !os.IsNotExist(err) {
+		t.Error("Old files left:", err)
+	}
+}
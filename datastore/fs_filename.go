@@ -0,0 +1,79 @@
+package datastore
+
+import (
+	"strconv"
+	"strings"
+)
+
+// File names of streams are derived from stream names by escaping every
+// byte that isn't safe to use in file names on all supported platforms
+// with %XX, where XX is the hexadecimal value of the byte. Uppercase
+// letters are escaped too, so names differing in case get different files
+// on case-insensitive file systems, and so is the first byte of names
+// Windows would take for a device, like "con.x".
+
+const fsDsUnsafeChars = "%:*?<>|\"/\\"
+
+func fsDsEncodeName(name string) string {
+	const hex = "0123456789ABCDEF"
+	buf := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		if ch < 32 || ch == 127 || ch >= 'A' && ch <= 'Z' || isFsDsUnsafeChar(ch) ||
+			i == 0 && isFsDsDeviceName(name) {
+			buf = append(buf, '%', hex[ch>>4], hex[ch&15])
+		} else {
+			buf = append(buf, ch)
+		}
+	}
+	return string(buf)
+}
+
+func fsDsDecodeName(fn string) (string, error) {
+	buf := make([]byte, 0, len(fn))
+	for i := 0; i < len(fn); i++ {
+		if fn[i] != '%' {
+			buf = append(buf, fn[i])
+			continue
+		}
+		if i+2 >= len(fn) {
+			return "", Error("Invalid file name: " + fn)
+		}
+		ch, err := strconv.ParseUint(fn[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", Error("Invalid file name: " + fn)
+		}
+		buf = append(buf, byte(ch))
+		i += 2
+	}
+	return string(buf), nil
+}
+
+func isFsDsUnsafeChar(ch byte) bool {
+	for i := 0; i < len(fsDsUnsafeChars); i++ {
+		if fsDsUnsafeChars[i] == ch {
+			return true
+		}
+	}
+	return false
+}
+
+// isFsDsDeviceName tells whether the part of a name before the first dot is
+// reserved for a device on Windows, regardless of the extension.
+func isFsDsDeviceName(name string) bool {
+	stem := strings.ToLower(name)
+	if i := strings.IndexByte(stem, '.'); i != -1 {
+		stem = stem[:i]
+	}
+	switch stem {
+	case "con", "prn", "aux", "nul":
+		return true
+	}
+	return len(stem) == 4 && (stem[:3] == "com" || stem[:3] == "lpt") && stem[3] >= '1' && stem[3] <= '9'
+}
+
+// EncodeFileName escapes a name like FsDatastore does, for other files kept
+// in its directory.
+func EncodeFileName(name string) string {
+	return fsDsEncodeName(name)
+}
@@ -0,0 +1,56 @@
+package datastore
+
+import "testing"
+
+func TestFsDsEncodeName(t *testing.T) {
+	var testCases = []struct {
+		name, fn string
+	}{
+		{"test", "test"},
+		{"test:counter", "test%3Acounter"},
+		{"a.b*:timer-min", "a.b%2A%3Atimer-min"},
+		{"100%:gauge", "100%25%3Agauge"},
+		{"a?<>|b", "a%3F%3C%3E%7Cb"},
+		{"\x01", "%01"},
+		{"Web.x", "%57eb.x"},
+		{"web.x", "web.x"},
+		{"a.B:gauge", "a.%42%3Agauge"},
+		{"con.x", "%63on.x"},
+		{"aux", "%61ux"},
+		{"nul.a:gauge", "%6Eul.a%3Agauge"},
+		{"com1.x", "%63om1.x"},
+		{"lpt9", "%6Cpt9"},
+		{"PRN.x", "%50%52%4E.x"},
+		{"console.x", "console.x"},
+		{"com0.x", "com0.x"},
+		{"x.con", "x.con"},
+		{"con:gauge", "con%3Agauge"},
+	}
+
+	for _, tc := range testCases {
+		fn := fsDsEncodeName(tc.name)
+		if fn != tc.fn {
+			t.Error("Incorrect result:", tc.name)
+			t.Error("Expected:", tc.fn)
+			t.Error("Returned:", fn)
+		}
+		name, err := fsDsDecodeName(fn)
+		if err != nil {
+			t.Error("Decoding failed:", fn)
+			t.Error("Error:", err)
+		} else if name != tc.name {
+			t.Error("Incorrect decoded name:", fn)
+			t.Error("Expected:", tc.name)
+			t.Error("Returned:", name)
+		}
+		if t.Failed() {
+			return
+		}
+	}
+
+	for _, fn := range []string{"%", "a%3", "a%XY"} {
+		if _, err := fsDsDecodeName(fn); err == nil {
+			t.Error("Decoding should have failed:", fn)
+		}
+	}
+}
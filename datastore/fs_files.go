@@ -0,0 +1,147 @@
+package datastore
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// DefaultMaxOpenFiles is the default of FsDatastore.MaxOpenFiles.
+const DefaultMaxOpenFiles = 768
+
+// fsDsFiles are the open files of a series. They are shared by the writer
+// and snapshots, so they are only accessed with ReadAt and WriteAt.
+type fsDsFiles struct {
+	name          string
+	dat, idx, crc *os.File
+	refs          int
+	cached        bool
+	elem          *list.Element // in fsDsFileCache.lru while unused
+}
+
+// fsDsFileCache keeps the files of recently used series open. Files in use
+// are never closed, so there can be more of them than max.
+type fsDsFileCache struct {
+	mu    sync.Mutex
+	max   int // series, not files
+	files map[string]*fsDsFiles
+	lru   list.List // unused files, the least recently used first
+}
+
+func (fc *fsDsFileCache) init(maxFiles int) {
+	if maxFiles == 0 {
+		maxFiles = DefaultMaxOpenFiles
+	}
+	fc.max = maxFiles / 3
+	fc.files = make(map[string]*fsDsFiles)
+	fc.lru.Init()
+}
+
+// acquire returns the files of a series with path as their name without
+// extension, opening them if necessary. They are created if they don't
+// exist.
+func (fc *fsDsFileCache) acquire(name, path string) (*fsDsFiles, error) {
+	fc.mu.Lock()
+	if f := fc.use(name); f != nil {
+		fc.mu.Unlock()
+		return f, nil
+	}
+	fc.mu.Unlock()
+
+	dat, err := os.OpenFile(path+".dat", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := os.OpenFile(path+".idx", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		dat.Close()
+		return nil, err
+	}
+	crc, err := os.OpenFile(path+".crc", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		dat.Close()
+		idx.Close()
+		return nil, err
+	}
+	f := &fsDsFiles{name: name, dat: dat, idx: idx, crc: crc}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if g := fc.use(name); g != nil {
+		// Opened by someone else meanwhile
+		f.close()
+		return g, nil
+	}
+	f.refs, f.cached = 1, true
+	fc.files[name] = f
+	fc.trim()
+	return f, nil
+}
+
+func (fc *fsDsFileCache) use(name string) *fsDsFiles {
+	f := fc.files[name]
+	if f == nil {
+		return nil
+	}
+	if f.elem != nil {
+		fc.lru.Remove(f.elem)
+		f.elem = nil
+	}
+	f.refs++
+	return f
+}
+
+func (fc *fsDsFileCache) release(f *fsDsFiles) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if f.refs--; f.refs > 0 {
+		return
+	}
+	if !f.cached {
+		f.close()
+		return
+	}
+	f.elem = fc.lru.PushBack(f)
+	fc.trim()
+}
+
+func (fc *fsDsFileCache) trim() {
+	for len(fc.files) > fc.max && fc.lru.Len() > 0 {
+		fc.evictFiles(fc.lru.Front().Value.(*fsDsFiles))
+	}
+}
+
+// evict closes the files of a series, or makes sure they are closed once
+// no longer in use, e.g. before they are removed.
+func (fc *fsDsFileCache) evict(name string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if f := fc.files[name]; f != nil {
+		fc.evictFiles(f)
+	}
+}
+
+func (fc *fsDsFileCache) evictFiles(f *fsDsFiles) {
+	delete(fc.files, f.name)
+	f.cached = false
+	if f.elem != nil {
+		fc.lru.Remove(f.elem)
+		f.elem = nil
+		f.close()
+	}
+}
+
+// closeAll closes the files of every series, none of which may be in use.
+func (fc *fsDsFileCache) closeAll() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for _, f := range fc.files {
+		fc.evictFiles(f)
+	}
+}
+
+func (f *fsDsFiles) close() {
+	f.dat.Close()
+	f.idx.Close()
+	f.crc.Close()
+}
@@ -0,0 +1,191 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fsDsVersion is the current layout of the data directory. Version 1 files
+// had no headers, version 2 had no checksums.
+const fsDsVersion = 3
+
+// Every .idx, .dat and tail_data file starts with a header made of a magic
+// string telling the kind of the file and the format version.
+const fsDsHeaderSize = 16
+
+var (
+	fsDsIdxMagic  = [8]byte{'S', 'T', 'A', 'T', 'S', 'I', 'D', 'X'}
+	fsDsDatMagic  = [8]byte{'S', 'T', 'A', 'T', 'S', 'D', 'A', 'T'}
+	fsDsTailMagic = [8]byte{'S', 'T', 'A', 'T', 'S', 'T', 'A', 'I'}
+)
+
+// fsDsMigrations[i] upgrades a data directory from version i+1 to i+2. They
+// must be safe to run again after being interrupted.
+var fsDsMigrations = []func(ds *FsDatastore) error{
+	(*FsDatastore).addHeaders,
+	(*FsDatastore).addChecksums,
+}
+
+type fsDsHeader struct {
+	Magic   [8]byte
+	Version uint64
+}
+
+func (ds *FsDatastore) formatFile() string {
+	return filepath.Join(ds.Dir, "format")
+}
+
+// formatVersion returns the version of the data directory. Directories
+// without a format file are new if they hold no data, or version 1.
+func (ds *FsDatastore) formatVersion() (int, error) {
+	buf, err := ioutil.ReadFile(ds.formatFile())
+	if err == nil {
+		v, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+		if err != nil || v < 1 {
+			return 0, Error("Invalid format file: " + ds.formatFile())
+		}
+		return v, nil
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	files, err := ioutil.ReadDir(ds.Dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, fi := range files {
+		if ext := filepath.Ext(fi.Name()); ext == ".idx" || ext == ".dat" || fi.Name() == "tail_data" {
+			return 1, nil
+		}
+	}
+	return fsDsVersion, nil
+}
+
+func (ds *FsDatastore) writeFormatVersion(v int) error {
+	f, err := os.Create(ds.formatFile())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(strconv.Itoa(v) + "\n")); err != nil {
+		f.Close()
+		return err
+	}
+	if !ds.NoSync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// migrate upgrades the data directory to the current version.
+func (ds *FsDatastore) migrate() error {
+	v, err := ds.formatVersion()
+	if err != nil {
+		return err
+	}
+	if v > fsDsVersion {
+		return Error("Data directory written by a newer version (format " + strconv.Itoa(v) + "): " + ds.Dir)
+	}
+	for ; v < fsDsVersion; v++ {
+		log.Println("FsDatastore: Upgrading data directory to format", v+1)
+		if err := fsDsMigrations[v-1](ds); err != nil {
+			return err
+		}
+		if err := ds.writeFormatVersion(v + 1); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(ds.formatFile()); os.IsNotExist(err) {
+		return ds.writeFormatVersion(fsDsVersion)
+	}
+	return nil
+}
+
+// addHeaders prepends a header to the files of a version 1 directory.
+func (ds *FsDatastore) addHeaders() error {
+	files, err := ioutil.ReadDir(ds.Dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		var magic [8]byte
+		switch {
+		case filepath.Ext(fi.Name()) == ".idx":
+			magic = fsDsIdxMagic
+		case filepath.Ext(fi.Name()) == ".dat":
+			magic = fsDsDatMagic
+		case fi.Name() == "tail_data":
+			magic = fsDsTailMagic
+		default:
+			continue
+		}
+		if err := ds.addHeader(filepath.Join(ds.Dir, fi.Name()), magic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *FsDatastore) addHeader(path string, magic [8]byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Skip files already upgraded before an interruption
+	var buf [8]byte
+	if n, _ := io.ReadFull(f, buf[:]); n == 8 && buf == magic {
+		return nil
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = writeFsDsHeader(tmp, magic, 2)
+	if err == nil {
+		_, err = io.Copy(tmp, f)
+	}
+	return ds.replaceFile(tmp, path, err)
+}
+
+func writeFsDsHeader(w io.Writer, magic [8]byte, version uint64) error {
+	return binary.Write(w, binary.LittleEndian, fsDsHeader{Magic: magic, Version: version})
+}
+
+func readFsDsHeader(r io.Reader, magic [8]byte, name string) error {
+	var h fsDsHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return err
+	}
+	if h.Magic != magic || h.Version != fsDsVersion {
+		return Error("Invalid file header: " + name)
+	}
+	return nil
+}
+
+// checkFsDsHeader verifies the header of a data or index file, or writes
+// it if the file has just been created. The offset of f is left alone, as
+// open files are shared.
+func checkFsDsHeader(f *os.File, size int64, magic [8]byte, name string) error {
+	if size == 0 {
+		buf := new(bytes.Buffer)
+		writeFsDsHeader(buf, magic, fsDsVersion)
+		_, err := f.WriteAt(buf.Bytes(), 0)
+		return err
+	}
+	return readFsDsHeader(io.NewSectionReader(f, 0, fsDsHeaderSize), magic, name)
+}
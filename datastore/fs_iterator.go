@@ -0,0 +1,194 @@
+package datastore
+
+import (
+	"context"
+)
+
+// fsDsChunkSize is the maximum number of values read from a data file at
+// once by an iterator, a checksummed block.
+const fsDsChunkSize = 512
+
+// fsDsIterator reads the records of a snapshot in chunks, walking the index
+// entries first and the tail after them.
+type fsDsIterator struct {
+	ctx         context.Context
+	s           *fsDsSnapshot
+	from, until int64
+	n, nEntries int64
+	ts, pos     int64
+	data        []float64
+	dataTs      int64
+	segPos      int64
+	segLeft     int64
+	tail        int
+	last        int64
+	err         error
+}
+
+func (ds *FsDatastore) Iterate(ctx context.Context, name string, from, until int64) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s, err := ds.takeSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if from < 0 {
+		from -= from % 60
+	} else if from%60 != 0 {
+		from -= from%60 - 60
+	}
+	if until > 0 {
+		until -= until % 60
+	} else if until%60 != 0 {
+		until -= until%60 + 60
+	}
+
+	it := &fsDsIterator{
+		ctx:      ctx,
+		s:        s,
+		from:     from,
+		until:    until,
+		nEntries: s.isize / fsDsISize,
+		last:     s.lastWr,
+	}
+	// The records of new series may only be in the tail yet
+	if it.nEntries == 0 {
+		return it, nil
+	}
+
+	n, err := s.findIdx(from)
+	if err == ErrCorrupted && ds.SkipCorrupted {
+		// Walk the whole index instead
+		n, err = 0, nil
+	}
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	if n == -1 {
+		n = 0
+	}
+	ts, pos, err := s.readIdxEntry(n)
+	if err == ErrCorrupted && ds.SkipCorrupted {
+		n, ts, pos, err = s.nextValidIdxEntry(n + 1)
+	}
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	it.n, it.ts, it.pos = n, ts, pos
+	return it, nil
+}
+
+func (it *fsDsIterator) Next() (Record, bool) {
+	for it.s != nil && it.err == nil {
+		if len(it.data) > 0 {
+			rec := Record{Ts: it.dataTs, Value: it.data[0]}
+			it.data, it.dataTs = it.data[1:], it.dataTs+60
+			return rec, true
+		}
+		if it.segLeft > 0 {
+			it.err = it.readChunk()
+			continue
+		}
+		if it.n < it.nEntries && it.ts <= it.until {
+			it.err = it.nextSegment()
+			continue
+		}
+		return it.nextTail()
+	}
+	return Record{}, false
+}
+
+// nextSegment selects the requested part of the data belonging to the
+// current index entry, and moves on to the next entry.
+func (it *fsDsIterator) nextSegment() error {
+	if err := it.ctx.Err(); err != nil {
+		return err
+	}
+
+	var nts, npos int64
+	if it.n != it.nEntries-1 {
+		var err error
+		nts, npos, err = it.s.readIdxEntry(it.n + 1)
+		if err == ErrCorrupted && it.s.ds.SkipCorrupted {
+			// The end of the segment is unknown, so its values can't be
+			// placed either
+			it.n, it.ts, it.pos, err = it.s.nextValidIdxEntry(it.n + 2)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		npos = it.s.dsize
+	}
+
+	f, u := (it.from-it.ts)/60, (it.until-it.ts)/60
+	if f < 0 {
+		f = 0
+	}
+	if maxu := (npos-it.pos)/fsDsDSize - 1; u > maxu {
+		u = maxu
+	}
+	if f <= u {
+		it.segPos, it.segLeft = it.pos+f*fsDsDSize, u-f+1
+		it.dataTs = it.ts + f*60
+	}
+
+	it.n, it.ts, it.pos = it.n+1, nts, npos
+	return nil
+}
+
+// readChunk reads the values of the segment from the current block.
+func (it *fsDsIterator) readChunk() error {
+	values, err := it.s.readBlock(it.segPos / fsDsBlockSize)
+	if err != nil && (err != ErrCorrupted || !it.s.ds.SkipCorrupted) {
+		return err
+	}
+
+	off := it.segPos % fsDsBlockSize / fsDsDSize
+	n := it.segLeft
+	if n > fsDsChunkSize-off {
+		n = fsDsChunkSize - off
+	}
+	if err == nil {
+		it.data = values[off : off+n]
+	} else {
+		it.dataTs += n * 60
+	}
+	it.segPos += n * fsDsDSize
+	it.segLeft -= n
+	return nil
+}
+
+func (it *fsDsIterator) nextTail() (Record, bool) {
+	for ; it.tail < len(it.s.tail); it.tail++ {
+		r := it.s.tail[it.tail]
+		if r.Ts%60 != 0 || it.last >= r.Ts {
+			continue
+		}
+		if r.Ts >= it.from && r.Ts <= it.until {
+			it.last = r.Ts
+			it.tail++
+			return Record{Ts: r.Ts, Value: r.Value}, true
+		}
+		it.last = r.Ts
+	}
+	it.Close()
+	return Record{}, false
+}
+
+func (it *fsDsIterator) Err() error {
+	return it.err
+}
+
+func (it *fsDsIterator) Close() error {
+	if it.s != nil {
+		it.s.close()
+		it.s = nil
+	}
+	return nil
+}
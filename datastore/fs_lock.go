@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const errFsDsLocked = Error("Data directory locked")
+
+func (ds *FsDatastore) lockFile() string {
+	return filepath.Join(ds.Dir, "lock")
+}
+
+// acquireLock makes sure no other process uses the data directory. The
+// lock is held by a live process for as long as it's locked, so it is never
+// taken over then. Once unlocked, the lock file still contains the PID of
+// its previous owner unless it was closed cleanly. If that process still
+// exists, it's most likely an unrelated one that got the same PID after a
+// crash, and the lock is only taken over if ForceTakeover is set.
+func (ds *FsDatastore) acquireLock() error {
+	f, err := os.OpenFile(ds.lockFile(), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+
+	err = fsDsLock(f)
+	buf, _ := ioutil.ReadAll(f)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err == errFsDsLocked {
+		f.Close()
+		return Error("Data directory in use by process " + strconv.Itoa(pid) + ": " + ds.Dir)
+	} else if err != nil {
+		f.Close()
+		return err
+	}
+	if pid > 0 && pid != os.Getpid() && processRunning(pid) && !ds.ForceTakeover {
+		f.Close()
+		return Error("Data directory not released by process " + strconv.Itoa(pid) + ", which is still running: " + ds.Dir)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return err
+	}
+	ds.lock = f
+	return nil
+}
+
+func (ds *FsDatastore) releaseLock() {
+	if ds.lock != nil {
+		ds.lock.Truncate(0)
+		ds.lock.Close()
+		ds.lock = nil
+	}
+}
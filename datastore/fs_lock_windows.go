@@ -0,0 +1,46 @@
+//go:build windows
+// +build windows
+
+package datastore
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately               = 1
+	lockfileExclusiveLock                 = 2
+	errorLockViolation      syscall.Errno = 33
+	stillActive                           = 259
+)
+
+// fsDsLock locks a byte beyond the PID, which could not be read by others
+// otherwise. The lock is released when the file is closed.
+func fsDsLock(f *os.File) error {
+	ol := syscall.Overlapped{OffsetHigh: 1}
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return errFsDsLocked
+	}
+	return err
+}
+
+func processRunning(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
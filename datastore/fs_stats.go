@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+)
+
+// loadUsage adds up the size of the files of every prefix.
+func (ds *FsDatastore) loadUsage() error {
+	files, err := ioutil.ReadDir(ds.Dir)
+	if err != nil {
+		return err
+	}
+
+	ds.usage = make(map[string]int64)
+	ds.exceeded = make(map[string]bool)
+	for _, fi := range files {
+		ext := filepath.Ext(fi.Name())
+		if ext != ".idx" && ext != ".dat" && ext != ".crc" {
+			continue
+		}
+		name, err := fsDsDecodeName(fi.Name()[:len(fi.Name())-len(ext)])
+		if err != nil {
+			continue
+		}
+		ds.usage[NamePrefix(name)] += fi.Size()
+	}
+	return nil
+}
+
+func (ds *FsDatastore) addUsage(name string, bytes int64) {
+	ds.usageMu.Lock()
+	defer ds.usageMu.Unlock()
+	ds.usage[NamePrefix(name)] += bytes
+}
+
+// checkQuota returns ErrQuotaExceeded if the prefix of the series has used
+// up its quota. Exceeding it is logged once.
+func (ds *FsDatastore) checkQuota(name string) error {
+	prefix := NamePrefix(name)
+	quota, ok := ds.Quotas[prefix]
+	if !ok {
+		return nil
+	}
+
+	ds.usageMu.Lock()
+	defer ds.usageMu.Unlock()
+	if ds.usage[prefix] < quota {
+		delete(ds.exceeded, prefix)
+		return nil
+	}
+	if !ds.exceeded[prefix] {
+		log.Println("FsDatastore: Quota exceeded, rejecting inserts:", prefix)
+		ds.exceeded[prefix] = true
+	}
+	return ErrQuotaExceeded
+}
+
+// Stats returns the size of the data and index files and the number of
+// series of every prefix. Records not yet written to the files are not
+// included.
+func (ds *FsDatastore) Stats() ([]PrefixStats, error) {
+	ds.mu.Lock()
+	if !ds.running {
+		ds.mu.Unlock()
+		return nil, ErrNotRunning
+	}
+	sm := make(statsMap)
+	for name := range ds.names {
+		sm.add(NamePrefix(name), 0, 1)
+	}
+	ds.mu.Unlock()
+
+	ds.usageMu.Lock()
+	defer ds.usageMu.Unlock()
+	for prefix, bytes := range ds.usage {
+		sm.add(prefix, bytes, 0)
+	}
+	for prefix, quota := range ds.Quotas {
+		sm.add(prefix, 0, 0)
+		sm[prefix].Quota = quota
+		sm[prefix].Exceeded = sm[prefix].Bytes >= quota
+	}
+	return sm.sorted(), nil
+}
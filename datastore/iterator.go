@@ -0,0 +1,84 @@
+package datastore
+
+// Iterator streams the records returned by Datastore.Iterate in ascending
+// order of timestamps. Next returns false when there are no more records or
+// an error occurred, which is then reported by Err. Iterators must be
+// closed after use.
+type Iterator interface {
+	Next() (Record, bool)
+	Err() error
+	Close() error
+}
+
+// Collect reads all records from an iterator and closes it.
+func Collect(it Iterator) ([]Record, error) {
+	defer it.Close()
+
+	r := make([]Record, 0)
+	for rec, ok := it.Next(); ok; rec, ok = it.Next() {
+		r = append(r, rec)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type sliceIterator struct {
+	records []Record
+}
+
+func newSliceIterator(records []Record) *sliceIterator {
+	return &sliceIterator{records: records}
+}
+
+func (it *sliceIterator) Next() (Record, bool) {
+	if len(it.records) == 0 {
+		return Record{}, false
+	}
+	rec := it.records[0]
+	it.records = it.records[1:]
+	return rec, true
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	it.records = nil
+	return nil
+}
+
+// concatIterator returns the records of its iterators one after the other.
+type concatIterator struct {
+	its []Iterator
+	err error
+}
+
+func (it *concatIterator) Next() (Record, bool) {
+	for len(it.its) > 0 && it.err == nil {
+		if rec, ok := it.its[0].Next(); ok {
+			return rec, true
+		}
+		it.err = it.its[0].Err()
+		it.its[0].Close()
+		it.its = it.its[1:]
+	}
+	return Record{}, false
+}
+
+func (it *concatIterator) Err() error {
+	return it.err
+}
+
+func (it *concatIterator) Close() error {
+	var err error
+	for _, x := range it.its {
+		if e := x.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	it.its = nil
+	return err
+}
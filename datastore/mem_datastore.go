@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// MemDatastore keeps all records in memory. If MaxRecords is positive, only
+// the latest MaxRecords records are kept for each name.
+type MemDatastore struct {
+	MaxRecords int
+	mu         sync.Mutex
+	series     map[string][]Record
+	running    bool
+}
+
+func (ds *MemDatastore) Open() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.running {
+		return ErrAlreadyRunning
+	}
+	ds.series = make(map[string][]Record)
+	ds.running = true
+	return nil
+}
+
+func (ds *MemDatastore) Close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if !ds.running {
+		return ErrNotRunning
+	}
+	ds.series = nil
+	ds.running = false
+	return nil
+}
+
+func (ds *MemDatastore) Insert(name string, r Record) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if !ds.running {
+		return ErrNotRunning
+	}
+	if r.Ts%60 != 0 {
+		return Error("Timestamp not divisible by 60")
+	}
+
+	s := ds.series[name]
+	if len(s) > 0 && s[len(s)-1].Ts >= r.Ts {
+		return Error("Timestamp in the past: " + name)
+	}
+	s = append(s, r)
+	if ds.MaxRecords > 0 && len(s) > ds.MaxRecords {
+		s = s[len(s)-ds.MaxRecords:]
+		if cap(s) > 2*ds.MaxRecords {
+			s = append(make([]Record, 0, ds.MaxRecords+1), s...)
+		}
+	}
+	ds.series[name] = s
+	return nil
+}
+
+func (ds *MemDatastore) Query(ctx context.Context, name string, from, until int64) ([]Record, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if !ds.running {
+		return []Record{}, ErrNotRunning
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s := ds.series[name]
+	i := sort.Search(len(s), func(i int) bool { return s[i].Ts >= from })
+	j := sort.Search(len(s), func(i int) bool { return s[i].Ts > until })
+	if i >= j {
+		return []Record{}, nil
+	}
+	return append([]Record(nil), s[i:j]...), nil
+}
+
+func (ds *MemDatastore) Iterate(ctx context.Context, name string, from, until int64) (Iterator, error) {
+	r, err := ds.Query(ctx, name, from, until)
+	if err != nil {
+		return nil, err
+	}
+	return newSliceIterator(r), nil
+}
+
+func (ds *MemDatastore) LatestBefore(ctx context.Context, name string, ts int64) (Record, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if !ds.running {
+		return Record{}, ErrNotRunning
+	}
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+
+	s := ds.series[name]
+	i := sort.Search(len(s), func(i int) bool { return s[i].Ts > ts })
+	if i == 0 {
+		return Record{}, NoDataError{Name: name}
+	}
+	return s[i-1], nil
+}
+
+func (ds *MemDatastore) ListNames(pattern string) ([]string, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	r := make([]string, 0)
+	for name, _ := range ds.series {
+		m, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if m {
+			r = append(r, name)
+		}
+	}
+	return r, nil
+}
+
+// Stats counts the memory used by records in Bytes.
+func (ds *MemDatastore) Stats() ([]PrefixStats, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if !ds.running {
+		return nil, ErrNotRunning
+	}
+	sm := make(statsMap)
+	for name, s := range ds.series {
+		sm.add(NamePrefix(name), int64(len(s))*16, 1)
+	}
+	return sm.sorted(), nil
+}
@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMemDatastore(t *testing.T) {
+	ds := &MemDatastore{MaxRecords: 3}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	ctx := context.Background()
+
+	for _, ts := range []int64{60, 120, 180, 300} {
+		if err := ds.Insert("test:gauge", Record{ts, float64(ts)}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+	if err := ds.Insert("test:gauge", Record{240, 0}); err == nil {
+		t.Error("Insert in the past should have failed")
+	}
+
+	var testCases = []struct {
+		from, until int64
+		n           int
+	}{
+		{0, 1000, 3},
+		{60, 120, 1},
+		{180, 180, 1},
+		{181, 299, 0},
+		{300, 0, 0},
+	}
+	for _, tc := range testCases {
+		r, err := ds.Query(ctx, "test:gauge", tc.from, tc.until)
+		if err != nil {
+			t.Error("Query:", err)
+		} else if len(r) != tc.n {
+			t.Error("Incorrect result:", tc.from, tc.until)
+			t.Error("Expected:", tc.n)
+			t.Error("Returned:", r)
+		}
+	}
+
+	if _, err := ds.LatestBefore(ctx, "test:gauge", 119); !errors.Is(err, ErrNoData) {
+		t.Error("LatestBefore should have returned ErrNoData:", err)
+	}
+	if r, err := ds.LatestBefore(ctx, "test:gauge", 299); err != nil || r.Ts != 180 {
+		t.Error("Incorrect LatestBefore result:", r, err)
+	}
+}
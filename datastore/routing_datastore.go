@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"context"
+	"log"
+	"strings"
+)
+
+type DatastoreRoute struct {
+	Prefix string
+	Ds     Datastore
+}
+
+// RoutingDatastore dispatches every operation to the Datastore of the
+// route with the longest matching name prefix, or to Default if no route
+// matches.
+type RoutingDatastore struct {
+	Routes  []DatastoreRoute
+	Default Datastore
+}
+
+func (ds *RoutingDatastore) Open() error {
+	opened := make([]Datastore, 0)
+	for _, d := range ds.backends() {
+		if err := d.Open(); err != nil {
+			for _, o := range opened {
+				if err := o.Close(); err != nil {
+					log.Println("RoutingDatastore.Open:", err)
+				}
+			}
+			return err
+		}
+		opened = append(opened, d)
+	}
+	return nil
+}
+
+func (ds *RoutingDatastore) Close() error {
+	var r error
+	for _, d := range ds.backends() {
+		if err := d.Close(); err != nil {
+			log.Println("RoutingDatastore.Close:", err)
+			r = err
+		}
+	}
+	return r
+}
+
+func (ds *RoutingDatastore) Insert(name string, r Record) error {
+	return ds.route(name).Insert(name, r)
+}
+
+func (ds *RoutingDatastore) Query(ctx context.Context, name string, from, until int64) ([]Record, error) {
+	return ds.route(name).Query(ctx, name, from, until)
+}
+
+func (ds *RoutingDatastore) Iterate(ctx context.Context, name string, from, until int64) (Iterator, error) {
+	return ds.route(name).Iterate(ctx, name, from, until)
+}
+
+func (ds *RoutingDatastore) LatestBefore(ctx context.Context, name string, ts int64) (Record, error) {
+	return ds.route(name).LatestBefore(ctx, name, ts)
+}
+
+func (ds *RoutingDatastore) ListNames(pattern string) ([]string, error) {
+	r := make([]string, 0)
+	for _, d := range ds.backends() {
+		names, err := d.ListNames(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			// Only report names stored where they are routed to
+			if ds.route(name) == d {
+				r = append(r, name)
+			}
+		}
+	}
+	return r, nil
+}
+
+func (ds *RoutingDatastore) Stats() ([]PrefixStats, error) {
+	stats := make([][]PrefixStats, 0)
+	for _, d := range ds.backends() {
+		s, err := d.Stats()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return mergeStats(stats...), nil
+}
+
+func (ds *RoutingDatastore) route(name string) Datastore {
+	r, l := ds.Default, -1
+	for _, rt := range ds.Routes {
+		if len(rt.Prefix) > l && strings.HasPrefix(name, rt.Prefix) {
+			r, l = rt.Ds, len(rt.Prefix)
+		}
+	}
+	if r == nil {
+		return nullDatastore{}
+	}
+	return r
+}
+
+func (ds *RoutingDatastore) backends() []Datastore {
+	r := make([]Datastore, 0, len(ds.Routes)+1)
+	add := func(d Datastore) {
+		if d == nil {
+			return
+		}
+		for _, x := range r {
+			if x == d {
+				return
+			}
+		}
+		r = append(r, d)
+	}
+	add(ds.Default)
+	for _, rt := range ds.Routes {
+		add(rt.Ds)
+	}
+	return r
+}
+
+type nullDatastore struct{}
+
+func (nullDatastore) Open() error {
+	return nil
+}
+
+func (nullDatastore) Close() error {
+	return nil
+}
+
+func (nullDatastore) Insert(name string, r Record) error {
+	return Error("No datastore for metric: " + name)
+}
+
+func (nullDatastore) Query(ctx context.Context, name string, from, until int64) ([]Record, error) {
+	return []Record{}, nil
+}
+
+func (nullDatastore) Iterate(ctx context.Context, name string, from, until int64) (Iterator, error) {
+	return newSliceIterator(nil), nil
+}
+
+func (nullDatastore) LatestBefore(ctx context.Context, name string, ts int64) (Record, error) {
+	return Record{}, NoDataError{Name: name}
+}
+
+func (nullDatastore) ListNames(pattern string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (nullDatastore) Stats() ([]PrefixStats, error) {
+	return []PrefixStats{}, nil
+}
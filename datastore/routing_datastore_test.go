@@ -0,0 +1,143 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestRoutingDatastore(t *testing.T) {
+	web, api, def := &MemDatastore{}, &MemDatastore{}, &MemDatastore{}
+	ds := &RoutingDatastore{
+		Routes: []DatastoreRoute{
+			{Prefix: "web.", Ds: web},
+			{Prefix: "web.api.", Ds: api},
+			{Prefix: "web.static.", Ds: web},
+		},
+		Default: def,
+	}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	ctx := context.Background()
+
+	var testCases = []struct {
+		name string
+		ds   *MemDatastore
+	}{
+		{"web.hits:counter", web},
+		{"web.api.hits:counter", api},
+		{"web.api:counter", web},
+		{"web.static.hits:counter", web},
+		{"db.load:gauge", def},
+		{"web:gauge", def},
+	}
+
+	for _, tc := range testCases {
+		if err := ds.Insert(tc.name, Record{60, 1}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+		for _, d := range []*MemDatastore{web, api, def} {
+			r, err := d.Query(ctx, tc.name, 0, 60)
+			if err != nil {
+				t.Fatal("Query:", err)
+			}
+			if (len(r) == 1) != (d == tc.ds) {
+				t.Error("Incorrect route:", tc.name)
+			}
+		}
+		if r, err := ds.Query(ctx, tc.name, 0, 60); err != nil || len(r) != 1 {
+			t.Error("Incorrect Query result:", tc.name, r, err)
+		}
+		if r, err := ds.LatestBefore(ctx, tc.name, 60); err != nil || r != (Record{60, 1}) {
+			t.Error("Incorrect LatestBefore result:", tc.name, r, err)
+		}
+	}
+
+	// Only the names stored where they are routed to are listed
+	api.Insert("web.hits:gauge", Record{60, 1})
+	names, err := ds.ListNames("web.*")
+	if err != nil {
+		t.Fatal("ListNames:", err)
+	}
+	sort.Strings(names)
+	expected := []string{"web.api.hits:counter", "web.api:counter", "web.hits:counter", "web.static.hits:counter"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Error("Incorrect ListNames result")
+		t.Error("Expected:", expected)
+		t.Error("Result:", names)
+	}
+
+	stats, err := ds.Stats()
+	if err != nil {
+		t.Fatal("Stats:", err)
+	}
+	expectedStats := []PrefixStats{{"db.", 16, 1, 0, false}, {"web.", 80, 5, 0, false}, {"web:", 16, 1, 0, false}}
+	if fmt.Sprint(stats) != fmt.Sprint(expectedStats) {
+		t.Error("Incorrect Stats result")
+		t.Error("Expected:", expectedStats)
+		t.Error("Result:", stats)
+	}
+
+	// Errors of the backends are passed through
+	if err := ds.Insert("web.hits:counter", Record{30, 1}); err == nil {
+		t.Error("Insert should have failed")
+	}
+	if _, err := ds.LatestBefore(ctx, "web.api.none:gauge", 60); !errors.Is(err, ErrNoData) {
+		t.Error("LatestBefore should have failed with ErrNoData:", err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := ds.Iterate(cctx, "db.load:gauge", 0, 60); err != context.Canceled {
+		t.Error("Iterate should have been canceled:", err)
+	}
+
+	// Every backend is closed once, even if one of them fails
+	api.Close()
+	if err := ds.Close(); err != ErrNotRunning {
+		t.Error("Close should have failed:", err)
+	}
+	for _, d := range []*MemDatastore{web, def} {
+		if err := d.Close(); err != ErrNotRunning {
+			t.Error("Backend not closed:", err)
+		}
+	}
+}
+
+func TestRoutingDatastoreOpen(t *testing.T) {
+	web, api, def := &MemDatastore{}, &MemDatastore{}, &MemDatastore{}
+	ds := &RoutingDatastore{
+		Routes:  []DatastoreRoute{{Prefix: "web.", Ds: web}, {Prefix: "web.api.", Ds: api}},
+		Default: def,
+	}
+
+	// The backends opened already are closed again if one fails
+	api.Open()
+	if err := ds.Open(); err != ErrAlreadyRunning {
+		t.Error("Open should have failed:", err)
+	}
+	for _, d := range []*MemDatastore{web, def} {
+		if err := d.Close(); err != ErrNotRunning {
+			t.Error("Backend left open:", err)
+		}
+	}
+	api.Close()
+
+	// Without a default, unrouted names can't be inserted
+	ds.Default = nil
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	if err := ds.Insert("db.load:gauge", Record{60, 1}); err == nil {
+		t.Error("Insert without a route should have failed")
+	}
+	if _, err := ds.LatestBefore(context.Background(), "db.load:gauge", 60); !errors.Is(err, ErrNoData) {
+		t.Error("LatestBefore should have failed with ErrNoData:", err)
+	}
+	if r, err := ds.Query(context.Background(), "db.load:gauge", 0, 60); err != nil || len(r) != 0 {
+		t.Error("Incorrect Query result:", r, err)
+	}
+}
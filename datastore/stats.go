@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"sort"
+	"strings"
+)
+
+// PrefixStats is the storage used by the series of a prefix, see
+// NamePrefix.
+type PrefixStats struct {
+	Prefix   string
+	Bytes    int64
+	Series   int
+	Quota    int64 `json:",omitempty"`
+	Exceeded bool  `json:",omitempty"`
+}
+
+const ErrQuotaExceeded = Error("Storage quota exceeded")
+
+// NamePrefix returns the prefix a series is accounted to: its name up to and
+// including the first dot, or the metric name if it has none.
+func NamePrefix(name string) string {
+	if i := strings.IndexAny(name, ".:"); i != -1 {
+		return name[:i+1]
+	}
+	return name
+}
+
+type statsMap map[string]*PrefixStats
+
+func (sm statsMap) add(prefix string, bytes int64, series int) {
+	ps := sm[prefix]
+	if ps == nil {
+		ps = &PrefixStats{Prefix: prefix}
+		sm[prefix] = ps
+	}
+	ps.Bytes += bytes
+	ps.Series += series
+}
+
+func (sm statsMap) sorted() []PrefixStats {
+	r := make([]PrefixStats, 0, len(sm))
+	for _, ps := range sm {
+		r = append(r, *ps)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Prefix < r[j].Prefix
+	})
+	return r
+}
+
+// mergeStats adds up the stats of several datastores.
+func mergeStats(stats ...[]PrefixStats) []PrefixStats {
+	sm := make(statsMap)
+	for _, s := range stats {
+		for _, ps := range s {
+			sm.add(ps.Prefix, ps.Bytes, ps.Series)
+			sm[ps.Prefix].Quota += ps.Quota
+			sm[ps.Prefix].Exceeded = sm[ps.Prefix].Exceeded || ps.Exceeded
+		}
+	}
+	return sm.sorted()
+}
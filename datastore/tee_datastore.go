@@ -0,0 +1,164 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// TeeDatastore writes every record to both Primary and Secondary, and reads
+// from Primary, falling back to Secondary for data Primary doesn't have.
+// It can be used to migrate between backends without downtime.
+type TeeDatastore struct {
+	Primary   Datastore
+	Secondary Datastore
+}
+
+func (ds *TeeDatastore) Open() error {
+	if err := ds.Primary.Open(); err != nil {
+		return err
+	}
+	if err := ds.Secondary.Open(); err != nil {
+		if err := ds.Primary.Close(); err != nil {
+			log.Println("TeeDatastore.Open:", err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (ds *TeeDatastore) Close() error {
+	err1, err2 := ds.Primary.Close(), ds.Secondary.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// Insert only fails if Primary does; errors of Secondary are logged.
+func (ds *TeeDatastore) Insert(name string, r Record) error {
+	err := ds.Primary.Insert(name, r)
+	if err2 := ds.Secondary.Insert(name, r); err2 != nil {
+		log.Println("TeeDatastore.Insert:", err2)
+	}
+	return err
+}
+
+func (ds *TeeDatastore) Query(ctx context.Context, name string, from, until int64) ([]Record, error) {
+	r, err := ds.Primary.Query(ctx, name, from, until)
+	if err != nil {
+		log.Println("TeeDatastore.Query:", err)
+		return ds.Secondary.Query(ctx, name, from, until)
+	}
+	if len(r) > 0 && r[0].Ts <= from {
+		return r, nil
+	}
+
+	// Fill the beginning of the range from the secondary
+	end := until
+	if len(r) > 0 {
+		end = r[0].Ts - 1
+	}
+	r2, err := ds.Secondary.Query(ctx, name, from, end)
+	if err != nil {
+		return nil, err
+	}
+	for len(r2) > 0 && len(r) > 0 && r2[len(r2)-1].Ts >= r[0].Ts {
+		r2 = r2[:len(r2)-1]
+	}
+	return append(r2, r...), nil
+}
+
+func (ds *TeeDatastore) Iterate(ctx context.Context, name string, from, until int64) (Iterator, error) {
+	it, err := ds.Primary.Iterate(ctx, name, from, until)
+	if err != nil {
+		log.Println("TeeDatastore.Iterate:", err)
+		return ds.Secondary.Iterate(ctx, name, from, until)
+	}
+	first, ok := it.Next()
+	if err := it.Err(); err != nil {
+		it.Close()
+		return nil, err
+	}
+	if ok && first.Ts <= from {
+		return &concatIterator{its: []Iterator{newSliceIterator([]Record{first}), it}}, nil
+	}
+
+	// Fill the beginning of the range from the secondary
+	end := until
+	if ok {
+		end = first.Ts - 1
+	}
+	it2, err := ds.Secondary.Iterate(ctx, name, from, end)
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	if !ok {
+		it.Close()
+		return it2, nil
+	}
+	it2 = &untilIterator{it: it2, until: first.Ts}
+	return &concatIterator{its: []Iterator{it2, newSliceIterator([]Record{first}), it}}, nil
+}
+
+// untilIterator stops before the first record not older than until.
+type untilIterator struct {
+	it    Iterator
+	until int64
+}
+
+func (it *untilIterator) Next() (Record, bool) {
+	rec, ok := it.it.Next()
+	if !ok || rec.Ts >= it.until {
+		return Record{}, false
+	}
+	return rec, true
+}
+
+func (it *untilIterator) Err() error {
+	return it.it.Err()
+}
+
+func (it *untilIterator) Close() error {
+	return it.it.Close()
+}
+
+func (ds *TeeDatastore) LatestBefore(ctx context.Context, name string, ts int64) (Record, error) {
+	r, err := ds.Primary.LatestBefore(ctx, name, ts)
+	if err != nil {
+		if !errors.Is(err, ErrNoData) {
+			log.Println("TeeDatastore.LatestBefore:", err)
+		}
+		return ds.Secondary.LatestBefore(ctx, name, ts)
+	}
+	return r, nil
+}
+
+func (ds *TeeDatastore) ListNames(pattern string) ([]string, error) {
+	names, err := ds.Primary.ListNames(pattern)
+	if err != nil {
+		return nil, err
+	}
+	names2, err := ds.Secondary.ListNames(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+	}
+	for _, name := range names2 {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Stats returns the stats of Primary, which should end up holding
+// everything.
+func (ds *TeeDatastore) Stats() ([]PrefixStats, error) {
+	return ds.Primary.Stats()
+}
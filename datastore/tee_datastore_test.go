@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestTeeDatastore(t *testing.T) {
+	primary, secondary := &MemDatastore{}, &MemDatastore{}
+	ds := &TeeDatastore{Primary: primary, Secondary: secondary}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	ctx := context.Background()
+
+	// History only the secondary has, then records written to both
+	for ts := int64(60); ts <= 180; ts += 60 {
+		secondary.Insert("a:gauge", Record{ts, float64(ts)})
+	}
+	secondary.Insert("b:gauge", Record{60, 1})
+	for ts := int64(240); ts <= 300; ts += 60 {
+		if err := ds.Insert("a:gauge", Record{ts, float64(ts)}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+
+	all := []Record{{60, 60}, {120, 120}, {180, 180}, {240, 240}, {300, 300}}
+	if r, err := secondary.Query(ctx, "a:gauge", 0, 300); err != nil || fmt.Sprint(r) != fmt.Sprint(all) {
+		t.Error("Secondary didn't receive the records:", r, err)
+	}
+	if r, err := primary.Query(ctx, "a:gauge", 0, 300); err != nil || len(r) != 2 {
+		t.Error("Primary didn't receive the records:", r, err)
+	}
+
+	var testCases = []struct {
+		from, until int64
+		result      []Record
+	}{
+		{0, 300, all},
+		{120, 240, all[1:4]},
+		{240, 300, all[3:]},
+		{60, 120, all[:2]},
+		{360, 600, []Record{}},
+	}
+
+	for _, tc := range testCases {
+		r, err := ds.Query(ctx, "a:gauge", tc.from, tc.until)
+		if err != nil {
+			t.Fatal("Query:", err)
+		}
+		it, err := ds.Iterate(ctx, "a:gauge", tc.from, tc.until)
+		if err != nil {
+			t.Fatal("Iterate:", err)
+		}
+		r2, err := Collect(it)
+		if err != nil {
+			t.Fatal("Collect:", err)
+		}
+		if fmt.Sprint(r) != fmt.Sprint(tc.result) || fmt.Sprint(r2) != fmt.Sprint(tc.result) {
+			t.Error("Incorrect result:", tc.from, tc.until)
+			t.Error("Expected:", tc.result)
+			t.Error("Result:", r, r2)
+		}
+	}
+
+	if r, err := ds.LatestBefore(ctx, "a:gauge", 200); err != nil || r != (Record{180, 180}) {
+		t.Error("Incorrect LatestBefore result:", r, err)
+	}
+	if r, err := ds.LatestBefore(ctx, "a:gauge", 600); err != nil || r != (Record{300, 300}) {
+		t.Error("Incorrect LatestBefore result:", r, err)
+	}
+
+	names, err := ds.ListNames("*")
+	sort.Strings(names)
+	if err != nil || fmt.Sprint(names) != "[a:gauge b:gauge]" {
+		t.Error("Incorrect ListNames result:", names, err)
+	}
+}
+
+func TestTeeDatastoreSecondaryFailure(t *testing.T) {
+	primary := &MemDatastore{}
+	secondary := &ChaosDatastore{Ds: &MemDatastore{}, InsertChaos: Chaos{ErrorRate: 1}}
+	ds := &TeeDatastore{Primary: primary, Secondary: secondary}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+
+	if err := ds.Insert("a:gauge", Record{60, 1}); err != nil {
+		t.Error("Failure of the secondary failed the insert:", err)
+	}
+	if r, err := primary.LatestBefore(context.Background(), "a:gauge", 60); err != nil || r != (Record{60, 1}) {
+		t.Error("Record not inserted into the primary:", r, err)
+	}
+
+	// Failures of the primary are reported
+	secondary.InsertChaos.ErrorRate = 0
+	if err := ds.Insert("a:gauge", Record{30, 1}); err == nil {
+		t.Error("Insert should have failed")
+	}
+}
@@ -0,0 +1,96 @@
+// Package election elects the leader among servers sharing a datastore.
+// The others stand by as replicas answering queries, and one of them is
+// promoted when the leader goes away.
+package election
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
+
+// Lock is held by the leader.
+type Lock interface {
+	// Acquire blocks until the lock is held or ctx is done. The returned
+	// channel is closed if the lock is lost before it is released.
+	Acquire(ctx context.Context) (<-chan int, error)
+	Release() error
+}
+
+const errLocked = Error("Locked by another process")
+
+const DefaultPoll = time.Second
+
+// FileLock is a Lock on a file, which contains the PID of its holder. It
+// only works between processes sharing a file system with working flock(),
+// it is never lost while held, and it isn't supported on Windows.
+type FileLock struct {
+	Path string
+	Poll time.Duration
+	mu   sync.Mutex
+	f    *os.File
+	lost chan int
+}
+
+func (l *FileLock) Acquire(ctx context.Context) (<-chan int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		return nil, Error("Lock already held")
+	}
+	poll := l.Poll
+	if poll <= 0 {
+		poll = DefaultPoll
+	}
+
+	f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := lockFile(f)
+		if err == nil {
+			break
+		} else if err != errLocked {
+			f.Close()
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f, l.lost = f, make(chan int)
+	return l.lost, nil
+}
+
+func (l *FileLock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return Error("Lock not held")
+	}
+	l.f.Truncate(0)
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
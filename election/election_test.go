@@ -0,0 +1,64 @@
+package election
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("File locks are not supported on Windows")
+	}
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leader")
+
+	a, b := &FileLock{Path: path}, &FileLock{Path: path, Poll: time.Millisecond}
+	if _, err := a.Acquire(context.Background()); err != nil {
+		t.Fatal("Acquire:", err)
+	}
+	buf, _ := ioutil.ReadFile(path)
+	if pid, _ := strconv.Atoi(strings.TrimSpace(string(buf))); pid != os.Getpid() {
+		t.Error("Incorrect PID in lock file:", string(buf))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	if _, err := b.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Error("Acquire should have timed out:", err)
+	}
+	cancel()
+
+	acquired := make(chan error)
+	go func() {
+		_, err := b.Acquire(context.Background())
+		acquired <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := a.Release(); err != nil {
+		t.Error("Release:", err)
+	}
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Error("Acquire:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for lock")
+	}
+	if err := b.Release(); err != nil {
+		t.Error("Release:", err)
+	}
+	if err := b.Release(); err == nil {
+		t.Error("Second Release should have failed")
+	}
+}
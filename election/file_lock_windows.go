@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package election
+
+import "os"
+
+func lockFile(f *os.File) error {
+	return Error("File locks are not supported on Windows")
+}
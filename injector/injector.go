@@ -0,0 +1,9 @@
+// Package injector receives metrics over the network and injects them into
+// a Server.
+package injector
+
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
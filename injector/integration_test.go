@@ -0,0 +1,845 @@
+package injector
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/adatboss/statsd/clock"
+	"github.com/adatboss/statsd/datastore"
+	"github.com/adatboss/statsd/server"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testHarness struct {
+	t     *testing.T
+	dir   string
+	clock *clock.Manual
+	ds    *datastore.FsDatastore
+	srv   *server.Server
+	ui    *UDPInjector
+	conn  net.Conn
+	start int64
+}
+
+func newTestHarness(t *testing.T, udpAddr string, udpSockets int) *testHarness {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &testHarness{t: t, dir: dir, start: 6000000}
+	h.clock = clock.NewManual(time.Unix(h.start, 0))
+	h.ds = &datastore.FsDatastore{Dir: dir, NoSync: true}
+	if err := h.ds.Open(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal("Open:", err)
+	}
+
+	h.srv = &server.Server{Ds: h.ds, Clock: h.clock}
+	if err := h.srv.Start(nil, nil); err != nil {
+		h.ds.Close()
+		os.RemoveAll(dir)
+		t.Fatal("Start:", err)
+	}
+
+	h.ui = &UDPInjector{Addr: udpAddr, Server: h.srv, Sockets: udpSockets}
+	if err := h.ui.Start(); err != nil {
+		h.close()
+		t.Fatal("UDPInjector.Start:", err)
+	}
+	h.conn, err = net.Dial("udp", h.ui.LocalAddrs()[0].String())
+	if err != nil {
+		h.close()
+		t.Fatal("Dial:", err)
+	}
+	return h
+}
+
+// send injects the metrics over UDP and waits until the server has
+// received all of them. A message can hold several metrics, one per line.
+func (h *testHarness) send(metrics ...string) {
+	h.sendTo(h.conn, metrics...)
+}
+
+func (h *testHarness) sendTo(conn net.Conn, metrics ...string) {
+	expected := h.srv.Usage().Injected
+	for _, m := range metrics {
+		expected += int64(strings.Count(m, "\n") + 1)
+		if _, err := conn.Write([]byte(m)); err != nil {
+			h.t.Fatal("Write:", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.srv.Usage().Injected < expected {
+		if time.Now().After(deadline) {
+			h.t.Fatal("Timeout waiting for injected metrics")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// close stops the server, advancing the clock until it reaches the end of
+// the minute, then releases everything the harness has set up.
+func (h *testHarness) close() {
+	if h.conn != nil {
+		h.conn.Close()
+	}
+	if h.ui.running {
+		h.ui.Stop()
+	}
+
+	done := make(chan int)
+	go func() {
+		if _, _, err := h.srv.Stop(); err != nil {
+			h.t.Error("Stop:", err)
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+		default:
+			h.clock.AdvanceUntil(time.Second, done)
+			continue
+		}
+		break
+	}
+
+	if err := h.ds.Close(); err != nil {
+		h.t.Error("Close:", err)
+	}
+	os.RemoveAll(h.dir)
+}
+
+func equalValues(a, b [][]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if a[i][j] != b[i][j] && !(math.IsNaN(a[i][j]) && math.IsNaN(b[i][j])) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestIntegration(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+	ctx := context.Background()
+
+	// The live log is only kept once it has been queried
+	if _, _, err := h.srv.LiveLog("a.counter", []string{"counter"}); err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+
+	h.send("a.counter:1|c", "a.counter:2|c\na.timer:10|ms", "a.timer:20|ms")
+	h.clock.Advance(time.Minute)
+
+	live, ts, err := h.srv.LiveLog("a.counter", []string{"counter"})
+	if err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+	if ts != h.start+60-server.LiveLogSize {
+		t.Error("Incorrect live log timestamp:", ts)
+	}
+	sum := 0.0
+	for _, row := range live {
+		if !math.IsNaN(row[0]) {
+			sum += row[0]
+		}
+	}
+	if sum != 3 {
+		t.Error("Incorrect live log sum:", sum)
+	}
+	if !math.IsNaN(live[0][0]) {
+		t.Error("Live log should be unknown before the first query:", live[0])
+	}
+
+	w, err := h.srv.Watch(ctx, "a.counter", []string{"counter"}, 0, 60, "")
+	if err != nil {
+		t.Fatal("Watch:", err)
+	}
+	defer w.Close()
+
+	h.send("a.counter:4|c")
+	h.clock.Advance(time.Minute)
+
+	select {
+	case row := <-w.C:
+		if !equalValues([][]float64{row}, [][]float64{{4}}) {
+			t.Error("Incorrect watcher result:", row)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timeout waiting for watcher")
+	}
+
+	var testCases = []struct {
+		name   string
+		chs    []string
+		length int64
+		result [][]float64
+	}{
+		{"a.counter", []string{"counter"}, 2, [][]float64{{3}, {4}}},
+		{"a.counter", []string{"counter"}, 5, [][]float64{{3}, {4}}},
+		{"a.timer", []string{"timer-min", "timer-max", "timer-cnt"}, 1,
+			[][]float64{{10, 20, 2}}},
+	}
+
+	for _, tc := range testCases {
+		result, err := h.srv.Log(ctx, tc.name, tc.chs, h.start, tc.length, 60, "")
+		if err != nil {
+			t.Error("Log:", tc.name, err)
+		} else if !equalValues(result, tc.result) {
+			t.Error("Incorrect result:", tc.name, tc.chs)
+			t.Error("Expected:", tc.result)
+			t.Error("Result:", result)
+		}
+	}
+}
+
+func TestUDPInjectorAddrs(t *testing.T) {
+	if c, err := net.ListenPacket("udp", "[::1]:0"); err != nil {
+		t.Skip("IPv6 is not available")
+	} else {
+		c.Close()
+	}
+
+	h := newTestHarness(t, "127.0.0.1:0, [::1]:0", 1)
+	defer h.close()
+
+	addrs := h.ui.LocalAddrs()
+	if len(addrs) != 2 {
+		t.Fatal("Incorrect number of addresses:", addrs)
+	}
+	h.send("b.counter:1|c")
+
+	conn, err := net.Dial("udp", addrs[1].String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer conn.Close()
+	h.sendTo(conn, "b.counter:1|c")
+}
+
+func TestUDPInjectorReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" || strings.HasPrefix(runtime.GOARCH, "mips") {
+		t.Skip("SO_REUSEPORT is only supported on Linux")
+	}
+
+	h := newTestHarness(t, "127.0.0.1:0", 4)
+	defer h.close()
+
+	addrs := h.ui.LocalAddrs()
+	if len(addrs) != 4 {
+		t.Fatal("Incorrect number of addresses:", addrs)
+	}
+	for _, addr := range addrs[1:] {
+		if addr.String() != addrs[0].String() {
+			t.Error("Sockets bound to different addresses:", addrs)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		h.send("c.counter:1|c")
+	}
+}
+
+func TestPersistentDefaults(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+	ctx := context.Background()
+
+	h.send("a.acc:5|ac", "a.gauge:7|g")
+	h.clock.Advance(time.Minute)
+
+	// Idle metrics are deleted after the live log has expired, so the next
+	// input creates them again from the stored values.
+	h.clock.Advance(time.Duration(server.LiveLogSize+120) * time.Second)
+	h.send("a.acc:1|ac")
+	h.clock.Advance(time.Minute)
+
+	var testCases = []struct {
+		name   string
+		chs    []string
+		result []float64
+	}{
+		{"a.acc", []string{"acc"}, []float64{6}},
+		{"a.gauge", []string{"gauge"}, []float64{7}},
+	}
+
+	for _, tc := range testCases {
+		ts := h.start + int64(server.LiveLogSize) + 180
+		result, err := h.srv.Log(ctx, tc.name, tc.chs, ts, 1, 60, "")
+		if err != nil {
+			t.Error("Log:", tc.name, err)
+		} else if !equalValues(result, [][]float64{tc.result}) {
+			t.Error("Incorrect result:", tc.name, tc.chs)
+			t.Error("Expected:", tc.result)
+			t.Error("Result:", result)
+		}
+	}
+}
+
+func TestCombine(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+	ctx := context.Background()
+
+	h.send("fe1.req:1|c", "fe2.req:2|c", "fe3.req:4|c", "fe1.lat:10|ms", "fe2.lat:30|ms")
+	h.clock.Advance(time.Minute)
+	h.send("fe1.req:8|c", "fe1.lat:20|ms")
+	h.clock.Advance(time.Minute)
+
+	var testCases = []struct {
+		names   []string
+		ch      string
+		op      string
+		missing server.MissingPolicy
+		result  [][]float64
+	}{
+		{[]string{"fe1.req", "fe2.req"}, "counter", "sum", server.MissingSkip, [][]float64{{3}, {8}}},
+		{[]string{"fe*.req"}, "counter", "sum", server.MissingSkip, [][]float64{{7}, {8}}},
+		{[]string{"fe*.req", "fe1.req"}, "counter", "avg", server.MissingSkip, [][]float64{{7.0 / 3}, {8}}},
+		{[]string{"fe*.lat"}, "timer-max", "avg", server.MissingSkip, [][]float64{{20}, {20}}},
+		{[]string{"fe*.lat"}, "timer-max", "avg", server.MissingZero, [][]float64{{20}, {10}}},
+	}
+
+	for _, tc := range testCases {
+		result, err := h.srv.Combine(ctx, tc.names, tc.ch, h.start, 2, 60, "", tc.op, tc.missing)
+		if err != nil {
+			t.Error("Combine:", tc.names, err)
+		} else if !equalValues(result, tc.result) {
+			t.Error("Incorrect result:", tc.names, tc.ch, tc.op, tc.missing)
+			t.Error("Expected:", tc.result)
+			t.Error("Result:", result)
+		}
+	}
+}
+
+func TestWatchShift(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+	ctx := context.Background()
+
+	h.send("s.counter:5|c")
+	h.clock.Advance(time.Minute)
+	h.send("s.counter:7|c")
+	h.clock.Advance(time.Minute)
+
+	if _, err := h.srv.WatchShift(ctx, "s.counter", []string{"counter"}, 0, 60, -30, ""); err == nil {
+		t.Error("Expected error for a shift within the current interval")
+	}
+	w, err := h.srv.WatchShift(ctx, "s.counter", []string{"counter"}, 0, 60, -120, "")
+	if err != nil {
+		t.Fatal("WatchShift:", err)
+	}
+	defer w.Close()
+
+	for _, expected := range []float64{5, 7} {
+		h.send("s.counter:1|c")
+		h.clock.Advance(time.Minute)
+		select {
+		case row := <-w.C:
+			if !equalValues([][]float64{row}, [][]float64{{expected}}) {
+				t.Error("Incorrect watcher result:", row, "expected:", expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for watcher")
+		}
+	}
+}
+
+func TestLogConsistentChannels(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+	ctx := context.Background()
+
+	done, errs := make(chan int), make(chan string, 1)
+	go func() {
+		defer close(errs)
+		chs := []string{"timer-min", "timer-max", "timer-cnt"}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			data, err := h.srv.Log(ctx, "t.timer", chs, h.start, 30, 60, "")
+			if err != nil {
+				errs <- err.Error()
+				return
+			}
+			for _, row := range data {
+				if !equalValues([][]float64{row}, [][]float64{{1, 3, 2}}) &&
+					!(math.IsNaN(row[0]) && math.IsNaN(row[1]) && math.IsNaN(row[2])) {
+					errs <- fmt.Sprint("Inconsistent row: ", row)
+					return
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		h.send("t.timer:1|ms", "t.timer:3|ms")
+		h.clock.Advance(time.Minute)
+	}
+	close(done)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// replicaMirror passes the rows of a server to a replica directly.
+type replicaMirror struct {
+	replica *server.Server
+}
+
+func (m replicaMirror) Tick(typ server.MetricType, name string, ts int64, data []float64) {
+	m.replica.PutReplicaRow(typ, name, ts, data, false)
+}
+
+func (m replicaMirror) Flush(typ server.MetricType, name string, ts int64, data []float64) {
+	m.replica.PutReplicaRow(typ, name, ts, data, true)
+}
+
+// startReplica starts a replica of the server of the harness, and returns
+// it along with its clock and a function stopping it.
+func (h *testHarness) startReplica() (*server.Server, *clock.Manual, func()) {
+	// The replica lags behind by its delay, so it starts at the same tick
+	rclock := clock.NewManual(time.Unix(h.start+server.DefaultReplicaDelay, 0))
+	replica := &server.Server{Ds: h.ds, Clock: rclock, Replica: true}
+	if err := replica.Start(nil, nil); err != nil {
+		h.t.Fatal("Start:", err)
+	}
+	h.srv.Mirror = replicaMirror{replica}
+
+	return replica, rclock, func() { stopServer(replica, rclock) }
+}
+
+// stopServer stops a server other than the one of the harness, advancing
+// its clock until it has stopped.
+func stopServer(srv *server.Server, c *clock.Manual) {
+	done := make(chan int)
+	go func() {
+		srv.Stop()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			c.AdvanceUntil(time.Second, done)
+		}
+	}
+}
+
+func TestReplica(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+	ctx := context.Background()
+
+	replica, rclock, stop := h.startReplica()
+	defer stop()
+
+	if err := replica.Inject(&server.Metric{Name: "r.counter", Value: 1, SampleRate: 1}); err == nil {
+		t.Error("Inject into a replica should have failed")
+	}
+
+	chs := []string{"counter"}
+	h.srv.LiveLog("r.counter", chs)
+	replica.LiveLog("r.counter", chs)
+	w, err := replica.Watch(ctx, "r.counter", chs, 0, 60, "")
+	if err != nil {
+		t.Fatal("Watch:", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 60; i++ {
+		h.send("r.counter:1|c")
+		h.clock.Advance(time.Second)
+	}
+	rclock.Advance(time.Minute)
+
+	live, ts, err := h.srv.LiveLog("r.counter", chs)
+	if err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+	rlive, rts, err := replica.LiveLog("r.counter", chs)
+	if err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+	if rts != ts || !equalValues(rlive, live) || !equalValues(live[len(live)-60:len(live)-59], [][]float64{{1}}) {
+		t.Error("Incorrect replica live log:", rts, rlive[len(rlive)-3:])
+		t.Error("Expected:", ts, live[len(live)-3:])
+	}
+
+	select {
+	case row := <-w.C:
+		if !equalValues([][]float64{row}, [][]float64{{60}}) {
+			t.Error("Incorrect watcher result:", row)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for watcher")
+	}
+}
+
+func TestPromote(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+	ctx := context.Background()
+
+	replica, rclock, stop := h.startReplica()
+	defer stop()
+
+	if err := h.srv.Promote(); err == nil {
+		t.Error("Promoting a server which is not a replica should have failed")
+	}
+
+	replica.LiveLog("p.gauge", []string{"gauge"})
+	h.send("p.gauge:5|g")
+	h.clock.Advance(10 * time.Second)
+	rclock.Advance(10 * time.Second)
+	h.srv.Mirror = nil
+	if err := replica.Promote(); err != nil {
+		t.Fatal("Promote:", err)
+	}
+
+	// The gauge carries on from the last mirrored value
+	m := &server.Metric{Type: server.Counter, Name: "p.counter", Value: 1, SampleRate: 1}
+	if err := replica.Inject(m); err != nil {
+		t.Fatal("Inject:", err)
+	}
+	rclock.Advance(50 * time.Second)
+
+	live, _, err := replica.LiveLog("p.gauge", []string{"gauge"})
+	if err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+	if !equalValues(live[len(live)-1:], [][]float64{{5}}) {
+		t.Error("Incorrect live log after promotion:", live[len(live)-3:])
+	}
+	data, err := replica.Log(ctx, "p.counter", []string{"counter"}, h.start, 1, 60, "")
+	if err != nil {
+		t.Fatal("Log:", err)
+	}
+	if !equalValues(data, [][]float64{{1}}) {
+		t.Error("Incorrect result after promotion:", data)
+	}
+}
+
+func TestActiveMetrics(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+
+	h.send("a.x:1|c")
+	h.clock.Advance(10 * time.Second)
+	h.send("b.y:1|g")
+	// Watched metrics without input aren't active
+	if _, _, err := h.srv.LiveLog("c.z", []string{"gauge"}); err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+
+	a := server.ActiveMetric{Name: "a.x", Type: "counter", LastInput: h.start + 1}
+	b := server.ActiveMetric{Name: "b.y", Type: "gauge", LastInput: h.start + 11}
+	check := func(since int64, expected []server.ActiveMetric) {
+		result, err := h.srv.ActiveMetrics(since)
+		if err != nil {
+			t.Error("ActiveMetrics:", since, err)
+		} else if fmt.Sprint(result) != fmt.Sprint(expected) {
+			t.Error("Incorrect result:", since)
+			t.Error("Expected:", expected)
+			t.Error("Result:", result)
+		}
+	}
+	check(5, []server.ActiveMetric{b})
+	check(60, []server.ActiveMetric{b, a})
+	h.clock.Advance(2 * time.Minute)
+	check(60, []server.ActiveMetric{})
+	check(server.LiveLogSize, []server.ActiveMetric{b, a})
+
+	if _, err := h.srv.ActiveMetrics(server.LiveLogSize + 1); err == nil {
+		t.Error("ActiveMetrics should have failed")
+	}
+}
+
+func TestLiveLogWindow(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+
+	chs := []string{"gauge"}
+	if _, _, err := h.srv.LiveLog("w.gauge", chs); err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+	for i := 1; i <= 10; i++ {
+		h.send(fmt.Sprintf("w.gauge:%d|g", i))
+		h.clock.Advance(time.Second)
+	}
+
+	var testCases = []struct {
+		window, step int64
+		ts           int64
+		result       [][]float64
+	}{
+		{10, 1, h.start, [][]float64{{1}, {2}, {3}, {4}, {5}, {6}, {7}, {8}, {9}, {10}}},
+		{3, 1, h.start + 7, [][]float64{{8}, {9}, {10}}},
+		{10, 3, h.start + 3, [][]float64{{4}, {7}, {10}}},
+		{10, 10, h.start + 9, [][]float64{{10}}},
+	}
+	for _, tc := range testCases {
+		result, ts, err := h.srv.LiveLogWindow("w.gauge", chs, tc.window, tc.step)
+		if err != nil {
+			t.Error("LiveLogWindow:", tc.window, tc.step, err)
+		} else if ts != tc.ts || !equalValues(result, tc.result) {
+			t.Error("Incorrect result:", tc.window, tc.step)
+			t.Error("Expected:", tc.ts, tc.result)
+			t.Error("Result:", ts, result)
+		}
+	}
+
+	for _, p := range [][2]int64{{0, 1}, {server.LiveLogSize + 1, 1}, {10, 0}, {10, 11}} {
+		if _, _, err := h.srv.LiveLogWindow("w.gauge", chs, p[0], p[1]); err == nil {
+			t.Error("LiveLogWindow should have failed:", p)
+		}
+	}
+}
+
+func TestTCPReply(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+
+	ti := &TCPInjector{Addr: "127.0.0.1:0", Server: h.srv, Reply: true}
+	if err := ti.Start(); err != nil {
+		t.Fatal("TCPInjector.Start:", err)
+	}
+	defer ti.Stop()
+	conn, err := net.Dial("tcp", ti.listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer conn.Close()
+
+	long := "a" + strings.Repeat("b", TcpMsgMaxSize) + ":1|c"
+	if _, err := conn.Write([]byte("t.a:1|c\nt.b:1|x\n\n" + long + "\nt/c:1|g\nt.d:1:2|ms\n")); err != nil {
+		t.Fatal("Write:", err)
+	}
+
+	expected := []string{
+		"ok 1",
+		"error 2 Metric type invalid",
+		"error 4 Line too long",
+		"error 5 Invalid characters in metric name",
+		"ok 6",
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	sc := bufio.NewScanner(conn)
+	for _, e := range expected {
+		if !sc.Scan() {
+			t.Fatal("Reading replies:", sc.Err())
+		}
+		if sc.Text() != e {
+			t.Error("Incorrect result:", sc.Text())
+			t.Error("Expected:", e)
+		}
+	}
+}
+
+func TestFailingDatastore(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+	ctx := context.Background()
+
+	ds := &datastore.ChaosDatastore{
+		Ds:                h.ds,
+		InsertChaos:       datastore.Chaos{Latency: 10 * time.Millisecond, ErrorRate: 1},
+		QueryChaos:        datastore.Chaos{ErrorRate: 1},
+		LatestBeforeChaos: datastore.Chaos{ErrorRate: 1},
+	}
+	c := clock.NewManual(time.Unix(h.start, 0))
+	srv := &server.Server{Ds: ds, Clock: c}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal("Start:", err)
+	}
+	defer stopServer(srv, c)
+
+	// The live log keeps working without the datastore
+	chs := []string{"counter"}
+	if _, _, err := srv.LiveLog("f.counter", chs); err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+	srv.InjectBytes([]byte("f.counter:1|c\nf.counter:2|c"))
+	c.Advance(time.Minute)
+
+	live, _, err := srv.LiveLog("f.counter", chs)
+	if err != nil {
+		t.Error("LiveLog:", err)
+	} else if !equalValues(live[len(live)-60:len(live)-59], [][]float64{{3}}) {
+		t.Error("Incorrect live log:", live[len(live)-60:len(live)-59])
+	}
+
+	if _, err := srv.Log(ctx, "f.counter", chs, h.start, 1, 60, ""); err != datastore.ErrChaos {
+		t.Error("Log should have failed:", err)
+	}
+	if _, err := srv.Watch(ctx, "f.counter", chs, 0, 60, ""); err != datastore.ErrChaos {
+		t.Error("Watch should have failed:", err)
+	}
+	if u := srv.Usage(); u.Inserted != 0 {
+		t.Error("Nothing should have been inserted:", u.Inserted)
+	}
+}
+
+// TestWatcherClose closes watchers while the server is sending them rows,
+// and after the server has ended them by stopping. Run it with -race.
+func TestWatcherClose(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+	ctx := context.Background()
+
+	c := clock.NewManual(time.Unix(h.start, 0))
+	srv := &server.Server{Ds: h.ds, Clock: c}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal("Start:", err)
+	}
+
+	chs := []string{"counter"}
+	var watchers []*server.Watcher
+	for i := 0; i < 20; i++ {
+		w, err := srv.LiveWatch("wc.counter", chs)
+		if err != nil {
+			t.Fatal("LiveWatch:", err)
+		}
+		watchers = append(watchers, w)
+		if w, err = srv.Watch(ctx, "wc.counter", chs, 0, 60, ""); err != nil {
+			t.Fatal("Watch:", err)
+		}
+		watchers = append(watchers, w)
+	}
+
+	// Half of them are closed while rows are sent, the rest only read
+	var wg sync.WaitGroup
+	for i, w := range watchers {
+		wg.Add(1)
+		go func(w *server.Watcher, close bool) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				if _, ok := <-w.C; !ok {
+					return
+				}
+				if close && n == 5 {
+					w.Close()
+				}
+			}
+		}(w, i%2 == 0)
+	}
+	for i := 0; i < 90; i++ {
+		srv.InjectBytes([]byte("wc.counter:1|c"))
+		c.Advance(time.Second)
+	}
+
+	stopServer(srv, c)
+	wg.Wait()
+	for i, w := range watchers {
+		w.Close()
+		if err := w.Err(); (err == nil) != (i%2 == 0) {
+			t.Error("Incorrect watcher error:", i, err)
+		}
+	}
+}
+
+func TestTickWorkers(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+
+	c := clock.NewManual(time.Unix(h.start, 0))
+	srv := &server.Server{Ds: h.ds, Clock: c, TickWorkers: 3}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal("Start:", err)
+	}
+	defer stopServer(srv, c)
+
+	chs := []string{"counter"}
+	for i := 0; i < 10; i++ {
+		if _, _, err := srv.LiveLog(fmt.Sprintf("tw.%d", i), chs); err != nil {
+			t.Fatal("LiveLog:", err)
+		}
+		srv.InjectBytes([]byte(fmt.Sprintf("tw.%d:%d|c", i, i)))
+	}
+	c.Advance(2 * time.Second)
+
+	for i := 0; i < 10; i++ {
+		live, _, err := srv.LiveLog(fmt.Sprintf("tw.%d", i), chs)
+		if err != nil {
+			t.Fatal("LiveLog:", err)
+		}
+		if result := live[len(live)-2:]; !equalValues(result, [][]float64{{float64(i)}, {0}}) {
+			t.Error("Incorrect result:", i)
+			t.Error("Result:", result)
+		}
+	}
+	if u := srv.Usage(); u.TickTime < 0 || u.MaxTickTime < u.TickTime {
+		t.Error("Incorrect tick times:", u.TickTime, u.MaxTickTime)
+	}
+}
+
+func TestFlushSpread(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+	ctx := context.Background()
+
+	c := clock.NewManual(time.Unix(h.start, 0))
+	srv := &server.Server{Ds: h.ds, Clock: c, FlushSpread: 30}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal("Start:", err)
+	}
+	defer stopServer(srv, c)
+
+	chs := []string{"counter"}
+	stored := func() int {
+		n := 0
+		for i := 0; i < 5; i++ {
+			r, err := h.ds.Query(ctx, fmt.Sprintf("fs.%d:counter", i), h.start, h.start+60)
+			if err != nil {
+				t.Fatal("Query:", err)
+			}
+			n += len(r)
+		}
+		return n
+	}
+
+	for i := 0; i < 5; i++ {
+		srv.InjectBytes([]byte(fmt.Sprintf("fs.%d:%d|c", i, i+1)))
+	}
+	c.Advance(time.Minute)
+	if n := stored(); n == 5 {
+		t.Error("Every row was inserted at the end of the minute")
+	}
+	// Queries of the server see the rows not yet inserted
+	for i := 0; i < 5; i++ {
+		result, err := srv.Log(ctx, fmt.Sprintf("fs.%d", i), chs, h.start, 1, 60, "")
+		if err != nil {
+			t.Fatal("Log:", err)
+		} else if !equalValues(result, [][]float64{{float64(i + 1)}}) {
+			t.Error("Incorrect result:", i)
+			t.Error("Result:", result)
+		}
+	}
+
+	c.Advance(30 * time.Second)
+	if n := stored(); n != 5 {
+		t.Error("Rows not inserted after 30 seconds:", n)
+	}
+}
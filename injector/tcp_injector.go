@@ -1,16 +1,27 @@
-package main
+package injector
 
 import (
+	"bufio"
+	"github.com/adatboss/statsd/server"
 	"log"
 	"net"
+	"strconv"
 	"sync"
 )
 
 const TcpMsgMaxSize = 128
 
+// ErrLineTooLong is reported for lines longer than TcpMsgMaxSize.
+const ErrLineTooLong = Error("Line too long")
+
+// TCPInjector receives metrics over TCP, one per line. If Reply is set,
+// every line is answered with "ok <n>" or "error <n> <reason>", where n is
+// the number of the line within the connection starting from 1, so clients
+// can tell which metrics were rejected. Empty lines aren't answered.
 type TCPInjector struct {
 	Addr     string
-	Server   *Server
+	Server   *server.Server
+	Reply    bool
 	mu, cmu  sync.Mutex
 	listener *net.TCPListener
 	conns    []*net.TCPConn
@@ -79,22 +90,32 @@ func (ti *TCPInjector) run() {
 
 func (ti *TCPInjector) serve(conn *net.TCPConn, i int) {
 	buff, bsize, drop := make([]byte, TcpMsgMaxSize), 0, false
+	w, line := bufio.NewWriter(conn), 0
 	for {
 		n, err := conn.Read(buff[bsize:])
 		if n > 0 {
 			bsize += n
 			for i := 0; i < bsize; i++ {
 				if buff[i] == '\n' {
-					if !drop {
+					line++
+					if drop {
+						ti.reply(w, line, ErrLineTooLong)
+					} else if !ti.Reply {
 						ti.Server.InjectBytes(buff[0:i])
+					} else if i > 0 {
+						ti.reply(w, line, ti.Server.InjectLine(buff[0:i]))
 					}
 					bsize = copy(buff[0:], buff[i+1:bsize])
-					i, drop = 0, false
+					i, drop = -1, false
 				}
 			}
 			if bsize == len(buff) {
 				drop, bsize = true, 0
 			}
+			if ferr := w.Flush(); ferr != nil {
+				log.Println("TCPConn.Write:", ferr)
+				break
+			}
 		}
 		if err != nil {
 			log.Println("TCPConn.Read:", err)
@@ -107,3 +128,14 @@ func (ti *TCPInjector) serve(conn *net.TCPConn, i int) {
 	ti.cmu.Unlock()
 	ti.wg.Done()
 }
+
+func (ti *TCPInjector) reply(w *bufio.Writer, line int, err error) {
+	if !ti.Reply {
+		return
+	}
+	if err == nil {
+		w.WriteString("ok " + strconv.Itoa(line) + "\n")
+	} else {
+		w.WriteString("error " + strconv.Itoa(line) + " " + err.Error() + "\n")
+	}
+}
@@ -0,0 +1,106 @@
+package injector
+
+import (
+	"bufio"
+	"github.com/adatboss/statsd/server"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var DropsInterval = 10 * time.Second
+
+// reportDrops periodically injects the number of packets the kernel has
+// dropped on the sockets of the injector since the last report, until quit
+// is closed.
+func (ui *UDPInjector) reportDrops(quit <-chan int) {
+	defer ui.wg.Done()
+
+	ports := make(map[int]bool)
+	for _, conn := range ui.conns {
+		ports[conn.LocalAddr().(*net.UDPAddr).Port] = true
+	}
+
+	ticker := time.NewTicker(DropsInterval)
+	defer ticker.Stop()
+
+	var last int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		drops, err := readUDPDrops(ports)
+		if err != nil {
+			log.Println("UDPInjector.reportDrops:", err)
+			return
+		}
+		if drops > last {
+			err = ui.Server.Inject(&server.Metric{
+				Name:       ui.DropsMetric,
+				Type:       server.Counter,
+				Value:      float64(drops - last),
+				SampleRate: 1,
+			})
+			if err != nil {
+				log.Println("UDPInjector.reportDrops:", err)
+			}
+		}
+		last = drops
+	}
+}
+
+// readUDPDrops sums the drop counters of the sockets bound to the given
+// ports from /proc/net/udp and /proc/net/udp6. It only works on Linux.
+func readUDPDrops(ports map[int]bool) (int64, error) {
+	var sum int64
+	for _, fn := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(fn)
+		if os.IsNotExist(err) && fn == "/proc/net/udp6" {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		n, err := parseUDPDrops(f, ports)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		sum += n
+	}
+	return sum, nil
+}
+
+func parseUDPDrops(r io.Reader, ports map[int]bool) (int64, error) {
+	var sum int64
+	sc := bufio.NewScanner(r)
+	for first := true; sc.Scan(); first = false {
+		fields := strings.Fields(sc.Text())
+		if first || len(fields) < 13 {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i == -1 {
+			return 0, Error("Invalid local address: " + fields[1])
+		}
+		port, err := strconv.ParseInt(fields[1][i+1:], 16, 32)
+		if err != nil {
+			return 0, err
+		}
+		if !ports[int(port)] {
+			continue
+		}
+		drops, err := strconv.ParseInt(fields[12], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		sum += drops
+	}
+	return sum, sc.Err()
+}
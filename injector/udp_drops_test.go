@@ -0,0 +1,67 @@
+package injector
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testProcNetUDP = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:1770 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 11111 2 0000000000000000 5
+  124: 00000000:1770 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 11112 2 0000000000000000 7
+  125: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 11113 2 0000000000000000 100
+`
+
+func TestParseUDPDrops(t *testing.T) {
+	var testCases = []struct {
+		ports map[int]bool
+		drops int64
+	}{
+		{map[int]bool{}, 0},
+		{map[int]bool{6000: true}, 12},
+		{map[int]bool{53: true}, 100},
+		{map[int]bool{53: true, 6000: true}, 112},
+		{map[int]bool{6001: true}, 0},
+	}
+
+	for _, tc := range testCases {
+		drops, err := parseUDPDrops(strings.NewReader(testProcNetUDP), tc.ports)
+		if err != nil {
+			t.Error("Error:", tc.ports, err)
+		} else if drops != tc.drops {
+			t.Error("Incorrect result:", tc.ports)
+			t.Error("Expected:", tc.drops)
+			t.Error("Result:", drops)
+		}
+	}
+}
+
+func TestUDPInjectorReportDrops(t *testing.T) {
+	h := newTestHarness(t, "127.0.0.1:0", 1)
+	defer h.close()
+
+	defer func(d time.Duration) { DropsInterval = d }(DropsInterval)
+	DropsInterval = time.Millisecond
+
+	// Stopped while the reporter is busy, and started again
+	for i := 0; i < 3; i++ {
+		ui := &UDPInjector{Addr: "127.0.0.1:0", Server: h.srv, DropsMetric: "udp.drops"}
+		if err := ui.Start(); err != nil {
+			t.Fatal("Start:", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		done := make(chan error)
+		go func() {
+			done <- ui.Stop()
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error("Stop:", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Stop hangs")
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package injector
+
+import (
+	"github.com/adatboss/statsd/server"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const UdpMsgMaxSize = 512
+
+// UDPInjector listens on one or more UDP addresses. Addr is a comma
+// separated list, e.g. "0.0.0.0:6000,[::1]:6000".
+//
+// If Sockets is greater than 1, that many sockets are bound to each address
+// with SO_REUSEPORT (Linux only), so the kernel spreads the packets among
+// them. Each socket is then served by its own worker on a dedicated thread.
+//
+// ReadBuffer sets the receive buffer size of the sockets (SO_RCVBUF) if it
+// is positive. If DropsMetric is set, the number of packets dropped by the
+// kernel is injected as a counter with that name every DropsInterval.
+type UDPInjector struct {
+	Addr        string
+	Server      *server.Server
+	Sockets     int
+	ReadBuffer  int
+	DropsMetric string
+	mu          sync.Mutex
+	conns       []*net.UDPConn
+	running     bool
+	wg          sync.WaitGroup
+	quit        chan int
+}
+
+func (ui *UDPInjector) Start() error {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	if ui.running {
+		return Error("Injector already running")
+	}
+
+	var conns []*net.UDPConn
+	for _, a := range strings.Split(ui.Addr, ",") {
+		a = strings.TrimSpace(a)
+		if ui.Sockets > 1 {
+			c, err := listenUDPReusePortN(a, ui.Sockets)
+			conns = append(conns, c...)
+			if err != nil {
+				closeUDPConns(conns)
+				return err
+			}
+			continue
+		}
+		conn, err := listenUDP(a)
+		if err != nil {
+			closeUDPConns(conns)
+			return err
+		}
+		conns = append(conns, conn)
+	}
+
+	if ui.ReadBuffer > 0 {
+		for _, conn := range conns {
+			if err := conn.SetReadBuffer(ui.ReadBuffer); err != nil {
+				closeUDPConns(conns)
+				return err
+			}
+		}
+	}
+
+	ui.conns, ui.running = conns, true
+
+	if len(ui.DropsMetric) > 0 {
+		ui.quit = make(chan int)
+		ui.wg.Add(1)
+		go ui.reportDrops(ui.quit)
+	}
+
+	for _, conn := range conns {
+		if ui.Sockets > 1 {
+			ui.wg.Add(1)
+			go ui.work(conn)
+		} else {
+			go ui.run(conn)
+		}
+	}
+	return nil
+}
+
+// listenUDPReusePortN binds n sockets to the same address. If the port is
+// chosen by the system, the later sockets reuse the port of the first one.
+func listenUDPReusePortN(a string, n int) ([]*net.UDPConn, error) {
+	conns := make([]*net.UDPConn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := listenUDPReusePort(a)
+		if err != nil {
+			return conns, err
+		}
+		if i == 0 {
+			a = conn.LocalAddr().String()
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+func closeUDPConns(conns []*net.UDPConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func listenUDP(a string) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", a)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+func (ui *UDPInjector) Stop() error {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	if !ui.running {
+		return Error("Injector not running")
+	}
+
+	ui.running = false
+	closeUDPConns(ui.conns)
+	if ui.quit != nil {
+		close(ui.quit)
+	}
+	ui.wg.Wait()
+	ui.quit = nil
+	return nil
+}
+
+// LocalAddrs returns the addresses the injector is listening on, which
+// differ from Addr if the ports were chosen by the system.
+func (ui *UDPInjector) LocalAddrs() []net.Addr {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	if !ui.running {
+		return nil
+	}
+	addrs := make([]net.Addr, len(ui.conns))
+	for i, conn := range ui.conns {
+		addrs[i] = conn.LocalAddr()
+	}
+	return addrs
+}
+
+func (ui *UDPInjector) run(conn *net.UDPConn) {
+	for {
+		buff := make([]byte, UdpMsgMaxSize)
+		n, err := conn.Read(buff)
+		if n > 0 {
+			ui.wg.Add(1)
+			go func() {
+				ui.Server.InjectBytes(buff[0:n])
+				ui.wg.Done()
+			}()
+		}
+		if err != nil {
+			log.Println("UDPConn.Read:", err)
+			break
+		}
+	}
+}
+
+// work serves a single socket, injecting each packet before reading the
+// next one.
+func (ui *UDPInjector) work(conn *net.UDPConn) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer ui.wg.Done()
+
+	buff := make([]byte, UdpMsgMaxSize)
+	for {
+		n, err := conn.Read(buff)
+		if n > 0 {
+			ui.Server.InjectBytes(buff[0:n])
+		}
+		if err != nil {
+			log.Println("UDPConn.Read:", err)
+			break
+		}
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le
+
+package injector
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// The syscall package doesn't define SO_REUSEPORT on every architecture.
+// Its value is the same everywhere but on MIPS.
+const soReusePort = 0xf
+
+func listenUDPReusePort(a string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", a)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
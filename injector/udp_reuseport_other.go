@@ -0,0 +1,11 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package injector
+
+import (
+	"net"
+)
+
+func listenUDPReusePort(a string) (*net.UDPConn, error) {
+	return nil, Error("SO_REUSEPORT is only supported on Linux")
+}
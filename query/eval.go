@@ -0,0 +1,235 @@
+package query
+
+import (
+	"context"
+	"math"
+	"strconv"
+)
+
+// Source provides the series selected by an expression. It is implemented
+// by *server.Server.
+type Source interface {
+	Log(ctx context.Context, name string, chs []string, from, length, gran int64, aggr string) ([][]float64, error)
+}
+
+// Expr is a parsed expression.
+type Expr interface {
+	String() string
+	eval(ctx context.Context, src Source, w window) ([]float64, error)
+}
+
+// MaxLength is the maximum number of intervals an expression is evaluated
+// for, including the ones the windows of its functions reach back.
+var MaxLength int64 = 1 << 20
+
+// window is the time range an expression is evaluated for.
+type window struct {
+	from, length, gran int64
+}
+
+// Eval evaluates the expression for length intervals of gran seconds
+// starting at from. Intervals without a value are NaN.
+func Eval(ctx context.Context, src Source, e Expr, from, length, gran int64) ([]float64, error) {
+	if gran < 1 {
+		return nil, Error("Granularity must be positive")
+	}
+	if length < 0 {
+		return nil, Error("Length must not be negative")
+	}
+	if length > MaxLength {
+		return nil, Error("Length too large, at most " + strconv.FormatInt(MaxLength, 10) + " intervals")
+	}
+	return e.eval(ctx, src, window{from, length, gran})
+}
+
+type numberExpr float64
+
+func (e numberExpr) String() string {
+	return strconv.FormatFloat(float64(e), 'g', -1, 64)
+}
+
+func (e numberExpr) eval(ctx context.Context, src Source, w window) ([]float64, error) {
+	values := make([]float64, w.length)
+	for i := range values {
+		values[i] = float64(e)
+	}
+	return values, nil
+}
+
+type seriesExpr struct {
+	name, ch string
+}
+
+func (e *seriesExpr) String() string {
+	return e.name + ":" + e.ch
+}
+
+func (e *seriesExpr) eval(ctx context.Context, src Source, w window) ([]float64, error) {
+	data, err := src.Log(ctx, e.name, []string{e.ch}, w.from, w.length, w.gran, "")
+	if err != nil {
+		return nil, err
+	}
+	// The log ends at the last complete interval
+	values := make([]float64, w.length)
+	for i := range values {
+		if i < len(data) {
+			values[i] = data[i][0]
+		} else {
+			values[i] = math.NaN()
+		}
+	}
+	return values, nil
+}
+
+type negExpr struct {
+	e Expr
+}
+
+func (e *negExpr) String() string {
+	return "-" + e.e.String()
+}
+
+func (e *negExpr) eval(ctx context.Context, src Source, w window) ([]float64, error) {
+	values, err := e.e.eval(ctx, src, w)
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		values[i] = -values[i]
+	}
+	return values, nil
+}
+
+type binaryExpr struct {
+	op   byte
+	l, r Expr
+}
+
+func (e *binaryExpr) String() string {
+	return "(" + e.l.String() + " " + string(e.op) + " " + e.r.String() + ")"
+}
+
+func (e *binaryExpr) eval(ctx context.Context, src Source, w window) ([]float64, error) {
+	l, err := e.l.eval(ctx, src, w)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.r.eval(ctx, src, w)
+	if err != nil {
+		return nil, err
+	}
+	for i := range l {
+		switch e.op {
+		case '+':
+			l[i] += r[i]
+		case '-':
+			l[i] -= r[i]
+		case '*':
+			l[i] *= r[i]
+		case '/':
+			l[i] /= r[i]
+		}
+	}
+	return l, nil
+}
+
+type function struct {
+	duration bool
+	eval     func(e *callExpr, ctx context.Context, src Source, w window) ([]float64, error)
+}
+
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"rate":  {false, evalRate},
+		"shift": {true, evalShift},
+		"avg":   {true, evalWindow},
+		"sum":   {true, evalWindow},
+		"min":   {true, evalWindow},
+		"max":   {true, evalWindow},
+	}
+}
+
+type callExpr struct {
+	fn  string
+	arg Expr
+	d   int64
+}
+
+func (e *callExpr) String() string {
+	if !functions[e.fn].duration {
+		return e.fn + "(" + e.arg.String() + ")"
+	}
+	return e.fn + "(" + e.arg.String() + ", " + strconv.FormatInt(e.d, 10) + "s)"
+}
+
+func (e *callExpr) eval(ctx context.Context, src Source, w window) ([]float64, error) {
+	return functions[e.fn].eval(e, ctx, src, w)
+}
+
+// evalRate turns the values of intervals into values per second.
+func evalRate(e *callExpr, ctx context.Context, src Source, w window) ([]float64, error) {
+	values, err := e.arg.eval(ctx, src, w)
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		values[i] /= float64(w.gran)
+	}
+	return values, nil
+}
+
+// evalShift returns the values from d seconds earlier.
+func evalShift(e *callExpr, ctx context.Context, src Source, w window) ([]float64, error) {
+	if e.d%w.gran != 0 {
+		return nil, Error("Shift must be a multiple of the granularity: " + e.String())
+	}
+	return e.arg.eval(ctx, src, window{w.from - e.d, w.length, w.gran})
+}
+
+// evalWindow aggregates the values of the last d seconds of every
+// interval, skipping unknown values.
+func evalWindow(e *callExpr, ctx context.Context, src Source, w window) ([]float64, error) {
+	if e.d <= 0 || e.d%w.gran != 0 {
+		return nil, Error("Window must be a positive multiple of the granularity: " + e.String())
+	}
+	if e.d/w.gran > MaxLength-w.length {
+		return nil, Error("Window too large: " + e.String())
+	}
+	n := int(e.d / w.gran)
+	values, err := e.arg.eval(ctx, src, window{w.from - int64(n-1)*w.gran, w.length + int64(n-1), w.gran})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]float64, w.length)
+	for i := range result {
+		acc, cnt := 0.0, 0
+		for _, v := range values[i : i+n] {
+			if math.IsNaN(v) {
+				continue
+			}
+			switch {
+			case cnt == 0:
+				acc = v
+			case e.fn == "min":
+				acc = math.Min(acc, v)
+			case e.fn == "max":
+				acc = math.Max(acc, v)
+			default:
+				acc += v
+			}
+			cnt++
+		}
+		switch {
+		case cnt == 0:
+			result[i] = math.NaN()
+		case e.fn == "avg":
+			result[i] = acc / float64(cnt)
+		default:
+			result[i] = acc
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,289 @@
+// Package query implements a small expression language over the archived
+// series of a server, e.g.
+//
+//	avg(rate(web.requests:counter), 5m) * 2
+//	fe1.lat:timer-max - shift(fe1.lat:timer-max, 1w)
+//
+// A series is selected by metric name and channel separated by a colon.
+// Series and numbers can be combined with + - * / interval by interval.
+// Since metric and channel names may contain dashes, a subtraction
+// following a name has to be separated by spaces.
+package query
+
+import (
+	"strconv"
+	"strings"
+)
+
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokNumber
+	tokDuration
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	pos  int
+}
+
+var durationUnits = map[byte]int64{
+	's': 1,
+	'm': 60,
+	'h': 3600,
+	'd': 86400,
+	'w': 7 * 86400,
+}
+
+func isNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == ':'
+}
+
+func lex(s string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+			continue
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", pos: i})
+			i++
+			continue
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", pos: i})
+			i++
+			continue
+		case c == ',':
+			tokens = append(tokens, token{kind: tokComma, text: ",", pos: i})
+			i++
+			continue
+		case c == '+' || c == '-' || c == '*' || c == '/':
+			tokens = append(tokens, token{kind: tokOp, text: s[i : i+1], pos: i})
+			i++
+			continue
+		case !isNameChar(c):
+			return nil, Error("Invalid character at " + strconv.Itoa(i) + ": " + strconv.Quote(s[i:i+1]))
+		}
+
+		// A dash continues a name only if it is not a number so far, so
+		// that 2-1 is a subtraction while timer-max is a channel.
+		j, numeric := i, true
+		for j < len(s) {
+			if isNameChar(s[j]) {
+				if (s[j] < '0' || s[j] > '9') && s[j] != '.' {
+					numeric = false
+				}
+			} else if s[j] != '-' || numeric || j+1 == len(s) || !isNameChar(s[j+1]) {
+				break
+			}
+			j++
+		}
+		tok, err := classify(s[i:j], i)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		i = j
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(s)}), nil
+}
+
+func classify(text string, pos int) (token, error) {
+	if v, err := strconv.ParseFloat(text, 64); err == nil {
+		return token{kind: tokNumber, text: text, num: v, pos: pos}, nil
+	}
+	if _, ok := durationUnits[text[len(text)-1]]; ok {
+		if d, err := ParseDuration(text); err == nil {
+			return token{kind: tokDuration, text: text, num: float64(d), pos: pos}, nil
+		}
+	}
+	return token{kind: tokName, text: text, pos: pos}, nil
+}
+
+// ParseDuration parses a number of seconds with an optional unit, one of
+// s, m, h, d and w, e.g. 90, 5m or -7d.
+func ParseDuration(s string) (int64, error) {
+	n, unit := s, int64(1)
+	if len(s) > 0 {
+		if u, ok := durationUnits[s[len(s)-1]]; ok {
+			n, unit = s[:len(s)-1], u
+		}
+	}
+	v, err := strconv.ParseInt(n, 10, 64)
+	if err != nil {
+		return 0, Error("Invalid duration: " + s)
+	}
+	return v * unit, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses an expression.
+func Parse(s string) (Expr, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.unexpected(tok)
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) unexpected(tok token) error {
+	if tok.kind == tokEOF {
+		return Error("Unexpected end of expression")
+	}
+	return Error("Unexpected " + strconv.Quote(tok.text) + " at " + strconv.Itoa(tok.pos))
+}
+
+func (p *parser) expect(kind tokenKind) error {
+	if tok := p.next(); tok.kind != kind {
+		return p.unexpected(tok)
+	}
+	return nil
+}
+
+func (p *parser) parseExpr() (Expr, error) {
+	l, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokOp && (tok.text == "+" || tok.text == "-"); tok = p.peek() {
+		p.next()
+		r, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: tok.text[0], l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseTerm() (Expr, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokOp && (tok.text == "*" || tok.text == "/"); tok = p.peek() {
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: tok.text[0], l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == "-" {
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negExpr{e}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		return numberExpr(tok.num), nil
+	case tokLParen:
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRParen); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case tokName:
+		if p.peek().kind == tokLParen {
+			return p.parseCall(tok)
+		}
+		i := strings.IndexByte(tok.text, ':')
+		if i <= 0 || i == len(tok.text)-1 || strings.IndexByte(tok.text[i+1:], ':') != -1 {
+			return nil, Error("Invalid series at " + strconv.Itoa(tok.pos) + ": " + tok.text)
+		}
+		return &seriesExpr{name: tok.text[:i], ch: tok.text[i+1:]}, nil
+	}
+	return nil, p.unexpected(tok)
+}
+
+func (p *parser) parseCall(name token) (Expr, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, Error("Unknown function: " + name.text)
+	}
+	p.next()
+
+	arg, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	call := &callExpr{fn: name.text, arg: arg}
+	if fn.duration {
+		if err := p.expect(tokComma); err != nil {
+			return nil, err
+		}
+		neg := false
+		if tok := p.peek(); tok.kind == tokOp && tok.text == "-" {
+			p.next()
+			neg = true
+		}
+		tok := p.next()
+		if tok.kind != tokDuration {
+			return nil, Error(name.text + " expects a duration like 5m as its second argument")
+		}
+		call.d = int64(tok.num)
+		if neg {
+			call.d = -call.d
+		}
+	}
+	if err := p.expect(tokRParen); err != nil {
+		return nil, err
+	}
+	return call, nil
+}
@@ -0,0 +1,142 @@
+package query
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	var testCases = []struct {
+		expr   string
+		result string
+	}{
+		{"a.b:counter", "a.b:counter"},
+		{"avg(rate(web.requests:counter),5m)", "avg(rate(web.requests:counter), 300s)"},
+		{"a:timer-max - b:timer-min", "(a:timer-max - b:timer-min)"},
+		{"1+2*3", "(1 + (2 * 3))"},
+		{"(1+2)*3", "((1 + 2) * 3)"},
+		{"2-1-1", "((2 - 1) - 1)"},
+		{"-a:gauge/1e-3", "(-a:gauge / 0.001)"},
+		{"shift(a:gauge, -1w)", "shift(a:gauge, -604800s)"},
+		{"max(a-1.b_2:avg, 2h)", "max(a-1.b_2:avg, 7200s)"},
+	}
+
+	for _, tc := range testCases {
+		e, err := Parse(tc.expr)
+		if err != nil {
+			t.Error("Parse:", tc.expr, err)
+		} else if e.String() != tc.result {
+			t.Error("Incorrect result:", tc.expr)
+			t.Error("Expected:", tc.result)
+			t.Error("Result:", e.String())
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	var testCases = []string{
+		"",
+		"a.b",
+		"a:b:c",
+		"a:gauge +",
+		"(a:gauge",
+		"a:gauge)",
+		"foo(a:gauge)",
+		"avg(a:gauge)",
+		"avg(a:gauge, 5)",
+		"rate(a:gauge, 5m)",
+		"5m",
+		"a:gauge # 1",
+	}
+
+	for _, expr := range testCases {
+		if _, err := Parse(expr); err == nil {
+			t.Error("Expected error:", expr)
+		}
+	}
+}
+
+// testSource returns the timestamp of every interval divided by 60 as the
+// value of a:gauge, and nothing else.
+type testSource struct{}
+
+func (testSource) Log(ctx context.Context, name string, chs []string, from, length, gran int64, aggr string) ([][]float64, error) {
+	if name != "a" || chs[0] != "gauge" {
+		return nil, Error("Unknown series")
+	}
+	data := make([][]float64, length)
+	for i := range data {
+		data[i] = []float64{float64(from/60 + int64(i))}
+	}
+	return data, nil
+}
+
+func TestEval(t *testing.T) {
+	var testCases = []struct {
+		expr   string
+		result []float64
+	}{
+		{"a:gauge", []float64{10, 11, 12}},
+		{"a:gauge * 2 - 1", []float64{19, 21, 23}},
+		{"rate(a:gauge)", []float64{10.0 / 60, 11.0 / 60, 12.0 / 60}},
+		{"shift(a:gauge, 2m)", []float64{8, 9, 10}},
+		{"a:gauge - shift(a:gauge, -1m)", []float64{-1, -1, -1}},
+		{"sum(a:gauge, 3m)", []float64{27, 30, 33}},
+		{"avg(a:gauge, 2m)", []float64{9.5, 10.5, 11.5}},
+		{"min(a:gauge, 3m) + max(a:gauge, 1m)", []float64{18, 20, 22}},
+		{"a:gauge / 0 * 0", []float64{math.NaN(), math.NaN(), math.NaN()}},
+	}
+
+	for _, tc := range testCases {
+		e, err := Parse(tc.expr)
+		if err != nil {
+			t.Error("Parse:", tc.expr, err)
+			continue
+		}
+		result, err := Eval(context.Background(), testSource{}, e, 600, 3, 60)
+		if err != nil {
+			t.Error("Eval:", tc.expr, err)
+			continue
+		}
+		ok := len(result) == len(tc.result)
+		for i := 0; ok && i < len(result); i++ {
+			ok = result[i] == tc.result[i] || math.IsNaN(result[i]) && math.IsNaN(tc.result[i])
+		}
+		if !ok {
+			t.Error("Incorrect result:", tc.expr)
+			t.Error("Expected:", tc.result)
+			t.Error("Result:", result)
+		}
+	}
+
+	for _, expr := range []string{"b:gauge", "shift(a:gauge, 30s)", "avg(a:gauge, 90s)"} {
+		e, err := Parse(expr)
+		if err != nil {
+			t.Error("Parse:", expr, err)
+		} else if _, err := Eval(context.Background(), testSource{}, e, 600, 3, 60); err == nil {
+			t.Error("Expected error:", expr)
+		}
+	}
+	// Too many intervals, e.g. /q?expr=1&from=0&length=10000000000
+	var largeCases = []struct {
+		expr   string
+		length int64
+	}{
+		{"1", 10000000000},
+		{"1", MaxLength + 1},
+		{"sum(a:gauge, 600000000m)", 3},
+		{"avg(a:gauge, 2m)", MaxLength},
+	}
+	for _, tc := range largeCases {
+		e, err := Parse(tc.expr)
+		if err != nil {
+			t.Error("Parse:", tc.expr, err)
+		} else if _, err := Eval(context.Background(), testSource{}, e, 600, tc.length, 60); err == nil {
+			t.Error("Expected error:", tc.expr, tc.length)
+		}
+	}
+	if r, err := Eval(context.Background(), testSource{}, numberExpr(1), 600, MaxLength, 60); err != nil || int64(len(r)) != MaxLength {
+		t.Error("Incorrect result at the maximum length:", len(r), err)
+	}
+}
@@ -0,0 +1,271 @@
+// Package redismirror mirrors the rows of a server into a Redis stream, so
+// that replica servers sharing its datastore can serve the live log and
+// watchers of its metrics, see server.Mirror.
+package redismirror
+
+import (
+	"context"
+	"github.com/adatboss/statsd/server"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultStream = "statsd:rows"
+
+	// Every server appends a row per metric per second, so the stream is
+	// trimmed to roughly this many entries
+	DefaultMaxLen = 1000000
+
+	// Rows produced while this many are waiting to be sent are dropped
+	publisherQueueSize = 100000
+)
+
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
+
+type row struct {
+	typ   server.MetricType
+	name  string
+	ts    int64
+	data  []float64
+	flush bool
+}
+
+func encodeRow(r *row) map[string]interface{} {
+	data := make([]string, len(r.data))
+	for i, v := range r.data {
+		data[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	flush := "0"
+	if r.flush {
+		flush = "1"
+	}
+	return map[string]interface{}{
+		"type":  strconv.Itoa(int(r.typ)),
+		"name":  r.name,
+		"ts":    strconv.FormatInt(r.ts, 10),
+		"flush": flush,
+		"data":  strings.Join(data, " "),
+	}
+}
+
+func decodeRow(values map[string]interface{}) (*row, error) {
+	str := func(key string) string {
+		s, _ := values[key].(string)
+		return s
+	}
+
+	r := &row{name: str("name"), flush: str("flush") == "1"}
+	typ, err := strconv.Atoi(str("type"))
+	if err != nil {
+		return nil, Error("Invalid row type: " + str("type"))
+	}
+	r.typ = server.MetricType(typ)
+	if r.ts, err = strconv.ParseInt(str("ts"), 10, 64); err != nil {
+		return nil, Error("Invalid row timestamp: " + str("ts"))
+	}
+	fields := strings.Fields(str("data"))
+	r.data = make([]float64, len(fields))
+	for i, f := range fields {
+		if r.data[i], err = strconv.ParseFloat(f, 64); err != nil {
+			return nil, Error("Invalid row data: " + str("data"))
+		}
+	}
+	return r, nil
+}
+
+// Publisher is a server.Mirror appending the rows to a Redis stream. The
+// rows are queued and sent in the background, those which don't fit into
+// the queue are dropped.
+type Publisher struct {
+	Addr    string
+	Stream  string
+	MaxLen  int64
+	mu      sync.Mutex
+	client  *redis.Client
+	rows    chan *row
+	dropped int64
+	running bool
+	done    chan int
+}
+
+func (p *Publisher) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running {
+		return Error("Publisher already running")
+	}
+	if p.Stream == "" {
+		p.Stream = DefaultStream
+	}
+	if p.MaxLen <= 0 {
+		p.MaxLen = DefaultMaxLen
+	}
+
+	p.client = redis.NewClient(&redis.Options{Addr: p.Addr})
+	if err := p.client.Ping(context.Background()).Err(); err != nil {
+		p.client.Close()
+		return err
+	}
+	p.rows = make(chan *row, publisherQueueSize)
+	p.done = make(chan int)
+	p.running = true
+	go p.run()
+	return nil
+}
+
+// Stop sends the queued rows and disconnects.
+func (p *Publisher) Stop() error {
+	p.mu.Lock()
+	if !p.running {
+		p.mu.Unlock()
+		return Error("Publisher not running")
+	}
+	p.running = false
+	close(p.rows)
+	p.mu.Unlock()
+
+	<-p.done
+	return p.client.Close()
+}
+
+func (p *Publisher) Tick(typ server.MetricType, name string, ts int64, data []float64) {
+	p.put(&row{typ: typ, name: name, ts: ts, data: data})
+}
+
+func (p *Publisher) Flush(typ server.MetricType, name string, ts int64, data []float64) {
+	p.put(&row{typ: typ, name: name, ts: ts, data: data, flush: true})
+}
+
+func (p *Publisher) put(r *row) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.running {
+		return
+	}
+	select {
+	case p.rows <- r:
+	default:
+		atomic.AddInt64(&p.dropped, 1)
+	}
+}
+
+func (p *Publisher) run() {
+	defer close(p.done)
+	ctx := context.Background()
+
+	for r := range p.rows {
+		pipe := p.client.Pipeline()
+		for n := len(p.rows); ; n-- {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: p.Stream,
+				MaxLen: p.MaxLen,
+				Approx: true,
+				Values: encodeRow(r),
+			})
+			if n == 0 {
+				break
+			}
+			r = <-p.rows
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Println("Publisher.run:", err)
+		}
+
+		if dropped := atomic.SwapInt64(&p.dropped, 0); dropped > 0 {
+			log.Println("Publisher.run: Queue full, dropped", dropped, "rows")
+		}
+	}
+}
+
+// Subscriber reads the rows appended to a Redis stream after it has been
+// started, and passes them to a replica server.
+type Subscriber struct {
+	Addr    string
+	Stream  string
+	Server  *server.Server
+	mu      sync.Mutex
+	client  *redis.Client
+	cancel  context.CancelFunc
+	running bool
+	done    chan int
+}
+
+func (s *Subscriber) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return Error("Subscriber already running")
+	}
+	if s.Stream == "" {
+		s.Stream = DefaultStream
+	}
+
+	s.client = redis.NewClient(&redis.Options{Addr: s.Addr})
+	if err := s.client.Ping(context.Background()).Err(); err != nil {
+		s.client.Close()
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan int)
+	s.running = true
+	go s.run(ctx)
+	return nil
+}
+
+func (s *Subscriber) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		return Error("Subscriber not running")
+	}
+	s.running = false
+	s.cancel()
+	<-s.done
+	return s.client.Close()
+}
+
+func (s *Subscriber) run(ctx context.Context) {
+	defer close(s.done)
+
+	id := "$"
+	for ctx.Err() == nil {
+		streams, err := s.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{s.Stream, id},
+			Count:   10000,
+			Block:   time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Subscriber.run:", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				id = msg.ID
+				r, err := decodeRow(msg.Values)
+				if err == nil {
+					err = s.Server.PutReplicaRow(r.typ, r.name, r.ts, r.data, r.flush)
+				}
+				if err != nil {
+					log.Println("Subscriber.run:", err)
+				}
+			}
+		}
+	}
+}
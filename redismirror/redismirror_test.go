@@ -0,0 +1,40 @@
+package redismirror
+
+import (
+	"github.com/adatboss/statsd/server"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeRow(t *testing.T) {
+	var testCases = []row{
+		{typ: server.Counter, name: "a.b", ts: 6000001, data: []float64{3}},
+		{typ: server.Gauge, name: "g", ts: 6000060, data: []float64{1.5, -2, 1e300, 0}, flush: true},
+		{typ: server.Counter, name: "c", ts: 60, data: []float64{}},
+	}
+	for _, tc := range testCases {
+		r, err := decodeRow(encodeRow(&tc))
+		if err != nil {
+			t.Error("decodeRow:", err)
+		} else if !reflect.DeepEqual(*r, tc) {
+			t.Error("Incorrect result:", tc)
+			t.Error("Result:", *r)
+		}
+	}
+
+	r, err := decodeRow(encodeRow(&row{name: "n", data: []float64{math.NaN()}}))
+	if err != nil || len(r.data) != 1 || !math.IsNaN(r.data[0]) {
+		t.Error("Incorrect NaN result:", r, err)
+	}
+
+	for _, values := range []map[string]interface{}{
+		{"type": "x", "ts": "60", "data": "1"},
+		{"type": "0", "ts": "", "data": "1"},
+		{"type": "0", "ts": "60", "data": "1 y"},
+	} {
+		if _, err := decodeRow(values); err == nil {
+			t.Error("Expected error for", values)
+		}
+	}
+}
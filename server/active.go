@@ -0,0 +1,52 @@
+package server
+
+import "sort"
+
+// ActiveMetric is a metric which has received input recently. LastInput is
+// the end of the last second with input, which may be still in progress.
+type ActiveMetric struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	LastInput int64  `json:"lastInput"`
+}
+
+// ActiveMetrics lists the metrics which have received input in the last
+// since seconds, most recent first. Idle metrics are forgotten once their
+// live log has expired, so since can't be more than LiveLogSize.
+func (srv *Server) ActiveMetrics(since int64) ([]ActiveMetric, error) {
+	if since <= 0 || since > LiveLogSize {
+		return nil, Error("Interval invalid")
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.running {
+		return nil, ErrNotRunning
+	}
+
+	r := make([]ActiveMetric, 0)
+	for typ, metrics := range srv.metrics {
+		for _, me := range metrics {
+			me.Lock()
+			am := ActiveMetric{Name: me.name, Type: metricTypes[typ].name, LastInput: me.lastInput}
+			if me.recvdInputTick {
+				am.LastInput = srv.lastTick + 1
+			}
+			me.Unlock()
+			if am.LastInput > srv.lastTick-since {
+				r = append(r, am)
+			}
+		}
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].LastInput != r[j].LastInput {
+			return r[i].LastInput > r[j].LastInput
+		}
+		if r[i].Name != r[j].Name {
+			return r[i].Name < r[j].Name
+		}
+		return r[i].Type < r[j].Type
+	})
+	return r, nil
+}
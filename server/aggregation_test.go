@@ -0,0 +1,184 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/quick"
+)
+
+// testInput is a random input of a metric over 5 minutes. Values are
+// integers and sample rates powers of two, so sums are exact.
+type testInput struct {
+	Init    float64
+	Samples []testSample
+}
+
+type testSample struct {
+	Second            int
+	Value, SampleRate float64
+}
+
+func (testInput) Generate(r *rand.Rand, size int) reflect.Value {
+	rates := []float64{1, 0.5, 0.25, 0.125}
+	sample := func(second int) testSample {
+		return testSample{second, float64(r.Intn(2001) - 1000), rates[r.Intn(len(rates))]}
+	}
+
+	in := testInput{Init: float64(r.Intn(2001) - 1000)}
+	// Every minute gets input, like the ones stored
+	for m := 0; m < 5; m++ {
+		in.Samples = append(in.Samples, sample(m*60+r.Intn(60)))
+	}
+	for i, n := 0, r.Intn(10*size+1); i < n; i++ {
+		in.Samples = append(in.Samples, sample(r.Intn(300)))
+	}
+	sort.SliceStable(in.Samples, func(i, j int) bool {
+		return in.Samples[i].Second < in.Samples[j].Second
+	})
+	return reflect.ValueOf(in)
+}
+
+// initData returns the values a metric starts with.
+func (in testInput) initData(typ MetricType) []float64 {
+	mt := metricTypes[typ]
+	data := append([]float64(nil), mt.defaults...)
+	for i := range data {
+		if mt.persist[i] {
+			data[i] = in.Init
+		}
+	}
+	return data
+}
+
+// run feeds the input to a metric of srv ticking every second, and returns the
+// rows of its ticks and of its flushes every interval seconds.
+func (in testInput) run(srv *Server, typ MetricType, interval int) (ticks, flushes [][]float64) {
+	m := metricTypes[typ].create(srv)
+	m.init(in.initData(typ))
+	j := 0
+	for s := 0; s < 300; s++ {
+		for ; j < len(in.Samples) && in.Samples[j].Second == s; j++ {
+			sample := in.Samples[j]
+			m.inject(&Metric{Type: typ, Value: sample.Value, SampleRate: sample.SampleRate})
+		}
+		ticks = append(ticks, m.tick())
+		if (s+1)%interval == 0 {
+			flushes = append(flushes, m.flush())
+		}
+	}
+	return ticks, flushes
+}
+
+// aggregate combines rows of all the channels of a metric type, like a
+// query over a longer interval.
+func aggregate(typ MetricType, init []float64, rows [][]float64) []float64 {
+	aggr := metricTypes[typ].aggregator(metricTypes[typ].channels)
+	chs := aggr.Channels()
+	pick := func(row []float64) []float64 {
+		r := make([]float64, len(chs))
+		for i, ch := range chs {
+			r[i] = row[ch]
+		}
+		return r
+	}
+	aggr.Init(pick(init))
+	for _, row := range rows {
+		aggr.Put(pick(row))
+	}
+	return aggr.Get()
+}
+
+func approxEqual(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+// Aggregating the rows of 5 minutes gives what a single flush after 5
+// minutes would. Timer quartiles are estimated from the quartiles of the
+// minutes, so only their order is checked.
+func TestAggregationIntervals(t *testing.T) {
+	for typ := MetricType(0); typ < NMetricTypes; typ++ {
+		f := func(in testInput) bool {
+			_, minutes := in.run(&Server{}, typ, 60)
+			_, whole := in.run(&Server{}, typ, 300)
+			result := aggregate(typ, in.initData(typ), minutes)
+			for i, v := range result {
+				if typ == Timer && i >= 1 && i <= 3 {
+					if !(result[i-1] <= v && v <= result[i+1]) {
+						t.Error("Timer quartiles out of order:", result)
+						return false
+					}
+				} else if !approxEqual(v, whole[0][i]) {
+					t.Error("Incorrect result:", metricTypes[typ].channels[i])
+					t.Error("Expected:", whole[0])
+					t.Error("Result:", result)
+					return false
+				}
+			}
+			return true
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Error(metricTypes[typ].name+":", err)
+		}
+	}
+}
+
+// The count of a timer is the sum of the weights of the samples, 1/rate,
+// even if only some of them are kept.
+func TestTimerCount(t *testing.T) {
+	for _, size := range []int{0, 10} {
+		f := func(in testInput) bool {
+			n := 0.0
+			for _, s := range in.Samples {
+				n += 1 / s.SampleRate
+			}
+			ticks, flushes := in.run(&Server{TimerSamples: size}, Timer, 300)
+			tn := 0.0
+			for _, row := range ticks {
+				tn += row[5]
+			}
+			return flushes[0][5] == n && tn == n
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Error("Reservoir size", size, err)
+		}
+	}
+}
+
+// The ticks of the live log add up to the minutes stored.
+func TestTicksAddUpToFlush(t *testing.T) {
+	f := func(in testInput) bool {
+		for _, typ := range []MetricType{Counter, Averager} {
+			ticks, flushes := in.run(&Server{}, typ, 60)
+			for m, row := range flushes {
+				sum, cnt := 0.0, 0.0
+				for _, tick := range ticks[m*60 : (m+1)*60] {
+					if typ == Counter {
+						sum += tick[0]
+					} else if tick[1] > 0 {
+						sum += tick[0] * tick[1]
+						cnt += tick[1]
+					}
+				}
+				if typ == Averager {
+					sum /= cnt
+				}
+				if !approxEqual(sum, row[0]) {
+					t.Error("Incorrect result:", metricTypes[typ].name, m)
+					t.Error("Expected:", row[0])
+					t.Error("Result:", sum)
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
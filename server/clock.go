@@ -0,0 +1,18 @@
+package server
+
+import (
+	"github.com/adatboss/statsd/clock"
+	"time"
+)
+
+func (srv *Server) clock() clock.Clock {
+	if srv.Clock == nil {
+		return clock.System
+	}
+	return srv.Clock
+}
+
+// Now returns the current time according to the clock of the server.
+func (srv *Server) Now() time.Time {
+	return srv.clock().Now()
+}
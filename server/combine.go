@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"math"
+	"strings"
+)
+
+// MissingPolicy tells Combine what to do with intervals of a series which
+// have no value.
+type MissingPolicy int
+
+const (
+	MissingSkip        MissingPolicy = iota // leave the series out
+	MissingZero                             // use 0 instead
+	MissingInterpolate                      // interpolate between neighbors, skip at the edges
+)
+
+func ParseMissingPolicy(s string) (MissingPolicy, error) {
+	switch s {
+	case "", "skip":
+		return MissingSkip, nil
+	case "zero":
+		return MissingZero, nil
+	case "interpolate":
+		return MissingInterpolate, nil
+	}
+	return 0, Error("Invalid missing data policy: " + s)
+}
+
+// Combine aggregates a channel of several metrics like Log, then sums
+// ("sum") or averages ("avg") the series interval by interval. Names may
+// contain * wildcards, which are matched against the stored metrics.
+func (srv *Server) Combine(ctx context.Context, names []string, ch string, from, length, gran int64, aggr, op string, missing MissingPolicy) ([][]float64, error) {
+	if op != "sum" && op != "avg" {
+		return nil, Error("Invalid operation: " + op)
+	}
+
+	names, err := srv.expandNames(names, ch)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, Error("No matching metrics")
+	}
+
+	series, n := make([][]float64, len(names)), 0
+	for i, name := range names {
+		data, err := srv.Log(ctx, name, []string{ch}, from, length, gran, aggr)
+		if err != nil {
+			return nil, err
+		}
+		series[i] = make([]float64, len(data))
+		for j, row := range data {
+			series[i][j] = row[0]
+		}
+		if missing == MissingInterpolate {
+			interpolate(series[i])
+		}
+		if len(data) > n {
+			n = len(data)
+		}
+	}
+
+	result := make([][]float64, n)
+	for j := range result {
+		sum, cnt := 0.0, 0
+		for _, s := range series {
+			v := math.NaN()
+			if j < len(s) {
+				v = s[j]
+			}
+			if math.IsNaN(v) {
+				if missing != MissingZero {
+					continue
+				}
+				v = 0
+			}
+			sum += v
+			cnt++
+		}
+		switch {
+		case cnt == 0:
+			result[j] = []float64{math.NaN()}
+		case op == "avg":
+			result[j] = []float64{sum / float64(cnt)}
+		default:
+			result[j] = []float64{sum}
+		}
+	}
+	return result, nil
+}
+
+// expandNames replaces the names containing wildcards with the names of the
+// stored metrics matching them.
+func (srv *Server) expandNames(names []string, ch string) ([]string, error) {
+	r, seen := make([]string, 0, len(names)), make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			r = append(r, name)
+		}
+	}
+
+	suffix := ":" + ch
+	for _, name := range names {
+		if !strings.Contains(name, "*") {
+			add(name)
+			continue
+		}
+		matches, err := srv.Ds.ListNames(srv.Prefix + name + suffix)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if strings.HasPrefix(m, srv.Prefix) && strings.HasSuffix(m, suffix) {
+				add(m[len(srv.Prefix) : len(m)-len(suffix)])
+			}
+		}
+	}
+	return r, nil
+}
+
+// interpolate replaces NaNs between two values with a linear interpolation.
+func interpolate(s []float64) {
+	last := -1
+	for i, v := range s {
+		if math.IsNaN(v) {
+			continue
+		}
+		if last != -1 && last < i-1 {
+			step := (v - s[last]) / float64(i-last)
+			for j := last + 1; j < i; j++ {
+				s[j] = s[last] + step*float64(j-last)
+			}
+		}
+		last = i
+	}
+}
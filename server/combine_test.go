@@ -0,0 +1,34 @@
+package server
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	nan := math.NaN()
+	var testCases = []struct {
+		in, out []float64
+	}{
+		{[]float64{}, []float64{}},
+		{[]float64{nan}, []float64{nan}},
+		{[]float64{1, 2}, []float64{1, 2}},
+		{[]float64{1, nan, 3}, []float64{1, 2, 3}},
+		{[]float64{0, nan, nan, 3}, []float64{0, 1, 2, 3}},
+		{[]float64{nan, 1, nan, 3, nan}, []float64{nan, 1, 2, 3, nan}},
+	}
+
+	for _, tc := range testCases {
+		s := append([]float64(nil), tc.in...)
+		interpolate(s)
+		ok := len(s) == len(tc.out)
+		for i := 0; ok && i < len(s); i++ {
+			ok = s[i] == tc.out[i] || math.IsNaN(s[i]) && math.IsNaN(tc.out[i])
+		}
+		if !ok {
+			t.Error("Incorrect result:", tc.in)
+			t.Error("Expected:", tc.out)
+			t.Error("Result:", s)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import "bytes"
+
+// Conformance selects quirks of the Etsy statsd implementation, so that
+// the numbers don't change when it is replaced. All of them are off by
+// default.
+type Conformance struct {
+	// Counters without a value count one, e.g. "hits:|c".
+	EmptyCounters bool
+
+	// Gauge values starting with a sign adjust the current value instead
+	// of setting it, e.g. "queue:-3|g". A gauge can't be set to a negative
+	// value directly then, only by first setting it to zero.
+	GaugeDeltas bool
+
+	// A line can hold several values of the metric separated by ':', each
+	// with its own type and sample rate, e.g. "req:1|c:250|ms".
+	MultiValue bool
+
+	// Names prefixed with the namespaces of the legacy output of Etsy's
+	// statsd are stripped of them, e.g. "stats.gauges.load" becomes "load".
+	StripLegacyNamespace bool
+}
+
+// legacyNamespaces are stripped in this order, so the longest ones are
+// tried first.
+var legacyNamespaces = []string{"stats.timers.", "stats.gauges.", "stats_counts.", "stats."}
+
+// ParseLine parses a line of input into the metrics it holds, allowing the
+// quirks enabled in c. Several values sharing a type can be packed in a
+// line, e.g. "rt:12:15:9|ms|@0.1" holds three samples of rt.
+func ParseLine(line []byte, c Conformance) ([]*Metric, error) {
+	i := bytes.IndexByte(line, ':')
+	if c == (Conformance{}) && (i == -1 || bytes.IndexByte(line[i+1:], ':') == -1) {
+		metric, err := ParseMetric(line)
+		if err != nil {
+			return nil, err
+		}
+		return []*Metric{metric}, nil
+	}
+
+	if i == -1 {
+		// Let ParseMetric report what is wrong
+		_, err := ParseMetric(line)
+		return nil, err
+	}
+	name, values := line[:i], bytes.Split(line[i+1:], []byte{':'})
+	if c.StripLegacyNamespace {
+		for _, ns := range legacyNamespaces {
+			if bytes.HasPrefix(name, []byte(ns)) && len(name) > len(ns) {
+				name = name[len(ns):]
+				break
+			}
+		}
+	}
+
+	metrics := make([]*Metric, 0, len(values))
+	for j := 0; j < len(values); {
+		// Values without a type share the one of the next value
+		k := j
+		for k < len(values)-1 && bytes.IndexByte(values[k], '|') == -1 {
+			k++
+		}
+		if k != len(values)-1 && !c.MultiValue {
+			return nil, ErrTypeInvalid
+		}
+		var typ []byte
+		if n := bytes.IndexByte(values[k], '|'); n != -1 {
+			typ = values[k][n:]
+		}
+
+		for ; j <= k; j++ {
+			v := values[j]
+			if j < k {
+				v = append(v[:len(v):len(v)], typ...)
+			} else if c.EmptyCounters && bytes.HasPrefix(v, []byte("|c")) {
+				v = append([]byte{'1'}, v...)
+			}
+			m := make([]byte, 0, len(name)+1+len(v))
+			m = append(append(append(m, name...), ':'), v...)
+			metric, err := ParseMetric(m)
+			if err != nil {
+				return nil, err
+			}
+			if c.GaugeDeltas && metric.Type == Gauge && (v[0] == '+' || v[0] == '-') {
+				metric.Delta = true
+			}
+			metrics = append(metrics, metric)
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ChannelDefault overrides the default value of a channel for the metrics
+// whose names start with Prefix; the longest matching prefix wins. New
+// metrics start with Value in persistent channels, or, if Previous is set,
+// with the last value stored before, like the channel does by default. In
+// the other channels, Value fills in the minutes missing from the
+// datastore in queries.
+type ChannelDefault struct {
+	Prefix   string
+	Channel  string
+	Value    float64
+	Previous bool
+}
+
+// ParseChannelDefault parses a channel default like "web.:gauge=0", or
+// "web.:gauge=previous" to start a persistent channel from the last stored
+// value, falling back to the default of the channel type.
+func ParseChannelDefault(s string) (ChannelDefault, error) {
+	var cd ChannelDefault
+	i, j := strings.LastIndexByte(s, ':'), strings.LastIndexByte(s, '=')
+	if i == -1 || j < i {
+		return cd, Error("Channel default must be in prefix:channel=value format")
+	}
+	cd.Prefix, cd.Channel = s[:i], s[i+1:j]
+	if err := checkChannelDefaults([]ChannelDefault{cd}); err != nil {
+		return cd, err
+	}
+
+	typ := outputChannels[cd.Channel]
+	if v := s[j+1:]; v == "previous" {
+		cd.Previous = true
+		cd.Value = metricTypes[typ].defaults[getChannelIndex(typ, cd.Channel)]
+		if err := checkChannelDefaults([]ChannelDefault{cd}); err != nil {
+			return cd, err
+		}
+	} else if f, err := strconv.ParseFloat(v, 64); err == nil {
+		cd.Value = f
+	} else {
+		return cd, Error("Invalid default value: " + v)
+	}
+	return cd, nil
+}
+
+func checkChannelDefaults(defaults []ChannelDefault) error {
+	for _, cd := range defaults {
+		typ, ok := outputChannels[cd.Channel]
+		if !ok {
+			return Error("Invalid channel: " + cd.Channel)
+		}
+		if cd.Previous && !metricTypes[typ].persist[getChannelIndex(typ, cd.Channel)] {
+			return Error("Channel has no previous value: " + cd.Channel)
+		}
+	}
+	return nil
+}
+
+// channelDefault returns the default value of a channel of a metric, and
+// whether the last stored value takes precedence.
+func (srv *Server) channelDefault(typ MetricType, name string, i int) (float64, bool) {
+	mt := metricTypes[typ]
+	if cd := srv.channelOverride(typ, name, i); cd != nil {
+		return cd.Value, cd.Previous
+	}
+	return mt.defaults[i], mt.persist[i]
+}
+
+// missingDefault returns the value filling in the minutes of a
+// non-persistent channel missing from the datastore, if it is overridden.
+func (srv *Server) missingDefault(typ MetricType, name string, i int) (float64, bool) {
+	if metricTypes[typ].persist[i] {
+		return 0, false
+	}
+	if cd := srv.channelOverride(typ, name, i); cd != nil {
+		return cd.Value, true
+	}
+	return 0, false
+}
+
+// channelOverride returns the default with the longest prefix matching
+// the channel of the metric, or nil.
+func (srv *Server) channelOverride(typ MetricType, name string, i int) *ChannelDefault {
+	var r *ChannelDefault
+	ch := metricTypes[typ].channels[i]
+	for k := range srv.Defaults {
+		cd := &srv.Defaults[k]
+		if cd.Channel == ch && (r == nil || len(cd.Prefix) > len(r.Prefix)) && strings.HasPrefix(name, cd.Prefix) {
+			r = cd
+		}
+	}
+	return r
+}
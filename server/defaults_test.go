@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/adatboss/statsd/datastore"
+	"math"
+	"testing"
+)
+
+func TestParseChannelDefault(t *testing.T) {
+	var testCases = []struct {
+		s  string
+		cd *ChannelDefault
+	}{
+		{"", nil},
+		{"web.", nil},
+		{"web.:gauge", nil},
+		{"web.:gauge=", nil},
+		{"web.:gauge=X", nil},
+		{"web.:foo=0", nil},
+		{"web.:counter=previous", nil},
+		{"web.:gauge-min=previous", nil},
+		{"web.:counter=0", &ChannelDefault{"web.", "counter", 0, false}},
+		{"web.:gauge-min=-1", &ChannelDefault{"web.", "gauge-min", -1, false}},
+		{"web.:gauge=5", &ChannelDefault{"web.", "gauge", 5, false}},
+		{":gauge=-1.5", &ChannelDefault{"", "gauge", -1.5, false}},
+		{"acc=previous", nil},
+		{"web.:gauge=previous", &ChannelDefault{"web.", "gauge", 0, true}},
+	}
+
+	for _, tc := range testCases {
+		cd, err := ParseChannelDefault(tc.s)
+		if tc.cd == nil && err == nil || tc.cd != nil && (err != nil || cd != *tc.cd) {
+			t.Error("Incorrect result:", tc.s)
+			t.Error("Expected:", tc.cd)
+			t.Error("Result:", cd, err)
+		}
+	}
+}
+
+func TestChannelDefault(t *testing.T) {
+	srv := &Server{Defaults: []ChannelDefault{
+		{"biz.", "gauge", math.NaN(), false},
+		{"biz.disk.", "gauge", 0, true},
+		{"", "acc", 100, false},
+	}}
+
+	var testCases = []struct {
+		typ     MetricType
+		name    string
+		i       int
+		def     float64
+		persist bool
+	}{
+		{Gauge, "web.load", 0, 0, true},
+		{Gauge, "biz.sales", 0, math.NaN(), false},
+		{Gauge, "biz.disk.size", 0, 0, true},
+		{Gauge, "biz.sales", 1, math.NaN(), false},
+		{Accumulator, "web.total", 0, 100, false},
+		{Counter, "biz.orders", 0, 0, false},
+	}
+
+	for _, tc := range testCases {
+		def, persist := srv.channelDefault(tc.typ, tc.name, tc.i)
+		if def != tc.def && !(math.IsNaN(def) && math.IsNaN(tc.def)) || persist != tc.persist {
+			t.Error("Incorrect result:", tc.typ, tc.name, tc.i)
+			t.Error("Expected:", tc.def, tc.persist)
+			t.Error("Result:", def, persist)
+		}
+	}
+}
+
+func TestMissingChannelDefault(t *testing.T) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	for _, name := range []string{"web.hits:counter", "biz.hits:counter", "biz.load:gauge-min"} {
+		for _, r := range []datastore.Record{{Ts: 60, Value: 1}, {Ts: 180, Value: 3}} {
+			if err := ds.Insert(name, r); err != nil {
+				t.Fatal("Insert:", err)
+			}
+		}
+	}
+	srv := &Server{Ds: ds, Defaults: []ChannelDefault{
+		{"web.", "counter", 10, false},
+		{"web.", "gauge-min", 0, false},
+		{"web.", "gauge", 5, false},
+	}}
+
+	// Minutes 60, 120 and 180
+	var testCases = []struct {
+		typ    MetricType
+		name   string
+		ch     string
+		fill   Fill
+		data   []float64
+		filled []bool
+	}{
+		{Counter, "web.hits", "counter", Fill{}, []float64{1, 10, 3}, []bool{false, true, false}},
+		{Counter, "web.hits", "counter", Fill{Policy: FillZero}, []float64{1, 0, 3}, []bool{false, true, false}},
+		{Counter, "web.hits", "counter", Fill{Policy: FillPrevious}, []float64{1, 1, 3}, []bool{false, true, false}},
+		{Counter, "biz.hits", "counter", Fill{}, []float64{1, 0, 3}, []bool{false, false, false}},
+		{Gauge, "web.load", "gauge-min", Fill{}, []float64{0, 0, 0}, []bool{true, true, true}},
+		{Gauge, "biz.load", "gauge-min", Fill{}, []float64{1, math.NaN(), 3}, []bool{false, false, false}},
+		// Persistent channels only start from their default
+		{Gauge, "web.load", "gauge", Fill{}, []float64{5, 5, 5}, []bool{false, false, false}},
+	}
+
+	for _, tc := range testCases {
+		aggr, err := createAggregator(tc.typ, "", []string{tc.ch})
+		if err != nil {
+			t.Fatal("createAggregator:", err)
+		}
+		in, err := srv.initAggregator(context.Background(), aggr, tc.name, tc.typ, nil, 0, 180, tc.fill)
+		if err != nil {
+			t.Fatal("initAggregator:", err)
+		}
+		data, filled := make([]float64, 0), make([]bool, 0)
+		for ts := int64(0); ts < 180; ts += 60 {
+			filled = append(filled, feedAggregator(aggr, in, ts, 60, tc.fill))
+			data = append(data, aggr.Get()[0])
+		}
+		closeRecordStreams(in)
+		if fmt.Sprint(data, filled) != fmt.Sprint(tc.data, tc.filled) {
+			t.Error("Incorrect result:", tc.name, tc.ch, tc.fill)
+			t.Error("Expected:", tc.data, tc.filled)
+			t.Error("Result:", data, filled)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+// FillPolicy tells how to fill in the minutes of a query which have no
+// stored value in some of the channels.
+type FillPolicy int
+
+const (
+	FillNull     FillPolicy = iota // leave the minute out
+	FillPrevious                   // repeat the previous value
+	FillZero                       // use 0
+	FillLinear                     // interpolate between the previous and the next value
+	FillCarry                      // like FillPrevious, persistent channels start from the value stored before
+)
+
+// Fill is a fill policy with its options. MaxStaleness limits how far
+// FillPrevious and FillCarry carry a value forward, in seconds (0:
+// unlimited).
+type Fill struct {
+	Policy       FillPolicy
+	MaxStaleness int64
+}
+
+func ParseFillPolicy(s string) (FillPolicy, error) {
+	switch s {
+	case "", "null":
+		return FillNull, nil
+	case "previous":
+		return FillPrevious, nil
+	case "zero":
+		return FillZero, nil
+	case "linear":
+		return FillLinear, nil
+	case "carry":
+		return FillCarry, nil
+	}
+	return 0, Error("Invalid fill policy: " + s)
+}
+
+// fill returns the value of a missing minute of the stream, if the policy
+// can produce one. Otherwise the overridden default of the channel is used,
+// if any.
+func (s *recordStream) fill(ts int64, f Fill) (float64, bool) {
+	p := f.Policy
+	switch {
+	case p == FillZero:
+		return 0, true
+	case (p == FillPrevious || p == FillCarry) && s.hasPrev:
+		if f.MaxStaleness > 0 && ts-s.prev.Ts > f.MaxStaleness {
+			return s.def, s.hasDef
+		}
+		return s.prev.Value, true
+	case p == FillLinear && s.hasPrev && s.ok:
+		r := float64(ts-s.prev.Ts) / float64(s.rec.Ts-s.prev.Ts)
+		return s.prev.Value + r*(s.rec.Value-s.prev.Value), true
+	}
+	return s.def, s.hasDef
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/adatboss/statsd/datastore"
+	"testing"
+)
+
+func TestFeedAggregatorFill(t *testing.T) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	for _, r := range []datastore.Record{{Ts: 60, Value: 1}, {Ts: 180, Value: 3}} {
+		if err := ds.Insert("test:counter", r); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+
+	var testCases = []struct {
+		fill   FillPolicy
+		sum    float64
+		filled bool
+	}{
+		{FillNull, 4, false},
+		{FillZero, 4, true},
+		{FillPrevious, 5, true},
+		{FillLinear, 6, true},
+	}
+
+	for _, tc := range testCases {
+		it, err := ds.Iterate(context.Background(), "test:counter", 60, 240)
+		if err != nil {
+			t.Fatal("Iterate:", err)
+		}
+		in := []*recordStream{newRecordStream(it)}
+		aggr := &counterAggregator{}
+		aggr.Init([]float64{0})
+		filled := feedAggregator(aggr, in, 0, 180, Fill{Policy: tc.fill})
+		closeRecordStreams(in)
+		if sum := aggr.Get()[0]; sum != tc.sum || filled != tc.filled {
+			t.Error("Incorrect result:", tc.fill)
+			t.Error("Expected:", tc.sum, tc.filled)
+			t.Error("Result:", sum, filled)
+		}
+	}
+}
+
+func TestFillCarry(t *testing.T) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	for _, r := range []datastore.Record{{Ts: 60, Value: 5}, {Ts: 240, Value: 7}} {
+		if err := ds.Insert("test:gauge", r); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+	srv := &Server{Ds: ds}
+
+	// Minutes 180, 240 and 300; only the persistent channel is carried
+	// into the query from the value stored before
+	var testCases = []struct {
+		chs    []string
+		fill   Fill
+		filled []bool
+	}{
+		{[]string{"gauge"}, Fill{Policy: FillPrevious}, []bool{false, false, true}},
+		{[]string{"gauge"}, Fill{Policy: FillCarry}, []bool{true, false, true}},
+		{[]string{"gauge"}, Fill{Policy: FillCarry, MaxStaleness: 120}, []bool{true, false, true}},
+		{[]string{"gauge"}, Fill{Policy: FillCarry, MaxStaleness: 60}, []bool{false, false, true}},
+		{[]string{"gauge-max"}, Fill{Policy: FillCarry}, []bool{false, false, false}},
+	}
+
+	for _, tc := range testCases {
+		aggr := createGaugeAggregator(tc.chs)
+		in, err := srv.initAggregator(context.Background(), aggr, "test", Gauge, nil, 120, 300, tc.fill)
+		if err != nil {
+			t.Fatal("initAggregator:", err)
+		}
+		filled := make([]bool, 0)
+		for ts := int64(120); ts < 300; ts += 60 {
+			filled = append(filled, feedAggregator(aggr, in, ts, 60, tc.fill))
+			aggr.Get()
+		}
+		closeRecordStreams(in)
+		if fmt.Sprint(filled) != fmt.Sprint(tc.filled) {
+			t.Error("Incorrect result:", tc.chs, tc.fill)
+			t.Error("Expected:", tc.filled)
+			t.Error("Result:", filled)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"github.com/adatboss/statsd/datastore"
+	"hash/fnv"
+	"log"
+	"sync/atomic"
+)
+
+// With FlushSpread set, the rows of the minute are still computed at the
+// end of it, but every metric inserts them into the datastore up to
+// FlushSpread seconds later, at a second of its own, so that the writes
+// aren't all at once. The records keep the timestamp of the minute. Until
+// the rows are inserted, queries of the server see them nonetheless, but
+// others reading the datastore don't. It can be at most 59 seconds.
+
+// unsavedRow is a row of a metric not yet inserted into the datastore.
+type unsavedRow struct {
+	ts   int64
+	data []float64
+}
+
+// flushDelay returns the number of seconds the metric waits after the end
+// of the minute before inserting its row.
+func (srv *Server) flushDelay(me *metricEntry) int64 {
+	spread := srv.FlushSpread
+	if spread > 59 {
+		spread = 59
+	}
+	if spread <= 0 || srv.stopping {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(metricTypes[me.typ].name))
+	h.Write([]byte(me.name))
+	return int64(h.Sum32() % uint32(spread+1))
+}
+
+// insertUnsaved inserts the unsaved row of the metric, if any.
+func (srv *Server) insertUnsaved(me *metricEntry) {
+	if me.unsaved == nil {
+		return
+	}
+	p := me.unsaved
+	me.unsaved = nil
+	for i, n := range metricTypes[me.typ].channels {
+		dbName := srv.Prefix + me.name + ":" + n
+		rec := datastore.Record{Ts: p.ts, Value: p.data[i]}
+		insertStart := srv.traceStart()
+		err := srv.Ds.Insert(dbName, rec)
+		srv.trace(TraceInsert, dbName, insertStart, err)
+		if err == nil {
+			atomic.AddInt64(&srv.usage.Inserted, 1)
+		} else if err != datastore.ErrQuotaExceeded {
+			// Exceeded quotas are reported by the datastore once
+			log.Println("Server.insertUnsaved:", err)
+		}
+	}
+}
+
+// unsavedIterator returns the records of it followed by the unsaved one.
+type unsavedIterator struct {
+	it  datastore.Iterator
+	rec datastore.Record
+	ok  bool
+}
+
+func (it *unsavedIterator) Next() (datastore.Record, bool) {
+	if rec, ok := it.it.Next(); ok || !it.ok {
+		return rec, ok
+	}
+	it.ok = false
+	return it.rec, true
+}
+
+func (it *unsavedIterator) Err() error {
+	return it.it.Err()
+}
+
+func (it *unsavedIterator) Close() error {
+	return it.it.Close()
+}
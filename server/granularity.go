@@ -0,0 +1,30 @@
+package server
+
+// granularities are the granularities ChooseGranularity picks from, in
+// ascending order. Longer ranges use multiples of a week.
+var granularities = []int64{
+	60, 120, 300, 600, 900, 1800,
+	3600, 7200, 10800, 21600, 43200,
+	86400, 172800, 604800,
+}
+
+// ChooseGranularity returns the smallest granularity at which the range
+// [from, until) fits in at most maxPoints intervals.
+func ChooseGranularity(from, until, maxPoints int64) (int64, error) {
+	if maxPoints < 1 {
+		return 0, Error("Maximum number of points must be positive")
+	}
+	if until <= from {
+		return 0, Error("Until must be after from")
+	}
+
+	span := until - from
+	for _, gran := range granularities {
+		if (span+gran-1)/gran <= maxPoints {
+			return gran, nil
+		}
+	}
+	week := granularities[len(granularities)-1]
+	n := (span + week*maxPoints - 1) / (week * maxPoints)
+	return n * week, nil
+}
@@ -0,0 +1,36 @@
+package server
+
+import "testing"
+
+func TestChooseGranularity(t *testing.T) {
+	var testCases = []struct {
+		from, until, maxPoints int64
+		gran                   int64
+	}{
+		{0, 3600, 60, 60},
+		{0, 3600, 59, 120},
+		{0, 3601, 60, 120},
+		{0, 86400, 100, 900},
+		{0, 86400, 1, 86400},
+		{0, 604800 * 10, 5, 1209600},
+		{0, 604800 * 10, 3, 2419200},
+	}
+
+	for _, tc := range testCases {
+		gran, err := ChooseGranularity(tc.from, tc.until, tc.maxPoints)
+		if err != nil {
+			t.Error("Error:", tc.from, tc.until, tc.maxPoints, err)
+		} else if gran != tc.gran {
+			t.Error("Incorrect result:", tc.from, tc.until, tc.maxPoints)
+			t.Error("Expected:", tc.gran)
+			t.Error("Result:", gran)
+		}
+	}
+
+	if _, err := ChooseGranularity(0, 3600, 0); err == nil {
+		t.Error("Zero maximum should have failed")
+	}
+	if _, err := ChooseGranularity(3600, 0, 10); err == nil {
+		t.Error("Empty range should have failed")
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+// Health tells whether the server is running, and the outcome of the last
+// configuration reload, if any. LastReload is a Unix timestamp.
+type Health struct {
+	Running     bool   `json:"running"`
+	Replica     bool   `json:"replica"`
+	LastReload  int64  `json:"lastReload,omitempty"`
+	ReloadError string `json:"reloadError,omitempty"`
+}
+
+// Reloaded records the outcome of a configuration reload, nil if it
+// succeeded.
+func (srv *Server) Reloaded(err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.lastReload = srv.clock().Now().Unix()
+	srv.reloadErr = err
+}
+
+func (srv *Server) Health() Health {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	h := Health{Running: srv.running, Replica: srv.isReplica(), LastReload: srv.lastReload}
+	if srv.reloadErr != nil {
+		h.ReloadError = srv.reloadErr.Error()
+	}
+	return h
+}
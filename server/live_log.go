@@ -0,0 +1,125 @@
+package server
+
+import "math"
+
+// LiveLogColdRes is the resolution in seconds of the live log before the
+// hot seconds, see Server.LiveLogHot.
+const LiveLogColdRes = 10
+
+// liveLog holds the values of the channels of a metric in the last
+// LiveLogSize seconds. The last hot seconds are kept one by one, the ones
+// before are averaged over LiveLogColdRes seconds aligned to the clock.
+type liveLog struct {
+	ts    int64 // the last second stored
+	hot   int64
+	ncold int64
+	data  [][]float64 // per channel, hot ring followed by cold ring
+	sum   []float64   // per channel, of the cold bucket being filled
+	n     []int
+	cold  int64 // the cold bucket being filled
+}
+
+func newLiveLog(nchs int, hot, ts int64) *liveLog {
+	if hot <= 0 || hot > LiveLogSize {
+		hot = LiveLogSize
+	}
+	ll := &liveLog{ts: ts, hot: hot, cold: floorDiv(ts-hot, LiveLogColdRes)}
+	if hot < LiveLogSize {
+		// The first and the last bucket can be partial
+		ll.ncold = (LiveLogSize-hot)/LiveLogColdRes + 2
+	}
+
+	ll.data = make([][]float64, nchs)
+	ll.sum, ll.n = make([]float64, nchs), make([]int, nchs)
+	for i := range ll.data {
+		ll.data[i] = make([]float64, ll.hot+ll.ncold)
+		for j := range ll.data[i] {
+			ll.data[i][j] = math.NaN()
+		}
+	}
+	return ll
+}
+
+// put stores the values of second ts. Seconds skipped since the last one
+// stored are unknown (NaN).
+func (ll *liveLog) put(ts int64, row []float64) {
+	if ts <= ll.ts {
+		return
+	}
+	if ts-ll.ts > LiveLogSize {
+		for ch := range ll.data {
+			ll.fill(ch, math.NaN())
+		}
+		ll.ts = ts - 1
+	}
+	for ll.ts < ts-1 {
+		ll.push(nil)
+	}
+	ll.push(row)
+}
+
+func (ll *liveLog) push(row []float64) {
+	ll.ts++
+	hot, slot, start := floorMod(ll.ts, ll.hot), int64(0), false
+	if ll.ncold > 0 {
+		cold := floorDiv(ll.ts-ll.hot, LiveLogColdRes)
+		slot = ll.hot + floorMod(cold, ll.ncold)
+		start, ll.cold = cold != ll.cold, cold
+	}
+
+	for i, data := range ll.data {
+		v := math.NaN()
+		if row != nil {
+			v = row[i]
+		}
+		if ll.ncold == 0 {
+			data[hot] = v
+			continue
+		}
+
+		// The second leaving the hot ring goes into its cold bucket
+		v, data[hot] = data[hot], v
+		if start {
+			ll.sum[i], ll.n[i] = 0, 0
+		}
+		if !math.IsNaN(v) {
+			ll.sum[i] += v
+			ll.n[i]++
+		}
+		data[slot] = math.NaN()
+		if ll.n[i] > 0 {
+			data[slot] = ll.sum[i] / float64(ll.n[i])
+		}
+	}
+}
+
+// get returns the value of a channel in second ts, which must be within
+// the last LiveLogSize seconds.
+func (ll *liveLog) get(ch int, ts int64) float64 {
+	if ts > ll.ts-ll.hot {
+		return ll.data[ch][floorMod(ts, ll.hot)]
+	}
+	return ll.data[ch][ll.hot+floorMod(floorDiv(ts, LiveLogColdRes), ll.ncold)]
+}
+
+// fill sets a channel to v in every second.
+func (ll *liveLog) fill(ch int, v float64) {
+	for i := range ll.data[ch] {
+		ll.data[ch][i] = v
+	}
+	ll.sum[ch], ll.n[ch] = 0, 0
+	if !math.IsNaN(v) {
+		ll.sum[ch], ll.n[ch] = v, 1
+	}
+}
+
+func floorDiv(a, b int64) int64 {
+	if a < 0 {
+		return -((b - 1 - a) / b)
+	}
+	return a / b
+}
+
+func floorMod(a, b int64) int64 {
+	return (a%b + b) % b
+}
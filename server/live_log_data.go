@@ -1,10 +1,11 @@
-package main
+package server
 
 import (
 	"bufio"
 	"encoding/binary"
 	"io"
 	"log"
+	"math"
 	"os"
 )
 
@@ -25,7 +26,9 @@ func saveLiveLogData(srv *Server) *LiveLogData {
 	lld := &LiveLogData{ts: srv.lastTick, size: LiveLogSize}
 	for _, metrics := range srv.metrics {
 		for _, me := range metrics {
-			lld.entries = append(lld.entries, newLiveLogEntry(me))
+			if me.liveLog != nil {
+				lld.entries = append(lld.entries, newLiveLogEntry(me))
+			}
 		}
 	}
 	return lld
@@ -43,8 +46,9 @@ func newLiveLogEntry(me *metricEntry) *liveLogEntry {
 	for i, n := range chs {
 		lle.chs[i] = []byte(n)
 		lle.data[i] = make([]float64, LiveLogSize)
-		n := copy(lle.data[i], me.liveLog[i][me.livePtr:])
-		copy(lle.data[i][n:], me.liveLog[i][:me.livePtr])
+		for j := range lle.data[i] {
+			lle.data[i][j] = me.liveLog.get(i, me.lastTick-LiveLogSize+1+int64(j))
+		}
 	}
 
 	return lle
@@ -84,13 +88,23 @@ func (lld *LiveLogData) restore(srv *Server) {
 			log.Println(chsStr)
 			continue
 		}
-		me := srv.createMetricEntry(e.typ, nameStr)
+		me := srv.createMetricEntry(e.typ, nameStr, false)
 		srv.metrics[e.typ][nameStr] = me
-		me.livePtr = (int64(lld.size) - offs) % LiveLogSize
-		for i, ch := range chsStr {
-			j := getChannelIndex(e.typ, ch)
-			copy(me.liveLog[j][0:], e.data[i][offs:])
+
+		// The first restored second is the first one in the live log
+		ll := newLiveLog(len(metricTypes[e.typ].channels), srv.LiveLogHot, srv.lastTick-LiveLogSize)
+		row, first := make([]float64, len(metricTypes[e.typ].channels)), lld.ts-int64(lld.size)+1
+		for k := offs; k < int64(lld.size); k++ {
+			for j := range row {
+				row[j] = math.NaN()
+			}
+			for i, ch := range chsStr {
+				row[getChannelIndex(e.typ, ch)] = e.data[i][k]
+			}
+			ll.put(first+k, row)
 		}
+		ll.put(srv.lastTick, nil)
+		me.liveLog = ll
 	}
 }
 
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"github.com/adatboss/statsd/datastore"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// If Server.LiveLogDir is set, Start restores the live log from a file in
+// that directory unless one is passed to it, and Stop saves the live log
+// there. The file name depends on Prefix, so servers with different
+// prefixes can share a directory. Saved live logs which are too old to be
+// restored are deleted by Start.
+
+const liveLogFilePrefix = "live_log"
+
+func (srv *Server) liveLogFile() string {
+	fn := liveLogFilePrefix
+	if len(srv.Prefix) > 0 {
+		fn += "." + datastore.EncodeFileName(srv.Prefix)
+	}
+	return filepath.Join(srv.LiveLogDir, fn)
+}
+
+func (srv *Server) loadLiveLog() *LiveLogData {
+	srv.expireLiveLogs()
+
+	lld, fn := new(LiveLogData), srv.liveLogFile()
+	if err := lld.ReadFrom(fn); err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Server.loadLiveLog:", err)
+		}
+		return nil
+	}
+	return lld
+}
+
+func (srv *Server) saveLiveLog(lld *LiveLogData) {
+	fn := srv.liveLogFile()
+	if err := lld.WriteTo(fn); err != nil {
+		log.Println("Server.saveLiveLog:", err)
+		if err := os.Remove(fn); err != nil {
+			log.Println("Server.saveLiveLog:", err)
+		}
+	}
+}
+
+func (srv *Server) expireLiveLogs() {
+	fis, err := ioutil.ReadDir(srv.LiveLogDir)
+	if err != nil {
+		log.Println("Server.expireLiveLogs:", err)
+		return
+	}
+
+	limit := srv.clock().Now().Add(-LiveLogSize * time.Second)
+	for _, fi := range fis {
+		n := fi.Name()
+		if n != liveLogFilePrefix && !strings.HasPrefix(n, liveLogFilePrefix+".") {
+			continue
+		}
+		if fi.Mode().IsRegular() && fi.ModTime().Before(limit) {
+			if err := os.Remove(filepath.Join(srv.LiveLogDir, n)); err != nil {
+				log.Println("Server.expireLiveLogs:", err)
+			}
+		}
+	}
+}
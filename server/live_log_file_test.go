@@ -0,0 +1,117 @@
+package server
+
+import (
+	"github.com/adatboss/statsd/clock"
+	"github.com/adatboss/statsd/datastore"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func stopServer(t *testing.T, srv *Server, c *clock.Manual) {
+	done := make(chan int)
+	go func() {
+		if _, _, err := srv.Stop(); err != nil {
+			t.Error("Stop:", err)
+		}
+		close(done)
+	}()
+
+	// Don't let the clock run away before Stop has taken effect
+	for stopping := false; !stopping; {
+		srv.mu.Lock()
+		stopping = srv.stopping
+		srv.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			c.AdvanceUntil(time.Second, done)
+		}
+	}
+}
+
+func liveLogSum(t *testing.T, srv *Server, name string) float64 {
+	live, _, err := srv.LiveLog(name, []string{"counter"})
+	if err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+	sum := 0.0
+	for _, row := range live {
+		if !math.IsNaN(row[0]) {
+			sum += row[0]
+		}
+	}
+	return sum
+}
+
+func TestLiveLogDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(6000000, 0)
+	old := filepath.Join(dir, "live_log.old")
+	if err := ioutil.WriteFile(old, []byte{}, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(old, start.Add(-time.Hour), start.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+
+	c := clock.NewManual(start)
+	newServer := func(prefix string) *Server {
+		srv := &Server{Ds: ds, Clock: c, Prefix: prefix, LiveLogDir: dir}
+		if err := srv.Start(nil, nil); err != nil {
+			t.Fatal("Start:", err)
+		}
+		return srv
+	}
+
+	srv := newServer("t1.")
+	liveLogSum(t, srv, "a")
+	if err := srv.Inject(&Metric{"a", Counter, 5, 1, false}); err != nil {
+		t.Fatal("Inject:", err)
+	}
+	c.Advance(10 * time.Second)
+	stopServer(t, srv, c)
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("Old live log should have been deleted:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "live_log.t1.")); err != nil {
+		t.Error("Live log not saved:", err)
+	}
+
+	var testCases = []struct {
+		prefix string
+		sum    float64
+	}{
+		{"t1.", 5},
+		{"t2.", 0},
+	}
+
+	for _, tc := range testCases {
+		srv := newServer(tc.prefix)
+		if sum := liveLogSum(t, srv, "a"); sum != tc.sum {
+			t.Error("Incorrect result:", tc.prefix)
+			t.Error("Expected:", tc.sum)
+			t.Error("Result:", sum)
+		}
+		stopServer(t, srv, c)
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLiveLog(t *testing.T) {
+	ll := newLiveLog(1, 60, 1000)
+	for ts := int64(1001); ts <= 1600; ts++ {
+		ll.put(ts, []float64{float64(ts)})
+	}
+
+	var testCases = []struct {
+		ts    int64
+		value float64
+	}{
+		{1600, 1600},
+		{1541, 1541},
+		{1540, 1540},
+		{1539, 1534.5},
+		{1530, 1534.5},
+		{1001, 1005},
+		{1009, 1005},
+	}
+	check := func() {
+		for _, tc := range testCases {
+			v := ll.get(0, tc.ts)
+			if v != tc.value && !(math.IsNaN(v) && math.IsNaN(tc.value)) {
+				t.Error("Incorrect result:", tc.ts)
+				t.Error("Expected:", tc.value)
+				t.Error("Result:", v)
+			}
+		}
+	}
+	check()
+
+	// Skipped seconds are unknown
+	ll.put(1605, []float64{1605})
+	testCases = []struct {
+		ts    int64
+		value float64
+	}{
+		{1605, 1605},
+		{1604, math.NaN()},
+		{1601, math.NaN()},
+		{1600, 1600},
+		{1545, 1542.5},
+		{1539, 1534.5},
+		{1006, 1005},
+	}
+	check()
+
+	ll.put(3000, nil)
+	testCases = []struct {
+		ts    int64
+		value float64
+	}{
+		{3000, math.NaN()},
+		{2990, math.NaN()},
+		{2401, math.NaN()},
+	}
+	check()
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// Mirror receives the rows a server produces for every metric: one per
+// second, which goes into the live log, and one per minute, which is stored
+// in the datastore. A replica fed with them serves the live log and
+// watchers of the metrics like the server itself. The methods are called
+// while the metric is locked, so they must not block.
+type Mirror interface {
+	Tick(typ MetricType, name string, ts int64, data []float64)
+	Flush(typ MetricType, name string, ts int64, data []float64)
+}
+
+// DefaultReplicaDelay is the number of seconds a replica lags behind the
+// wall clock by default. Rows arriving later than that are lost.
+const DefaultReplicaDelay = 2
+
+// A replica server doesn't aggregate injected metrics, its rows are passed
+// to PutReplicaRow instead, typically by a Mirror of another server sharing
+// the same datastore. Replicas don't write to the datastore, they only
+// flush metrics to feed their watchers. Servers started with Replica set
+// stay replicas until promoted.
+
+func (srv *Server) isReplica() bool {
+	return atomic.LoadInt32(&srv.replica) != 0
+}
+
+func (srv *Server) replicaDelay() int64 {
+	if !srv.isReplica() {
+		return 0
+	} else if srv.ReplicaDelay <= 0 {
+		return DefaultReplicaDelay
+	}
+	return srv.ReplicaDelay
+}
+
+// PutReplicaRow passes a row produced by another server to a replica. Flush
+// tells whether it is a per minute row.
+func (srv *Server) PutReplicaRow(typ MetricType, name string, ts int64, data []float64, flush bool) error {
+	if srv.stopping {
+		return ErrStopping
+	}
+	if !srv.isReplica() {
+		return Error("Server is not a replica")
+	}
+	if typ >= NMetricTypes || typ < 0 {
+		return ErrTypeInvalid
+	}
+	if len(data) != len(metricTypes[typ].channels) {
+		return Error("Number of channels invalid")
+	}
+
+	me, err := srv.getMetricEntry(typ, name, false)
+	if err != nil {
+		return err
+	}
+	defer me.Unlock()
+
+	if ts <= me.lastTick {
+		return nil
+	}
+	me.recvdInputTick = true
+	if flush {
+		if me.replicaFlush == nil {
+			me.replicaFlush = make(map[int64][]float64)
+		}
+		me.replicaFlush[ts] = data
+	} else {
+		if me.replicaTick == nil {
+			me.replicaTick = make(map[int64][]float64)
+		}
+		me.replicaTick[ts] = data
+	}
+	return nil
+}
+
+// tickRow returns the row of the second ending at ts.
+func (srv *Server) tickRow(me *metricEntry, ts int64) []float64 {
+	if srv.isReplica() {
+		data, ok := me.replicaRow(me.replicaTick, ts)
+		if ok {
+			me.replicaLast = data
+		}
+		return data
+	}
+	data := me.tick()
+	if srv.Mirror != nil {
+		srv.Mirror.Tick(me.typ, me.name, ts, data)
+	}
+	return data
+}
+
+// flushRow returns the row of the minute ending at ts.
+func (srv *Server) flushRow(me *metricEntry, ts int64) []float64 {
+	if srv.isReplica() {
+		data, _ := me.replicaRow(me.replicaFlush, ts)
+		return data
+	}
+	data := me.flush()
+	if srv.Mirror != nil {
+		srv.Mirror.Flush(me.typ, me.name, ts, data)
+	}
+	return data
+}
+
+// replicaRow takes the row of ts out of rows, dropping the older ones which
+// were never used. Missing rows are unknown (NaN).
+func (me *metricEntry) replicaRow(rows map[int64][]float64, ts int64) ([]float64, bool) {
+	data, ok := rows[ts]
+	for rts := range rows {
+		if rts <= ts {
+			delete(rows, rts)
+		}
+	}
+	if !ok {
+		data = make([]float64, len(metricTypes[me.typ].channels))
+		for i := range data {
+			data[i] = math.NaN()
+		}
+	}
+	return data, ok
+}
+
+// Promote turns a replica into a normal server, e.g. after it has been
+// elected leader. Metrics continue from the last rows received, so the
+// live log and watchers carry on, but the minute in progress only gets the
+// input injected from now on.
+func (srv *Server) Promote() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.running {
+		return ErrNotRunning
+	}
+	if srv.stopping {
+		return ErrStopping
+	}
+	if !srv.isReplica() {
+		return Error("Server is not a replica")
+	}
+
+	atomic.StoreInt32(&srv.replica, 0)
+	for _, metrics := range srv.metrics {
+		for _, me := range metrics {
+			me.Lock()
+			srv.promoteMetric(me)
+			me.Unlock()
+		}
+	}
+	return nil
+}
+
+// promoteMetric initializes the persistent channels of a metric from the
+// last row received, or loads them like for a new metric.
+func (srv *Server) promoteMetric(me *metricEntry) {
+	mt := metricTypes[me.typ]
+	last := me.replicaLast
+	me.replicaTick, me.replicaFlush, me.replicaLast = nil, nil, nil
+
+	data, load := make([]float64, len(mt.channels)), false
+	for i := range mt.channels {
+		def, persist := srv.channelDefault(me.typ, me.name, i)
+		data[i] = def
+		if mt.persist[i] && last != nil && !math.IsNaN(last[i]) {
+			data[i] = last[i]
+		} else if persist {
+			load = true
+		}
+	}
+	me.init(data)
+
+	if load {
+		me.loading = true
+		srv.loads.Add(1)
+		go srv.loadDefaults(me, srv.lastTick)
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Errors returned by ParseMetric and CheckMetricName.
+const (
+	ErrNameMissing          = Error("Metric name missing")
+	ErrNameInvalid          = Error("Invalid characters in metric name")
+	ErrNameNotUTF8          = Error("Metric name is not valid UTF-8")
+	ErrValueMissing         = Error("Metric value missing")
+	ErrValueInvalid         = Error("Metric value invalid")
+	ErrValueOutOfRange      = Error("Metric value out of range")
+	ErrTypeMissing          = Error("Metric type missing")
+	ErrTypeInvalid          = Error("Metric type invalid")
+	ErrSampleRateMissing    = Error("Sample rate missing")
+	ErrSampleRateInvalid    = Error("Sample rate invalid")
+	ErrSampleRateOutOfRange = Error("Sample rate out of range")
+)
+
+func ParseMetric(m []byte) (*Metric, error) {
+	var n int
+
+	if len(m) == 0 {
+		return nil, ErrNameMissing
+	}
+	n = -1
+	for i, ch := range m {
+		if ch == ':' {
+			n = i
+			break
+		} else if ch < 32 || ch == '/' || ch == '\\' || ch == '"' {
+			return nil, ErrNameInvalid
+		}
+	}
+	if n == 0 {
+		return nil, ErrNameMissing
+	} else if n == -1 || n == len(m)-1 {
+		return nil, ErrValueMissing
+	}
+	name := m[:n]
+	if !utf8.Valid(name) {
+		return nil, ErrNameNotUTF8
+	}
+
+	n, m = -1, m[n+1:]
+	for i, ch := range m {
+		if ch == '|' {
+			n = i
+			break
+		}
+	}
+	if n == 0 {
+		return nil, ErrValueMissing
+	} else if n == -1 || n == len(m)-1 {
+		return nil, ErrTypeMissing
+	}
+	value, err := parseFloat(m[:n])
+	if err == errFloatRange {
+		return nil, ErrValueOutOfRange
+	} else if err != nil {
+		return nil, ErrValueInvalid
+	}
+
+	n, m = -1, m[n+1:]
+	for i, ch := range m {
+		if ch == '|' {
+			n = i
+			break
+		}
+	}
+	if n == -1 {
+		n = len(m)
+	}
+	typ := MetricType(-1)
+	if n == 1 {
+		switch m[0] {
+		case 'c':
+			typ = Counter
+		case 'g':
+			typ = Gauge
+		case 'a':
+			typ = Averager
+		}
+	} else if n == 2 {
+		if m[0] == 'm' && m[1] == 's' {
+			typ = Timer
+		} else if m[0] == 'a' && m[1] == 'c' {
+			typ = Accumulator
+		}
+	}
+	if typ == MetricType(-1) {
+		return nil, ErrTypeInvalid
+	}
+
+	sr := 1.0
+	if n != len(m) {
+		if n == len(m)-1 {
+			return nil, ErrSampleRateMissing
+		}
+		if m[n+1] != '@' {
+			return nil, ErrSampleRateInvalid
+		}
+		if n == len(m)-2 {
+			return nil, ErrSampleRateMissing
+		}
+		s, err := parseFloat(m[n+2:])
+		if err == errFloatRange || err == nil && s <= 0 {
+			return nil, ErrSampleRateOutOfRange
+		} else if err != nil {
+			return nil, ErrSampleRateInvalid
+		}
+
+		sr = s
+	}
+
+	return &Metric{string(name), typ, value, sr, false}, nil
+}
+
+// parseFloat parses a finite number. Numbers which don't fit in a float64
+// are reported with errFloatRange.
+func parseFloat(b []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			return 0, errFloatRange
+		}
+		return 0, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, errFloatInvalid
+	}
+	return f, nil
+}
+
+const (
+	errFloatRange   = Error("Number out of range")
+	errFloatInvalid = Error("Number not finite")
+)
+
+func CheckMetricName(name string) error {
+	if len(name) == 0 {
+		return ErrNameMissing
+	}
+	if !utf8.ValidString(name) {
+		return ErrNameNotUTF8
+	}
+	for _, ch := range name {
+		if ch < 32 || ch == '/' || ch == '\\' || ch == '"' || ch == ':' {
+			return ErrNameInvalid
+		}
+	}
+	return nil
+}
+
+func MatchMetricName(name, pattern string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] != '*' {
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			} else {
+				pattern, name = pattern[1:], name[1:]
+			}
+		} else {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return true
+			}
+			for len(name) > 0 && name[0] != pattern[0] {
+				name = name[1:]
+			}
+			if len(name) == 0 {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return len(name) == 0
+}
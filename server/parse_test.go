@@ -0,0 +1,232 @@
+package server
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseMetric(t *testing.T) {
+	var testCases = []struct {
+		s string
+		m *Metric
+	}{
+		{"", nil},
+		{"test", nil},
+		{"te/st", nil},
+		{"test:", nil},
+		{"test:X", nil},
+		{"test:1", nil},
+		{"test:1.", nil},
+		{"test:1.X", nil},
+		{"test:1.5", nil},
+		{"test:1.5X", nil},
+		{"test:1.5|", nil},
+		{"test:1.5|X", nil},
+		{"test:1.5|c|", nil},
+		{"test:1.5|c|X", nil},
+		{"test:1.5|c|@", nil},
+		{"test:1.5|c|@X", nil},
+		{"test:1.5|c|@0", nil},
+		{"test:1.5|c|@0X", nil},
+		{"test:1.5|c|@0.", nil},
+		{"test:1.5|c|@0.X", nil},
+		{"test:1.5|c|@0.1X", nil},
+		{"te/st:1.5|c|@0.1", nil},
+		{"te\\st:1.5|c|@0.1", nil},
+		{"te\nst:1.5|c|@0.1", nil},
+		{"te\"st:1.5|c|@0.1", nil},
+		{"1.5|c|@0.1", nil},
+		{":1.5|c|@0.1", nil},
+		{"test:|c|@0.1", nil},
+		{"test:1.5||@0.1", nil},
+		{"test:1.5||", nil},
+		{"test:1.5|c|@0", nil},
+		{"test:1.5|c", &Metric{"test", Counter, 1.5, 1.0, false}},
+		{"test:1.5|c|@0.1", &Metric{"test", Counter, 1.5, 0.1, false}},
+		{"test:1.5|g", &Metric{"test", Gauge, 1.5, 1.0, false}},
+		{"test:1.5|a", &Metric{"test", Averager, 1.5, 1.0, false}},
+		{"test:1.5|ms", &Metric{"test", Timer, 1.5, 1.0, false}},
+		{"test:1.5|ac", &Metric{"test", Accumulator, 1.5, 1.0, false}},
+		{"test:1.5|x", nil},
+		{"test:1.5|xy", nil},
+		{"test:1.5|xyz", nil},
+	}
+
+	for _, tc := range testCases {
+		m, err := ParseMetric([]byte(tc.s))
+		if tc.m == nil {
+			if m != nil {
+				t.Error("Parsing should have failed:", tc.s)
+				t.Error("Returned:", *m)
+			} else if err == nil {
+				t.Error("nil error:", tc.s)
+			}
+		} else {
+			if m == nil {
+				t.Error("Parsing shouldn't have failed:", tc.s)
+				t.Error("Error:", err)
+				t.Error("Expected:", *tc.m)
+			} else if err != nil {
+				t.Error("Non-nil error:", tc.s)
+				t.Error("Error:", err)
+			} else if *tc.m != *m {
+				t.Error("Incorrect result:", tc.s)
+				t.Error("Expected:", *tc.m)
+				t.Error("Returned:", *m)
+			}
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func TestCheckMetricName(t *testing.T) {
+	var testCases = []struct {
+		s  string
+		ok bool
+	}{
+		{"", false},
+		{"te/st", false},
+		{"te\\st", false},
+		{"te\nst", false},
+		{"te:st", false},
+		{"te\"st", false},
+		{"test", true},
+	}
+
+	for _, tc := range testCases {
+		err := CheckMetricName(tc.s)
+		if tc.ok {
+			if err != nil {
+				t.Error("Should have been accepted:", tc.s)
+				t.Error("Error:", err)
+			}
+		} else {
+			if err == nil {
+				t.Error("Shouldn't have been accepted:", tc.s)
+			}
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func TestParseMetricErrors(t *testing.T) {
+	var testCases = []struct {
+		s   string
+		err error
+	}{
+		{"", ErrNameMissing},
+		{":1|c", ErrNameMissing},
+		{"te\x00st:1|c", ErrNameInvalid},
+		{"te\xffst:1|c", ErrNameNotUTF8},
+		{"test", ErrValueMissing},
+		{"test:", ErrValueMissing},
+		{"test:|c", ErrValueMissing},
+		{"test:1\x00|c", ErrValueInvalid},
+		{"test:X|c", ErrValueInvalid},
+		{"test:NaN|c", ErrValueInvalid},
+		{"test:Inf|c", ErrValueInvalid},
+		{"test:1e400|c", ErrValueOutOfRange},
+		{"test:-1e400|c", ErrValueOutOfRange},
+		{"test:1", ErrTypeMissing},
+		{"test:1|", ErrTypeMissing},
+		{"test:1|x", ErrTypeInvalid},
+		{"test:1|c|", ErrSampleRateMissing},
+		{"test:1|c|@", ErrSampleRateMissing},
+		{"test:1|c|X", ErrSampleRateInvalid},
+		{"test:1|c|@X", ErrSampleRateInvalid},
+		{"test:1|c|@NaN", ErrSampleRateInvalid},
+		{"test:1|c|@0", ErrSampleRateOutOfRange},
+		{"test:1|c|@-1", ErrSampleRateOutOfRange},
+		{"test:1|c|@1e-400", ErrSampleRateOutOfRange},
+	}
+
+	for _, tc := range testCases {
+		_, err := ParseMetric([]byte(tc.s))
+		if err != tc.err {
+			t.Error("Incorrect error:", tc.s)
+			t.Error("Expected:", tc.err)
+			t.Error("Returned:", err)
+		}
+	}
+}
+
+func FuzzParseMetric(f *testing.F) {
+	for _, s := range []string{"test:1.5|c", "test:1.5|ms|@0.1", "te\xffst:1|g", "test:1e400|a"} {
+		f.Add([]byte(s))
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := ParseMetric(b)
+		if err != nil {
+			if _, ok := err.(Error); !ok {
+				t.Error("Unexpected error type:", err)
+			}
+			return
+		}
+		if err := CheckMetricName(m.Name); err != nil {
+			t.Error("Invalid name accepted:", m.Name, err)
+		}
+		if m.Type < 0 || m.Type >= NMetricTypes {
+			t.Error("Invalid type accepted:", m.Type)
+		}
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			t.Error("Invalid value accepted:", m.Value)
+		}
+		if !(m.SampleRate > 0) || math.IsInf(m.SampleRate, 0) {
+			t.Error("Invalid sample rate accepted:", m.SampleRate)
+		}
+	})
+}
+
+func TestParseLine(t *testing.T) {
+	all := Conformance{true, true, true, true}
+	var testCases = []struct {
+		s       string
+		c       Conformance
+		metrics []Metric
+	}{
+		{"a:1|c", Conformance{}, []Metric{{"a", Counter, 1, 1, false}}},
+		{"a:|c", Conformance{}, nil},
+		{"a:|c", all, []Metric{{"a", Counter, 1, 1, false}}},
+		{"a:|c|@0.5", all, []Metric{{"a", Counter, 1, 0.5, false}}},
+		{"a:-3|g", Conformance{}, []Metric{{"a", Gauge, -3, 1, false}}},
+		{"a:-3|g", all, []Metric{{"a", Gauge, -3, 1, true}}},
+		{"a:+3|g", all, []Metric{{"a", Gauge, 3, 1, true}}},
+		{"a:3|g", all, []Metric{{"a", Gauge, 3, 1, false}}},
+		{"a:-3|c", all, []Metric{{"a", Counter, -3, 1, false}}},
+		{"a:1|c:250|ms", Conformance{}, nil},
+		{"a:1|c:250|ms", all, []Metric{{"a", Counter, 1, 1, false}, {"a", Timer, 250, 1, false}}},
+		{"a:1|c:|ms", all, nil},
+		{"a:1|c:", all, nil},
+		{"stats.a:1|c", Conformance{}, []Metric{{"stats.a", Counter, 1, 1, false}}},
+		{"stats.a:1|c", all, []Metric{{"a", Counter, 1, 1, false}}},
+		{"stats.timers.a:1|ms", all, []Metric{{"a", Timer, 1, 1, false}}},
+		{"stats_counts.a:1|c", all, []Metric{{"a", Counter, 1, 1, false}}},
+		{"stats.:1|c", all, []Metric{{"stats.", Counter, 1, 1, false}}},
+		{"a", all, nil},
+		{"a:1:2:3|ms", Conformance{}, []Metric{{"a", Timer, 1, 1, false}, {"a", Timer, 2, 1, false}, {"a", Timer, 3, 1, false}}},
+		{"a:1:2|c|@0.5", Conformance{}, []Metric{{"a", Counter, 1, 0.5, false}, {"a", Counter, 2, 0.5, false}}},
+		{"a:1:2", Conformance{}, nil},
+		{"a::2|ms", Conformance{}, nil},
+		{"a:1:2|ms:", Conformance{}, nil},
+		{"a:1:-2|g", all, []Metric{{"a", Gauge, 1, 1, false}, {"a", Gauge, -2, 1, true}}},
+		{"a:1:2|ms:3:|c", all, []Metric{{"a", Timer, 1, 1, false}, {"a", Timer, 2, 1, false}, {"a", Counter, 3, 1, false}, {"a", Counter, 1, 1, false}}},
+	}
+
+	for _, tc := range testCases {
+		metrics, err := ParseLine([]byte(tc.s), tc.c)
+		ok := (err == nil) == (tc.metrics != nil) && len(metrics) == len(tc.metrics)
+		for i := 0; ok && i < len(metrics); i++ {
+			ok = *metrics[i] == tc.metrics[i]
+		}
+		if !ok {
+			t.Error("Incorrect result:", tc.s, tc.c)
+			t.Error("Expected:", tc.metrics)
+			t.Error("Result:", metrics, err)
+		}
+	}
+}
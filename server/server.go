@@ -0,0 +1,1316 @@
+// Package server aggregates injected metrics, keeps their live logs and
+// answers queries about them.
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/adatboss/statsd/clock"
+	"github.com/adatboss/statsd/datastore"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Metric struct {
+	Name       string
+	Type       MetricType
+	Value      float64
+	SampleRate float64
+	Delta      bool // the value adjusts a gauge, see Conformance
+}
+
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
+
+const (
+	ErrNotRunning     = Error("Server not running")
+	ErrAlreadyRunning = Error("Server already running")
+	ErrStopping       = Error("Server is stopping")
+	ErrBadGranularity = Error("Granularity must be a positive multiple of 60")
+)
+
+const LiveLogSize = 600
+
+// New metrics load the last values of their persistent channels from the
+// datastore in the background, at most maxDefaultLoads at a time.
+const maxDefaultLoads = 16
+
+// If the clock jumps forward by more than maxClockJump seconds (e.g. after
+// a suspend), the missed ticks are skipped instead of being replayed.
+const maxClockJump = 120
+
+type Server struct {
+	Ds           datastore.Datastore
+	Prefix       string
+	AutoWc       bool
+	UsagePrefix  string
+	Clock        clock.Clock
+	Trace        func(TraceEvent)
+	LiveLogDir   string
+	Mirror       Mirror
+	Replica      bool
+	ReplicaDelay int64
+	Defaults     []ChannelDefault
+	Conformance  Conformance
+	LiveLogHot   int64
+	TickWorkers  int
+	FlushSpread  int64
+	TimerSamples int
+	mu           sync.Mutex
+	usage        Usage
+	lastUsage    Usage
+	prefixMu     sync.RWMutex
+	prefixUsage  map[string]*prefixCounters
+	usageDay     int64
+	wg           sync.WaitGroup
+	metrics      [NMetricTypes]map[string]*metricEntry
+	metricList   []*metricEntry
+	wildcards    [NMetricTypes]map[string]int
+	running      bool
+	stopping     bool
+	quit         chan int
+	lastTick     int64
+	loads        sync.WaitGroup
+	loadSem      chan int
+	replica      int32
+	lastReload   int64
+	reloadErr    error
+}
+
+type metricEntry struct {
+	metric
+	sync.Mutex
+	typ            MetricType
+	name           string
+	recvdInput     bool
+	recvdInputTick bool
+	idleTicks      int
+	lastInput      int64
+	liveLog        *liveLog
+	unsaved        *unsavedRow
+	lastTick       int64
+	watchers       []*Watcher
+	loading        bool
+	pending        []Metric
+	replicaTick    map[int64][]float64
+	replicaFlush   map[int64][]float64
+	replicaLast    []float64
+}
+
+type Watcher struct {
+	Ts    int64
+	C     <-chan []float64
+	err   error
+	me    *metricEntry
+	in    chan []float64
+	done  chan int
+	out   chan []float64
+	chs   []int
+	aggr  Aggregator
+	gran  int64
+	offs  int64
+	shift int64
+}
+
+func (srv *Server) Start(lld *LiveLogData, wildcards []string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.running {
+		return ErrAlreadyRunning
+	}
+	if srv.stopping {
+		return ErrStopping
+	}
+	if err := checkChannelDefaults(srv.Defaults); err != nil {
+		return err
+	}
+
+	for i := range srv.metrics {
+		srv.metrics[i] = make(map[string]*metricEntry)
+	}
+	if srv.Replica {
+		atomic.StoreInt32(&srv.replica, 1)
+	} else {
+		atomic.StoreInt32(&srv.replica, 0)
+	}
+	srv.lastTick = srv.clock().Now().Unix() - srv.replicaDelay()
+	if lld == nil && len(srv.LiveLogDir) > 0 {
+		lld = srv.loadLiveLog()
+	}
+	if lld != nil {
+		lld.restore(srv)
+	}
+	if wildcards != nil {
+		srv.restoreWildcards(wildcards)
+	}
+	srv.running = true
+	srv.quit = make(chan int, 1)
+	srv.loadSem = make(chan int, maxDefaultLoads)
+	go srv.tick()
+	return nil
+}
+
+func (srv *Server) Stop() (*LiveLogData, []string, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.running {
+		return nil, nil, ErrNotRunning
+	}
+	if srv.stopping {
+		return nil, nil, ErrStopping
+	}
+
+	srv.stopping = true
+	srv.mu.Unlock()
+	<-srv.quit
+	srv.loads.Wait()
+	srv.mu.Lock()
+
+	for _, metrics := range srv.metrics {
+		for _, me := range metrics {
+			me.Lock()
+			me.endWatchers(Error("Server stopped"))
+			me.Unlock()
+		}
+	}
+	lld := saveLiveLogData(srv)
+	if len(srv.LiveLogDir) > 0 {
+		srv.saveLiveLog(lld)
+	}
+	wcd := srv.getWildcards()
+	srv.metrics = [NMetricTypes]map[string]*metricEntry{}
+	srv.wildcards = [NMetricTypes]map[string]int{}
+	srv.running = false
+	srv.stopping = false
+	return lld, wcd, nil
+}
+
+func (srv *Server) InjectBytes(msg []byte) {
+	for i, j := 0, -1; i <= len(msg); i++ {
+		if i != len(msg) && msg[i] != '\n' || i == j+1 {
+			continue
+		}
+		line := msg[j+1 : i]
+		j = i
+		if err := srv.InjectLine(line); err != nil {
+			log.Println("Server.InjectLine:", err, strconv.Quote(string(line)))
+		}
+	}
+}
+
+// InjectLine parses a line of input and injects the metrics it holds. If
+// some of them are rejected, the others are still injected and the first
+// error is returned.
+func (srv *Server) InjectLine(line []byte) error {
+	start := srv.traceStart()
+	metrics, err := ParseLine(line, srv.Conformance)
+	if err != nil {
+		srv.trace(TraceParse, "", start, err)
+		return err
+	}
+	srv.trace(TraceParse, metrics[0].Name, start, nil)
+	for _, metric := range metrics {
+		if e := srv.Inject(metric); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (srv *Server) InjectWithoutWildcards(metric *Metric) error {
+	if srv.isReplica() {
+		return Error("Server is a replica")
+	}
+	if metric.Type >= NMetricTypes || metric.Type < 0 {
+		return ErrTypeInvalid
+	}
+	if metric.SampleRate <= 0 {
+		return Error("Sample rate invalid")
+	}
+	if err := CheckMetricName(metric.Name); err != nil {
+		return err
+	}
+
+	me, err := srv.getMetricEntry(metric.Type, metric.Name, false)
+	if err != nil {
+		return err
+	}
+	defer me.Unlock()
+
+	me.recvdInputTick = true
+	if me.loading {
+		me.pending = append(me.pending, *metric)
+		return nil
+	}
+	me.recvdInput = true
+	me.inject(metric)
+	return nil
+}
+
+func (srv *Server) Inject(metric *Metric) error {
+	start := srv.traceStart()
+	err := srv.inject(metric)
+	srv.trace(TraceInject, metric.Name, start, err)
+	return err
+}
+
+func (srv *Server) inject(metric *Metric) error {
+	if err := srv.InjectWithoutWildcards(metric); err != nil {
+		return err
+	}
+	atomic.AddInt64(&srv.usage.Injected, 1)
+	atomic.AddInt64(&srv.getPrefixCounters(metric.Name).injected, 1)
+
+	wcs, m := srv.getMatchingWildcards(metric.Type, metric.Name), *metric
+	for _, wc := range wcs {
+		m.Name = wc
+		if err := srv.InjectWithoutWildcards(&m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (srv *Server) getMatchingWildcards(typ MetricType, name string) []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	matches := []string(nil)
+	for wc, _ := range srv.wildcards[typ] {
+		if MatchMetricName(name, wc) {
+			matches = append(matches, wc)
+		}
+	}
+	return matches
+}
+
+func (srv *Server) AddWildcard(typ MetricType, name string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !srv.running {
+		return ErrNotRunning
+	}
+	if typ >= NMetricTypes || typ < 0 {
+		return ErrTypeInvalid
+	}
+	if err := CheckMetricName(name); err != nil {
+		return err
+	}
+
+	return srv.addWildcard(typ, name)
+}
+
+func (srv *Server) DeleteWildcard(typ MetricType, name string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !srv.running {
+		return ErrNotRunning
+	}
+	if typ >= NMetricTypes || typ < 0 {
+		return ErrTypeInvalid
+	}
+
+	delete(srv.wildcards[typ], name)
+	return nil
+}
+
+func (srv *Server) addWildcard(typ MetricType, name string) error {
+	if strings.Index(name, "*") != -1 {
+		if srv.wildcards[typ] == nil {
+			srv.wildcards[typ] = make(map[string]int)
+		}
+		srv.wildcards[typ][name] = 1
+		return nil
+	} else {
+		return Error("Not a wildcard")
+	}
+}
+
+func (srv *Server) Wildcards() ([]string, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !srv.running {
+		return nil, ErrNotRunning
+	}
+
+	return srv.getWildcards(), nil
+}
+
+// MergeWildcards adds wildcards to the ones of the server, e.g. the ones
+// learned since they were saved. Either all wildcards are applied or, if any
+// of them is invalid, none of them.
+func (srv *Server) MergeWildcards(wcs []string) error {
+	wildcards, err := parseWildcards(wcs)
+	if err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !srv.running {
+		return ErrNotRunning
+	}
+	for typ, names := range wildcards {
+		for name := range names {
+			srv.addWildcard(MetricType(typ), name)
+		}
+	}
+	return nil
+}
+
+func parseWildcards(wcs []string) ([NMetricTypes]map[string]int, error) {
+	var wildcards [NMetricTypes]map[string]int
+	for _, wc := range wcs {
+		s := strings.SplitN(wc, ":", 2)
+		typ, err := metricTypeByChannels(s[1:])
+		if err != nil {
+			return wildcards, Error("Bad wildcard: " + wc + ": " + err.Error())
+		}
+		if err := CheckMetricName(s[0]); err != nil {
+			return wildcards, Error("Bad wildcard: " + wc + ": " + err.Error())
+		}
+		if strings.Index(s[0], "*") == -1 {
+			return wildcards, Error("Not a wildcard: " + wc)
+		}
+		if wildcards[typ] == nil {
+			wildcards[typ] = make(map[string]int)
+		}
+		wildcards[typ][s[0]] = 1
+	}
+	return wildcards, nil
+}
+
+// restoreWildcards adds the saved wildcards, skipping the invalid ones.
+func (srv *Server) restoreWildcards(wcs []string) {
+	for _, wc := range wcs {
+		wildcards, err := parseWildcards([]string{wc})
+		if err != nil {
+			log.Println("Server.restoreWildcards:", err)
+			continue
+		}
+		for typ, names := range wildcards {
+			for name := range names {
+				srv.addWildcard(MetricType(typ), name)
+			}
+		}
+	}
+}
+
+func (srv *Server) getWildcards() []string {
+	r := make([]string, 0)
+	for typ, wcs := range srv.wildcards {
+		for name, _ := range wcs {
+			r = append(r, name+":"+metricTypes[typ].channels[0])
+		}
+	}
+	return r
+}
+
+func (srv *Server) getMetricEntry(typ MetricType, name string, wc bool) (*metricEntry, error) {
+	if err := CheckMetricName(name); err != nil {
+		return nil, err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !srv.running {
+		return nil, ErrNotRunning
+	}
+
+	me := srv.metrics[typ][name]
+	if me == nil {
+		me = srv.createMetricEntry(typ, name, true)
+		srv.metrics[typ][name] = me
+	}
+
+	if wc && srv.AutoWc {
+		srv.addWildcard(typ, name)
+	}
+
+	me.Lock()
+	return me, nil
+}
+
+// createMetricEntry creates a metric entry initialized with the last values
+// of its persistent channels. If async is set, the entry starts with the
+// default values of the channels and the last values are loaded in the
+// background. Injected metrics are held back until they arrive. Once the
+// server is stopping, Stop may already be waiting for the loads, so they
+// aren't started in the background anymore.
+func (srv *Server) createMetricEntry(typ MetricType, name string, async bool) *metricEntry {
+	mt := metricTypes[typ]
+	async = async && !srv.stopping
+
+	me := &metricEntry{
+		metric:   mt.create(srv),
+		typ:      typ,
+		name:     name,
+		lastTick: srv.lastTick,
+	}
+
+	initData, load := make([]float64, len(mt.channels)), false
+	for i := range mt.channels {
+		def, persist := srv.channelDefault(typ, name, i)
+		if !async {
+			def = srv.getChannelDefault(context.Background(), typ, name, i, srv.lastTick)
+		} else if persist && !srv.isReplica() {
+			load = true
+		}
+		initData[i] = def
+	}
+	me.init(initData)
+
+	if load {
+		me.loading = true
+		srv.loads.Add(1)
+		go srv.loadDefaults(me, srv.lastTick)
+	}
+
+	return me
+}
+
+func (srv *Server) loadDefaults(me *metricEntry, ts int64) {
+	defer srv.loads.Done()
+
+	srv.loadSem <- 1
+	mt := metricTypes[me.typ]
+	data := make([]float64, len(mt.channels))
+	for i := range mt.channels {
+		data[i] = srv.getChannelDefault(context.Background(), me.typ, me.name, i, ts)
+	}
+	<-srv.loadSem
+
+	me.Lock()
+	defer me.Unlock()
+
+	me.init(data)
+	for i := range mt.channels {
+		if _, persist := srv.channelDefault(me.typ, me.name, i); persist && me.liveLog != nil {
+			me.liveLog.fill(i, data[i])
+		}
+	}
+	for i := range me.pending {
+		me.inject(&me.pending[i])
+	}
+	if len(me.pending) > 0 {
+		me.recvdInput = true
+	}
+	me.loading, me.pending = false, nil
+}
+
+func (srv *Server) getChannelDefault(ctx context.Context, typ MetricType, name string, i int, ts int64) float64 {
+	mt := metricTypes[typ]
+	def, persist := srv.channelDefault(typ, name, i)
+	if persist {
+		rec, err := srv.Ds.LatestBefore(ctx, srv.Prefix+name+":"+mt.channels[i], ts)
+		if err == nil {
+			def = rec.Value
+		} else if !errors.Is(err, datastore.ErrNoData) {
+			log.Println("Server.getChannelDefault:", err)
+		}
+	}
+	return def
+}
+
+// tick calls handleTick right after every wall clock second. The delay is
+// recalculated before each tick, so ticks stay aligned to the wall clock even
+// if it drifts relative to the monotonic clock used for sleeping.
+func (srv *Server) tick() {
+	c := srv.clock()
+	for {
+		c.Sleep(time.Second - time.Duration(c.Now().Nanosecond()))
+		if srv.handleTick(c.Now().Unix() - srv.replicaDelay()) {
+			srv.quit <- 1
+			return
+		}
+	}
+}
+
+func (srv *Server) handleTick(ts int64) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for srv.lastTick < ts {
+		if ts-srv.lastTick > maxClockJump && srv.lastTick%60 == 0 {
+			srv.skipTicks(ts - ts%60)
+			continue
+		}
+		srv.lastTick++
+		start := time.Now()
+		if srv.lastTick%60 != 0 {
+			srv.tickMetrics()
+			srv.countTick(time.Since(start))
+		} else {
+			srv.flushMetrics(start)
+			if srv.stopping {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (srv *Server) skipTicks(ts int64) {
+	log.Println("Clock jumped forward, skipping", ts-srv.lastTick, "seconds")
+	for _, metrics := range srv.metrics {
+		for _, me := range metrics {
+			me.Lock()
+			srv.insertUnsaved(me)
+			me.skipTicks(ts - srv.lastTick)
+			me.Unlock()
+		}
+	}
+	srv.lastTick = ts
+}
+
+func (srv *Server) tickMetrics() {
+	mes := srv.metricList[:0]
+	for _, metrics := range srv.metrics {
+		for _, me := range metrics {
+			mes = append(mes, me)
+		}
+	}
+	srv.eachMetric(mes, srv.tickMetric)
+}
+
+// flushMetrics flushes the metrics, and deletes the ones which have been
+// idle for long. Start is when the tick began.
+func (srv *Server) flushMetrics(start time.Time) {
+	mes := srv.metricList[:0]
+	for _, metrics := range srv.metrics {
+		for _, me := range metrics {
+			if srv.flushOrDelete(me) {
+				mes = append(mes, me)
+			}
+		}
+	}
+	srv.eachMetric(mes, srv.flushMetric)
+	srv.countTick(time.Since(start))
+	srv.saveUsage()
+}
+
+// eachMetric calls fn for every metric of mes in parallel, split between
+// TickWorkers goroutines, and returns when all calls have returned. Mes is
+// reused for the next tick.
+func (srv *Server) eachMetric(mes []*metricEntry, fn func(*metricEntry)) {
+	n := srv.TickWorkers
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	if n > len(mes) {
+		n = len(mes)
+	}
+	srv.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(shard []*metricEntry) {
+			defer srv.wg.Done()
+			for _, me := range shard {
+				fn(me)
+			}
+		}(mes[i*len(mes)/n : (i+1)*len(mes)/n])
+	}
+	srv.wg.Wait()
+
+	// Deleted metrics shouldn't be kept around
+	for i := range mes {
+		mes[i] = nil
+	}
+	srv.metricList = mes[:0]
+}
+
+func (srv *Server) tickMetric(me *metricEntry) {
+	me.Lock()
+	defer me.Unlock()
+
+	start := srv.traceStart()
+	me.updateIdle()
+	me.updateLiveLog(srv.lastTick, srv.tickRow(me, srv.lastTick))
+	if me.unsaved != nil && srv.lastTick-me.unsaved.ts >= srv.flushDelay(me) {
+		srv.insertUnsaved(me)
+	}
+	srv.trace(TraceTick, me.name, start, nil)
+}
+
+// flushOrDelete tells whether the metric has to be flushed, or deletes it
+// if it has been idle for long.
+func (srv *Server) flushOrDelete(me *metricEntry) bool {
+	me.Lock()
+	defer me.Unlock()
+
+	me.updateIdle()
+
+	if me.recvdInput || len(me.watchers) != 0 {
+		return true
+	} else if me.idleTicks > LiveLogSize {
+		delete(srv.metrics[me.typ], me.name)
+	}
+	return false
+}
+
+func (me *metricEntry) updateIdle() {
+	if me.recvdInputTick {
+		me.idleTicks = 0
+		me.lastInput = me.lastTick + 1
+		me.recvdInputTick = false
+	} else {
+		me.idleTicks++
+	}
+}
+
+// skipTicks marks n skipped seconds in the live log with NaNs. Watchers
+// are closed, since they cannot be notified about the gap.
+func (me *metricEntry) skipTicks(n int64) {
+	if me.liveLog != nil {
+		me.liveLog.put(me.lastTick+n, nil)
+	}
+	me.lastTick += n
+	me.idleTicks += int(n)
+
+	me.endWatchers(Error("Clock jumped forward, data is missing"))
+}
+
+// allocLiveLog allocates the live log of the metric, which is only kept
+// once it has been queried. The seconds before that are unknown (NaN).
+func (me *metricEntry) allocLiveLog(hot int64) {
+	if me.liveLog != nil {
+		return
+	}
+	me.liveLog = newLiveLog(len(metricTypes[me.typ].channels), hot, me.lastTick)
+}
+
+func (me *metricEntry) updateLiveLog(ts int64, data []float64) {
+	if me.liveLog != nil {
+		me.liveLog.put(ts, data)
+	}
+	me.lastTick = ts
+
+	for _, w := range me.watchers {
+		if w.aggr != nil {
+			continue
+		}
+		wdata := make([]float64, len(w.chs))
+		for i, j := range w.chs {
+			wdata[i] = data[j]
+		}
+		w.in <- wdata
+	}
+}
+
+func (srv *Server) flushMetric(me *metricEntry) {
+	me.Lock()
+	defer me.Unlock()
+
+	start := srv.traceStart()
+	defer srv.trace(TraceFlush, me.name, start, nil)
+
+	me.updateLiveLog(srv.lastTick, srv.tickRow(me, srv.lastTick))
+	data := srv.flushRow(me, srv.lastTick)
+
+	// Queries lock the metric as well, so they never see a minute which
+	// has only been inserted into some of the channels
+	if me.recvdInput {
+		srv.insertUnsaved(me)
+		me.unsaved = &unsavedRow{srv.lastTick, data}
+		if srv.flushDelay(me) == 0 {
+			srv.insertUnsaved(me)
+		}
+		me.recvdInput = false
+	}
+
+	var failed []*Watcher
+	for _, w := range me.watchers {
+		if w.aggr == nil {
+			continue
+		}
+		if w.shift != 0 {
+			if (me.lastTick-w.offs)%w.gran != 0 {
+				continue
+			}
+			row, err := srv.shiftedRow(w, me.lastTick-w.gran+w.shift)
+			if err != nil {
+				log.Println("Server.flushMetric:", err)
+				w.err = err
+				failed = append(failed, w)
+				continue
+			}
+			w.in <- row
+			continue
+		}
+		wdata := make([]float64, len(w.chs))
+		for i, j := range w.chs {
+			wdata[i] = data[j]
+		}
+		w.aggr.Put(wdata)
+		if (me.lastTick-w.offs)%w.gran == 0 {
+			w.in <- w.aggr.Get()
+		}
+	}
+
+	for _, w := range failed {
+		me.endWatcher(w, w.err)
+	}
+}
+
+// shiftedRow aggregates the interval of a shifted watcher starting at ts
+// from the datastore.
+func (srv *Server) shiftedRow(w *Watcher, ts int64) ([]float64, error) {
+	input, err := srv.initAggregator(context.Background(), w.aggr, w.me.name, w.me.typ, w.me.unsaved, ts, ts+w.gran, Fill{})
+	if err != nil {
+		return nil, err
+	}
+	feedAggregator(w.aggr, input, ts, w.gran, Fill{})
+	if err := closeRecordStreams(input); err != nil {
+		return nil, err
+	}
+	return w.aggr.Get(), nil
+}
+
+func (srv *Server) LiveLog(name string, chs []string) ([][]float64, int64, error) {
+	return srv.LiveLogWindow(name, chs, LiveLogSize, 1)
+}
+
+// LiveLogWindow is like LiveLog, but only returns every step-th second of
+// the last window seconds, ending with the last one.
+func (srv *Server) LiveLogWindow(name string, chs []string, window, step int64) ([][]float64, int64, error) {
+	srv.countQuery(name)
+	if window < 1 || window > LiveLogSize {
+		return nil, 0, Error("Window invalid")
+	}
+	if step < 1 || step > window {
+		return nil, 0, Error("Step invalid")
+	}
+	typ, err := metricTypeByChannels(chs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	me, err := srv.getMetricEntry(typ, name, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer me.Unlock()
+
+	me.allocLiveLog(srv.LiveLogHot)
+	idx := make([]int, len(chs))
+	for i, n := range chs {
+		idx[i] = getChannelIndex(typ, n)
+	}
+
+	// The rows are labeled with the start of their seconds
+	result := make([][]float64, window/step)
+	ts := me.lastTick - int64(len(result)-1)*step - 1
+	for i := range result {
+		row := make([]float64, len(chs))
+		for j, k := range idx {
+			row[j] = me.liveLog.get(k, ts+1+int64(i)*step)
+		}
+		result[i] = row
+	}
+
+	return result, ts, nil
+}
+
+// Log returns the values of the channels of a metric aggregated over length
+// intervals of gran seconds starting at from. The channels are read while
+// the metric is locked, and flushes insert all channels of a minute while
+// holding the same lock, so the rows are consistent across channels: a
+// minute is either present in all of them or in none.
+func (srv *Server) Log(ctx context.Context, name string, chs []string, from, length, gran int64, aggr string) ([][]float64, error) {
+	data, _, err := srv.LogFill(ctx, name, chs, from, length, gran, aggr, Fill{})
+	return data, err
+}
+
+// LogFill is like Log, but minutes missing from the datastore are filled in
+// according to the fill policy. It also reports which of the returned
+// intervals contain filled in minutes.
+func (srv *Server) LogFill(ctx context.Context, name string, chs []string, from, length, gran int64, aggr string, fill Fill) ([][]float64, []bool, error) {
+	srv.countQuery(name)
+	if from%60 != 0 {
+		return nil, nil, Error("From must be divisable by 60")
+	}
+	if gran < 1 || gran%60 != 0 {
+		return nil, nil, ErrBadGranularity
+	}
+	if length < 0 {
+		return nil, nil, Error("Length must not be negative")
+	}
+
+	typ, err := metricTypeByChannels(chs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	me, err := srv.getMetricEntry(typ, name, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer me.Unlock()
+
+	return srv.log(ctx, me, chs, from, length, gran, aggr, fill)
+}
+
+func (srv *Server) log(ctx context.Context, me *metricEntry, chs []string, from, length, gran int64, aggrName string, fill Fill) ([][]float64, []bool, error) {
+	typ, name := me.typ, me.name
+	maxLength := (me.lastTick - from) / gran
+
+	if length > maxLength {
+		length = maxLength
+	}
+
+	if length <= 0 {
+		return [][]float64{}, []bool{}, nil
+	}
+
+	aggr, err := createAggregator(typ, aggrName, chs)
+	if err != nil {
+		return nil, nil, err
+	}
+	input, err := srv.initAggregator(ctx, aggr, name, typ, me.unsaved, from, from+gran*length, fill)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	output, filled := make([][]float64, length), make([]bool, length)
+	for i, ts := int64(0), from; i < length; i++ {
+		filled[i] = feedAggregator(aggr, input, ts, gran, fill)
+		ts += gran
+		output[i] = aggr.Get()
+	}
+	if err := closeRecordStreams(input); err != nil {
+		return nil, nil, err
+	}
+
+	return output, filled, nil
+}
+
+// initAggregator initializes the aggregator for the interval from..until,
+// and returns the streams of the records of its channels. Unsaved is the
+// row of the metric not yet inserted, if any.
+func (srv *Server) initAggregator(ctx context.Context, aggr Aggregator, name string, typ MetricType, unsaved *unsavedRow, from, until int64, fill Fill) ([]*recordStream, error) {
+	inChs := aggr.Channels()
+	input, tmp := make([]*recordStream, 0, len(inChs)), make([]float64, len(inChs))
+	for i, j := range inChs {
+		dbName := srv.Prefix + name + ":" + metricTypes[typ].channels[j]
+		it, err := srv.Ds.Iterate(ctx, dbName, from+60, until)
+		if err != nil {
+			closeRecordStreams(input)
+			return nil, err
+		}
+		if unsaved != nil && unsaved.ts > from && unsaved.ts <= until {
+			rec := datastore.Record{Ts: unsaved.ts, Value: unsaved.data[j]}
+			it = &unsavedIterator{it: it, rec: rec, ok: true}
+		}
+		s := newRecordStream(it)
+		s.def, s.hasDef = srv.missingDefault(typ, name, j)
+		input = append(input, s)
+
+		if unsaved != nil && unsaved.ts <= from {
+			// The unsaved row is newer than anything stored
+			rec := datastore.Record{Ts: unsaved.ts, Value: unsaved.data[j]}
+			if fill.Policy == FillCarry && metricTypes[typ].persist[j] {
+				s.prev, s.hasPrev = rec, true
+			}
+			def, persist := srv.channelDefault(typ, name, j)
+			if persist {
+				def = rec.Value
+			}
+			tmp[i] = def
+			continue
+		}
+		if fill.Policy == FillCarry && metricTypes[typ].persist[j] {
+			rec, err := srv.Ds.LatestBefore(ctx, dbName, from)
+			if err == nil {
+				s.prev, s.hasPrev = rec, true
+			} else if !errors.Is(err, datastore.ErrNoData) {
+				closeRecordStreams(input)
+				return nil, err
+			}
+		}
+		tmp[i] = srv.getChannelDefault(ctx, typ, name, j, from)
+	}
+	aggr.Init(tmp)
+	return input, nil
+}
+
+// feedAggregator puts the minutes of an interval into the aggregator. Minutes
+// with missing channels are filled in according to the fill policy, or left
+// out if that isn't possible. It returns whether any minute was filled in.
+func feedAggregator(aggr Aggregator, in []*recordStream, ts, gran int64, fill Fill) bool {
+	tmp, filled := make([]float64, len(in)), false
+	for j := int64(0); j < gran; j += 60 {
+		ts += 60
+		missing, fillMinute := false, false
+		for k, s := range in {
+			for s.ok && s.rec.Ts < ts {
+				s.next()
+			}
+			if s.ok && s.rec.Ts == ts {
+				tmp[k] = s.rec.Value
+			} else if v, ok := s.fill(ts, fill); ok {
+				tmp[k], fillMinute = v, true
+			} else {
+				missing = true
+			}
+		}
+		if !missing {
+			aggr.Put(tmp)
+			filled = filled || fillMinute
+		}
+	}
+	return filled
+}
+
+// recordStream is an iterator over datastore records with the current
+// record looked ahead.
+type recordStream struct {
+	it      datastore.Iterator
+	rec     datastore.Record
+	ok      bool
+	prev    datastore.Record
+	hasPrev bool
+	def     float64
+	hasDef  bool
+}
+
+func newRecordStream(it datastore.Iterator) *recordStream {
+	s := &recordStream{it: it}
+	s.next()
+	return s
+}
+
+func (s *recordStream) next() {
+	if s.ok {
+		s.prev, s.hasPrev = s.rec, true
+	}
+	s.rec, s.ok = s.it.Next()
+}
+
+// closeRecordStreams closes the streams and returns the first error any of
+// them encountered while reading.
+func closeRecordStreams(in []*recordStream) error {
+	var err error
+	for _, s := range in {
+		if e := s.it.Err(); e != nil && err == nil {
+			err = e
+		}
+		s.it.Close()
+	}
+	return err
+}
+
+func (srv *Server) LiveWatch(name string, chs []string) (*Watcher, error) {
+	srv.countQuery(name)
+	typ, err := metricTypeByChannels(chs)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		in:   make(chan []float64),
+		done: make(chan int),
+		out:  make(chan []float64),
+		chs:  make([]int, len(chs)),
+	}
+	w.C = w.out
+
+	for i, n := range chs {
+		w.chs[i] = getChannelIndex(typ, n)
+	}
+
+	me, err := srv.getMetricEntry(typ, name, true)
+	if err != nil {
+		return nil, err
+	}
+	defer me.Unlock()
+
+	w.me = me
+	w.Ts = me.lastTick
+	me.watchers = append(me.watchers, w)
+	go w.run()
+
+	return w, nil
+}
+
+func (srv *Server) Watch(ctx context.Context, name string, chs []string, offs, gran int64, aggr string) (*Watcher, error) {
+	return srv.WatchShift(ctx, name, chs, offs, gran, 0, aggr)
+}
+
+// WatchShift is like Watch, but when an interval ends the watcher emits the
+// values of the interval shift seconds away instead, e.g. the values of a
+// week ago with a shift of -604800. The shift has to be at least one
+// interval into the past.
+func (srv *Server) WatchShift(ctx context.Context, name string, chs []string, offs, gran, shift int64, aggr string) (*Watcher, error) {
+	srv.countQuery(name)
+	if offs%60 != 0 {
+		return nil, Error("Offset must be divisable by 60")
+	}
+	if gran < 1 || gran%60 != 0 {
+		return nil, ErrBadGranularity
+	}
+	if shift%60 != 0 {
+		return nil, Error("Shift must be divisable by 60")
+	}
+	if shift > -gran && shift != 0 {
+		return nil, Error("Shift must be at least one interval into the past")
+	}
+
+	typ, err := metricTypeByChannels(chs)
+	if err != nil {
+		return nil, err
+	}
+
+	me, err := srv.getMetricEntry(typ, name, true)
+	if err != nil {
+		return nil, err
+	}
+	defer me.Unlock()
+
+	return srv.watch(ctx, me, chs, offs, gran, shift, aggr)
+}
+
+// Series returns the aggregated values of a metric from a point in time up to
+// the current interval, and a Watcher that continues exactly where the
+// returned values end.
+func (srv *Server) Series(ctx context.Context, name string, chs []string, from, gran int64, aggr string) ([][]float64, *Watcher, error) {
+	srv.countQuery(name)
+	if from%60 != 0 {
+		return nil, nil, Error("From must be divisable by 60")
+	}
+	if gran < 1 || gran%60 != 0 {
+		return nil, nil, ErrBadGranularity
+	}
+
+	typ, err := metricTypeByChannels(chs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	me, err := srv.getMetricEntry(typ, name, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer me.Unlock()
+
+	start := me.lastTick - ((me.lastTick-from)%gran+gran)%gran
+	data, _, err := srv.log(ctx, me, chs, from, (start-from)/gran, gran, aggr, Fill{})
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := srv.watch(ctx, me, chs, from, gran, 0, aggr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, w, nil
+}
+
+func (srv *Server) watch(ctx context.Context, me *metricEntry, chs []string, offs, gran, shift int64, aggrName string) (*Watcher, error) {
+	typ, name := me.typ, me.name
+	aggr, err := createAggregator(typ, aggrName, chs)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		in:    make(chan []float64),
+		done:  make(chan int),
+		out:   make(chan []float64),
+		aggr:  aggr,
+		gran:  gran,
+		offs:  offs,
+		shift: shift,
+	}
+	w.chs = w.aggr.Channels()
+	w.C = w.out
+
+	w.me = me
+	w.Ts = me.lastTick - ((me.lastTick-offs)%gran+gran)%gran
+
+	if shift != 0 {
+		// The values are read from the datastore when the interval ends
+		me.watchers = append(me.watchers, w)
+		go w.run()
+		return w, nil
+	}
+
+	input, err := srv.initAggregator(ctx, w.aggr, name, typ, me.unsaved, w.Ts, w.Ts+gran, Fill{})
+	if err != nil {
+		return nil, err
+	}
+	feedAggregator(w.aggr, input, w.Ts, gran, Fill{})
+	if err := closeRecordStreams(input); err != nil {
+		return nil, err
+	}
+
+	me.watchers = append(me.watchers, w)
+	go w.run()
+
+	return w, nil
+}
+
+type MultiWatcher struct {
+	C        <-chan WatchRow
+	watchers []*Watcher
+	quit     chan int
+	once     sync.Once
+}
+
+// WatchRow is a row emitted by a MultiWatcher, tagged with its timestamp and
+// granularity.
+type WatchRow struct {
+	Ts     int64
+	Gran   int64
+	Values []float64
+}
+
+// MultiWatch watches the same channels of a metric with several
+// granularities at once. Rows of all granularities are emitted on the same
+// channel.
+func (srv *Server) MultiWatch(ctx context.Context, name string, chs []string, offs int64, grans []int64, aggr string) (*MultiWatcher, error) {
+	if len(grans) == 0 {
+		return nil, Error("No granularities specified")
+	}
+
+	mw := &MultiWatcher{quit: make(chan int)}
+	for _, gran := range grans {
+		w, err := srv.Watch(ctx, name, chs, offs, gran, aggr)
+		if err != nil {
+			mw.Close()
+			return nil, err
+		}
+		mw.watchers = append(mw.watchers, w)
+	}
+
+	out, wg := make(chan WatchRow), new(sync.WaitGroup)
+	mw.C = out
+	wg.Add(len(grans))
+	for i, w := range mw.watchers {
+		go func(w *Watcher, gran int64) {
+			defer wg.Done()
+			for ts, values := w.Ts, []float64(nil); ; ts += gran {
+				var ok bool
+				if values, ok = <-w.C; !ok {
+					return
+				}
+				select {
+				case out <- WatchRow{Ts: ts, Gran: gran, Values: values}:
+				case <-mw.quit:
+				}
+			}
+		}(w, grans[i])
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return mw, nil
+}
+
+// Err returns the reason the server closed one of the watchers, if any.
+func (mw *MultiWatcher) Err() error {
+	for _, w := range mw.watchers {
+		if err := w.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mw *MultiWatcher) Close() {
+	mw.once.Do(func() {
+		close(mw.quit)
+		for _, w := range mw.watchers {
+			w.Close()
+		}
+	})
+}
+
+// Err returns the reason the server closed the watcher, or nil if it was
+// closed by Close. It must only be called after C is closed.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+func (w *Watcher) Close() {
+	w.me.Lock()
+	defer w.me.Unlock()
+	w.me.endWatcher(w, nil)
+}
+
+// A watcher is ended by whoever removes it from its metric, with the metric
+// locked, so it is ended only once. Rows are only sent on in with the
+// metric locked and the watcher in place, so none are sent after done is
+// closed, and run can stop receiving them.
+
+// endWatcher removes a watcher from the metric and ends it with err, unless
+// it has been ended already.
+func (me *metricEntry) endWatcher(w *Watcher, err error) {
+	if me.removeWatcher(w) {
+		w.err = err
+		close(w.done)
+	}
+}
+
+// endWatchers ends all the watchers of the metric with err.
+func (me *metricEntry) endWatchers(err error) {
+	for _, w := range me.watchers {
+		w.err = err
+		close(w.done)
+	}
+	me.watchers = nil
+}
+
+// removeWatcher removes the watcher from the metric, and returns whether
+// it was found.
+func (me *metricEntry) removeWatcher(w *Watcher) bool {
+	for i, l := 0, len(me.watchers); i < l; i++ {
+		if me.watchers[i] == w {
+			me.watchers[i] = me.watchers[l-1]
+			me.watchers[l-1] = nil
+			me.watchers = me.watchers[:l-1]
+			if cap(me.watchers) > 2*len(me.watchers) {
+				me.watchers = append([]*Watcher(nil), me.watchers...)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// run passes the rows received on in to out, buffering them so that the
+// server never waits for the reader. Out is closed once the watcher has
+// ended and the rows buffered have been received.
+func (w *Watcher) run() {
+	defer close(w.out)
+
+	in, done := w.in, w.done
+	var buff [][]float64
+	for done != nil || len(buff) > 0 {
+		out, data := chan []float64(nil), []float64(nil)
+		if len(buff) > 0 {
+			out, data = w.out, buff[0]
+		}
+		select {
+		case out <- data:
+			buff[0] = nil
+			buff = buff[1:]
+		case data := <-in:
+			buff = append(buff, data)
+		case <-done:
+			in, done = nil, nil
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/adatboss/statsd/clock"
+	"github.com/adatboss/statsd/datastore"
+	"testing"
+	"time"
+)
+
+func TestStopLoads(t *testing.T) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+
+	start := int64(6000000)
+	if err := ds.Insert("g:gauge", datastore.Record{Ts: start - 60, Value: 10}); err != nil {
+		t.Fatal("Insert:", err)
+	}
+	c := clock.NewManual(time.Unix(start, 0))
+	srv := &Server{Ds: ds, Clock: c}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal("Start:", err)
+	}
+
+	done := make(chan int)
+	go func() {
+		if _, _, err := srv.Stop(); err != nil {
+			t.Error("Stop:", err)
+		}
+		close(done)
+	}()
+	for stopping := false; !stopping; {
+		srv.mu.Lock()
+		stopping = srv.stopping
+		srv.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	// Metrics created while stopping still start from their last values
+	if err := srv.Inject(&Metric{"g", Gauge, 1, 1, true}); err != nil {
+		t.Fatal("Inject:", err)
+	}
+	if err := srv.Promote(); err != ErrStopping {
+		t.Error("Promote should have failed:", err)
+	}
+	for {
+		select {
+		case <-done:
+		default:
+			c.AdvanceUntil(time.Second, done)
+			continue
+		}
+		break
+	}
+
+	r, err := ds.Query(context.Background(), "g:gauge", start, start+60)
+	if err != nil {
+		t.Fatal("Query:", err)
+	}
+	if expected := []datastore.Record{{Ts: start + 60, Value: 11}}; fmt.Sprint(r) != fmt.Sprint(expected) {
+		t.Error("Incorrect result")
+		t.Error("Expected:", expected)
+		t.Error("Result:", r)
+	}
+}
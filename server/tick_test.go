@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/adatboss/statsd/clock"
+	"github.com/adatboss/statsd/datastore"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClockJump(t *testing.T) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+
+	start := int64(6000000)
+	c := clock.NewManual(time.Unix(start, 0))
+	srv := &Server{Ds: ds, Clock: c}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal("Start:", err)
+	}
+	defer stopServer(t, srv, c)
+
+	liveLogSum(t, srv, "a")
+	w, err := srv.LiveWatch("a", []string{"counter"})
+	if err != nil {
+		t.Fatal("LiveWatch:", err)
+	}
+	if err := srv.Inject(&Metric{"a", Counter, 5, 1, false}); err != nil {
+		t.Fatal("Inject:", err)
+	}
+	c.Advance(10 * time.Second)
+	c.Jump(time.Hour)
+	c.Advance(time.Second)
+
+	// The ticks up to the end of the minute are handled, the rest of the
+	// hour is skipped
+	rows := 0
+	for timeout := time.After(5 * time.Second); ; rows++ {
+		select {
+		case _, ok := <-w.C:
+			if ok {
+				continue
+			}
+		case <-timeout:
+			t.Fatal("Watcher not closed")
+		}
+		break
+	}
+	if rows != 60 || w.Err() == nil {
+		t.Error("Incorrect watcher result:", rows, w.Err())
+	}
+
+	live, ts, err := srv.LiveLog("a", []string{"counter"})
+	if err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+	if ts != start+3611-LiveLogSize {
+		t.Error("Incorrect live log timestamp:", ts-start)
+	}
+	for i, row := range live {
+		if skipped := i < LiveLogSize-11; skipped != math.IsNaN(row[0]) || !skipped && row[0] != 0 {
+			t.Error("Incorrect live log row:", ts+1+int64(i)-start, row)
+			break
+		}
+	}
+
+	// No zeros are stored for the skipped minutes
+	r, err := ds.Query(context.Background(), "a:counter", 0, start+7200)
+	if err != nil {
+		t.Fatal("Query:", err)
+	}
+	if expected := []datastore.Record{{Ts: start + 60, Value: 5}}; fmt.Sprint(r) != fmt.Sprint(expected) {
+		t.Error("Incorrect records stored")
+		t.Error("Expected:", expected)
+		t.Error("Result:", r)
+	}
+}
+
+// lateClock oversleeps by late, and records when the sleeper woke up.
+type lateClock struct {
+	*clock.Manual
+	late  time.Duration
+	mu    sync.Mutex
+	wakes []time.Time
+}
+
+func (c *lateClock) Sleep(d time.Duration) {
+	c.Manual.Sleep(d + c.late)
+	c.mu.Lock()
+	c.wakes = append(c.wakes, c.Now())
+	c.mu.Unlock()
+}
+
+func TestTickAlignment(t *testing.T) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+
+	start := int64(6000000)
+	c := &lateClock{Manual: clock.NewManual(time.Unix(start, 3e8)), late: 10 * time.Millisecond}
+	srv := &Server{Ds: ds, Clock: c}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal("Start:", err)
+	}
+	for i := 0; i < 150; i++ {
+		if err := srv.Inject(&Metric{"a", Counter, 1, 1, false}); err != nil {
+			t.Fatal("Inject:", err)
+		}
+		c.Advance(time.Second)
+	}
+	stopServer(t, srv, c.Manual)
+
+	// Late wakeups don't add up
+	c.mu.Lock()
+	wakes := c.wakes
+	c.mu.Unlock()
+	if len(wakes) < 150 {
+		t.Fatal("Too few ticks:", len(wakes))
+	}
+	for i, wake := range wakes[:150] {
+		if expected := time.Unix(start+1+int64(i), 1e7); !wake.Equal(expected) {
+			t.Error("Incorrect tick:", i)
+			t.Error("Expected:", expected)
+			t.Error("Result:", wake)
+			break
+		}
+	}
+
+	r, err := ds.Query(context.Background(), "a:counter", 0, start+7200)
+	if err != nil {
+		t.Fatal("Query:", err)
+	}
+	if len(r) < 2 || r[0].Ts != start+60 || r[1].Ts != start+120 {
+		t.Error("Flushes not aligned to minutes:", r)
+	}
+}
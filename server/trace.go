@@ -0,0 +1,63 @@
+package server
+
+import (
+	"time"
+)
+
+// TraceStage identifies a stage of the ingestion pipeline.
+type TraceStage int
+
+const (
+	TraceParse TraceStage = iota
+	TraceInject
+	TraceTick
+	TraceFlush
+	TraceInsert
+)
+
+var traceStageNames = []string{"parse", "inject", "tick", "flush", "insert"}
+
+func (ts TraceStage) String() string {
+	if ts < 0 || int(ts) >= len(traceStageNames) {
+		return "unknown"
+	}
+	return traceStageNames[ts]
+}
+
+// TraceEvent describes a metric passing a stage of the pipeline, timed by
+// the clock of the server. Name is the metric name, except for TraceInsert,
+// where it is the datastore name, and for failed TraceParse events, where
+// it is empty.
+//
+// If Server.Trace is set, it is called with every event. It is called from
+// several goroutines at once, often with the metric locked, so it must be
+// quick and must not call back into the server.
+type TraceEvent struct {
+	Stage    TraceStage
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// traceStart returns the start time of a traced stage, or the zero time if
+// tracing is disabled, so untraced servers don't pay for reading the clock.
+func (srv *Server) traceStart() time.Time {
+	if srv.Trace == nil {
+		return time.Time{}
+	}
+	return srv.clock().Now()
+}
+
+func (srv *Server) trace(stage TraceStage, name string, start time.Time, err error) {
+	if srv.Trace == nil {
+		return
+	}
+	srv.Trace(TraceEvent{
+		Stage:    stage,
+		Name:     name,
+		Start:    start,
+		Duration: srv.clock().Now().Sub(start),
+		Err:      err,
+	})
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"github.com/adatboss/statsd/clock"
+	"github.com/adatboss/statsd/datastore"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTraceClock(t *testing.T) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+
+	var mu sync.Mutex
+	events := make(map[TraceStage][]TraceEvent)
+	start := int64(6000000)
+	c := clock.NewManual(time.Unix(start, 0))
+	srv := &Server{Ds: ds, Clock: c, Trace: func(ev TraceEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events[ev.Stage] = append(events[ev.Stage], ev)
+	}}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal("Start:", err)
+	}
+	srv.InjectBytes([]byte("a:1|c"))
+	c.Advance(60 * time.Second)
+	stopServer(t, srv, c)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var testCases = []struct {
+		stage TraceStage
+		name  string
+		ts    int64
+	}{
+		{TraceParse, "a", start},
+		{TraceInject, "a", start},
+		{TraceTick, "a", start + 1},
+		{TraceFlush, "a", start + 60},
+		{TraceInsert, "a:counter", start + 60},
+	}
+
+	for _, tc := range testCases {
+		if len(events[tc.stage]) == 0 {
+			t.Error("No event:", tc.stage)
+			continue
+		}
+		ev := events[tc.stage][0]
+		if ev.Name != tc.name || !ev.Start.Equal(time.Unix(tc.ts, 0)) || ev.Duration != 0 || ev.Err != nil {
+			t.Error("Incorrect result:", tc.stage)
+			t.Error("Expected:", tc.name, time.Unix(tc.ts, 0), 0, nil)
+			t.Error("Result:", ev.Name, ev.Start, ev.Duration, ev.Err)
+		}
+	}
+}
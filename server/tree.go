@@ -0,0 +1,71 @@
+package server
+
+import (
+	"sort"
+	"strings"
+)
+
+// TreeNode is a child in the dotted namespace of the stored metrics. It is
+// a leaf if there is a metric of that name, and a branch if there are
+// metrics below it; it can be both.
+type TreeNode struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Leaf   bool   `json:"leaf"`
+	Branch bool   `json:"branch"`
+}
+
+// MetricTree returns the immediate children of path, sorted by name. The
+// empty path is the root of the namespace.
+func (srv *Server) MetricTree(path string) ([]TreeNode, error) {
+	path = strings.TrimSuffix(path, ".")
+	if path != "" {
+		if err := CheckMetricName(path); err != nil {
+			return nil, err
+		}
+	}
+	names, err := srv.Ds.ListNames("*")
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := srv.Prefix
+	if path != "" {
+		prefix += path + "."
+	}
+	nodes := make(map[string]*TreeNode)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		name = name[len(prefix):]
+		if i := strings.LastIndexByte(name, ':'); i != -1 {
+			name = name[:i]
+		}
+		child, branch := name, false
+		if i := strings.IndexByte(name, '.'); i != -1 {
+			child, branch = name[:i], true
+		}
+		if child == "" {
+			continue
+		}
+
+		node := nodes[child]
+		if node == nil {
+			node = &TreeNode{Name: child, Path: child}
+			if path != "" {
+				node.Path = path + "." + child
+			}
+			nodes[child] = node
+		}
+		node.Branch = node.Branch || branch
+		node.Leaf = node.Leaf || !branch
+	}
+
+	r := make([]TreeNode, 0, len(nodes))
+	for _, node := range nodes {
+		r = append(r, *node)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r, nil
+}
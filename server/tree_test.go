@@ -0,0 +1,62 @@
+package server
+
+import (
+	"github.com/adatboss/statsd/datastore"
+	"reflect"
+	"testing"
+)
+
+func TestMetricTree(t *testing.T) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	names := []string{
+		"p.web.frontend.hits:counter",
+		"p.web.frontend.hits:rate",
+		"p.web.frontend.latency.p99:gauge",
+		"p.web.frontend:gauge",
+		"p.web.backend.errors:counter",
+		"p.db:gauge",
+		"q.web.other:gauge",
+	}
+	for _, name := range names {
+		if err := ds.Insert(name, datastore.Record{Ts: 60, Value: 1}); err != nil {
+			t.Fatal("Insert:", err)
+		}
+	}
+	srv := &Server{Ds: ds, Prefix: "p."}
+
+	var testCases = []struct {
+		path  string
+		nodes []TreeNode
+	}{
+		{"", []TreeNode{
+			{Name: "db", Path: "db", Leaf: true},
+			{Name: "web", Path: "web", Branch: true},
+		}},
+		{"web", []TreeNode{
+			{Name: "backend", Path: "web.backend", Branch: true},
+			{Name: "frontend", Path: "web.frontend", Leaf: true, Branch: true},
+		}},
+		{"web.frontend.", []TreeNode{
+			{Name: "hits", Path: "web.frontend.hits", Leaf: true},
+			{Name: "latency", Path: "web.frontend.latency", Branch: true},
+		}},
+		{"web.fr", []TreeNode{}},
+		{"db", []TreeNode{}},
+	}
+	for _, tc := range testCases {
+		nodes, err := srv.MetricTree(tc.path)
+		if err != nil || !reflect.DeepEqual(nodes, tc.nodes) {
+			t.Error("Incorrect result:", tc.path)
+			t.Error("Expected:", tc.nodes)
+			t.Error("Result:", nodes, err)
+		}
+	}
+
+	if _, err := srv.MetricTree("web:counter"); err == nil {
+		t.Error("MetricTree should have failed")
+	}
+}
@@ -1,12 +1,13 @@
-package main
+package server
 
 func init() {
 	mt := metricType{
-		create:     func() metric { return &accMetric{} },
+		name:       "acc",
+		create:     func(*Server) metric { return &accMetric{} },
 		channels:   []string{"acc"},
 		defaults:   []float64{0},
 		persist:    []bool{true},
-		aggregator: func([]string) aggregator { return &accAggregator{} },
+		aggregator: func([]string) Aggregator { return &accAggregator{} },
 	}
 	registerMetricType(Accumulator, mt)
 }
@@ -35,18 +36,18 @@ type accAggregator struct {
 	value float64
 }
 
-func (aggr *accAggregator) channels() []int {
+func (aggr *accAggregator) Channels() []int {
 	return []int{0}
 }
 
-func (aggr *accAggregator) init(data []float64) {
+func (aggr *accAggregator) Init(data []float64) {
 	aggr.value = data[0]
 }
 
-func (aggr *accAggregator) put(data []float64) {
+func (aggr *accAggregator) Put(data []float64) {
 	aggr.value = data[0]
 }
 
-func (aggr *accAggregator) get() []float64 {
+func (aggr *accAggregator) Get() []float64 {
 	return []float64{aggr.value}
 }
@@ -1,10 +1,11 @@
-package main
+package server
 
 import "math"
 
 func init() {
 	mt := metricType{
-		create:     func() metric { return &avgMetric{} },
+		name:       "avg",
+		create:     func(*Server) metric { return &avgMetric{} },
 		channels:   []string{"avg", "avg-cnt"},
 		defaults:   []float64{math.NaN(), 0},
 		persist:    []bool{false, false},
@@ -44,7 +45,7 @@ type avgAggregator struct {
 	sum, cnt       float64
 }
 
-func createAvgAggregator(chs []string) aggregator {
+func createAvgAggregator(chs []string) Aggregator {
 	aggr := &avgAggregator{avgOut: -1, cntOut: -1}
 	for i, ch := range chs {
 		if ch == "avg" {
@@ -57,7 +58,7 @@ func createAvgAggregator(chs []string) aggregator {
 	return aggr
 }
 
-func (aggr *avgAggregator) channels() []int {
+func (aggr *avgAggregator) Channels() []int {
 	if aggr.avgOut == -1 {
 		return []int{1}
 	} else {
@@ -65,10 +66,10 @@ func (aggr *avgAggregator) channels() []int {
 	}
 }
 
-func (aggr *avgAggregator) init([]float64) {
+func (aggr *avgAggregator) Init([]float64) {
 }
 
-func (aggr *avgAggregator) put(data []float64) {
+func (aggr *avgAggregator) Put(data []float64) {
 	if aggr.avgOut != -1 {
 		aggr.sum += data[0] * data[1]
 		aggr.cnt += data[1]
@@ -77,7 +78,7 @@ func (aggr *avgAggregator) put(data []float64) {
 	}
 }
 
-func (aggr *avgAggregator) get() []float64 {
+func (aggr *avgAggregator) Get() []float64 {
 	avg, cnt := aggr.sum/aggr.cnt, aggr.cnt
 	aggr.sum, aggr.cnt = 0, 0
 	switch aggr.avgOut {
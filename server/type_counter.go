@@ -1,12 +1,13 @@
-package main
+package server
 
 func init() {
 	mt := metricType{
-		create:     func() metric { return &counterMetric{} },
+		name:       "counter",
+		create:     func(*Server) metric { return &counterMetric{} },
 		channels:   []string{"counter"},
 		defaults:   []float64{0},
 		persist:    []bool{false},
-		aggregator: func([]string) aggregator { return &counterAggregator{} },
+		aggregator: func([]string) Aggregator { return &counterAggregator{} },
 	}
 	registerMetricType(Counter, mt)
 }
@@ -39,18 +40,18 @@ type counterAggregator struct {
 	sum float64
 }
 
-func (aggr *counterAggregator) channels() []int {
+func (aggr *counterAggregator) Channels() []int {
 	return []int{0}
 }
 
-func (aggr *counterAggregator) init([]float64) {
+func (aggr *counterAggregator) Init([]float64) {
 }
 
-func (aggr *counterAggregator) put(data []float64) {
+func (aggr *counterAggregator) Put(data []float64) {
 	aggr.sum += data[0]
 }
 
-func (aggr *counterAggregator) get() []float64 {
+func (aggr *counterAggregator) Get() []float64 {
 	sum := aggr.sum
 	aggr.sum = 0
 	return []float64{sum}
@@ -0,0 +1,146 @@
+package server
+
+import "math"
+
+func init() {
+	mt := metricType{
+		name:       "gauge",
+		create:     func(*Server) metric { return &gaugeMetric{} },
+		channels:   []string{"gauge", "gauge-min", "gauge-max", "gauge-avg"},
+		defaults:   []float64{0, math.NaN(), math.NaN(), math.NaN()},
+		persist:    []bool{true, false, false, false},
+		aggregator: createGaugeAggregator,
+	}
+	registerMetricType(Gauge, mt)
+}
+
+type gaugeMetric struct {
+	value            float64
+	tickMin, tickMax float64
+	min, max         float64
+	sum, n           float64
+}
+
+func (m *gaugeMetric) init(data []float64) {
+	m.value = data[0]
+	m.tickMin, m.tickMax = m.value, m.value
+	m.min, m.max = m.value, m.value
+}
+
+func (m *gaugeMetric) inject(metric *Metric) {
+	if !metric.Delta {
+		m.value = metric.Value
+	} else if math.IsNaN(m.value) {
+		m.value = metric.Value
+	} else {
+		m.value += metric.Value
+	}
+	m.tickMin = minValue(m.tickMin, m.value)
+	m.tickMax = maxValue(m.tickMax, m.value)
+}
+
+func (m *gaugeMetric) tick() []float64 {
+	r := []float64{m.value, m.tickMin, m.tickMax, m.value}
+	m.min = minValue(m.min, m.tickMin)
+	m.max = maxValue(m.max, m.tickMax)
+	if !math.IsNaN(m.value) {
+		m.sum += m.value
+		m.n++
+	}
+	m.tickMin, m.tickMax = m.value, m.value
+	return r
+}
+
+// minValue is like math.Min, but NaN only if both values are, since gauges
+// starting from NaN have no value until the first update.
+func minValue(x, y float64) float64 {
+	if math.IsNaN(x) || y < x {
+		return y
+	}
+	return x
+}
+
+func maxValue(x, y float64) float64 {
+	if math.IsNaN(x) || y > x {
+		return y
+	}
+	return x
+}
+
+func (m *gaugeMetric) flush() []float64 {
+	// Every second of the interval has the same weight in the average
+	r := []float64{m.value, m.min, m.max, m.sum / m.n}
+	m.min, m.max = m.value, m.value
+	m.sum, m.n = 0, 0
+	return r
+}
+
+type gaugeAggregator struct {
+	chs      []int
+	value    float64
+	min, max float64
+	sum, n   float64
+}
+
+func createGaugeAggregator(chs []string) Aggregator {
+	aggr := &gaugeAggregator{chs: make([]int, len(chs))}
+	for i, ch := range chs {
+		aggr.chs[i] = getChannelIndex(Gauge, ch)
+	}
+	aggr.reset()
+	return aggr
+}
+
+func (aggr *gaugeAggregator) Channels() []int {
+	return aggr.chs
+}
+
+func (aggr *gaugeAggregator) Init(data []float64) {
+	for i, j := range aggr.chs {
+		if j == 0 {
+			aggr.value = data[i]
+		}
+	}
+}
+
+func (aggr *gaugeAggregator) Put(data []float64) {
+	for i, j := range aggr.chs {
+		switch j {
+		case 0:
+			aggr.value = data[i]
+		case 1:
+			aggr.min = minValue(aggr.min, data[i])
+		case 2:
+			aggr.max = maxValue(aggr.max, data[i])
+		case 3:
+			// Intervals before the first update have no average
+			if !math.IsNaN(data[i]) {
+				aggr.sum += data[i]
+				aggr.n++
+			}
+		}
+	}
+}
+
+func (aggr *gaugeAggregator) Get() []float64 {
+	r := make([]float64, len(aggr.chs))
+	for i, j := range aggr.chs {
+		switch j {
+		case 0:
+			r[i] = aggr.value
+		case 1:
+			r[i] = aggr.min
+		case 2:
+			r[i] = aggr.max
+		case 3:
+			r[i] = aggr.sum / aggr.n
+		}
+	}
+	aggr.reset()
+	return r
+}
+
+func (aggr *gaugeAggregator) reset() {
+	aggr.min, aggr.max = math.NaN(), math.NaN()
+	aggr.sum, aggr.n = 0, 0
+}
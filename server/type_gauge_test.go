@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestGaugeMetric(t *testing.T) {
+	nan := math.NaN()
+	type tick struct {
+		injects []Metric
+		row     []float64
+	}
+
+	var testCases = []struct {
+		init  float64
+		ticks []tick
+		flush []float64
+	}{
+		// Several updates within a tick
+		{5, []tick{
+			{[]Metric{{Value: 3}, {Value: 8}, {Value: 6}}, []float64{6, 3, 8, 6}},
+			{nil, []float64{6, 6, 6, 6}},
+			{[]Metric{{Value: 4, Delta: true}, {Value: -12, Delta: true}}, []float64{-2, -2, 10, -2}},
+		}, []float64{-2, -2, 10, 10.0 / 3}},
+		{5, []tick{
+			{nil, []float64{5, 5, 5, 5}},
+		}, []float64{5, 5, 5, 5}},
+		// No value until the first update
+		{nan, []tick{
+			{nil, []float64{nan, nan, nan, nan}},
+			{[]Metric{{Value: 2, Delta: true}, {Value: 1, Delta: true}}, []float64{3, 2, 3, 3}},
+			{[]Metric{{Value: 7}, {Value: 1}}, []float64{1, 1, 7, 1}},
+		}, []float64{1, 1, 7, 2}},
+	}
+
+	for _, tc := range testCases {
+		m := &gaugeMetric{}
+		m.init([]float64{tc.init, nan, nan, nan})
+		for _, tk := range tc.ticks {
+			for i := range tk.injects {
+				tk.injects[i].SampleRate = 1
+				m.inject(&tk.injects[i])
+			}
+			if row := m.tick(); fmt.Sprint(row) != fmt.Sprint(tk.row) {
+				t.Error("Incorrect tick:", tc.init, tk.injects)
+				t.Error("Expected:", tk.row)
+				t.Error("Result:", row)
+			}
+		}
+		if row := m.flush(); fmt.Sprint(row) != fmt.Sprint(tc.flush) {
+			t.Error("Incorrect flush:", tc.init, tc.ticks)
+			t.Error("Expected:", tc.flush)
+			t.Error("Result:", row)
+		}
+
+		// The next interval starts from the last value
+		if row := m.flush(); row[1] != row[0] || row[2] != row[0] {
+			t.Error("Min and max not reset:", row)
+		}
+	}
+}
+
+func TestGaugeAggregator(t *testing.T) {
+	aggr := createGaugeAggregator([]string{"gauge-avg", "gauge", "gauge-max", "gauge-min"})
+	aggr.Init([]float64{0, 4, 0, 0})
+	if r := aggr.Get(); fmt.Sprint(r) != fmt.Sprint([]float64{math.NaN(), 4, math.NaN(), math.NaN()}) {
+		t.Error("Incorrect result of an empty interval:", r)
+	}
+
+	aggr.Put([]float64{2, 3, 5, 1})
+	aggr.Put([]float64{4, 6, 9, 2})
+	if r := aggr.Get(); fmt.Sprint(r) != fmt.Sprint([]float64{3, 6, 9, 1}) {
+		t.Error("Incorrect result:", r)
+	}
+	if r := aggr.Get(); fmt.Sprint(r) != fmt.Sprint([]float64{math.NaN(), 6, math.NaN(), math.NaN()}) {
+		t.Error("Incorrect result of an empty interval:", r)
+	}
+
+	// Intervals without a value are left out
+	nan := math.NaN()
+	aggr.Put([]float64{nan, nan, nan, nan})
+	aggr.Put([]float64{2, 2, 5, 1})
+	if r := aggr.Get(); fmt.Sprint(r) != fmt.Sprint([]float64{2, 2, 5, 1}) {
+		t.Error("Incorrect result with missing values:", r)
+	}
+}
@@ -1,13 +1,15 @@
-package main
+package server
 
 import (
 	"math"
+	"math/rand"
 	"sort"
 )
 
 func init() {
 	mt := metricType{
-		create: func() metric { return &timerMetric{} },
+		name:   "timer",
+		create: func(srv *Server) metric { return newTimerMetric(srv.TimerSamples) },
 		channels: []string{
 			"timer-min",
 			"timer-quart1",
@@ -38,31 +40,71 @@ func init() {
 }
 
 type timerMetric struct {
-	tickData, data []float64
-	tickCnt, cnt   []float64
+	tickSamples, samples timerSamples
+}
+
+func newTimerMetric(size int) *timerMetric {
+	return &timerMetric{tickSamples: timerSamples{size: size}, samples: timerSamples{size: size}}
 }
 
 func (m *timerMetric) init([]float64) {
 }
 
 func (m *timerMetric) inject(metric *Metric) {
-	m.tickData = append(m.tickData, metric.Value)
-	m.tickCnt = append(m.tickCnt, 1/metric.SampleRate)
+	m.tickSamples.add(metric.Value, 1/metric.SampleRate)
+	m.samples.add(metric.Value, 1/metric.SampleRate)
 }
 
 func (m *timerMetric) tick() []float64 {
-	stats := timerStats(m.tickData, m.tickCnt)
-	m.data = append(m.data, m.tickData...)
-	m.cnt = append(m.cnt, m.tickCnt...)
-	m.tickData = make([]float64, 0, 2*len(m.tickData))
-	m.tickCnt = make([]float64, 0, len(m.tickData))
-	return stats
+	return m.tickSamples.stats()
 }
 
 func (m *timerMetric) flush() []float64 {
-	stats := timerStats(m.data, m.cnt)
-	m.data = make([]float64, 0, 2*len(m.data))
-	m.cnt = make([]float64, 0, len(m.data))
+	return m.samples.stats()
+}
+
+// Server.TimerSamples limits the number of samples a timer keeps between
+// flushes. If there are more samples, a uniform random subset of them is
+// used to calculate the quartiles. Minimum, maximum and count are always
+// exact. Zero means no limit.
+type timerSamples struct {
+	size      int
+	data, cnt []float64
+	seen      int
+	min, max  float64
+	n         float64
+}
+
+func (s *timerSamples) add(value, cnt float64) {
+	if s.seen == 0 {
+		s.min, s.max = value, value
+	} else {
+		s.min, s.max = math.Min(s.min, value), math.Max(s.max, value)
+	}
+	s.seen++
+	s.n += cnt
+
+	if s.size <= 0 || len(s.data) < s.size {
+		s.data = append(s.data, value)
+		s.cnt = append(s.cnt, cnt)
+	} else if i := rand.Intn(s.seen); i < len(s.data) {
+		s.data[i], s.cnt[i] = value, cnt
+	}
+}
+
+func (s *timerSamples) stats() []float64 {
+	stats := timerStats(s.data, s.cnt)
+	if s.seen > 0 {
+		stats[0], stats[4], stats[5] = s.min, s.max, s.n
+	}
+
+	if l := len(s.data); cap(s.data) > 4*l {
+		s.data = make([]float64, 0, 2*l)
+		s.cnt = make([]float64, 0, 2*l)
+	} else {
+		s.data, s.cnt = s.data[:0], s.cnt[:0]
+	}
+	s.seen, s.n = 0, 0
 	return stats
 }
 
@@ -114,7 +156,7 @@ type timerAggregator struct {
 	data, cnt []float64
 }
 
-func createTimerAggregator(chs []string) aggregator {
+func createTimerAggregator(chs []string) Aggregator {
 	aggr := &timerAggregator{chs: make([]int, len(chs))}
 	for i, ch := range chs {
 		for j, ch2 := range metricTypes[Timer].channels {
@@ -127,19 +169,19 @@ func createTimerAggregator(chs []string) aggregator {
 	return aggr
 }
 
-func (aggr *timerAggregator) channels() []int {
+func (aggr *timerAggregator) Channels() []int {
 	return []int{0, 1, 2, 3, 4, 5}
 }
 
-func (aggr *timerAggregator) init(data []float64) {
+func (aggr *timerAggregator) Init(data []float64) {
 }
 
-func (aggr *timerAggregator) put(data []float64) {
+func (aggr *timerAggregator) Put(data []float64) {
 	aggr.data = append(aggr.data, data[0], data[1], data[2], data[3], data[4])
 	aggr.cnt = append(aggr.cnt, data[5], data[5], data[5], data[5], data[5])
 }
 
-func (aggr *timerAggregator) get() []float64 {
+func (aggr *timerAggregator) Get() []float64 {
 	// TODO: optimize
 	stats := timerStats(aggr.data, aggr.cnt)
 	stats[5] /= 5
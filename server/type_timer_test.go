@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestTimerReservoir(t *testing.T) {
+	var testCases = []struct {
+		size, n int
+		exact   bool
+	}{
+		{0, 10000, true},
+		{10000, 10000, true},
+		{1000, 10000, false},
+		{1000, 100000, false},
+	}
+
+	for _, tc := range testCases {
+		m := newTimerMetric(tc.size)
+		for interval := 0; interval < 2; interval++ {
+			for i := 0; i < tc.n; i++ {
+				// Every value between 1 and n, in an order uncorrelated with the values
+				v := float64((i*7919)%tc.n + 1)
+				m.inject(&Metric{Value: v, SampleRate: 1})
+			}
+			if l := len(m.samples.data); tc.size > 0 && l > tc.size || l > tc.n {
+				t.Error("Too many samples kept:", tc.size, tc.n, l)
+			}
+			m.tick()
+			r := m.flush()
+
+			n := float64(tc.n)
+			expected := []float64{1, n / 4, n / 2, n * 3 / 4, n, n}
+			if tc.exact && fmt.Sprint(r) != fmt.Sprint(expected) {
+				t.Error("Incorrect result:", tc.size, tc.n)
+				t.Error("Expected:", expected)
+				t.Error("Result:", r)
+			}
+			// The quartiles are estimated within a few standard deviations
+			for i, v := range r {
+				if math.Abs(v-expected[i]) > n/10 || (i == 0 || i >= 4) && v != expected[i] {
+					t.Error("Incorrect result:", tc.size, tc.n, i)
+					t.Error("Expected:", expected[i])
+					t.Error("Result:", v)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"math"
+	"sync"
+)
+
+type MetricType int64
+
+const (
+	Counter = MetricType(iota)
+	Timer
+	Gauge
+	Averager
+	Accumulator
+	NMetricTypes = iota
+)
+
+var (
+	metricTypes    [NMetricTypes]metricType
+	outputChannels map[string]MetricType = make(map[string]MetricType)
+	aggregatorsMu  sync.RWMutex
+	aggregators    [NMetricTypes]map[string]func([]string) Aggregator
+)
+
+type metric interface {
+	init([]float64)
+	inject(*Metric)
+	tick() []float64
+	flush() []float64
+}
+
+// Aggregator combines the values of consecutive intervals into one value
+// per requested output channel. Channels returns the indices of the input
+// channels it needs; Init receives their values before the first interval,
+// Put their values in every interval. Get returns the aggregated output
+// and starts a new aggregation.
+type Aggregator interface {
+	Channels() []int
+	Init([]float64)
+	Put([]float64)
+	Get() []float64
+}
+
+type metricType struct {
+	name       string
+	create     func(*Server) metric
+	channels   []string
+	defaults   []float64
+	persist    []bool
+	aggregator func([]string) Aggregator
+}
+
+type TypeInfo struct {
+	Name     string        `json:"name"`
+	Channels []ChannelInfo `json:"channels"`
+}
+
+type ChannelInfo struct {
+	Name    string   `json:"name"`
+	Default *float64 `json:"default"`
+	Persist bool     `json:"persist"`
+}
+
+// MetricTypes describes the registered metric types. Defaults are nil
+// where the default value is NaN.
+func MetricTypes() []TypeInfo {
+	types := make([]TypeInfo, len(metricTypes))
+	for i, mt := range metricTypes {
+		types[i] = TypeInfo{Name: mt.name}
+		for j, ch := range mt.channels {
+			ci := ChannelInfo{Name: ch, Persist: mt.persist[j]}
+			if def := mt.defaults[j]; !math.IsNaN(def) {
+				ci.Default = &def
+			}
+			types[i].Channels = append(types[i].Channels, ci)
+		}
+	}
+	return types
+}
+
+func registerMetricType(typ MetricType, mt metricType) {
+	metricTypes[typ] = mt
+	for _, ch := range mt.channels {
+		outputChannels[ch] = typ
+	}
+}
+
+// RegisterAggregator registers a named aggregator for a metric type, which
+// can be selected by queries instead of the default aggregator of the type.
+// create is called with the requested output channels. It is safe to call
+// while servers are running.
+func RegisterAggregator(typ MetricType, name string, create func([]string) Aggregator) error {
+	if typ >= NMetricTypes || typ < 0 {
+		return ErrTypeInvalid
+	}
+	if len(name) == 0 {
+		return Error("Aggregator name missing")
+	}
+	aggregatorsMu.Lock()
+	defer aggregatorsMu.Unlock()
+	if aggregators[typ] == nil {
+		aggregators[typ] = make(map[string]func([]string) Aggregator)
+	}
+	if _, ok := aggregators[typ][name]; ok {
+		return Error("Aggregator already registered: " + name)
+	}
+	aggregators[typ][name] = create
+	return nil
+}
+
+func createAggregator(typ MetricType, name string, chs []string) (Aggregator, error) {
+	if len(name) == 0 {
+		return metricTypes[typ].aggregator(chs), nil
+	}
+	aggregatorsMu.RLock()
+	create, ok := aggregators[typ][name]
+	aggregatorsMu.RUnlock()
+	if !ok {
+		return nil, Error("No such aggregator: " + name)
+	}
+	return create(chs), nil
+}
+
+func metricTypeByChannels(chs []string) (MetricType, error) {
+	if len(chs) == 0 {
+		return -1, Error("No channels specified")
+	}
+
+	typ, ok := outputChannels[chs[0]]
+	if !ok {
+		return -1, Error("No such channel: " + chs[0])
+	}
+
+	names := map[string]bool{chs[0]: true}
+	for _, ch := range chs[1:] {
+		t, ok := outputChannels[ch]
+		if !ok {
+			return -1, Error("No such channel: " + ch)
+		}
+		if t != typ {
+			return -1, Error("Cannot mix different metric types")
+		}
+		if names[ch] {
+			return -1, Error("Channel names must be unique: " + ch)
+		}
+		names[ch] = true
+	}
+	return typ, nil
+}
+
+// ChannelIndex returns the index of a channel of a metric type, or -1 if
+// the type has no such channel.
+func ChannelIndex(typ MetricType, ch string) int {
+	return getChannelIndex(typ, ch)
+}
+
+func getChannelIndex(typ MetricType, ch string) int {
+	for i, n := range metricTypes[typ].channels {
+		if n == ch {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMetricTypeByChannels(t *testing.T) {
+	var testCases = []struct {
+		chs []string
+		typ MetricType
+	}{
+		{[]string{}, -1},
+		{[]string{"xyz"}, -1},
+		{[]string{"avg"}, Averager},
+		{[]string{"avg", "xyz"}, -1},
+		{[]string{"avg", "counter"}, -1},
+		{[]string{"avg", "avg-cnt"}, Averager},
+		{[]string{"avg", "avg-cnt", "counter"}, -1},
+		{[]string{"gauge-min", "gauge"}, Gauge},
+	}
+
+	for _, tc := range testCases {
+		mt, err := metricTypeByChannels(tc.chs)
+		if tc.typ == -1 {
+			if mt != -1 {
+				t.Error("Should have failed:", tc.chs)
+			} else if err == nil {
+				t.Error("nil error:", tc.chs)
+			}
+		} else {
+			if mt == -1 {
+				t.Error("Shouldn't have failed:", tc.chs)
+				t.Error("Error:", err)
+				t.Error("Expected:", tc.typ)
+			} else if mt != tc.typ {
+				t.Error("Incorrect result:", tc.chs)
+				t.Error("Expected:", tc.typ)
+				t.Error("Result:", mt)
+			} else if err != nil {
+				t.Error("Non-nil error:", tc.chs)
+				t.Error("Error:", err)
+			}
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func TestGetChannelIndex(t *testing.T) {
+	var testCases = []struct {
+		typ MetricType
+		ch  string
+		ok  bool
+	}{
+		{Counter, "counter", true},
+		{Timer, "timer-min", true},
+		{Gauge, "gauge", true},
+		{Gauge, "gauge-max", true},
+		{Averager, "avg", true},
+		{Accumulator, "acc", true},
+		{Counter, "xyz", false},
+		{Counter, "timer-min", false},
+	}
+
+	for _, tc := range testCases {
+		i := getChannelIndex(tc.typ, tc.ch)
+		if tc.ok {
+			if i == -1 {
+				t.Error("Shouldn't have failed:", tc.typ, tc.ch)
+			} else if metricTypes[tc.typ].channels[i] != tc.ch {
+				t.Error("Incorrect result:", tc.typ, tc.ch)
+				t.Error("Result:", i)
+			}
+		} else {
+			if i != -1 {
+				t.Error("Should have failed:", tc.typ, tc.ch)
+				t.Error("Result:", i)
+			}
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+type testMaxAggregator struct {
+	max float64
+}
+
+func (aggr *testMaxAggregator) Channels() []int {
+	return []int{0}
+}
+
+func (aggr *testMaxAggregator) Init([]float64) {
+}
+
+func (aggr *testMaxAggregator) Put(data []float64) {
+	if data[0] > aggr.max {
+		aggr.max = data[0]
+	}
+}
+
+func (aggr *testMaxAggregator) Get() []float64 {
+	max := aggr.max
+	aggr.max = 0
+	return []float64{max}
+}
+
+func TestRegisterAggregator(t *testing.T) {
+	create := func([]string) Aggregator { return &testMaxAggregator{} }
+	if err := RegisterAggregator(Counter, "test-max", create); err != nil {
+		t.Fatal("RegisterAggregator:", err)
+	}
+	if err := RegisterAggregator(Counter, "test-max", create); err == nil {
+		t.Error("Registering a name twice should have failed")
+	}
+	if err := RegisterAggregator(NMetricTypes, "test-max", create); err == nil {
+		t.Error("Registering for an invalid type should have failed")
+	}
+
+	aggr, err := createAggregator(Counter, "test-max", []string{"counter"})
+	if err != nil {
+		t.Fatal("createAggregator:", err)
+	}
+	for _, v := range []float64{1, 3, 2} {
+		aggr.Put([]float64{v})
+	}
+	if r := aggr.Get(); r[0] != 3 {
+		t.Error("Incorrect result:", r)
+	}
+
+	if _, err := createAggregator(Gauge, "test-max", []string{"gauge"}); err == nil {
+		t.Error("Aggregator should only be registered for counters")
+	}
+	if _, err := createAggregator(Gauge, "", []string{"gauge"}); err != nil {
+		t.Error("Default aggregator missing:", err)
+	}
+}
+
+func TestRegisterAggregatorConcurrently(t *testing.T) {
+	create := func([]string) Aggregator { return &testMaxAggregator{} }
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		name := "test-concurrent-" + strconv.Itoa(i)
+		go func() {
+			defer wg.Done()
+			// Fails if registered by an earlier run of the test
+			RegisterAggregator(Counter, name, create)
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				createAggregator(Counter, name, []string{"counter"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		if _, err := createAggregator(Counter, "test-concurrent-"+strconv.Itoa(i), []string{"counter"}); err != nil {
+			t.Error("createAggregator:", err)
+		}
+	}
+}
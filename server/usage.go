@@ -0,0 +1,80 @@
+package server
+
+import (
+	"github.com/adatboss/statsd/datastore"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Usage counts the work done by a Server since it was started. TickTime is
+// how long the last tick took in microseconds, and MaxTickTime the longest
+// tick of the current minute; a tick taking more than a second delays the
+// next ones.
+type Usage struct {
+	Injected    int64 `json:"injected"`
+	Inserted    int64 `json:"inserted"`
+	Queries     int64 `json:"queries"`
+	TickTime    int64 `json:"tickTime"`
+	MaxTickTime int64 `json:"maxTickTime"`
+}
+
+func (srv *Server) Usage() Usage {
+	return Usage{
+		Injected:    atomic.LoadInt64(&srv.usage.Injected),
+		Inserted:    atomic.LoadInt64(&srv.usage.Inserted),
+		Queries:     atomic.LoadInt64(&srv.usage.Queries),
+		TickTime:    atomic.LoadInt64(&srv.usage.TickTime),
+		MaxTickTime: atomic.LoadInt64(&srv.usage.MaxTickTime),
+	}
+}
+
+// countTick records the duration of a tick. The server is locked.
+func (srv *Server) countTick(d time.Duration) {
+	us := int64(d / time.Microsecond)
+	atomic.StoreInt64(&srv.usage.TickTime, us)
+	if us > atomic.LoadInt64(&srv.usage.MaxTickTime) {
+		atomic.StoreInt64(&srv.usage.MaxTickTime, us)
+	}
+}
+
+func (srv *Server) countQuery(name string) {
+	atomic.AddInt64(&srv.usage.Queries, 1)
+	atomic.AddInt64(&srv.getPrefixCounters(name).queries, 1)
+}
+
+// saveUsage stores the usage of the last interval in the datastore as
+// counters named UsagePrefix + ".injected", ".inserted" and ".queries", so
+// daily totals can be queried like any other counter, and the longest tick
+// as the gauge UsagePrefix + ".ticktime".
+func (srv *Server) saveUsage() {
+	srv.savePrefixUsage()
+	u := srv.Usage()
+	last := srv.lastUsage
+	srv.lastUsage = u
+	atomic.StoreInt64(&srv.usage.MaxTickTime, 0)
+	if len(srv.UsagePrefix) == 0 || srv.isReplica() {
+		return
+	}
+
+	values := []struct {
+		name  string
+		value int64
+	}{
+		{".injected", u.Injected - last.Injected},
+		{".inserted", u.Inserted - last.Inserted},
+		{".queries", u.Queries - last.Queries},
+	}
+	for _, v := range values {
+		name := srv.Prefix + srv.UsagePrefix + v.name + ":counter"
+		rec := datastore.Record{Ts: srv.lastTick, Value: float64(v.value)}
+		if err := srv.Ds.Insert(name, rec); err != nil {
+			log.Println("Server.saveUsage:", err)
+		}
+	}
+	name := srv.Prefix + srv.UsagePrefix + ".ticktime:gauge"
+	rec := datastore.Record{Ts: srv.lastTick, Value: float64(u.MaxTickTime)}
+	if err := srv.Ds.Insert(name, rec); err != nil {
+		log.Println("Server.saveUsage:", err)
+	}
+}
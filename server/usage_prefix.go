@@ -0,0 +1,138 @@
+package server
+
+import (
+	"github.com/adatboss/statsd/datastore"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// PrefixUsage is the usage of the metrics of a prefix (see
+// datastore.NamePrefix) since the start of the day in UTC. Rate is the
+// number of metrics injected per second during the last minute, and Bytes
+// the storage used by the series of the prefix, which is only known if the
+// server has no Prefix.
+type PrefixUsage struct {
+	Prefix   string  `json:"prefix"`
+	Injected int64   `json:"injected"`
+	Rate     float64 `json:"rate"`
+	Queries  int64   `json:"queries"`
+	Bytes    int64   `json:"bytes"`
+}
+
+type prefixCounters struct {
+	injected, queries int64 // accessed atomically
+	lastInjected      int64 // at the end of the last minute
+	rate              float64
+}
+
+func (srv *Server) getPrefixCounters(name string) *prefixCounters {
+	prefix := datastore.NamePrefix(name)
+	srv.prefixMu.RLock()
+	pc := srv.prefixUsage[prefix]
+	srv.prefixMu.RUnlock()
+	if pc != nil {
+		return pc
+	}
+
+	srv.prefixMu.Lock()
+	defer srv.prefixMu.Unlock()
+	if srv.prefixUsage == nil {
+		srv.prefixUsage = make(map[string]*prefixCounters)
+	}
+	if pc = srv.prefixUsage[prefix]; pc == nil {
+		pc = &prefixCounters{}
+		srv.prefixUsage[prefix] = pc
+	}
+	return pc
+}
+
+// PrefixUsage returns the start of the day and the usage of every prefix
+// with input, queries or stored series, sorted by prefix.
+func (srv *Server) PrefixUsage() (int64, []PrefixUsage, error) {
+	var stats []datastore.PrefixStats
+	if len(srv.Prefix) == 0 {
+		var err error
+		if stats, err = srv.Ds.Stats(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	srv.prefixMu.RLock()
+	day := srv.usageDay
+	if day == 0 {
+		day = srv.clock().Now().Unix() / 86400 * 86400
+	}
+	pus := make(map[string]*PrefixUsage, len(srv.prefixUsage))
+	for prefix, pc := range srv.prefixUsage {
+		pus[prefix] = &PrefixUsage{
+			Prefix:   prefix,
+			Injected: atomic.LoadInt64(&pc.injected),
+			Rate:     pc.rate,
+			Queries:  atomic.LoadInt64(&pc.queries),
+		}
+	}
+	srv.prefixMu.RUnlock()
+
+	for _, ps := range stats {
+		// Series of metric names without a dot, e.g. "a:counter"
+		prefix := strings.TrimSuffix(ps.Prefix, ":")
+		if pu := pus[prefix]; pu != nil {
+			pu.Bytes += ps.Bytes
+		} else {
+			pus[prefix] = &PrefixUsage{Prefix: prefix, Bytes: ps.Bytes}
+		}
+	}
+	r := make([]PrefixUsage, 0, len(pus))
+	for _, pu := range pus {
+		r = append(r, *pu)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Prefix < r[j].Prefix
+	})
+	return day, r, nil
+}
+
+// savePrefixUsage updates the ingest rates at the end of every minute.
+// Once a day has ended, its totals are stored as the counters
+// UsagePrefix + ".prefix." + the prefix without its dot + ".injected" and
+// ".queries", at the midnight that closes the day, and counting starts again.
+func (srv *Server) savePrefixUsage() {
+	day := srv.lastTick / 86400 * 86400
+	srv.prefixMu.Lock()
+	defer srv.prefixMu.Unlock()
+
+	for _, pc := range srv.prefixUsage {
+		injected := atomic.LoadInt64(&pc.injected)
+		pc.rate = float64(injected-pc.lastInjected) / 60
+		pc.lastInjected = injected
+	}
+	if srv.usageDay == 0 {
+		srv.usageDay = day
+	}
+	if day == srv.usageDay {
+		return
+	}
+
+	if len(srv.UsagePrefix) > 0 && !srv.isReplica() {
+		for prefix, pc := range srv.prefixUsage {
+			name := srv.Prefix + srv.UsagePrefix + ".prefix." + strings.TrimSuffix(prefix, ".")
+			values := []struct {
+				name  string
+				value int64
+			}{
+				{".injected", atomic.LoadInt64(&pc.injected)},
+				{".queries", atomic.LoadInt64(&pc.queries)},
+			}
+			for _, v := range values {
+				rec := datastore.Record{Ts: srv.usageDay + 86400, Value: float64(v.value)}
+				if err := srv.Ds.Insert(name+v.name+":counter", rec); err != nil {
+					log.Println("Server.savePrefixUsage:", err)
+				}
+			}
+		}
+	}
+	srv.prefixUsage = make(map[string]*prefixCounters)
+	srv.usageDay = day
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"github.com/adatboss/statsd/clock"
+	"github.com/adatboss/statsd/datastore"
+	"testing"
+	"time"
+)
+
+func TestPrefixUsage(t *testing.T) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+
+	// Two minutes before midnight
+	day := int64(70 * 86400)
+	c := clock.NewManual(time.Unix(day-120, 0))
+	srv := &Server{Ds: ds, Clock: c, UsagePrefix: "usage"}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal("Start:", err)
+	}
+	defer stopServer(t, srv, c)
+
+	for _, m := range []Metric{
+		{"web.a", Counter, 1, 1, false},
+		{"web.b", Counter, 1, 1, false},
+		{"web.a", Counter, 1, 1, false},
+		{"db", Gauge, 1, 1, false},
+	} {
+		if err := srv.Inject(&m); err != nil {
+			t.Fatal("Inject:", err)
+		}
+	}
+	if _, _, err := srv.LiveLog("web.a", []string{"counter"}); err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+	// Injections into the gauge are pending until its last value is loaded
+	srv.loads.Wait()
+	c.Advance(time.Minute)
+
+	d, pus, err := srv.PrefixUsage()
+	if err != nil {
+		t.Fatal("PrefixUsage:", err)
+	}
+	expected := []PrefixUsage{
+		{Prefix: "db", Injected: 1, Rate: 1.0 / 60, Bytes: 64},
+		{Prefix: "usage.", Bytes: 64},
+		{Prefix: "web.", Injected: 3, Rate: 3.0 / 60, Queries: 1, Bytes: 32},
+	}
+	ok := d == day-86400 && len(pus) == len(expected)
+	for i := 0; ok && i < len(pus); i++ {
+		ok = pus[i] == expected[i]
+	}
+	if !ok {
+		t.Error("Incorrect result")
+		t.Error("Expected:", day-86400, expected)
+		t.Error("Result:", d, pus)
+	}
+
+	// The totals of the day are stored at midnight
+	c.Advance(time.Minute)
+	var testCases = []struct {
+		name  string
+		value float64
+	}{
+		{"usage.prefix.web.injected:counter", 3},
+		{"usage.prefix.web.queries:counter", 1},
+		{"usage.prefix.db.injected:counter", 1},
+		{"usage.prefix.db.queries:counter", 0},
+	}
+	for _, tc := range testCases {
+		r, err := ds.Query(context.Background(), tc.name, day-86400, day)
+		if err != nil {
+			t.Error("Query:", err)
+		} else if len(r) != 1 || r[0].Ts != day || r[0].Value != tc.value {
+			t.Error("Incorrect result:", tc.name)
+			t.Error("Expected:", tc.value)
+			t.Error("Result:", r)
+		}
+	}
+	if d, pus, err := srv.PrefixUsage(); err != nil || d != day || len(pus) != 3 || pus[2].Injected != 0 {
+		t.Error("Usage not reset at midnight:", d, pus, err)
+	}
+}
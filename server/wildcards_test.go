@@ -0,0 +1,84 @@
+package server
+
+import (
+	"github.com/adatboss/statsd/clock"
+	"github.com/adatboss/statsd/datastore"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeWildcards(t *testing.T) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	c := clock.NewManual(time.Unix(6000000, 0))
+	srv := &Server{Ds: ds, Clock: c, AutoWc: true}
+	if err := srv.Start(nil, []string{"saved.*:counter"}); err != nil {
+		t.Fatal("Start:", err)
+	}
+	defer stopServer(t, srv, c)
+
+	// Learned since the wildcards were saved
+	if _, _, err := srv.LiveLog("learned.*", []string{"gauge"}); err != nil {
+		t.Fatal("LiveLog:", err)
+	}
+
+	var testCases = []struct {
+		wcs    []string
+		ok     bool
+		result string
+	}{
+		{[]string{"saved.*:counter", "new.*:counter"}, true,
+			"learned.*:gauge new.*:counter saved.*:counter"},
+		{[]string{"other.*:counter", "invalid:counter"}, false,
+			"learned.*:gauge new.*:counter saved.*:counter"},
+		{[]string{"other.*:nothing"}, false,
+			"learned.*:gauge new.*:counter saved.*:counter"},
+		{nil, true, "learned.*:gauge new.*:counter saved.*:counter"},
+	}
+
+	for _, tc := range testCases {
+		err := srv.MergeWildcards(tc.wcs)
+		wcs, _ := srv.Wildcards()
+		sort.Strings(wcs)
+		if (err == nil) != tc.ok || strings.Join(wcs, " ") != tc.result {
+			t.Error("Incorrect result:", tc.wcs)
+			t.Error("Expected:", tc.ok, tc.result)
+			t.Error("Result:", err, wcs)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ds := &datastore.MemDatastore{}
+	if err := ds.Open(); err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer ds.Close()
+	c := clock.NewManual(time.Unix(6000000, 0))
+	srv := &Server{Ds: ds, Clock: c}
+	if h := srv.Health(); h != (Health{}) {
+		t.Error("Incorrect health before Start:", h)
+	}
+	if err := srv.Start(nil, nil); err != nil {
+		t.Fatal("Start:", err)
+	}
+	defer stopServer(t, srv, c)
+
+	if h := srv.Health(); h != (Health{Running: true}) {
+		t.Error("Incorrect health:", h)
+	}
+	srv.Reloaded(Error("Bad wildcard"))
+	if h := srv.Health(); h != (Health{Running: true, LastReload: 6000000, ReloadError: "Bad wildcard"}) {
+		t.Error("Incorrect health after a failed reload:", h)
+	}
+	c.Advance(time.Second)
+	srv.Reloaded(nil)
+	if h := srv.Health(); h != (Health{Running: true, LastReload: 6000001}) {
+		t.Error("Incorrect health after a reload:", h)
+	}
+}